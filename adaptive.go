@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+	"github.com/moediddy/db/bulkimport"
+)
+
+var (
+	adaptiveWorkers = flag.Bool("adaptive-workers", false, "start with -workers requests in flight and adjust it: one more per round of healthy responses, halving it on a 429, a 503, a timeout or a latency spike")
+	maxWorkers      = flag.Int("max-workers", 64, "the most requests -adaptive-workers has in flight")
+)
+
+// A response slower than this many times the usual latency counts as a
+// spike.
+const latencySpike = 2
+
+// Holds the senders to the adaptive concurrency limit, nil with a fixed
+// -workers.
+var concurrency *adaptiveGate
+
+// Additive increase, multiplicative decrease: every healthy response raises
+// the limit by 1/limit, so a round of them adds one, and an overloaded one
+// halves it. Only one decrease is made per round trip, as the requests
+// already in flight when the server got overloaded will also see it.
+type adaptiveGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  float64
+	max    int
+	active int
+	peak   int
+
+	// A moving average of the healthy responses' latency, and when the
+	// limit was last cut.
+	latency time.Duration
+	cut     time.Time
+}
+
+func setupAdaptive() error {
+	if !*adaptiveWorkers {
+		return nil
+	}
+	if *maxWorkers < *workerCount {
+		return errors.New("-max-workers can't be less than -workers")
+	}
+	g := &adaptiveGate{limit: float64(*workerCount), max: *maxWorkers, peak: *workerCount}
+	g.cond = sync.NewCond(&g.mu)
+	concurrency = g
+	return nil
+}
+
+// How many goroutines send requests. With -adaptive-workers there are
+// enough for the most it allows, and the gate holds back the rest.
+func senderCount() int {
+	if concurrency != nil {
+		return concurrency.max
+	}
+	return *workerCount
+}
+
+// Lowers the most the gate allows, for a destination that has a limit.
+func (g *adaptiveGate) cap(max int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if max < g.max {
+		g.max = max
+		if g.limit > float64(max) {
+			g.limit = float64(max)
+		}
+	}
+}
+
+// Waits for a request to be allowed in flight.
+func (g *adaptiveGate) acquire() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.active >= int(g.limit) {
+		g.cond.Wait()
+	}
+	g.active++
+}
+
+// Ends a request, adjusting the limit by how it went.
+func (g *adaptiveGate) release(latency time.Duration, err error) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	defer g.cond.Broadcast()
+
+	reason := overloaded(err)
+	if reason == "" && err == nil && g.latency > 0 && latency > latencySpike*g.latency {
+		reason = "a latency spike"
+	}
+	if reason != "" {
+		if time.Since(g.cut) < g.latency {
+			return
+		}
+		g.cut = time.Now()
+		if g.limit /= 2; g.limit < 1 {
+			g.limit = 1
+		}
+		logCode(codeBackingOff, "Backing off to %v requests in flight after %v", int(g.limit), reason)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if g.latency == 0 {
+		g.latency = latency
+	} else {
+		g.latency = (9*g.latency + latency) / 10
+	}
+	if g.limit += 1 / g.limit; g.limit > float64(g.max) {
+		g.limit = float64(g.max)
+	}
+	if int(g.limit) > g.peak {
+		g.peak = int(g.limit)
+	}
+}
+
+// Describes why a failed request shows the server is overloaded, or returns
+// nothing if it doesn't.
+func overloaded(err error) string {
+	if err == bulkimport.ErrTimedOut {
+		return "a timeout"
+	}
+	switch {
+	case errors.Is(err, bulk.ErrRateLimited):
+		return "a 429"
+	case bulk.StatusCode(err) == http.StatusServiceUnavailable:
+		return "a 503"
+	}
+	return ""
+}
+
+// The current limit, for /status.
+func (g *adaptiveGate) current() int {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int(g.limit)
+}
+
+// Logs where the limit ended up.
+func finishAdaptive() {
+	g := concurrency
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	log.Printf("Adaptive concurrency ended at %v requests in flight, at most %v", int(g.limit), g.peak)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var adminAddr = flag.String("admin", "", "serve the importer's status as JSON at /status on this address, such as localhost:6060")
+
+var processStarted = time.Now()
+
+// What /status reports.
+type adminStatus struct {
+	Run         string            `json:"run"`
+	Uptime      string            `json:"uptime"`
+	Workers     int               `json:"workers"`
+	Concurrency int               `json:"concurrency,omitempty"`
+	Hedges      int64             `json:"hedges"`
+	Conns       connectionsStatus `json:"connections"`
+	Stages      stagesStatus      `json:"stages"`
+	Limit       *rateLimitStatus  `json:"rate_limit,omitempty"`
+}
+
+type connectionsStatus struct {
+	Open   int64 `json:"open"`
+	Peak   int64 `json:"peak"`
+	Dialed int64 `json:"dialed"`
+	Limit  int   `json:"limit,omitempty"`
+	// TLS handshakes, and how many resumed a session.
+	Handshakes int64 `json:"handshakes"`
+	Resumed    int64 `json:"resumed"`
+}
+
+// Starts serving the admin status when -admin is set.
+func startAdmin() error {
+	if *adminAddr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", *adminAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Error: admin server: %v", err)
+		}
+	}()
+	log.Printf("Serving status at http://%v/status", listener.Addr())
+	return nil
+}
+
+func statusHandler(res http.ResponseWriter, req *http.Request) {
+	status := adminStatus{
+		Run:         runID,
+		Uptime:      time.Since(processStarted).Round(time.Second).String(),
+		Workers:     *workerCount,
+		Concurrency: concurrency.current(),
+		Hedges:      atomic.LoadInt64(&hedges),
+		Conns: connectionsStatus{
+			Open:   atomic.LoadInt64(&conns.open),
+			Peak:   atomic.LoadInt64(&conns.peak),
+			Dialed: atomic.LoadInt64(&conns.dialed),
+			Limit:  *maxConnsPerHost,
+
+			Handshakes: atomic.LoadInt64(&handshakes.total),
+			Resumed:    atomic.LoadInt64(&handshakes.resumed),
+		},
+		Stages: currentStages(),
+		Limit:  limiter.status(),
+	}
+	res.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(res)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// How many example records an anomaly lists.
+	anomalyExamples = 5
+	// The most document fields profiled, so documents keyed by data don't
+	// grow the profile without end.
+	maxProfiledFields = 10000
+	// Null spikes are looked for in windows of this many records.
+	nullWindow = 1000
+	// A window's nulls are a spike if there are this many of them, they're
+	// at least half the field's values in it and they're this many times as
+	// common as in the rest of the input.
+	minSpikeNulls  = 10
+	nullSpikeRatio = 5
+	// Records this many standard deviations larger than the average are
+	// outliers, of the largest sizeOutlierCandidates records.
+	sizeOutlierDeviations = 4
+	sizeOutlierCandidates = 100
+)
+
+// What inspect has seen of the records' documents, for the anomalies it
+// reports: fields with values of several types, outlying record sizes,
+// spikes in a field's nulls and invalid UTF-8.
+type recordProfile struct {
+	fields map[string]*fieldProfile
+
+	records int
+	// Welford's running mean and variance of the record sizes.
+	mean, m2 float64
+	largest  sizeHeap
+
+	invalidUTF8         int
+	invalidUTF8Examples []recordPos
+}
+
+type fieldProfile struct {
+	types map[string]*typeCount
+	// The field's values and nulls in all the records, in the nullWindow
+	// being read and in the window with the most of them so far.
+	present, nulls int
+	window, worst  nullCount
+}
+
+type typeCount struct {
+	n        int
+	examples []recordPos
+}
+
+type nullCount struct {
+	index          int
+	present, nulls int
+	examples       []recordPos
+}
+
+func (c *nullCount) rate() float64 {
+	if c.present == 0 {
+		return 0
+	}
+	return float64(c.nulls) / float64(c.present)
+}
+
+// Whichever of w and the worst window so far has more of its values null.
+// w only counts if it has minSpikeNulls nulls and they're half its values.
+func (f *fieldProfile) worstWith(w nullCount) nullCount {
+	if w.nulls >= minSpikeNulls && w.rate() >= 0.5 && w.rate() > f.worst.rate() {
+		return w
+	}
+	return f.worst
+}
+
+func newRecordProfile() *recordProfile {
+	return &recordProfile{fields: make(map[string]*fieldProfile)}
+}
+
+// Adds a record to the profile.
+func (p *recordProfile) add(line []byte, pos recordPos) {
+	index := p.records
+	p.records++
+	size := float64(len(line))
+	delta := size - p.mean
+	p.mean += delta / float64(p.records)
+	p.m2 += delta * (size - p.mean)
+	if p.largest.Len() < sizeOutlierCandidates || len(line) > p.largest[0].size {
+		heap.Push(&p.largest, sizedRecord{size: len(line), pos: pos})
+		if p.largest.Len() > sizeOutlierCandidates {
+			heap.Pop(&p.largest)
+		}
+	}
+
+	if !utf8.Valid(line) {
+		p.invalidUTF8++
+		if len(p.invalidUTF8Examples) < anomalyExamples {
+			p.invalidUTF8Examples = append(p.invalidUTF8Examples, pos)
+		}
+	}
+
+	var item map[string]interface{}
+	if json.Unmarshal(line, &item) != nil {
+		return
+	}
+	if value := itemValue(item); value != nil {
+		p.addFields("", value, pos, index/nullWindow)
+	}
+}
+
+func (p *recordProfile) addFields(prefix string, doc map[string]interface{}, pos recordPos, window int) {
+	for name, value := range doc {
+		path := prefix + name
+		field := p.fields[path]
+		if field == nil {
+			if len(p.fields) == maxProfiledFields {
+				continue
+			}
+			field = &fieldProfile{types: make(map[string]*typeCount)}
+			p.fields[path] = field
+		}
+
+		if field.window.index != window {
+			field.worst = field.worstWith(field.window)
+			field.window = nullCount{index: window}
+		}
+		w := &field.window
+		field.present++
+		w.present++
+		if value == nil {
+			field.nulls++
+			w.nulls++
+			if len(w.examples) < anomalyExamples {
+				w.examples = append(w.examples, pos)
+			}
+			continue
+		}
+
+		kind := jsonType(value)
+		if kind == "integer" {
+			// Whole and fractional numbers mixing is nothing to flag.
+			kind = "number"
+		}
+		count := field.types[kind]
+		if count == nil {
+			count = &typeCount{}
+			field.types[kind] = count
+		}
+		count.n++
+		if len(count.examples) < anomalyExamples {
+			count.examples = append(count.examples, pos)
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			p.addFields(path+".", object, pos, window)
+		}
+	}
+}
+
+// An anomaly found in the records.
+type anomaly struct {
+	kind, field, detail string
+	examples            []recordPos
+}
+
+// The anomalies in the records profiled.
+func (p *recordProfile) anomalies() []anomaly {
+	var found []anomaly
+	fields := make([]string, 0, len(p.fields))
+	for name := range p.fields {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	for _, name := range fields {
+		field := p.fields[name]
+		if len(field.types) < 2 {
+			continue
+		}
+		// Most common first, the examples of the rarer types being the
+		// records most likely wrong.
+		kinds := make([]string, 0, len(field.types))
+		for kind := range field.types {
+			kinds = append(kinds, kind)
+		}
+		sort.Slice(kinds, func(i, j int) bool {
+			a, b := field.types[kinds[i]], field.types[kinds[j]]
+			return a.n > b.n || a.n == b.n && kinds[i] < kinds[j]
+		})
+		var counts []string
+		var examples []recordPos
+		for i, kind := range kinds {
+			counts = append(counts, fmt.Sprintf("%v %v", field.types[kind].n, kind))
+			if i > 0 {
+				examples = append(examples, field.types[kind].examples...)
+			}
+		}
+		if len(examples) > anomalyExamples {
+			examples = examples[:anomalyExamples]
+		}
+		found = append(found, anomaly{"mixed types", name, strings.Join(counts, ", "), examples})
+	}
+
+	if p.records > 1 {
+		stddev := math.Sqrt(p.m2 / float64(p.records-1))
+		threshold := p.mean + sizeOutlierDeviations*stddev
+		var outliers []sizedRecord
+		for _, rec := range p.largest {
+			if float64(rec.size) > threshold && float64(rec.size) > 2*p.mean {
+				outliers = append(outliers, rec)
+			}
+		}
+		if len(outliers) > 0 {
+			sort.Slice(outliers, func(i, j int) bool { return outliers[i].size > outliers[j].size })
+			count := fmt.Sprint(len(outliers))
+			if len(outliers) == sizeOutlierCandidates {
+				count += " or more"
+			}
+			var examples []recordPos
+			for i := 0; i < len(outliers) && i < anomalyExamples; i++ {
+				examples = append(examples, outliers[i].pos)
+			}
+			detail := fmt.Sprintf("%v records larger than %v, the average being %v", count, formatBytes(int64(threshold)), formatBytes(int64(p.mean)))
+			found = append(found, anomaly{"outlier size", "", detail, examples})
+		}
+	}
+
+	for _, name := range fields {
+		field := p.fields[name]
+		worst := field.worstWith(field.window)
+		if worst.nulls == 0 || worst.present == field.present {
+			continue
+		}
+		other := float64(field.nulls-worst.nulls) / float64(field.present-worst.present)
+		if worst.rate() >= nullSpikeRatio*other {
+			detail := fmt.Sprintf("%.0f%% null in records %v to %v, %.0f%% in the rest", worst.rate()*100,
+				worst.index*nullWindow+1, (worst.index+1)*nullWindow, other*100)
+			found = append(found, anomaly{"null spike", name, detail, worst.examples})
+		}
+	}
+
+	if p.invalidUTF8 > 0 {
+		found = append(found, anomaly{"invalid UTF-8", "", fmt.Sprintf("%v records", p.invalidUTF8), p.invalidUTF8Examples})
+	}
+	return found
+}
+
+// Writes the anomalies as a table, if there are any.
+func (p *recordProfile) write(w io.Writer) {
+	found := p.anomalies()
+	if len(found) == 0 {
+		fmt.Fprintln(w, "\nNo anomalies found")
+		return
+	}
+	fmt.Fprintln(w, "\nANOMALY\tFIELD\tDETAIL\tEXAMPLES")
+	for _, a := range found {
+		examples := make([]string, len(a.examples))
+		for i, pos := range a.examples {
+			examples[i] = fmt.Sprintf("%v:%v", pos.file, pos.line)
+		}
+		field := a.field
+		if field == "" {
+			field = "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", a.kind, field, a.detail, strings.Join(examples, " "))
+	}
+}
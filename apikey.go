@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var keyFile = flag.String("key-file", "", "read the api key from this file, or from an open file descriptor as fd:3, rather than passing it with -key, which shows in ps and shell history")
+
+// The environment variable the api key can be given in.
+const keyEnv = "ORC_API_KEY"
+
+// Sets the -key from the -key-file, or failing that $ORC_API_KEY, unless it
+// was given on the command line.
+func setupKey(given bool) error {
+	if given {
+		return nil
+	}
+	if *keyFile != "" {
+		key, err := readKeyFile(*keyFile)
+		if err != nil {
+			return fmt.Errorf("-key-file: %v", err)
+		}
+		*apiKey = key
+		return nil
+	}
+	if key := os.Getenv(keyEnv); key != "" {
+		*apiKey = key
+	}
+	return nil
+}
+
+// Reads a key from a file or a file descriptor, without the whitespace
+// around it.
+func readKeyFile(name string) (string, error) {
+	var data []byte
+	var err error
+	if fd := strings.TrimPrefix(name, "fd:"); fd != name {
+		n, convErr := strconv.Atoi(fd)
+		if convErr != nil || n < 0 {
+			return "", fmt.Errorf("%v isn't a file descriptor", name)
+		}
+		file := os.NewFile(uintptr(n), name)
+		defer file.Close()
+		data, err = ioutil.ReadAll(file)
+	} else {
+		if info, statErr := os.Stat(name); statErr == nil && info.Mode().IsRegular() && info.Mode().Perm()&0077 != 0 {
+			log.Printf("Warning: %v can be read by other users, keep it to its owner with chmod 600", name)
+		}
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", errors.New(name + " is empty")
+	}
+	if strings.ContainsAny(key, "\r\n") {
+		return "", errors.New(name + " has more than one line, it should hold only the key")
+	}
+	return key, nil
+}
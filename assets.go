@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	assetFields    = flag.String("asset-fields", "", "comma separated document fields holding local file paths to upload and replace with their URL")
+	assetDir       = flag.String("asset-dir", ".", "the directory relative -asset-fields paths are resolved against")
+	assetUploadURL = flag.String("asset-upload-url", "", "the object storage URL prefix assets are PUT under")
+	assetPublicURL = flag.String("asset-public-url", "", "the URL prefix assets are served from (defaults to -asset-upload-url)")
+	assetHeaders   = make(headerFlags)
+)
+
+func init() {
+	flag.Var(assetHeaders, "asset-header", "a \"Name: value\" header to send with asset uploads, may be repeated")
+}
+
+// A flag.Value collecting repeated "Name: value" headers.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	var s []string
+	for k, v := range h {
+		s = append(s, k+": "+v)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("expected \"Name: value\", not %q", value)
+	}
+	h[strings.TrimSpace(value[:i])] = strings.TrimSpace(value[i+1:])
+	return nil
+}
+
+// Uploads the files named by asset fields to object storage, replacing each
+// path with the URL it's served from. Objects are named by content hash so
+// an asset shared by many records is only uploaded once.
+type assetUploader struct {
+	fields []string
+
+	mu       sync.Mutex
+	uploaded map[string]string
+}
+
+func newAssetTransform() (transform, error) {
+	if *assetUploadURL == "" {
+		return nil, errors.New("-asset-fields requires -asset-upload-url")
+	}
+	u := &assetUploader{
+		fields:   strings.Split(*assetFields, ","),
+		uploaded: make(map[string]string),
+	}
+	return u.transform, nil
+}
+
+func (u *assetUploader) transform(item map[string]interface{}, pos recordPos) error {
+	value := itemValue(item)
+	if value == nil {
+		return nil
+	}
+
+	for _, field := range u.fields {
+		doc, name, ok := lookupField(value, field)
+		if !ok {
+			continue
+		}
+
+		switch v := doc[name].(type) {
+		case string:
+			url, err := u.upload(v)
+			if err != nil {
+				return err
+			}
+			doc[name] = url
+		case []interface{}:
+			for i, elem := range v {
+				if path, ok := elem.(string); ok {
+					url, err := u.upload(path)
+					if err != nil {
+						return err
+					}
+					v[i] = url
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Uploads the file at path, returning its public URL. Values that are
+// already URLs are left alone.
+func (u *assetUploader) upload(path string) (string, error) {
+	if path == "" || isURL(path) {
+		return path, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(*assetDir, path)
+	}
+
+	u.mu.Lock()
+	url, ok := u.uploaded[path]
+	u.mu.Unlock()
+	if ok {
+		return url, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:]) + strings.ToLower(filepath.Ext(path))
+
+	req, err := http.NewRequest("PUT", joinURL(*assetUploadURL, name), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(data))
+	if ct := mime.TypeByExtension(filepath.Ext(path)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	for k, v := range assetHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := fetch(req)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("uploading %v: %v", path, resp.Status)
+	}
+
+	public := *assetPublicURL
+	if public == "" {
+		public = *assetUploadURL
+	}
+	url = joinURL(public, name)
+
+	u.mu.Lock()
+	u.uploaded[path] = url
+	u.mu.Unlock()
+	return url, nil
+}
+
+func joinURL(prefix, name string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
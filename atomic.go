@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var atomicPerFile = flag.Bool("atomic-per-file", false, "write each file to staging collections and copy it to the real ones only once the whole file has imported without errors, discarding it otherwise")
+
+// The staging collections each file has written to, by the collection they
+// stand in for.
+var staged = struct {
+	sync.Mutex
+	files map[string]map[string]string
+}{files: make(map[string]map[string]string)}
+
+func setupAtomic() error {
+	if !*atomicPerFile {
+		return nil
+	}
+	switch {
+	case *concat:
+		return errors.New("-atomic-per-file can't be used with -concat")
+	case *hashStore != "":
+		return errors.New("-atomic-per-file can't be used with -hash-store, the hashes would be of the staged items")
+	case anyCreateOnly():
+		return errors.New("-atomic-per-file needs -mode upsert, existing keys would be looked up in the staging collections")
+	}
+	return nil
+}
+
+// The staging collection a file's items for the collection go to. The run
+// ID's random suffix keeps concurrent runs apart.
+func stagingCollection(collection string) string {
+	return collection + "-staging-" + runID[strings.LastIndex(runID, "-")+1:]
+}
+
+// Readdresses an item to its staging collection. It runs after all the
+// other transforms, so it sees the collection they chose.
+func stageItem(item map[string]interface{}, pos recordPos) error {
+	path, _ := item["path"].(map[string]interface{})
+	collection, _ := path["collection"].(string)
+	if collection == "" {
+		return nil
+	}
+	staging := stagingCollection(collection)
+	path["collection"] = staging
+
+	staged.Lock()
+	defer staged.Unlock()
+	if staged.files[pos.file] == nil {
+		staged.files[pos.file] = make(map[string]string)
+	}
+	staged.files[pos.file][collection] = staging
+	return nil
+}
+
+// Once a file has finished, copies its staged items to the real collections
+// if all of them imported, then drops the staging collections. Staging
+// collections that couldn't be fully copied are kept for a retry.
+func finishStaged(filename string, ok bool) {
+	if !*atomicPerFile {
+		return
+	}
+	staged.Lock()
+	collections := staged.files[filename]
+	delete(staged.files, filename)
+	staged.Unlock()
+
+	var names []string
+	for collection := range collections {
+		names = append(names, collection)
+	}
+	sort.Strings(names)
+
+	for _, collection := range names {
+		staging := collections[collection]
+		if !ok {
+			log.Printf("Discarding %v's items staged in %v", filename, staging)
+		} else {
+			n, err := promoteStaged(staging, collection)
+			if err != nil {
+				log.Printf("Error promoting %v to %v after %v items, keeping it: %v", staging, collection, n, err)
+				continue
+			}
+			log.Printf("Promoted %v items of %v from %v to %v", n, filename, staging, collection)
+		}
+		if err := deleteCollection(staging); err != nil {
+			log.Printf("Error deleting %v: %v", staging, err)
+		}
+	}
+}
+
+// Copies every item of the staging collection to the real one.
+func promoteStaged(staging, collection string) (int, error) {
+	promoted := 0
+	current := &batch{}
+	send := func() error {
+		body, err := postBatch(context.Background(), client, current, nil)
+		if err != nil {
+			return err
+		}
+		if n := processedCount(body, len(current.records)); body["status"] != "success" || n < len(current.records) {
+			return fmt.Errorf("%v: %v", body["status"], body["message"])
+		}
+		promoted += len(current.records)
+		current = &batch{}
+		return nil
+	}
+
+	var sendErr error
+	err := listItems(*host, *apiKey, staging, true, func(key string, value json.RawMessage) {
+		if sendErr != nil {
+			return
+		}
+		line, _ := json.Marshal(map[string]interface{}{
+			"kind":  "item",
+			"path":  map[string]string{"collection": collection, "key": key},
+			"value": value,
+		})
+		line = append(line, '\n')
+		if !current.Fits(len(line)) {
+			if sendErr = send(); sendErr != nil {
+				return
+			}
+		}
+		current.add(line, batchRecord{})
+		if current.Full() {
+			sendErr = send()
+		}
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err == nil && len(current.records) > 0 {
+		err = send()
+	}
+	return promoted, err
+}
+
+func deleteCollection(collection string) error {
+	resp, err := doRequest("DELETE", url.PathEscape(collection)+"?force=true", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return bulk.ParseError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var batchGroup = flag.String("batch-group", "", "fill batches by group rather than in input order, so each request goes to fewer of the destination's shards: collection, prefix:n for the collection and the first n characters of the key, or shard:n for one of n groups hashed from the collection and key")
+
+// The most batches filled at once with -batch-group. Opening another sends
+// the one opened longest ago, however full it is.
+const maxOpenBatches = 256
+
+// Names the group a record's batch is filled from, by its collection and
+// key.
+type batchGrouping func(collection, key string) string
+
+// The -batch-group strategies, by name, made from what follows the colon.
+var batchGroupings = map[string]func(arg string) (batchGrouping, error){
+	"collection": func(arg string) (batchGrouping, error) {
+		if arg != "" {
+			return nil, errors.New("collection takes no argument")
+		}
+		return func(collection, key string) string { return collection }, nil
+	},
+	"prefix": func(arg string) (batchGrouping, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, errors.New("prefix takes the number of key characters, such as prefix:2")
+		}
+		return func(collection, key string) string {
+			if i := charIndex(key, n); i >= 0 {
+				key = key[:i]
+			}
+			return collection + "/" + key
+		}, nil
+	},
+	"shard": func(arg string) (batchGrouping, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, errors.New("shard takes the number of shards, such as shard:16")
+		}
+		return func(collection, key string) string {
+			h := fnv.New32a()
+			h.Write([]byte(collection + "/" + key))
+			return strconv.Itoa(int(h.Sum32() % uint32(n)))
+		}, nil
+	},
+}
+
+// The -batch-group strategy, nil to fill batches in input order.
+var grouping batchGrouping
+
+func setupBatchGroup() error {
+	if *batchGroup == "" {
+		return nil
+	}
+	name, arg := *batchGroup, ""
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name, arg = name[:i], name[i+1:]
+	}
+	newGrouping := batchGroupings[name]
+	if newGrouping == nil {
+		var names []string
+		for name := range batchGroupings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("-batch-group %v isn't one of %v", name, strings.Join(names, ", "))
+	}
+	if *checkpointFile != "" {
+		return errors.New("-checkpoint can't follow batches filled out of input order, leave out -batch-group")
+	}
+	var err error
+	if grouping, err = newGrouping(arg); err != nil {
+		return fmt.Errorf("-batch-group: %v", err)
+	}
+	return nil
+}
+
+// The group a record's batch is filled from, "" without -batch-group.
+func recordGroup(line []byte) (string, error) {
+	if grouping == nil {
+		return "", nil
+	}
+	collection, key, err := scanItemPath(line)
+	if err != nil {
+		return "", err
+	}
+	return grouping(collection, key), nil
+}
+
+// The byte index of the nth character of s, -1 if it's shorter.
+func charIndex(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return -1
+}
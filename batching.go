@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/moediddy/db/bulkimport"
+)
+
+var (
+	batchSize       = flag.Int("batch-size", bulkimport.DefaultBatchSize, "the most records sent in one request")
+	batchBytesFlag  = flag.String("batch-bytes", "", "the largest request body to send, such as 4MB, to stay under the server's payload limit; records bigger than it go alone")
+	adaptiveBatches = flag.Bool("adaptive-batches", false, "size batches by bytes from the measured upload throughput, shrinking them when sends slow down or fail and growing them on fast links")
+
+	// The -batch-bytes limit, 0 for none.
+	batchBytes int
+)
+
+const (
+	minBatchBytes     = 64 << 10
+	maxBatchBytes     = 16 << 20
+	initialBatchBytes = 1 << 20
+
+	// Adaptive batches still stop at this many records, however small.
+	maxAdaptiveRecords = 10000
+
+	// Batches are sized so one takes about this long to send at the
+	// measured throughput. Losing a batch on a lossy link then costs at
+	// most this long to resend.
+	adaptiveBatchTime = 2 * time.Second
+)
+
+var sizer = &batchSizer{target: initialBatchBytes, logged: initialBatchBytes}
+
+func setupBatching() error {
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be at least 1")
+	}
+	if *batchBytesFlag != "" {
+		n, err := parseByteSize(*batchBytesFlag)
+		if err != nil {
+			return fmt.Errorf("-batch-bytes: %v", err)
+		}
+		if n < 1 {
+			return errors.New("-batch-bytes must be at least 1 byte")
+		}
+		batchBytes = int(n)
+	}
+	if *adaptiveBatches && batchBytes > 0 && sizer.target > batchBytes {
+		sizer.target, sizer.logged = batchBytes, batchBytes
+	}
+	return nil
+}
+
+// Keeps batches within the destination's limits, 0 for no limit.
+func limitBatches(records int, bytes int64) {
+	if records > 0 && *batchSize > records {
+		logLimit("batch-size", fmt.Sprintf("%v records", records))
+		*batchSize = records
+	}
+	if bytes > 0 && (batchBytes == 0 || int64(batchBytes) > bytes) {
+		logLimit("batch-bytes", formatBytes(bytes))
+		batchBytes = int(bytes)
+		if sizer.target > batchBytes {
+			sizer.target, sizer.logged = batchBytes, batchBytes
+		}
+	}
+}
+
+// Logs the limit taking over from a flag, as a warning if it was given.
+func logLimit(name, limit string) {
+	if flagGiven(name) {
+		log.Printf("Warning: the destination takes batches of at most %v, lowering -%v", limit, name)
+	} else {
+		log.Printf("The destination takes batches of at most %v", limit)
+	}
+}
+
+// Whether the flag was given on the command line, rather than left at its
+// default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
+
+// Picks the byte size of batches from how sending recent ones went.
+type batchSizer struct {
+	mu         sync.Mutex
+	target     int
+	throughput float64 // bytes per second, a moving average
+	logged     int
+}
+
+// Whether a batch has all the records it should get.
+func (b *batch) Full() bool {
+	if !*adaptiveBatches {
+		return len(b.records) >= *batchSize || batchBytes > 0 && len(b.body) >= batchBytes
+	}
+	return len(b.records) == maxAdaptiveRecords || len(b.body) >= sizer.size()
+}
+
+// Whether a record of n bytes can be added to the batch without taking it
+// over -batch-bytes. An empty batch takes any record.
+func (b *batch) Fits(n int) bool {
+	return batchBytes == 0 || len(b.records) == 0 || len(b.body)+n <= batchBytes
+}
+
+func (s *batchSizer) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// Records how sending a batch of size bytes went. A failure halves the
+// target, since on a lossy link it is likely to happen again and each one
+// is resent in full. Otherwise the target follows the throughput, growing
+// at most twofold at a time so one quick send can't overshoot.
+func (s *batchSizer) sent(size int, elapsed time.Duration, err error) {
+	if !*adaptiveBatches {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.target /= 2
+	} else if elapsed > 0 {
+		rate := float64(size) / elapsed.Seconds()
+		if s.throughput == 0 {
+			s.throughput = rate
+		} else {
+			s.throughput = 0.7*s.throughput + 0.3*rate
+		}
+		target := int(s.throughput * adaptiveBatchTime.Seconds())
+		if target > s.target*2 {
+			target = s.target * 2
+		}
+		s.target = target
+	}
+	if s.target < minBatchBytes {
+		s.target = minBatchBytes
+	}
+	if s.target > maxBatchBytes {
+		s.target = maxBatchBytes
+	}
+	if batchBytes > 0 && s.target > batchBytes {
+		s.target = batchBytes
+	}
+
+	if s.target >= s.logged*2 || s.target <= s.logged/2 {
+		log.Printf("Adjusted batch size to %v at %v/s", formatBytes(int64(s.target)), formatBytes(int64(s.throughput)))
+		s.logged = s.target
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	mode                = flag.String("mode", "upsert", "how items are written: upsert, or create-only to skip keys that already exist")
+	existingKeys        = flag.String("existing-keys", "", "an export stream of the destination whose keys seed the -mode create-only bloom filter")
+	existingCollections = flag.String("existing-collections", "", "comma separated destination collections to LIST to seed the -mode create-only bloom filter")
+	bloomCapacity       = flag.Int("bloom-capacity", 10000000, "the number of existing keys the bloom filter is sized for")
+	bloomFPRate         = flag.Float64("bloom-fp-rate", 0.01, "the bloom filter's target false positive rate")
+
+	// Keys known to the destination, built by setupMode. When nil every key
+	// is checked on the server.
+	existing *bloomFilter
+)
+
+// A bloom filter over "collection/key" strings. A miss means the key
+// certainly doesn't exist, a hit that it probably does.
+type bloomFilter struct {
+	bits []uint64
+	m, k uint64
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// Derives the k bit positions from two halves of a 64 bit FNV hash.
+func (f *bloomFilter) positions(key string, fn func(bit uint64) bool) bool {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	for i := uint64(0); i < f.k; i++ {
+		if !fn((h1 + i*h2) % f.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(key string) {
+	f.positions(key, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	return f.positions(key, func(bit uint64) bool {
+		return f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+func setupMode() error {
+	switch *mode {
+	case "upsert", "create-only":
+	default:
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+	if !anyCreateOnly() {
+		return nil
+	}
+
+	if *existingKeys == "" && *existingCollections == "" {
+		log.Printf("Warning: -mode create-only without -existing-keys or -existing-collections checks every key on the server")
+		return nil
+	}
+
+	existing = newBloomFilter(*bloomCapacity, *bloomFPRate)
+	count := 0
+	if *existingKeys != "" {
+		n, err := addExportKeys(*existingKeys)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+	if *existingCollections != "" {
+		for _, c := range strings.Split(*existingCollections, ",") {
+			n, err := addListedKeys(c)
+			if err != nil {
+				return err
+			}
+			count += n
+		}
+	}
+
+	log.Printf("Bloom filter loaded with %v existing keys", count)
+	if count > *bloomCapacity {
+		log.Printf("Warning: more existing keys than -bloom-capacity, expect more false positives")
+	}
+	return nil
+}
+
+// Adds the key of every item in an export stream file.
+func addExportKeys(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	records := &lineReader{reader: bufio.NewReaderSize(file, 1024*1024)}
+	for {
+		line, err := records.ReadRecord()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		collection, key, err := itemPath(line)
+		if err != nil {
+			return count, fmt.Errorf("%v:%v: %v", filename, records.line, err)
+		}
+		existing.add(collection + "/" + key)
+		count++
+	}
+}
+
+// Pages through a destination collection with the LIST API, adding each key.
+func addListedKeys(collection string) (int, error) {
+	count := 0
+	path := url.PathEscape(collection) + "?limit=100&values=false"
+	for path != "" {
+		var page struct {
+			Results []struct {
+				Path struct {
+					Key string `json:"key"`
+				} `json:"path"`
+			} `json:"results"`
+			Next string `json:"next"`
+		}
+		if _, err := jsonReply("GET", path, nil, 200, &page); err != nil {
+			return count, fmt.Errorf("listing %v: %v", collection, err)
+		}
+		for _, result := range page.Results {
+			existing.add(collection + "/" + result.Path.Key)
+			count++
+		}
+		path = nextPage(page.Next)
+	}
+	return count, nil
+}
+
+// Reports whether an item's key already exists on the destination. Keys the
+// bloom filter has never seen are new, anything else is confirmed with a
+// GET so false positives aren't dropped.
+func itemExists(line []byte) (bool, error) {
+	collection, key, err := itemPath(line)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && !existing.mayContain(collection+"/"+key) {
+		return false, nil
+	}
+
+	resp, err := doRequest("GET", url.PathEscape(collection)+"/"+url.PathEscape(key), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		// Drain the body so the connection can be reused.
+		io.Copy(ioutil.Discard, resp.Body)
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, bulk.ParseError(resp)
+}
+
+// Whether the item is written with create-only, by -mode or its
+// collection's mode in the -config.
+func createOnly(line []byte) bool {
+	if len(config.Collections) == 0 {
+		return *mode == "create-only"
+	}
+	collection, _, err := scanItemPath(line)
+	if err != nil {
+		return *mode == "create-only"
+	}
+	return collectionMode(collection) == "create-only"
+}
+
+// Returns the collection and key an export stream item is addressed to.
+func itemPath(line []byte) (string, string, error) {
+	var item struct {
+		Path struct {
+			Collection string `json:"collection"`
+			Key        string `json:"key"`
+		} `json:"path"`
+	}
+	if err := json.Unmarshal(line, &item); err != nil {
+		return "", "", err
+	}
+	if item.Path.Collection == "" || item.Path.Key == "" {
+		return "", "", errors.New("item has no collection or key")
+	}
+	return item.Path.Collection, item.Path.Key, nil
+}
@@ -0,0 +1,227 @@
+// Package bulk speaks the bulk import protocol orcbulkimport sends batches
+// with: the items of a batch, one JSON object a line, posted in one request,
+// and the response saying how each of them went.
+//
+//	client := &bulk.Client{Host: "api.orchestrate.io", Key: key}
+//	var batch bulk.Batch
+//	batch.Add(bulk.NewItem("users", "alice", map[string]interface{}{"name": "Alice"}))
+//	resp, err := client.Post(ctx, &batch)
+package bulk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The content type of Orchestrate's export stream, the default a batch is
+// sent as.
+const ContentType = "application/orchestrate-export-stream+json"
+
+// One line of a batch.
+type Item struct {
+	Kind  string          `json:"kind"`
+	Path  Path            `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Where an item goes, and in responses where it went.
+type Path struct {
+	Collection string `json:"collection"`
+	Kind       string `json:"kind"`
+	Key        string `json:"key"`
+	Ref        string `json:"ref,omitempty"`
+}
+
+// Makes an item putting the value at the collection's key. A value that
+// can't be encoded is left out, and the server fails the item.
+func NewItem(collection, key string, value interface{}) Item {
+	raw, _ := json.Marshal(value)
+	return Item{Kind: "item", Path: Path{Collection: collection, Kind: "item", Key: key}, Value: raw}
+}
+
+// The body of a request: the items' lines one after another.
+type Batch struct {
+	body  bytes.Buffer
+	items int
+}
+
+// Adds an item to the batch.
+func (b *Batch) Add(item Item) error {
+	line, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return b.AddLine(line)
+}
+
+// Adds a line that is already an encoded item, as read from an export.
+func (b *Batch) AddLine(line []byte) error {
+	line = bytes.TrimRight(line, "\r\n")
+	if !json.Valid(line) {
+		return errors.New("bulk: batch line isn't JSON")
+	}
+	b.body.Write(line)
+	b.body.WriteByte('\n')
+	b.items++
+	return nil
+}
+
+// How many items the batch has.
+func (b *Batch) Len() int { return b.items }
+
+// The request body.
+func (b *Batch) Bytes() []byte { return b.body.Bytes() }
+
+// The server's answer to a batch: "success" if it was taken, the items'
+// results in the order they were sent, and how many of them succeeded.
+type Response struct {
+	Status       string   `json:"status"`
+	Message      string   `json:"message,omitempty"`
+	SuccessCount int      `json:"success_count"`
+	Results      []Result `json:"results,omitempty"`
+}
+
+// How one item went.
+type Result struct {
+	Status string       `json:"status"`
+	Item   *Path        `json:"item,omitempty"`
+	Error  *ResultError `json:"error,omitempty"`
+}
+
+type ResultError struct {
+	Message string `json:"message"`
+}
+
+func (e *ResultError) Error() string { return e.Message }
+
+// Whether the item was imported.
+func (r Result) OK() bool { return r.Status == "success" }
+
+// The items that failed, as *ValidationErrors with their index in the
+// batch.
+func (r *Response) Failures() []error {
+	var failures []error
+	for i, result := range r.Results {
+		if result.Status == "failure" {
+			message := ""
+			if result.Error != nil {
+				message = result.Error.Message
+			}
+			failures = append(failures, &ValidationError{StatusError: StatusError{Message: message}, ItemIndex: i})
+		}
+	}
+	return failures
+}
+
+// Reads the response to a batch, decoding a gzip or deflate body. A status
+// other than the one given is an error from ParseError.
+func ParseResponse(resp *http.Response, status int) (*Response, error) {
+	if resp.StatusCode != status {
+		return nil, ParseError(resp)
+	}
+	var reader io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+	case "deflate":
+		reader = flate.NewReader(reader)
+	}
+	result := &Response{}
+	if err := json.NewDecoder(reader).Decode(result); err != nil {
+		return nil, fmt.Errorf("bulk: bad response: %v", err)
+	}
+	return result, nil
+}
+
+// Posts batches to a bulk endpoint. The zero value of everything but Host
+// and Key is Orchestrate's.
+type Client struct {
+	// The host, and the key sent as the basic auth user.
+	Host string
+	Key  string
+
+	// Whether to send plain http rather than https, as to a unix socket.
+	Insecure bool
+
+	// The path batches are posted to, under /v0/ unless it starts with a
+	// slash.
+	Endpoint string
+
+	// What batches are sent as, and the status a successful response has.
+	ContentType string
+	Status      int
+
+	// Headers added to every request.
+	Header http.Header
+
+	HTTPClient *http.Client
+}
+
+// The URL batches are posted to.
+func (c *Client) URL() string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	if strings.HasPrefix(c.Endpoint, "/") {
+		return scheme + "://" + c.Host + c.Endpoint
+	}
+	return scheme + "://" + c.Host + "/v0/" + c.Endpoint
+}
+
+// Posts a batch, returning the server's response to it. A response with an
+// unexpected status is an error from ParseError; one that's taken can still
+// have failed items, in its Failures.
+func (c *Client) Post(ctx context.Context, batch *Batch) (*Response, error) {
+	return c.PostBody(ctx, batch.Bytes(), "")
+}
+
+// Posts a body of encoded items, compressed with the Content-Encoding if
+// one is given.
+func (c *Client) PostBody(ctx context.Context, body []byte, encoding string) (*Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range c.Header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	req.SetBasicAuth(c.Key, "")
+	contentType := c.ContentType
+	if contentType == "" {
+		contentType = ContentType
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	status := c.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return ParseResponse(resp, status)
+}
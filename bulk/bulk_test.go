@@ -0,0 +1,339 @@
+package bulk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func errorResponse(code int, body string, header http.Header) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:     http.StatusText(code),
+		StatusCode: code,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		code  int
+		class error
+	}{
+		{http.StatusUnauthorized, ErrAuth},
+		{http.StatusForbidden, ErrAuth},
+		{http.StatusTooManyRequests, ErrRateLimited},
+		{http.StatusBadRequest, ErrValidation},
+		{http.StatusUnprocessableEntity, ErrValidation},
+		{http.StatusInternalServerError, ErrServer},
+		{http.StatusServiceUnavailable, ErrServer},
+		{http.StatusNotFound, nil},
+	}
+	classes := []error{ErrAuth, ErrRateLimited, ErrValidation, ErrServer}
+	for _, test := range tests {
+		err := ParseError(errorResponse(test.code, `{"message": "no"}`, nil))
+		for _, class := range classes {
+			if got := errors.Is(err, class); got != (class == test.class) {
+				t.Errorf("%v: errors.Is(%v) = %v", test.code, class, got)
+			}
+		}
+		var e *StatusError
+		if !errors.As(err, &e) || e.StatusCode != test.code || e.Message != "no" {
+			t.Errorf("%v: got %#v, want a *StatusError with the message", test.code, err)
+		}
+		if got := StatusCode(err); got != test.code {
+			t.Errorf("%v: StatusCode = %v", test.code, got)
+		}
+	}
+
+	var validation *ValidationError
+	if err := ParseError(errorResponse(400, "{}", nil)); !errors.As(err, &validation) || validation.ItemIndex != -1 {
+		t.Errorf("a 400 is %#v, want a *ValidationError for the whole request", err)
+	}
+}
+
+func TestParseErrorBody(t *testing.T) {
+	err := ParseError(errorResponse(502, "<html>Bad Gateway</html>", nil))
+	var e *StatusError
+	if !errors.As(err, &e) || e.Message != "<html>Bad Gateway</html>" {
+		t.Errorf("got %#v, want the body as the message", err)
+	}
+}
+
+func TestParseErrorRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": {"3"}}
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		err := ParseError(errorResponse(code, "", header))
+		if got := RetryAfter(err); got != 3*time.Second {
+			t.Errorf("%v: RetryAfter = %v, want 3s", code, got)
+		}
+	}
+	if got := RetryAfter(ParseError(errorResponse(400, "", header))); got != 0 {
+		t.Errorf("a 400's RetryAfter = %v, want 0", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{"1.5", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		if got := ParseRetryAfter(test.header); got < test.min || got > test.max {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v to %v", test.header, got, test.min, test.max)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err                   error
+		retryable, overloaded bool
+	}{
+		{nil, false, false},
+		{errors.New("connection reset"), true, false},
+		{context.DeadlineExceeded, true, false},
+		{ParseError(errorResponse(429, "", nil)), true, true},
+		{ParseError(errorResponse(503, "", nil)), true, true},
+		{ParseError(errorResponse(500, "", nil)), true, false},
+		{ParseError(errorResponse(400, "", nil)), false, false},
+		{ParseError(errorResponse(401, "", nil)), false, false},
+		{ParseError(errorResponse(404, "", nil)), false, false},
+	}
+	for _, test := range tests {
+		if got := Retryable(test.err); got != test.retryable {
+			t.Errorf("Retryable(%v) = %v", test.err, got)
+		}
+		if got := Overloaded(test.err); got != test.overloaded {
+			t.Errorf("Overloaded(%v) = %v", test.err, got)
+		}
+	}
+}
+
+func TestBatchAddLine(t *testing.T) {
+	var batch Batch
+	if err := batch.AddLine([]byte(`{"kind":"item"}` + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Add(NewItem("users", "alice", map[string]string{"name": "Alice"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.AddLine([]byte(`{"kind":`)); err == nil {
+		t.Error("a line that isn't JSON was added")
+	}
+
+	want := `{"kind":"item"}` + "\n" +
+		`{"kind":"item","path":{"collection":"users","kind":"item","key":"alice"},"value":{"name":"Alice"}}` + "\n"
+	if got := string(batch.Bytes()); got != want {
+		t.Errorf("body is %q, want %q", got, want)
+	}
+	if batch.Len() != 2 {
+		t.Errorf("Len = %v, want 2", batch.Len())
+	}
+}
+
+func TestFailures(t *testing.T) {
+	resp := &Response{Results: []Result{
+		{Status: "success"},
+		{Status: "failure", Error: &ResultError{Message: "bad value"}},
+		{Status: "success"},
+		{Status: "failure"},
+	}}
+	failures := resp.Failures()
+	if len(failures) != 2 {
+		t.Fatalf("got %v failures, want 2", len(failures))
+	}
+	for i, want := range []struct {
+		index   int
+		message string
+	}{{1, "bad value"}, {3, ""}} {
+		var e *ValidationError
+		if !errors.As(failures[i], &e) || e.ItemIndex != want.index || e.Message != want.message {
+			t.Errorf("failure %v is %#v, want item %v with %q", i, failures[i], want.index, want.message)
+		}
+		if !errors.Is(failures[i], ErrValidation) {
+			t.Errorf("failure %v isn't ErrValidation", i)
+		}
+	}
+}
+
+func compressed(encoding, body string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	w.Write([]byte(body))
+	w.Close()
+	return buf.String()
+}
+
+func TestParseResponse(t *testing.T) {
+	const body = `{"status": "success", "success_count": 2}`
+	tests := []struct {
+		code     int
+		encoding string
+		body     string
+		ok       bool
+	}{
+		{200, "", body, true},
+		{200, "gzip", compressed("gzip", body), true},
+		{200, "deflate", compressed("deflate", body), true},
+		{201, "", body, false},
+		{200, "gzip", body, false},
+		{200, "", "<html>OK</html>", false},
+		{200, "deflate", "not deflate", false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.encoding != "" {
+			header.Set("Content-Encoding", test.encoding)
+		}
+		resp, err := ParseResponse(errorResponse(test.code, test.body, header), 200)
+		if !test.ok {
+			if resp != nil || err == nil {
+				t.Errorf("%v %q %q: got %+v, %v, want an error", test.code, test.encoding, test.body, resp, err)
+			}
+			continue
+		}
+		if err != nil || resp.Status != "success" || resp.SuccessCount != 2 {
+			t.Errorf("%v %q: got %+v, %v", test.code, test.encoding, resp, err)
+		}
+	}
+
+	if _, err := ParseResponse(errorResponse(201, `{"message": "no"}`, nil), 200); StatusCode(err) != 201 {
+		t.Errorf("a 201 where a 200 was expected gave %v, want its *StatusError", err)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&ResultError{Message: "bad value"}, "bad value"},
+		{&StatusError{Status: "Bad Gateway", StatusCode: 502, Message: "down"}, "Bad Gateway (502): down"},
+		{&ValidationError{StatusError: StatusError{Message: "bad value"}, ItemIndex: 3}, "item 3: bad value"},
+		{&ValidationError{StatusError: StatusError{Status: "Bad Request", StatusCode: 400, Message: "no"}, ItemIndex: -1}, "Bad Request (400): no"},
+	}
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("%#v: Error() = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestClientURL(t *testing.T) {
+	tests := []struct {
+		client Client
+		want   string
+	}{
+		{Client{Host: "api.orchestrate.io"}, "https://api.orchestrate.io/v0/"},
+		{Client{Host: "localhost:8080", Insecure: true, Endpoint: "bulk"}, "http://localhost:8080/v0/bulk"},
+		{Client{Host: "gateway", Endpoint: "/db/v1/bulk"}, "https://gateway/db/v1/bulk"},
+	}
+	for _, test := range tests {
+		if got := test.client.URL(); got != test.want {
+			t.Errorf("URL of %+v = %q, want %q", test.client, got, test.want)
+		}
+	}
+}
+
+func TestClientPost(t *testing.T) {
+	var (
+		status int
+		header http.Header
+		body   string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, _, _ := r.BasicAuth(); key != "key" {
+			t.Errorf("sent the key %q", key)
+		}
+		if got := r.Header.Get("Content-Type"); got != ContentType {
+			t.Errorf("sent the content type %q", got)
+		}
+		if got := r.Header.Get("X-Test"); got != "yes" {
+			t.Errorf("sent X-Test %q", got)
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	client := &Client{
+		Host:       strings.TrimPrefix(server.URL, "http://"),
+		Key:        "key",
+		Insecure:   true,
+		Header:     http.Header{"X-Test": {"yes"}},
+		HTTPClient: server.Client(),
+	}
+	var batch Batch
+	batch.Add(NewItem("users", "alice", 1))
+	batch.Add(NewItem("users", "bob", 2))
+
+	status, body = 200, `{"status": "success", "success_count": 1, "results": [{"status": "success"}, {"status": "failure", "error": {"message": "no"}}]}`
+	resp, err := client.Post(context.Background(), &batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" || resp.SuccessCount != 1 || len(resp.Results) != 2 || !resp.Results[0].OK() || len(resp.Failures()) != 1 {
+		t.Errorf("2xx response is %+v", resp)
+	}
+
+	tests := []struct {
+		status     int
+		header     http.Header
+		class      error
+		retryAfter time.Duration
+	}{
+		{400, nil, ErrValidation, 0},
+		{429, http.Header{"Retry-After": {"7"}}, ErrRateLimited, 7 * time.Second},
+		{500, nil, ErrServer, 0},
+		{503, http.Header{"Retry-After": {"2"}}, ErrServer, 2 * time.Second},
+	}
+	for _, test := range tests {
+		status, header, body = test.status, test.header, `{"message": "try again"}`
+		resp, err := client.Post(context.Background(), &batch)
+		if resp != nil || !errors.Is(err, test.class) {
+			t.Errorf("%v: got %+v, %v, want a %v", test.status, resp, err, test.class)
+		}
+		if got := RetryAfter(err); got != test.retryAfter {
+			t.Errorf("%v: RetryAfter = %v, want %v", test.status, got, test.retryAfter)
+		}
+		if got := Retryable(err); got != (test.status != 400) {
+			t.Errorf("%v: Retryable = %v", test.status, got)
+		}
+	}
+
+	// A client's own Status takes the place of 200.
+	client.Status = http.StatusCreated
+	status, header, body = 200, nil, `{"status": "success"}`
+	if _, err := client.Post(context.Background(), &batch); StatusCode(err) != 200 {
+		t.Errorf("a 200 where a 201 was expected gave %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package bulk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The classes of error, for errors.Is. Every error ParseError returns but a
+// plain *StatusError is one of them.
+var (
+	ErrAuth        = errors.New("bulk: unauthorized")
+	ErrRateLimited = errors.New("bulk: rate limited")
+	ErrValidation  = errors.New("bulk: invalid request")
+	ErrServer      = errors.New("bulk: server error")
+)
+
+// A request the server answered with an unexpected status. The classes
+// below wrap it, so errors.As finds it under any of them.
+type StatusError struct {
+	// The status string and code of the response.
+	Status     string
+	StatusCode int
+
+	// The server's message, or the body if it wasn't the usual JSON.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Status, e.StatusCode, e.Message)
+}
+
+// The server refused the key, with a 401 or a 403.
+type AuthError struct{ StatusError }
+
+func (e *AuthError) Is(target error) bool { return target == ErrAuth }
+func (e *AuthError) Unwrap() error        { return &e.StatusError }
+
+// The server turned the request away with a 429, asking to be left for
+// RetryAfter if it said.
+type RateLimitError struct {
+	StatusError
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Is(target error) bool { return target == ErrRateLimited }
+func (e *RateLimitError) Unwrap() error        { return &e.StatusError }
+
+// The server couldn't take the request, with a 400 or a 422, or, as one of
+// a response's Failures, an item of the batch. ItemIndex is the item's
+// index in the batch, -1 for the whole request.
+type ValidationError struct {
+	StatusError
+	ItemIndex int
+}
+
+func (e *ValidationError) Error() string {
+	if e.ItemIndex >= 0 && e.StatusCode == 0 {
+		return fmt.Sprintf("item %v: %v", e.ItemIndex, e.Message)
+	}
+	return e.StatusError.Error()
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrValidation }
+func (e *ValidationError) Unwrap() error        { return &e.StatusError }
+
+// The server failed, with a 5xx, asking to be left for RetryAfter if it
+// said, as a 503 may.
+type ServerError struct {
+	StatusError
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Is(target error) bool { return target == ErrServer }
+func (e *ServerError) Unwrap() error        { return &e.StatusError }
+
+// Reads an error from a response with an unexpected status, as the class
+// its status falls in. The body is read in full, so the connection can be
+// reused.
+func ParseError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	e := StatusError{Status: resp.Status, StatusCode: resp.StatusCode}
+	var message struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		e.Message = string(body)
+	} else {
+		e.Message = message.Message
+	}
+
+	retryAfter := ParseRetryAfter(resp.Header.Get("Retry-After"))
+	switch code := resp.StatusCode; {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return &AuthError{e}
+	case code == http.StatusTooManyRequests:
+		return &RateLimitError{e, retryAfter}
+	case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity:
+		return &ValidationError{e, -1}
+	case code >= 500:
+		return &ServerError{e, retryAfter}
+	}
+	return &e
+}
+
+// Parses a Retry-After header, given in seconds or as an HTTP date. One
+// that has passed, or can't be parsed, is 0.
+func ParseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// The status of the response the error was read from, 0 if it wasn't.
+func StatusCode(err error) int {
+	var e *StatusError
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// How long the server asked to be left before a retry, 0 if it didn't.
+func RetryAfter(err error) time.Duration {
+	var limited *RateLimitError
+	if errors.As(err, &limited) {
+		return limited.RetryAfter
+	}
+	var failed *ServerError
+	if errors.As(err, &failed) {
+		return failed.RetryAfter
+	}
+	return 0
+}
+
+// Whether the request may succeed if sent again: rate limits, server
+// errors and anything that never got a response.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServer) {
+		return true
+	}
+	return err != nil && StatusCode(err) == 0
+}
+
+// Whether the server turned the request away as overloaded, with a 429 or
+// a 503, which a client should back off from.
+func Overloaded(err error) bool {
+	return errors.Is(err, ErrRateLimited) || StatusCode(err) == http.StatusServiceUnavailable
+}
@@ -0,0 +1,475 @@
+// Package bulkimport imports export stream items into an app the way
+// orcbulkimport does: read a line at a time, checked by a pool of
+// validators, batched, several batches sent at once and the ones that fail
+// in a way worth retrying sent again. It's for Go programs that import as
+// part of their own work, with a Progress told how each batch goes.
+//
+//	importer, err := bulkimport.New(bulkimport.Config{Host: "api.orchestrate.io", Key: key})
+//	stats, err := importer.ImportFile(ctx, "users.json")
+//
+// Run is the pipeline itself, for any number of streams at once, with the
+// validating, batching and sending done by a Config's funcs. The
+// orcbulkimport command runs its imports with it.
+package bulkimport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+// The defaults of a Config's zero fields, orcbulkimport's own.
+const (
+	DefaultBatchSize       = 250
+	DefaultRetries         = 4
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultRetryMaxBackoff = 30 * time.Second
+	DefaultTimeouts        = 3
+)
+
+// What an Importer imports to and how. Only Host and Key are needed, and
+// not with a Send.
+type Config struct {
+	// The host, and the key sent as the basic auth user.
+	Host string
+	Key  string
+
+	// Whether to send plain http rather than https.
+	Insecure bool
+
+	// The path batches are posted to, as in a bulk.Client, Orchestrate's
+	// if empty.
+	Endpoint string
+
+	// How many batches are sent at once, four for each CPU if 0, at least 4
+	// and at most 64.
+	Workers int
+	// How many chunks of records are validated at once, one for each CPU
+	// if 0.
+	Validators int
+
+	// The most items sent in one request, and if BatchBytes isn't 0 the
+	// largest request body. An item bigger than BatchBytes goes alone.
+	BatchSize  int
+	BatchBytes int
+
+	// How many times a batch that failed with a network error, a 5xx or a
+	// 429 is sent again, the wait before the first retry, doubling for
+	// each one after, and the longest wait unless the server's
+	// Retry-After asks for longer. A negative one is none.
+	Retries         int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// How many times a batch whose Send returned ErrTimedOut is sent
+	// again, none if negative.
+	Timeouts int
+
+	// The client requests are sent with, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// Told how the batches go, if not nil.
+	Progress Progress
+
+	// For Run. Validate checks a chunk of a stream's records as read,
+	// leaving in its Records those to be batched; an error stops the
+	// import. Without it the records must be JSON.
+	Validate func(stream *Stream, chunk *Chunk) error
+	// Makes a batch for a stream's records of the key, one of lines up to
+	// the BatchSize and BatchBytes if nil.
+	NewBatch func(stream *Stream, key interface{}) Batch
+	// Makes one attempt at sending a batch: what the server answered, how
+	// many of the batch's items it got to and why it failed, if it did.
+	// Without it batches are posted to the Host with the HTTPClient, the
+	// result being a *bulk.Response.
+	Send func(ctx context.Context, batch BatchInfo) (result interface{}, processed int, err error)
+}
+
+// Told how an import goes. BatchSent and BatchRetry are called from the
+// goroutines sending batches, so at once; the others from ones of the
+// stream's own, in turn for each stream. All should return quickly.
+type Progress interface {
+	// A chunk of the stream's records has been read and handed to the
+	// validators.
+	ChunkRead(stream *Stream, chunk Chunk)
+	// A chunk has been validated, told in the order the chunks were read,
+	// and its Records are to be batched.
+	ChunkValidated(stream *Stream, chunk *Chunk)
+	// The stream has been read and its batches queued, err being why
+	// reading ended: io.EOF at the end, the Run's context's error if it
+	// was stopped.
+	StreamRead(stream *Stream, err error)
+	// A batch is being sent, for its Attempt'th time.
+	BatchSent(batch BatchInfo)
+	// A batch failed and will be sent again after the delay. A
+	// *PartialError is for the part of it the server didn't get to.
+	BatchRetry(batch BatchInfo, err error, delay time.Duration)
+	// A batch is done with: result is the server's answer if it was taken,
+	// err why not if it wasn't, after its retries. A Partial batch's
+	// remaining items are told of later.
+	BatchDone(batch BatchInfo, result interface{}, err error)
+	// An item of a batch the server took failed, err being a
+	// *bulk.ValidationError.
+	ItemFailed(batch BatchInfo, line []byte, err error)
+	// All of the stream's batches are done with, or, with err, it couldn't
+	// be opened or reading it failed, after the batches read before that.
+	StreamDone(stream *Stream, err error)
+}
+
+// A batch of an import.
+type BatchInfo struct {
+	Stream *Stream
+	Batch  Batch
+	// From 1, in the order the stream's batches were read.
+	Seq     int
+	Items   int
+	Bytes   int
+	Attempt int
+	// How many times it has been sent again after failing and after
+	// timing out, and when it last joined the queue for a sender.
+	Retries  int
+	Timeouts int
+	Queued   time.Time
+	// Set on the part of a batch the server got to, the rest having been
+	// queued again.
+	Partial bool
+}
+
+// A Progress calling whichever of its funcs aren't nil.
+type ProgressFuncs struct {
+	OnChunkRead      func(stream *Stream, chunk Chunk)
+	OnChunkValidated func(stream *Stream, chunk *Chunk)
+	OnStreamRead     func(stream *Stream, err error)
+	OnBatchSent      func(batch BatchInfo)
+	OnBatchRetry     func(batch BatchInfo, err error, delay time.Duration)
+	OnBatchDone      func(batch BatchInfo, result interface{}, err error)
+	OnItemFailed     func(batch BatchInfo, line []byte, err error)
+	OnStreamDone     func(stream *Stream, err error)
+}
+
+func (p ProgressFuncs) ChunkRead(stream *Stream, chunk Chunk) {
+	if p.OnChunkRead != nil {
+		p.OnChunkRead(stream, chunk)
+	}
+}
+
+func (p ProgressFuncs) ChunkValidated(stream *Stream, chunk *Chunk) {
+	if p.OnChunkValidated != nil {
+		p.OnChunkValidated(stream, chunk)
+	}
+}
+
+func (p ProgressFuncs) StreamRead(stream *Stream, err error) {
+	if p.OnStreamRead != nil {
+		p.OnStreamRead(stream, err)
+	}
+}
+
+func (p ProgressFuncs) BatchSent(batch BatchInfo) {
+	if p.OnBatchSent != nil {
+		p.OnBatchSent(batch)
+	}
+}
+
+func (p ProgressFuncs) BatchRetry(batch BatchInfo, err error, delay time.Duration) {
+	if p.OnBatchRetry != nil {
+		p.OnBatchRetry(batch, err, delay)
+	}
+}
+
+func (p ProgressFuncs) BatchDone(batch BatchInfo, result interface{}, err error) {
+	if p.OnBatchDone != nil {
+		p.OnBatchDone(batch, result, err)
+	}
+}
+
+func (p ProgressFuncs) ItemFailed(batch BatchInfo, line []byte, err error) {
+	if p.OnItemFailed != nil {
+		p.OnItemFailed(batch, line, err)
+	}
+}
+
+func (p ProgressFuncs) StreamDone(stream *Stream, err error) {
+	if p.OnStreamDone != nil {
+		p.OnStreamDone(stream, err)
+	}
+}
+
+// How an import went.
+type Stats struct {
+	// The items read, and sent in the batches.
+	Items   int
+	Batches int
+	// The items imported, and those that failed, either on their own or
+	// with their batch.
+	Imported int
+	Failed   int
+	// How many times batches were sent again.
+	Retries int
+	Elapsed time.Duration
+}
+
+// Imports items with a Config. An Importer can run several imports, one
+// after another or at once.
+type Importer struct {
+	// Batches waiting for a sender.
+	queued int64
+	config Config
+	client *bulk.Client
+}
+
+// Makes an Importer, filling in the defaults of the config's zero fields.
+func New(config Config) (*Importer, error) {
+	switch {
+	case config.Host == "" && config.Send == nil:
+		return nil, errors.New("bulkimport: no Host")
+	case config.Key == "" && config.Send == nil:
+		return nil, errors.New("bulkimport: no Key")
+	case config.Workers < 0, config.BatchSize < 0, config.BatchBytes < 0:
+		return nil, errors.New("bulkimport: Workers, BatchSize and BatchBytes can't be negative")
+	case config.Validators < 0:
+		return nil, errors.New("bulkimport: Validators can't be negative")
+	}
+	if config.Workers == 0 {
+		config.Workers = DefaultWorkers(runtime.NumCPU())
+	}
+	if config.Validators == 0 {
+		config.Validators = runtime.NumCPU()
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	switch {
+	case config.Retries == 0:
+		config.Retries = DefaultRetries
+	case config.Retries < 0:
+		config.Retries = 0
+	}
+	switch {
+	case config.RetryBackoff == 0:
+		config.RetryBackoff = DefaultRetryBackoff
+	case config.RetryBackoff < 0:
+		config.RetryBackoff = 0
+	}
+	switch {
+	case config.RetryMaxBackoff == 0:
+		config.RetryMaxBackoff = DefaultRetryMaxBackoff
+	case config.RetryMaxBackoff < 0:
+		config.RetryMaxBackoff = 0
+	}
+	switch {
+	case config.Timeouts == 0:
+		config.Timeouts = DefaultTimeouts
+	case config.Timeouts < 0:
+		config.Timeouts = 0
+	}
+	if config.Validate == nil {
+		config.Validate = validJSON
+	}
+	if config.Progress == nil {
+		config.Progress = ProgressFuncs{}
+	}
+	client := &bulk.Client{
+		Host:       config.Host,
+		Key:        config.Key,
+		Insecure:   config.Insecure,
+		Endpoint:   config.Endpoint,
+		HTTPClient: config.HTTPClient,
+	}
+	return &Importer{config: config, client: client}, nil
+}
+
+// Imports the export stream items read from r, one JSON object a line.
+// The error is why the import stopped, if it did before the end: r
+// couldn't be read, a line isn't JSON, the server refused the key or ctx
+// was done. Batches and items that failed are counted in the Stats and
+// told to the Progress, and don't stop it.
+func (im *Importer) Import(ctx context.Context, r io.Reader) (Stats, error) {
+	reader := bufio.NewReader(r)
+	n := 0
+	return im.importLines(ctx, func() ([]byte, error) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				n++
+			}
+			if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+				return trimmed, nil
+			}
+			if err != nil {
+				if err != io.EOF {
+					err = fmt.Errorf("bulkimport: reading line %v: %v", n+1, err)
+				}
+				return nil, err
+			}
+		}
+	})
+}
+
+// Imports a file of export stream items, as Import does, decompressing it
+// if its name ends in .gz.
+func (im *Importer) ImportFile(ctx context.Context, name string) (Stats, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return Stats{}, fmt.Errorf("bulkimport: %v: %v", name, err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+	return im.Import(ctx, r)
+}
+
+// Imports the items sent on the channel until it's closed, as Import does.
+func (im *Importer) ImportItems(ctx context.Context, items <-chan bulk.Item) (Stats, error) {
+	return im.importLines(ctx, func() ([]byte, error) {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				return nil, io.EOF
+			}
+			var batch bulk.Batch
+			if err := batch.Add(item); err != nil {
+				return nil, fmt.Errorf("bulkimport: %v/%v: %v", item.Path.Collection, item.Path.Key, err)
+			}
+			return batch.Bytes(), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+}
+
+// Counts an import into its Stats, passing everything on to the
+// Config's Progress.
+type counter struct {
+	Progress
+	// Stops the import for a Read error or a refused key.
+	stop func(err error)
+
+	mu    sync.Mutex
+	stats Stats
+	err   error
+}
+
+func (c *counter) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.stop(err)
+}
+
+func (c *counter) ChunkRead(stream *Stream, chunk Chunk) {
+	c.mu.Lock()
+	c.stats.Items += len(chunk.Records)
+	c.mu.Unlock()
+	c.Progress.ChunkRead(stream, chunk)
+}
+
+func (c *counter) StreamRead(stream *Stream, err error) {
+	if err != io.EOF && err != context.Canceled {
+		c.fail(err)
+	}
+	c.Progress.StreamRead(stream, err)
+}
+
+func (c *counter) BatchRetry(batch BatchInfo, err error, delay time.Duration) {
+	c.mu.Lock()
+	c.stats.Retries++
+	c.mu.Unlock()
+	c.Progress.BatchRetry(batch, err, delay)
+}
+
+func (c *counter) BatchDone(batch BatchInfo, result interface{}, err error) {
+	c.mu.Lock()
+	switch {
+	case err == ErrUnsent:
+	case err != nil:
+		c.stats.Batches++
+		c.stats.Failed += batch.Items
+	default:
+		if !batch.Partial {
+			c.stats.Batches++
+		}
+		failed := 0
+		if resp, ok := result.(*bulk.Response); ok {
+			failed = len(resp.Failures())
+		}
+		c.stats.Imported += batch.Items - failed
+		c.stats.Failed += failed
+	}
+	c.mu.Unlock()
+	if errors.Is(err, bulk.ErrAuth) {
+		c.fail(err)
+	}
+	c.Progress.BatchDone(batch, result, err)
+}
+
+// Runs an import of the lines next returns, until io.EOF.
+func (im *Importer) importLines(ctx context.Context, next func() ([]byte, error)) (Stats, error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := &counter{Progress: im.config.Progress, stop: func(error) { cancel() }}
+	stream := &Stream{Open: func() (Reader, error) { return &funcReader{next: next}, nil }}
+	err := im.run(ctx, []*Stream{stream}, c)
+	if c.err != nil {
+		err = c.err
+	}
+	c.stats.Elapsed = time.Since(start)
+	return c.stats, err
+}
+
+// How long to wait before the attempt'th retry of a request that failed
+// with err: the backoff doubling for each attempt after the first, up to
+// max, with jitter so batches that failed together don't all come back
+// together, or the server's Retry-After if that's longer.
+func RetryDelay(err error, attempt int, backoff, max time.Duration) time.Duration {
+	delay := backoff
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	if retryAfter := bulk.RetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// How many batches to send at once for the CPUs, by default. Senders spend
+// their time waiting on the network, so there are four per CPU, at least 4
+// and at most 64.
+func DefaultWorkers(cpus int) int {
+	n := cpus * 4
+	if n < 4 {
+		n = 4
+	}
+	if n > 64 {
+		n = 64
+	}
+	return n
+}
@@ -0,0 +1,596 @@
+package bulkimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+// Records are validated in chunks of this many, so the hand off between
+// stages doesn't cost more than the work.
+const chunkSize = 100
+
+// The most batches a stream fills at once, for records of different keys.
+// Opening another sends the one opened longest ago, however full it is.
+const maxOpenBatches = 256
+
+var (
+	// What a Send returns for an attempt it gave up on for taking too long.
+	// The batch is sent again up to the Config's Timeouts times.
+	ErrTimedOut = errors.New("request timed out")
+	// What BatchDone is told of a batch left unsent because the import was
+	// stopping.
+	ErrUnsent = errors.New("bulkimport: left unsent, the import stopped")
+)
+
+// A record on its way through Run: the line sent for it, the key of the
+// batches it can go in and whatever else the program keeps about it.
+type Record struct {
+	Line []byte
+	// Records are only batched with others of the same key, such as those
+	// going to the same app. It must be comparable.
+	Key  interface{}
+	Meta interface{}
+}
+
+// What Run reads a stream's records from.
+//
+// A Reader with a ReadWhole method returning true is read to the end and
+// validated in one go, without the validators: for small inputs, where the
+// hand offs between goroutines cost more than they save.
+type Reader interface {
+	// Reads the next record, io.EOF after the last. Any other error ends
+	// the stream, and the batches read before it are still sent.
+	Read() (Record, error)
+	Close() error
+}
+
+// An input of Run. Its records are batched apart from other streams', and
+// it's told to the Progress as it's read and once it's done.
+type Stream struct {
+	Name string
+	// Opens the stream when Run starts reading it.
+	Open func() (Reader, error)
+	// For the program's own use.
+	Meta interface{}
+}
+
+// A chunk of a stream's records, read together and validated by one of the
+// Validators.
+type Chunk struct {
+	// The records as read, then the ones Validate leaves to be batched.
+	Records []Record
+	// The size of the records as read.
+	Bytes int
+	// How long reading the chunk spent in the Reader, and blocked handing
+	// it to the validators, then how long it waited for a validator. A
+	// chunk read whole doesn't wait.
+	Reading, Handoff, Waiting time.Duration
+	// Set by Validate, for the Progress.
+	Meta interface{}
+}
+
+// A batch of a stream's records, sent in one request. Without a
+// Config.NewBatch, Run fills batches of lines up to the BatchSize and
+// BatchBytes.
+type Batch interface {
+	// Adds a record the batch Fits.
+	Add(record Record)
+	// How many records the batch has, and the line sent for record i.
+	Len() int
+	Line(i int) []byte
+	// Whether a record of n bytes can be added, and whether the batch has
+	// all it should get.
+	Fits(n int) bool
+	Full() bool
+	// Called once the batch is to be sent, with its number within the
+	// stream, from 1.
+	Seal(seq int)
+	// Splits the batch into its first n records and the rest.
+	Split(n int) (head, tail Batch)
+}
+
+// What a batch's retry is told for an answer that covered only the first
+// Processed of its Items: the rest are sent again.
+type PartialError struct {
+	Processed, Items int
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("bulkimport: the server processed only %v of %v items", e.Processed, e.Items)
+}
+
+// A batch on its way to a sender, and where its answer goes.
+type request struct {
+	info    BatchInfo
+	answers chan answer
+}
+
+// How sending a batch went, for the stream's BatchDone. The eof answer
+// says how many batches the stream had, once they've all been queued,
+// and why reading it failed if it did.
+type answer struct {
+	info    BatchInfo
+	result  interface{}
+	err     error
+	eof     bool
+	batches int
+}
+
+// A chunk being validated, and where it goes when it has been.
+type validation struct {
+	stream *Stream
+	chunk  *Chunk
+	queued time.Time
+	err    error
+	done   chan *validation
+}
+
+// The state of one Run.
+type run struct {
+	im       *Importer
+	progress Progress
+	// Done when the import is to stop: the caller's context, or a Validate
+	// error.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	validations chan *validation
+	requests    chan request
+
+	mu  sync.Mutex
+	err error
+}
+
+// Stops the Run for a Validate error, at once so no stream reads any more
+// of its input.
+func (r *run) fail(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mu.Unlock()
+	r.cancel()
+}
+
+// Imports the streams, all at once, their records checked by the
+// Validators and their batches sent by the Workers, which the streams
+// share. Once ctx is done reading stops and batches not yet sent are told
+// to BatchDone with ErrUnsent, while those already being sent are
+// finished. The error is what stopped the import, a Validate error or
+// ctx's; streams that can't be opened or read are told to the Progress.
+func (im *Importer) Run(ctx context.Context, streams []*Stream) error {
+	return im.run(ctx, streams, im.config.Progress)
+}
+
+func (im *Importer) run(ctx context.Context, streams []*Stream, progress Progress) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &run{
+		im:          im,
+		progress:    progress,
+		ctx:         ctx,
+		cancel:      cancel,
+		validations: make(chan *validation, 100),
+		requests:    make(chan request, 100),
+	}
+
+	for i := 0; i < im.config.Validators; i++ {
+		go r.validate()
+	}
+	var senders sync.WaitGroup
+	for i := 0; i < im.config.Workers; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			r.send()
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *Stream) {
+			defer wg.Done()
+			r.stream(s)
+		}(s)
+	}
+	wg.Wait()
+	close(r.validations)
+	close(r.requests)
+	senders.Wait()
+
+	if r.err == nil {
+		r.err = parent.Err()
+	}
+	return r.err
+}
+
+// How many batches are waiting for a sender.
+func (im *Importer) Queued() int {
+	return int(atomic.LoadInt64(&im.queued))
+}
+
+// Reads, batches and queues a stream's records, returning once every batch
+// has been answered.
+func (r *run) stream(s *Stream) {
+	progress := r.progress
+	reader, err := s.Open()
+	if err != nil {
+		progress.StreamDone(s, err)
+		return
+	}
+
+	answers := make(chan answer, 100)
+	answered := make(chan struct{})
+	go func() {
+		r.answer(s, answers)
+		close(answered)
+	}()
+
+	// Chunks are read in their own goroutine and validated by the pool,
+	// so neither waits behind the senders and their network I/O.
+	pending := make(chan chan *validation, 2*r.im.config.Validators)
+	readErr := make(chan error, 1)
+	if whole, ok := reader.(interface{ ReadWhole() bool }); ok && whole.ReadWhole() {
+		readErr <- r.readWhole(s, reader, pending)
+	} else {
+		go func() {
+			readErr <- r.readChunks(s, reader, pending)
+		}()
+	}
+
+	// The batch being filled for each key, and the keys in the order their
+	// batches were opened.
+	current := make(map[interface{}]Batch)
+	var open []interface{}
+	batches := 0
+	send := func(key interface{}) {
+		b := current[key]
+		batches++
+		b.Seal(batches)
+		r.queue(request{info: newBatchInfo(s, b, batches), answers: answers})
+		delete(current, key)
+		for i := range open {
+			if open[i] == key {
+				open = append(open[:i], open[i+1:]...)
+				break
+			}
+		}
+	}
+	// Set at the stream's first Validate error, after which its chunks
+	// still being validated are dropped.
+	failed := false
+	for done := range pending {
+		v := <-done
+		if v.err != nil && !failed {
+			failed = true
+			r.fail(v.err)
+		}
+		if failed {
+			continue
+		}
+		progress.ChunkValidated(s, v.chunk)
+		for _, record := range v.chunk.Records {
+			if b := current[record.Key]; b != nil && !b.Fits(len(record.Line)) {
+				send(record.Key)
+			}
+			b := current[record.Key]
+			if b == nil {
+				if len(open) == maxOpenBatches {
+					send(open[0])
+				}
+				b = r.im.newBatch(s, record.Key)
+				current[record.Key] = b
+				open = append(open, record.Key)
+			}
+			b.Add(record)
+			if b.Full() {
+				send(record.Key)
+			}
+		}
+	}
+	for len(open) > 0 {
+		send(open[0])
+	}
+	err = <-readErr
+	reader.Close()
+	progress.StreamRead(s, err)
+
+	// Reading ending anywhere but the end, unless stopped, fails the stream
+	// once the batches read before it are answered.
+	if err == io.EOF || err == context.Canceled {
+		err = nil
+	}
+	answers <- answer{eof: true, batches: batches, err: err}
+	<-answered
+}
+
+// Reads a stream in chunks, handing each to the validators and queueing
+// it on pending. Returns the error that ended the stream, io.EOF at the
+// end.
+func (r *run) readChunks(s *Stream, reader Reader, pending chan chan *validation) error {
+	defer close(pending)
+	chunk := &Chunk{}
+	flush := func() {
+		// The validator has the chunk once it's handed off.
+		read := *chunk
+		started := time.Now()
+		v := &validation{stream: s, chunk: chunk, queued: started, done: make(chan *validation, 1)}
+		r.validations <- v
+		pending <- v.done
+		read.Handoff = time.Since(started)
+		r.progress.ChunkRead(s, read)
+		chunk = &Chunk{}
+	}
+	for {
+		started := time.Now()
+		var record Record
+		err := r.ctx.Err()
+		if err == nil {
+			record, err = reader.Read()
+		}
+		chunk.Reading += time.Since(started)
+		if err != nil {
+			if len(chunk.Records) > 0 {
+				flush()
+			}
+			return err
+		}
+		chunk.Records = append(chunk.Records, record)
+		chunk.Bytes += len(record.Line)
+		if len(chunk.Records) == chunkSize {
+			flush()
+		}
+	}
+}
+
+// Reads all of a small stream's records and validates them here, as one
+// chunk.
+func (r *run) readWhole(s *Stream, reader Reader, pending chan chan *validation) error {
+	defer close(pending)
+	started := time.Now()
+	chunk := &Chunk{}
+	var err error
+	for err == nil {
+		var record Record
+		if record, err = reader.Read(); err == nil {
+			chunk.Records = append(chunk.Records, record)
+			chunk.Bytes += len(record.Line)
+		}
+	}
+	chunk.Reading = time.Since(started)
+	if len(chunk.Records) > 0 {
+		r.progress.ChunkRead(s, *chunk)
+		v := &validation{stream: s, chunk: chunk, done: make(chan *validation, 1)}
+		v.err = r.im.validate(s, chunk)
+		v.done <- v
+		pending <- v.done
+	}
+	return err
+}
+
+// Validates chunks until the Run is done.
+func (r *run) validate() {
+	for v := range r.validations {
+		v.chunk.Waiting = time.Since(v.queued)
+		v.err = r.im.validate(v.stream, v.chunk)
+		v.done <- v
+	}
+}
+
+// Queues a batch for the senders.
+func (r *run) queue(req request) {
+	req.info.Queued = time.Now()
+	atomic.AddInt64(&r.im.queued, 1)
+	r.requests <- req
+}
+
+// Sends batches until the Run is done, sending them again as the Config
+// says and passing on their answers.
+func (r *run) send() {
+	config := &r.im.config
+	progress := r.progress
+	for req := range r.requests {
+		atomic.AddInt64(&r.im.queued, -1)
+		info := req.info
+		if r.ctx.Err() != nil && info.Retries == 0 && info.Timeouts == 0 {
+			// Only the batches already being sent are finished.
+			req.answers <- answer{info: info, err: ErrUnsent}
+			continue
+		}
+		info.Attempt = info.Retries + info.Timeouts + 1
+		progress.BatchSent(info)
+		result, processed, err := r.im.send(r.ctx, info)
+		stopping := r.ctx.Err() != nil
+		if err == ErrTimedOut && info.Timeouts < config.Timeouts && !stopping {
+			info.Timeouts++
+			progress.BatchRetry(info, err, 0)
+			// Queued from another goroutine so a full queue can't leave
+			// every sender blocked on itself.
+			go r.queue(request{info, req.answers})
+			continue
+		}
+		if err != nil && err != ErrTimedOut && info.Retries < config.Retries && bulk.Retryable(err) && !stopping {
+			info.Retries++
+			delay := RetryDelay(err, info.Retries, config.RetryBackoff, config.RetryMaxBackoff)
+			progress.BatchRetry(info, err, delay)
+			retry := request{info, req.answers}
+			time.AfterFunc(delay, func() { r.queue(retry) })
+			continue
+		}
+		if err != nil {
+			req.answers <- answer{info: info, err: err}
+			continue
+		}
+
+		if processed < info.Items {
+			if processed == 0 && info.Timeouts >= config.Timeouts {
+				req.answers <- answer{info: info, err: fmt.Errorf("server processed none of %v", info.Batch)}
+				continue
+			}
+			if processed == 0 {
+				// No progress at all counts against the timeouts.
+				info.Timeouts++
+			}
+			progress.BatchRetry(info, &PartialError{processed, info.Items}, 0)
+			head, tail := info.Batch.Split(processed)
+			if processed > 0 {
+				done := info
+				done.Batch, done.Items, done.Bytes, done.Partial = head, head.Len(), batchBytes(head), true
+				req.answers <- answer{info: done, result: result}
+			}
+			rest := newBatchInfo(info.Stream, tail, info.Seq)
+			rest.Timeouts = info.Timeouts
+			go r.queue(request{rest, req.answers})
+			continue
+		}
+		req.answers <- answer{info: info, result: result}
+	}
+}
+
+// Tells the Progress how a stream's batches went, until all of them have.
+func (r *run) answer(s *Stream, answers chan answer) {
+	progress := r.progress
+	answered, batches := 0, -1
+	var failed error
+	for answered != batches {
+		a := <-answers
+		if a.eof {
+			batches, failed = a.batches, a.err
+			continue
+		}
+		if !a.info.Partial {
+			answered++
+		}
+		progress.BatchDone(a.info, a.result, a.err)
+		if resp, ok := a.result.(*bulk.Response); ok {
+			for _, failure := range resp.Failures() {
+				var item *bulk.ValidationError
+				if errors.As(failure, &item) && item.ItemIndex < a.info.Items {
+					progress.ItemFailed(a.info, a.info.Batch.Line(item.ItemIndex), failure)
+				}
+			}
+		}
+	}
+	progress.StreamDone(s, failed)
+}
+
+func newBatchInfo(s *Stream, b Batch, seq int) BatchInfo {
+	return BatchInfo{Stream: s, Batch: b, Seq: seq, Items: b.Len(), Bytes: batchBytes(b)}
+}
+
+func batchBytes(b Batch) int {
+	n := 0
+	for i := 0; i < b.Len(); i++ {
+		n += len(b.Line(i))
+	}
+	return n
+}
+
+// The batches Run fills without a Config.NewBatch.
+type lineBatch struct {
+	batch bulk.Batch
+	lines [][]byte
+	// The BatchSize and BatchBytes.
+	size, bytes int
+}
+
+func (b *lineBatch) Add(record Record) {
+	// Validate has made sure it's JSON.
+	b.batch.AddLine(record.Line)
+	b.lines = append(b.lines, record.Line)
+}
+
+func (b *lineBatch) Len() int          { return len(b.lines) }
+func (b *lineBatch) Line(i int) []byte { return b.lines[i] }
+func (b *lineBatch) Seal(int)          {}
+
+func (b *lineBatch) Fits(n int) bool {
+	return b.bytes == 0 || len(b.lines) == 0 || len(b.batch.Bytes())+n+1 <= b.bytes
+}
+
+func (b *lineBatch) Full() bool {
+	return len(b.lines) >= b.size || b.bytes > 0 && len(b.batch.Bytes()) >= b.bytes
+}
+
+func (b *lineBatch) Split(n int) (Batch, Batch) {
+	head, tail := &lineBatch{size: b.size, bytes: b.bytes}, &lineBatch{size: b.size, bytes: b.bytes}
+	for i, line := range b.lines {
+		if i < n {
+			head.Add(Record{Line: line})
+		} else {
+			tail.Add(Record{Line: line})
+		}
+	}
+	return head, tail
+}
+
+func (b *lineBatch) String() string {
+	return fmt.Sprintf("batch of %v items", len(b.lines))
+}
+
+func (im *Importer) newBatch(s *Stream, key interface{}) Batch {
+	if im.config.NewBatch != nil {
+		return im.config.NewBatch(s, key)
+	}
+	return &lineBatch{size: im.config.BatchSize, bytes: im.config.BatchBytes}
+}
+
+func (im *Importer) validate(s *Stream, chunk *Chunk) error {
+	if im.config.Validate == nil {
+		return nil
+	}
+	return im.config.Validate(s, chunk)
+}
+
+// Makes one attempt at sending a batch, with the Config's Send or, without
+// one, posting it with the bulk client.
+func (im *Importer) send(ctx context.Context, info BatchInfo) (interface{}, int, error) {
+	if im.config.Send != nil {
+		return im.config.Send(ctx, info)
+	}
+	resp, err := im.client.Post(ctx, &info.Batch.(*lineBatch).batch)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.Results == nil {
+		return resp, info.Items, nil
+	}
+	return resp, len(resp.Results), nil
+}
+
+// Checks that the records are JSON, as a batch needs them to be.
+func validJSON(s *Stream, chunk *Chunk) error {
+	var batch bulk.Batch
+	for _, record := range chunk.Records {
+		if err := batch.AddLine(record.Line); err != nil {
+			return fmt.Errorf("bulkimport: item %v: %v", record.Meta, err)
+		}
+	}
+	return nil
+}
+
+// Reads the lines a func returns as a Reader, each record's Meta being its
+// number.
+type funcReader struct {
+	next func() ([]byte, error)
+	n    int
+}
+
+func (r *funcReader) Read() (Record, error) {
+	line, err := r.next()
+	if err != nil {
+		return Record{}, err
+	}
+	r.n++
+	return Record{Line: line, Meta: r.n}, nil
+}
+
+func (r *funcReader) Close() error { return nil }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var capabilitiesPath = flag.String("capabilities-path", "_capabilities", "the destination's capabilities endpoint, under the -base-path, asked before the run for its batch limits, protocol version and compressions; empty to not probe")
+
+// What the destination says about its bulk endpoint. Fields it leaves out
+// are left to the flags.
+type capabilities struct {
+	// The bulk protocol version.
+	Version        string   `json:"version"`
+	MaxBatchSize   int      `json:"max_batch_size"`
+	MaxBatchBytes  int64    `json:"max_batch_bytes"`
+	ContentTypes   []string `json:"content_types"`
+	Compressions   []string `json:"compressions"`
+	MaxConcurrency int      `json:"max_concurrency"`
+}
+
+// The destination's capabilities, found by probeCapabilities.
+var serverCapabilities capabilities
+
+// Asks the destination what it supports, from an OPTIONS request to the
+// bulk endpoint and the -capabilities-path, and fits the import to it:
+// batches are kept under its limits, a sink profile for its protocol
+// version is used if -sink-profile doesn't name one, and a content type it
+// accepts is picked from the profile's.
+func probeCapabilities() error {
+	if *capabilitiesPath == "" || replay != nil || *dryRun {
+		return nil
+	}
+
+	caps := &serverCapabilities
+	resp, err := doRequest(http.MethodOptions, bulkSink.Endpoint, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			caps.ContentTypes = splitHeader(resp.Header.Get("Accept-Post"))
+			caps.Compressions = splitHeader(resp.Header.Get("Accept-Encoding"))
+		}
+	}
+	var reported capabilities
+	if _, err := jsonReply("GET", *capabilitiesPath, nil, 200, &reported); err != nil {
+		if bulk.StatusCode(err) != 404 {
+			log.Printf("Warning: probing capabilities: %v", err)
+		}
+	}
+	caps.Version, caps.MaxBatchSize, caps.MaxBatchBytes, caps.MaxConcurrency = reported.Version, reported.MaxBatchSize, reported.MaxBatchBytes, reported.MaxConcurrency
+	if len(reported.ContentTypes) > 0 {
+		caps.ContentTypes = reported.ContentTypes
+	}
+	if len(reported.Compressions) > 0 {
+		caps.Compressions = reported.Compressions
+	}
+
+	if caps.Version != "" {
+		log.Printf("The destination speaks bulk protocol %v", caps.Version)
+		if bulkSink.name == "" {
+			if name := profileForProtocol(caps.Version); name != "" {
+				log.Printf("Sending with sink profile %v", name)
+				if err := useSinkProfile(name); err != nil {
+					return err
+				}
+			}
+		} else if p := bulkSink.Protocol; p != "" && p != caps.Version {
+			log.Printf("Warning: sink profile %v is for bulk protocol %v", bulkSink.name, p)
+		}
+	}
+	if len(caps.ContentTypes) > 0 {
+		bulkSink.accept(caps.ContentTypes)
+	}
+	if len(caps.Compressions) > 0 {
+		log.Printf("The destination accepts %v request bodies", strings.Join(caps.Compressions, ", "))
+	}
+	limitBatches(caps.MaxBatchSize, caps.MaxBatchBytes)
+	if caps.MaxConcurrency > 0 && concurrency != nil {
+		concurrency.cap(caps.MaxConcurrency)
+	} else if caps.MaxConcurrency > 0 && *workerCount > caps.MaxConcurrency {
+		log.Printf("Warning: -workers %v is more than the %v concurrent requests the destination allows", *workerCount, caps.MaxConcurrency)
+	}
+	return nil
+}
+
+// Returns the one -config sink profile for the protocol version, if there
+// is exactly one.
+func profileForProtocol(version string) string {
+	var names []string
+	for name, profile := range config.SinkProfiles {
+		if profile.Protocol == version {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 1 {
+		sort.Strings(names)
+		log.Printf("Warning: sink profiles %v are all for bulk protocol %v, pass -sink-profile to pick one", strings.Join(names, ", "), version)
+		return ""
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// Splits a comma separated header such as Accept-Post, dropping parameters.
+func splitHeader(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if i := strings.Index(v, ";"); i >= 0 {
+			v = v[:i]
+		}
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	caCert     = flag.String("ca-cert", "", "a PEM file of the certificate authorities to trust for the API, instead of the system's, for endpoints with a private PKI")
+	clientCert = flag.String("client-cert", "", "a PEM file with the client certificate to present to the API, for endpoints that need mutual TLS")
+	clientKey  = flag.String("client-key", "", "a PEM file with the -client-cert's private key, if it isn't in the -client-cert file")
+)
+
+// Adds the -ca-cert authorities and -client-cert to the TLS settings.
+func addCertificates(conf *tls.Config) error {
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			return fmt.Errorf("-ca-cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("-ca-cert %v has no PEM certificates in it", *caCert)
+		}
+		conf.RootCAs = pool
+	}
+
+	if *clientKey != "" && *clientCert == "" {
+		return errors.New("-client-key needs a -client-cert")
+	}
+	if *clientCert == "" {
+		return nil
+	}
+	keyFile := *clientKey
+	if keyFile == "" {
+		keyFile = *clientCert
+	}
+	cert, err := tls.LoadX509KeyPair(*clientCert, keyFile)
+	if err != nil {
+		return fmt.Errorf("-client-cert: %v", err)
+	}
+	if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("-client-cert %v expired on %v", *clientCert, cert.Leaf.NotAfter.Format("2006-01-02"))
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault injection for rehearsing a run's retry and error settings. The flags
+// are left out of -help so nobody turns them on by accident.
+var (
+	injectErrorRate   = flag.String("inject-error-rate", "", "fail this fraction of requests before they're sent, such as 1% or 0.01")
+	injectLatency     = flag.String("inject-latency", "", "delay requests by this long, with an optional random spread such as 500ms±300ms")
+	injectDisconnects = flag.Bool("inject-disconnects", false, "also drop the connection partway through the response of -inject-error-rate of the requests, after the server has acted on them")
+)
+
+// The parsed fault injection settings, nil when none are set.
+var faults *faultSettings
+
+type faultSettings struct {
+	errorRate     float64
+	latency       time.Duration
+	latencySpread time.Duration
+	disconnects   bool
+}
+
+var errInjected = errors.New("injected fault")
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %v:\n", os.Args[0])
+		visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		visible.SetOutput(flag.CommandLine.Output())
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "inject-") {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		visible.PrintDefaults()
+	}
+}
+
+func setupFaults() error {
+	if *injectErrorRate == "" && *injectLatency == "" && !*injectDisconnects {
+		return nil
+	}
+	f := &faultSettings{disconnects: *injectDisconnects}
+
+	if *injectErrorRate != "" {
+		rate, err := parseRate(*injectErrorRate)
+		if err != nil {
+			return fmt.Errorf("-inject-error-rate: %v", err)
+		}
+		f.errorRate = rate
+	}
+	if f.disconnects && f.errorRate == 0 {
+		return errors.New("-inject-disconnects needs an -inject-error-rate")
+	}
+
+	if *injectLatency != "" {
+		base, spread := *injectLatency, ""
+		for _, sep := range []string{"±", "+-"} {
+			if i := strings.Index(base, sep); i >= 0 {
+				base, spread = base[:i], base[i+len(sep):]
+				break
+			}
+		}
+		var err error
+		if f.latency, err = time.ParseDuration(base); err != nil {
+			return fmt.Errorf("-inject-latency: %v", err)
+		}
+		if spread != "" {
+			if f.latencySpread, err = time.ParseDuration(spread); err != nil {
+				return fmt.Errorf("-inject-latency: %v", err)
+			}
+		}
+	}
+
+	faults = f
+	log.Printf("Warning: injecting faults, error rate %v, latency %v±%v, disconnects %v", f.errorRate, f.latency, f.latencySpread, f.disconnects)
+	return nil
+}
+
+// Parses a fraction given either as a percentage or a number from 0 to 1.
+func parseRate(s string) (float64, error) {
+	percent := strings.HasSuffix(s, "%")
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent {
+		rate /= 100
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("%v isn't between 0 and 100%%", s)
+	}
+	return rate, nil
+}
+
+// Perturbs requests on their way to the next transport.
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if delay := faults.delay(); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	if rand.Float64() < faults.errorRate {
+		return nil, errInjected
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && faults.disconnects && rand.Float64() < faults.errorRate {
+		resp.Body = &droppedBody{body: resp.Body, remaining: rand.Int63n(512)}
+	}
+	return resp, err
+}
+
+func (f *faultSettings) delay() time.Duration {
+	delay := f.latency
+	if f.latencySpread > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*f.latencySpread+1))) - f.latencySpread
+	}
+	return delay
+}
+
+// A response body that breaks off as though the connection was dropped.
+type droppedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *droppedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, fmt.Errorf("%v: %v", errInjected, io.ErrUnexpectedEOF)
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *droppedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	checkpointFile = flag.String("checkpoint", "", "record the records of each input that have been acknowledged in this file, so an interrupted import can be picked up with -resume")
+	resume         = flag.Bool("resume", false, "skip the records the -checkpoint file says were imported by an earlier run")
+	resumeByKey    = flag.Bool("resume-by-key", false, "instead of -resume, skip the records whose keys the -checkpoint has as imported by an earlier run, which is safe even when the inputs have been regenerated since")
+)
+
+// The -checkpoint, nil when there isn't one.
+var checkpoints *checkpoint
+
+type checkpoint struct {
+	mu     sync.Mutex
+	Inputs map[string]*checkpointInput `json:"inputs"`
+
+	saved time.Time
+	// Inputs checked against their fingerprint since the run started.
+	checked map[string]bool
+
+	// The keys acknowledged by earlier runs, with -resume-by-key, and the
+	// file the keys of each acknowledged batch are added to.
+	keys    map[string]bool
+	keyFile *os.File
+}
+
+// What has been imported of one input file.
+type checkpointInput struct {
+	Size       int64      `json:"size,omitempty"`
+	ModTime    *time.Time `json:"mod_time,omitempty"`
+	HeadSHA256 string     `json:"head_sha256,omitempty"`
+
+	// The acknowledged lines (or record numbers), in order.
+	Done []*lineRange `json:"done"`
+}
+
+// The lines from First to Last, which came in batches numbered from
+// FirstBatch to LastBatch of the -concat stream or input the run read them
+// in.
+// Ranges of consecutive batches are merged, since the lines between them
+// weren't sent at all. Ranges that are only part of a batch aren't.
+type lineRange struct {
+	First      int    `json:"first"`
+	Last       int    `json:"last"`
+	Run        string `json:"run"`
+	Stream     string `json:"stream"`
+	FirstBatch int    `json:"first_batch"`
+	LastBatch  int    `json:"last_batch"`
+	Part       bool   `json:"part,omitempty"`
+}
+
+// Whether b follows on from r with no unacknowledged records between them.
+func (r *lineRange) joins(b *lineRange) bool {
+	return r.Run == b.Run && r.Stream == b.Stream && !r.Part && !b.Part && r.LastBatch+1 == b.FirstBatch
+}
+
+func setupCheckpoint() error {
+	resuming := *resume || *resumeByKey
+	if *checkpointFile == "" {
+		if resuming {
+			return errors.New("-resume needs the -checkpoint to resume from")
+		}
+		return nil
+	}
+	if resuming && *atomicPerFile {
+		return errors.New("-resume can't pick up the staged items of an -atomic-per-file run")
+	}
+
+	checkpoints = &checkpoint{Inputs: make(map[string]*checkpointInput), checked: make(map[string]bool)}
+	body, err := ioutil.ReadFile(*checkpointFile)
+	switch {
+	case os.IsNotExist(err):
+		return checkpoints.openKeys(false)
+	case err != nil:
+		return err
+	case !resuming:
+		return fmt.Errorf("%v is there from an earlier run, pass -resume to continue it or remove it", *checkpointFile)
+	}
+	if err := json.Unmarshal(body, checkpoints); err != nil {
+		return fmt.Errorf("%v: %v", *checkpointFile, err)
+	}
+	if !*resumeByKey {
+		for name, input := range checkpoints.Inputs {
+			log.Printf("Resuming %v, %v ranges already imported", name, len(input.Done))
+		}
+		return checkpoints.openKeys(true)
+	}
+
+	if err := checkpoints.loadKeys(); err != nil {
+		return err
+	}
+	// The lines of inputs that have changed no longer mean anything, the
+	// ranges start again from this run.
+	for name, input := range checkpoints.Inputs {
+		if f := fingerprint(name); f.Size != input.Size || f.HeadSHA256 != input.HeadSHA256 || !sameTime(f.ModTime, input.ModTime) {
+			log.Printf("%v has changed since %v was written, resuming it by key", name, *checkpointFile)
+			delete(checkpoints.Inputs, name)
+		}
+	}
+	log.Printf("Resuming by key, %v keys already imported", len(checkpoints.keys))
+	return checkpoints.openKeys(true)
+}
+
+// Where the keys of the acknowledged records are kept, next to the
+// checkpoint.
+func checkpointKeysFile() string {
+	return *checkpointFile + ".keys"
+}
+
+// Opens the keys file to add to, starting it over for a new checkpoint.
+func (c *checkpoint) openKeys(resuming bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !resuming {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(checkpointKeysFile(), flags, 0644)
+	if err != nil {
+		return err
+	}
+	c.keyFile = file
+	return nil
+}
+
+// Reads the keys acknowledged by earlier runs. A checkpoint written before
+// keys were kept has none, and can't be resumed by key.
+func (c *checkpoint) loadKeys() error {
+	body, err := ioutil.ReadFile(checkpointKeysFile())
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%v has no keys file, %v, to -resume-by-key from", *checkpointFile, checkpointKeysFile())
+	}
+	if err != nil {
+		return err
+	}
+	c.keys = make(map[string]bool)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		// A partly written last line, from a crash, is left out.
+		var id checkpointKey
+		if len(line) > 0 && json.Unmarshal(line, &id) == nil {
+			c.keys[id.String()] = true
+		}
+	}
+	return nil
+}
+
+// A line of the keys file.
+type checkpointKey struct {
+	Collection string `json:"c"`
+	Key        string `json:"k"`
+	Tenant     string `json:"t,omitempty"`
+}
+
+func (k checkpointKey) String() string {
+	return k.Tenant + "\x00" + k.Collection + "\x00" + k.Key
+}
+
+// Returns the record's key as the keys file has it.
+func recordKey(t *tenant, line []byte) (checkpointKey, error) {
+	collection, key, err := scanItemPath(line)
+	id := checkpointKey{Collection: collection, Key: key}
+	if t != nil {
+		id.Tenant = t.name
+	}
+	return id, err
+}
+
+// Reports whether the record's key was acknowledged by an earlier run, with
+// -resume-by-key.
+func (c *checkpoint) importedKey(t *tenant, line []byte) bool {
+	if c == nil || c.keys == nil {
+		return false
+	}
+	id, err := recordKey(t, line)
+	return err == nil && c.keys[id.String()]
+}
+
+// Reports whether the record was imported by the run being resumed. The
+// input must be the same file the checkpoint was written for.
+func (c *checkpoint) imported(pos recordPos) bool {
+	if c == nil || !*resume || *resumeByKey {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	input := c.Inputs[pos.file]
+	if input == nil {
+		return false
+	}
+	if !c.checked[pos.file] {
+		f := fingerprint(pos.file)
+		if f.Size != input.Size || f.HeadSHA256 != input.HeadSHA256 || !sameTime(f.ModTime, input.ModTime) {
+			log.Fatalf("Error: %v has changed since %v was written, its lines can't be resumed; pass -resume-by-key instead to skip the keys already imported", pos.file, *checkpointFile)
+		}
+		c.checked[pos.file] = true
+	}
+	i := sort.Search(len(input.Done), func(i int) bool { return input.Done[i].Last >= pos.line })
+	return i < len(input.Done) && input.Done[i].First <= pos.line
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// Records the records of a batch of the stream that were imported, by
+// imported[i] for record i, saving the checkpoint if it hasn't been in the
+// last second. The failed ones are left for a resume to send again.
+func (c *checkpoint) acknowledged(stream string, b *batch, imported []bool) {
+	if c == nil || len(b.records) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A batch with failed records is acknowledged in parts, which mustn't
+	// be merged with the batches either side across the failures.
+	part := b.part
+	for _, ok := range imported {
+		part = part || !ok
+	}
+	// A batch of a -concat stream can run from the end of one file into
+	// the next.
+	var files []string
+	var spans []*lineRange
+	extend := false
+	for i, record := range b.records {
+		if !imported[i] {
+			extend = false
+			continue
+		}
+		pos := record.pos
+		if n := len(files); extend && files[n-1] == pos.file {
+			spans[n-1].Last = pos.line
+			continue
+		}
+		files = append(files, pos.file)
+		spans = append(spans, &lineRange{First: pos.line, Last: pos.line, Run: runID, Stream: stream, FirstBatch: b.seq, LastBatch: b.seq, Part: part})
+		extend = true
+	}
+	for i, file := range files {
+		input := c.Inputs[file]
+		if input == nil {
+			f := fingerprint(file)
+			input = &checkpointInput{Size: f.Size, ModTime: f.ModTime, HeadSHA256: f.HeadSHA256}
+			c.Inputs[file] = input
+		}
+		input.add(spans[i])
+	}
+	c.writeKeys(b, imported)
+
+	if time.Since(c.saved) >= time.Second {
+		c.saveLocked()
+	}
+}
+
+// Adds the keys of the batch's imported records to the keys file.
+func (c *checkpoint) writeKeys(b *batch, imported []bool) {
+	var lines []byte
+	for i, record := range b.records {
+		if !imported[i] {
+			continue
+		}
+		id, err := recordKey(record.tenant, b.Line(i))
+		if err != nil {
+			continue
+		}
+		line, err := json.Marshal(id)
+		if err != nil {
+			continue
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := c.keyFile.Write(lines); err != nil {
+		log.Printf("Error saving checkpoint keys: %v", err)
+	}
+}
+
+// Adds a range, merging it with the ranges of the batches either side.
+func (input *checkpointInput) add(r *lineRange) {
+	i := sort.Search(len(input.Done), func(i int) bool { return input.Done[i].First > r.First })
+	if i > 0 {
+		if prev := input.Done[i-1]; prev.joins(r) {
+			prev.Last, prev.LastBatch = r.Last, r.LastBatch
+			r = prev
+			i--
+			input.Done = append(input.Done[:i], input.Done[i+1:]...)
+		}
+	}
+	if i < len(input.Done) {
+		if next := input.Done[i]; r.joins(next) {
+			r.Last, r.LastBatch = next.Last, next.LastBatch
+			input.Done = append(input.Done[:i], input.Done[i+1:]...)
+		}
+	}
+	input.Done = append(input.Done, nil)
+	copy(input.Done[i+1:], input.Done[i:])
+	input.Done[i] = r
+}
+
+// Writes the checkpoint to a temporary file and moves it into place, so a
+// crash while saving leaves the previous one.
+func (c *checkpoint) saveLocked() {
+	c.saved = time.Now()
+	body, err := json.MarshalIndent(c, "", "  ")
+	if err == nil {
+		tmp := *checkpointFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, body, 0644); err == nil {
+			err = os.Rename(tmp, *checkpointFile)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving checkpoint: %v", err)
+	}
+}
+
+func (c *checkpoint) save() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.saveLocked()
+}
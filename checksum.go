@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var checksum = flag.String("checksum", "none", "send a digest of each batch so the server can detect corruption in transit: none, md5 (Content-MD5) or sha256 (Content-Digest)")
+
+func setupChecksum() error {
+	switch *checksum {
+	case "md5":
+		if fipsBuild {
+			return errors.New("-checksum md5 isn't allowed in a FIPS build, use sha256")
+		}
+		return nil
+	case "none", "sha256":
+		return nil
+	}
+	return fmt.Errorf("unknown checksum %q", *checksum)
+}
+
+// Returns the digest header for a request body, nil without -checksum.
+func checksumHeaders(body []byte) map[string]string {
+	switch *checksum {
+	case "md5":
+		sum := md5.Sum(body)
+		return map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(sum[:])}
+	case "sha256":
+		sum := sha256.Sum256(body)
+		return map[string]string{"Content-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"}
+	}
+	return nil
+}
+
+// With -checksum, checks a response body against the Content-MD5 or
+// Content-Digest the server sent with it, if any. Returns a reader for the
+// body either way.
+func verifyResponse(resp *http.Response) (io.Reader, error) {
+	if *checksum == "none" || resp.Uncompressed {
+		// A body the transport has decompressed no longer matches.
+		return resp.Body, nil
+	}
+	contentMD5 := resp.Header.Get("Content-MD5")
+	sha := digestValue(resp.Header.Get("Content-Digest"), "sha-256")
+	if contentMD5 == "" && sha == "" {
+		return resp.Body, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if contentMD5 != "" {
+		sum := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != contentMD5 {
+			return nil, fmt.Errorf("response body doesn't match its Content-MD5")
+		}
+	}
+	if sha != "" {
+		sum := sha256.Sum256(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != sha {
+			return nil, fmt.Errorf("response body doesn't match its Content-Digest")
+		}
+	}
+	return bytes.NewReader(body), nil
+}
+
+// Picks one algorithm's value out of a Content-Digest header such as
+// "sha-256=:base64:, sha-512=:base64:".
+func digestValue(header, algorithm string) string {
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && strings.EqualFold(name, algorithm) {
+			return strings.Trim(value, ":")
+		}
+	}
+	return ""
+}
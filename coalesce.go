@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var coalesceSmallFiles = flag.Bool("coalesce-small-files", false, "import the inputs of at most -small-file-size together, as a few -concat streams read in parallel, so their batches run across the file boundaries and go out full rather than one small request per file")
+
+// Each stream of coalesced small files holds at least this much, so few of
+// its batches go out part full.
+const coalesceStreamBytes = 8 << 20
+
+func setupCoalesce() error {
+	if !*coalesceSmallFiles {
+		return nil
+	}
+	switch {
+	case *concat:
+		return errors.New("-coalesce-small-files can't be used with -concat, which already imports every file as one stream")
+	case *atomicPerFile:
+		return errors.New("-coalesce-small-files can't be used with -atomic-per-file, a batch could hold several files' items")
+	case smallFileBytes == 0:
+		return errors.New("-coalesce-small-files needs a -small-file-size")
+	}
+	return nil
+}
+
+// Splits the inputs into streams of small files to import together, in
+// input order, and the rest to import on their own. Without
+// -coalesce-small-files every input is imported on its own.
+func coalesceInputs(inputs []string) (streams [][]string, single []string) {
+	if !*coalesceSmallFiles {
+		return nil, inputs
+	}
+	var small []string
+	var sizes []int64
+	var total int64
+	for _, name := range inputs {
+		info, err := os.Stat(name)
+		if name == stdinName || isURL(name) || err != nil || !info.Mode().IsRegular() || !isSmallFile(info.Size()) {
+			single = append(single, name)
+			continue
+		}
+		small = append(small, name)
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+	if len(small) < 2 {
+		return nil, inputs
+	}
+
+	n := int(total / coalesceStreamBytes)
+	if n > *workerCount {
+		n = *workerCount
+	}
+	if n < 1 {
+		n = 1
+	}
+	// Each stream takes files until it has its share of the bytes.
+	var filled int64
+	var names []string
+	for i, name := range small {
+		names = append(names, name)
+		filled += sizes[i]
+		if filled*int64(n) >= total*int64(len(streams)+1) {
+			streams = append(streams, names)
+			names = nil
+		}
+	}
+	if len(names) > 0 {
+		streams = append(streams, names)
+	}
+	return streams, single
+}
+
+// Names a stream of coalesced small files, uniquely by its first.
+func coalescedName(names []string) string {
+	return fmt.Sprintf("%v small files from %v", len(names), names[0])
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/moediddy/db/bulk"
+)
+
+// A stable code for a condition the log reports, carried by the
+// -log-format json events and the run's summaries, so alerting rules and
+// support docs can refer to it whatever its message says. E codes are
+// errors, W warnings and I information. A code keeps its meaning once
+// assigned; retired ones aren't reused.
+type eventCode string
+
+const (
+	codeError          eventCode = "E1000"
+	codeAuthFailed     eventCode = "E1001"
+	codeRateLimited    eventCode = "E1002"
+	codeServerError    eventCode = "E1003"
+	codeRequestInvalid eventCode = "E1004"
+	codeRequestFailed  eventCode = "E1005"
+	codeItemFailed     eventCode = "E1006"
+	codeInputFailed    eventCode = "E1007"
+	codeStalled        eventCode = "E1008"
+
+	codeWarning         eventCode = "W2000"
+	codeRetrying        eventCode = "W2001"
+	codeRecordSkipped   eventCode = "W2002"
+	codeRecordInvalid   eventCode = "W2003"
+	codeBackingOff      eventCode = "W2004"
+	codeSlowRequest     eventCode = "W2005"
+	codeSchemaViolation eventCode = "W2006"
+	codeErrorBudget     eventCode = "W2007"
+
+	codeInfo       eventCode = "I3000"
+	codeBatchSent  eventCode = "I3001"
+	codeBatchAcked eventCode = "I3002"
+	codeFileDone   eventCode = "I3003"
+)
+
+// What each code means, as "orcbulkimport codes" lists them.
+var eventCodes = []struct {
+	code        eventCode
+	description string
+}{
+	{codeError, "an error without a code of its own"},
+	{codeAuthFailed, "the destination refused the key, with a 401 or a 403"},
+	{codeRateLimited, "the destination kept answering a batch with 429s until the -retries ran out"},
+	{codeServerError, "the destination kept failing a batch with 5xx responses until the -retries ran out"},
+	{codeRequestInvalid, "the destination rejected a batch as a bad request, with a 400 or a 422"},
+	{codeRequestFailed, "a batch couldn't be sent: the connection failed, the request timed out or got another status"},
+	{codeItemFailed, "the destination rejected an item of a batch it took"},
+	{codeInputFailed, "an input couldn't be opened or read"},
+	{codeStalled, "batches were outstanding and none was acknowledged for the -stall-timeout"},
+	{codeWarning, "a warning without a code of its own"},
+	{codeRetrying, "a batch failed and will be sent again"},
+	{codeRecordSkipped, "a record was skipped, as a transform, -enrich-url, tenant routing or the existence check failed for it"},
+	{codeRecordInvalid, "a record isn't a JSON object, or with -dry-run isn't an item the destination would take"},
+	{codeBackingOff, "-adaptive-workers cut the requests in flight after a 429, a 503, a timeout or a latency spike"},
+	{codeSlowRequest, "a request took longer than -slow-request-threshold"},
+	{codeSchemaViolation, "a record's document doesn't match the -schema"},
+	{codeErrorBudget, "-target-error-rate cut the send rate after 429s, 5xx responses or timeouts overdrew the error budget"},
+	{codeInfo, "information without a code of its own"},
+	{codeBatchSent, "a batch was sent"},
+	{codeBatchAcked, "the destination answered for a batch"},
+	{codeFileDone, "an input was imported"},
+}
+
+// The level of a code's events.
+func (c eventCode) level() string {
+	switch c[0] {
+	case 'E':
+		return "error"
+	case 'W':
+		return "warning"
+	}
+	return "info"
+}
+
+// The code for a batch that failed with the error.
+func errorCode(err error) eventCode {
+	switch {
+	case errors.Is(err, bulk.ErrAuth):
+		return codeAuthFailed
+	case errors.Is(err, bulk.ErrRateLimited):
+		return codeRateLimited
+	case errors.Is(err, bulk.ErrServer):
+		return codeServerError
+	case errors.Is(err, bulk.ErrValidation):
+		return codeRequestInvalid
+	}
+	return codeRequestFailed
+}
+
+// Logs a line, as a log event with the code under -log-format json. The
+// line's "Error: " or "Warning: " prefix, if it has one, is left out of the
+// event's message, as the code gives its level.
+func logCode(code eventCode, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		log.Print(message)
+		return
+	}
+	_, message = logLevel(message)
+	emit(logEvent{Event: "log", Code: code, Level: code.level(), Message: message})
+}
+
+// Implements "orcbulkimport codes", which lists the event codes.
+func codesCommand(args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Usage: orcbulkimport codes")
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, c := range eventCodes {
+		fmt.Fprintf(table, "%v\t%v\t%v\n", c.code, strings.ToUpper(c.code.level()[:1])+c.code.level()[1:], c.description)
+	}
+	table.Flush()
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// The collection everything is imported into unless a route says otherwise,
+// and the routes from input file to collection, both from -collection.
+var (
+	defaultCollection string
+	collectionRoutes  map[string]string
+)
+
+// Parses -collection, a collection name or comma separated file=collection
+// routes, optionally along with a name for the files they don't cover.
+func parseCollections() error {
+	defaultCollection, collectionRoutes = "", nil
+	if *collection == "" {
+		return nil
+	}
+	for _, part := range strings.Split(*collection, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.LastIndex(part, "=")
+		if i < 0 {
+			if part == "" || defaultCollection != "" {
+				return fmt.Errorf("-collection %q should have one collection name, then file=collection routes", *collection)
+			}
+			defaultCollection = part
+			continue
+		}
+		file, name := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		if file == "" || name == "" {
+			return fmt.Errorf("-collection route %q should be file=collection", part)
+		}
+		if collectionRoutes == nil {
+			collectionRoutes = make(map[string]string)
+		}
+		if _, ok := collectionRoutes[file]; ok {
+			return fmt.Errorf("-collection routes %v more than once", file)
+		}
+		collectionRoutes[file] = name
+	}
+	return nil
+}
+
+// Checks the -collection routes against the inputs of an import: every
+// route should name an input, and for formats that produce bare documents
+// every input needs a collection.
+func setupCollections(inputs []string) error {
+	if collectionRoutes == nil {
+		return nil
+	}
+	used := make(map[string]bool)
+	for _, name := range inputs {
+		file, ok := collectionRoute(name)
+		if ok {
+			used[file] = true
+		} else if formats[*format].documents && defaultCollection == "" {
+			return fmt.Errorf("-collection has no route for %v, add one or a collection name for the rest", name)
+		}
+	}
+	for file := range collectionRoutes {
+		if !used[file] {
+			// It may still name a file inside an archive or directory.
+			log.Printf("Warning: the -collection route for %v doesn't name an input", file)
+		}
+	}
+	return nil
+}
+
+// Returns the route covering the file, by its path or just its name.
+func collectionRoute(file string) (string, bool) {
+	if _, ok := collectionRoutes[file]; ok {
+		return file, true
+	}
+	base := filepath.Base(file)
+	if _, ok := collectionRoutes[base]; ok {
+		return base, true
+	}
+	return "", false
+}
+
+// Returns the collection -collection puts the file's records in, empty if
+// it leaves them where they are.
+func collectionFor(file string) string {
+	if route, ok := collectionRoute(file); ok {
+		return collectionRoutes[route]
+	}
+	return defaultCollection
+}
+
+// Readdresses an item to the collection -collection gives its file. It runs
+// before the other transforms, so they see the collection it's going to.
+func routeCollection(item map[string]interface{}, pos recordPos) error {
+	name := collectionFor(pos.file)
+	if name == "" {
+		return nil
+	}
+	path, _ := item["path"].(map[string]interface{})
+	if path == nil {
+		return fmt.Errorf("item has no path to route to %v", name)
+	}
+	path["collection"] = name
+	return nil
+}
+
+// Settings for the items of one collection, from the -config:
+//
+//	collections:
+//	  users:
+//	    key-field: email
+//	    mode: create-only
+//	    transforms: redact pii
+//	  orders:
+//	    key-template: "{customer.id}-{number}"
+//
+// A key-field or key-template rekeys the collection's items from their
+// documents, a mode overrides -mode, and the transforms, as in pipeline
+// stages, run before the flag transforms.
+type collectionConfig struct {
+	KeyField    string   `json:"key-field"`
+	KeyTemplate string   `json:"key-template"`
+	Mode        string   `json:"mode"`
+	Transforms  ruleList `json:"transforms"`
+}
+
+// The per collection rules set up from the -config, by collection.
+var collectionRules map[string]*collectionRuleSet
+
+type collectionRuleSet struct {
+	key        func(value map[string]interface{}) (string, error)
+	transforms []transform
+}
+
+// Sets up the -config collections' rules, run after -collection routes
+// items, so they see the collection each item is going to.
+func setupCollectionRules() error {
+	if len(config.Collections) == 0 {
+		return nil
+	}
+	collectionRules = make(map[string]*collectionRuleSet)
+	for name, c := range config.Collections {
+		rules := &collectionRuleSet{}
+		switch {
+		case c.KeyField != "" && c.KeyTemplate != "":
+			return fmt.Errorf("collection %v: has both a key-field and a key-template", name)
+		case c.KeyField != "":
+			field := c.KeyField
+			rules.key = func(value map[string]interface{}) (string, error) { return fieldKey(value, field) }
+		case c.KeyTemplate != "":
+			template, err := parseKeyTemplate(c.KeyTemplate)
+			if err != nil {
+				return fmt.Errorf("collection %v: %v", name, err)
+			}
+			rules.key = template.render
+		}
+		if rules.key != nil && *mergeStrategy != "" {
+			return fmt.Errorf("collection %v: -merge picks winners by the keys in the inputs, it can't follow a key-field or key-template", name)
+		}
+		switch c.Mode {
+		case "", "upsert", "create-only":
+		default:
+			return fmt.Errorf("collection %v: unknown mode %q", name, c.Mode)
+		}
+		for _, spec := range c.Transforms {
+			t, err := newPipelineTransform(spec)
+			if err != nil {
+				return fmt.Errorf("collection %v: %v", name, err)
+			}
+			rules.transforms = append(rules.transforms, t)
+		}
+		if rules.key != nil || len(rules.transforms) > 0 {
+			collectionRules[name] = rules
+		}
+	}
+	if len(collectionRules) > 0 {
+		transforms = append(transforms, applyCollectionRules)
+	}
+	return nil
+}
+
+// Rekeys and transforms an item by the rules for its collection.
+func applyCollectionRules(item map[string]interface{}, pos recordPos) error {
+	path, _ := item["path"].(map[string]interface{})
+	collection, _ := path["collection"].(string)
+	rules := collectionRules[collection]
+	if rules == nil {
+		return nil
+	}
+	if rules.key != nil {
+		value := itemValue(item)
+		if value == nil {
+			return fmt.Errorf("item has no value to key %v items by", collection)
+		}
+		key, err := rules.key(value)
+		if err != nil {
+			return err
+		}
+		path["key"] = key
+	}
+	for _, t := range rules.transforms {
+		if err := t(item, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A key made of literal text and {field} references, such as
+// "{customer.id}-{number}".
+type keyTemplate []keyTemplatePart
+
+type keyTemplatePart struct {
+	text  string
+	field string
+}
+
+func parseKeyTemplate(s string) (keyTemplate, error) {
+	var t keyTemplate
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			t = append(t, keyTemplatePart{text: s})
+			break
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("key-template %q has an unclosed {", s)
+		}
+		field := s[open+1 : open+end]
+		if field == "" {
+			return nil, errors.New("key-template has an empty {}")
+		}
+		if open > 0 {
+			t = append(t, keyTemplatePart{text: s[:open]})
+		}
+		t = append(t, keyTemplatePart{field: field})
+		s = s[open+end+1:]
+	}
+	return t, nil
+}
+
+func (t keyTemplate) render(value map[string]interface{}) (string, error) {
+	var key strings.Builder
+	for _, part := range t {
+		if part.field == "" {
+			key.WriteString(part.text)
+			continue
+		}
+		doc, name, ok := lookupField(value, part.field)
+		if !ok {
+			return "", fmt.Errorf("document has no %q field for its key", part.field)
+		}
+		s, ok := keyString(doc[name])
+		if !ok {
+			return "", fmt.Errorf("document has no %q field for its key", part.field)
+		}
+		key.WriteString(s)
+	}
+	return key.String(), nil
+}
+
+// The -mode for items of the collection.
+func collectionMode(collection string) string {
+	if c := config.Collections[collection]; c != nil && c.Mode != "" {
+		return c.Mode
+	}
+	return *mode
+}
+
+// Whether any items may be imported with create-only, by -mode or in
+// the -config collections.
+func anyCreateOnly() bool {
+	if *mode == "create-only" {
+		return true
+	}
+	for _, c := range config.Collections {
+		if c.Mode == "create-only" {
+			return true
+		}
+	}
+	return false
+}
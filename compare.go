@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	sourceHost         = flag.String("source-host", "", "compare compares this app, rather than files, with the destination, and copy copies from it; defaults to -host")
+	sourceKey          = flag.String("source-key", "", "the API key of the app compare and copy read from, copy defaulting to -key")
+	compareCollections = flag.String("compare-collections", "", "comma separated collections compare reads from the -source-key app")
+	compareSamples     = flag.Int("compare-samples", 20, "how many random items of each collection compare checks value by value")
+	compareReport      = flag.String("compare-report", "", "write compare's report to this file, as HTML if it ends in .html and otherwise JSON; defaults to JSON on stdout")
+)
+
+// At most this many missing keys and differing fields are listed.
+const maxReportedDiffs = 10
+
+type compareResult struct {
+	Source      string                  `json:"source"`
+	Destination string                  `json:"destination"`
+	Generated   time.Time               `json:"generated"`
+	Collections []*collectionComparison `json:"collections"`
+}
+
+type collectionComparison struct {
+	Name             string       `json:"name"`
+	SourceCount      int          `json:"source_count"`
+	DestinationCount int          `json:"destination_count"`
+	Covered          int          `json:"covered"`
+	Coverage         float64      `json:"coverage_percent"`
+	Missing          []string     `json:"missing,omitempty"`
+	Sampled          int          `json:"sampled"`
+	Matching         int          `json:"matching"`
+	Diffs            []sampleDiff `json:"diffs,omitempty"`
+
+	keys    map[string]bool
+	samples []sampledItem
+	seen    int
+}
+
+type sampledItem struct {
+	key   string
+	value json.RawMessage
+}
+
+type sampleDiff struct {
+	Key     string   `json:"key"`
+	Missing bool     `json:"missing,omitempty"`
+	Fields  []string `json:"fields,omitempty"`
+}
+
+// Counts a source item, keeping a uniform random sample of them.
+func (c *collectionComparison) add(key string, value json.RawMessage) {
+	c.SourceCount++
+	c.keys[key] = true
+	c.seen++
+	if len(c.samples) < *compareSamples {
+		c.samples = append(c.samples, sampledItem{key, value})
+	} else if i := rand.Intn(c.seen); i < len(c.samples) {
+		c.samples[i] = sampledItem{key, value}
+	}
+}
+
+// Implements "orcbulkimport compare <files>" and, with -source-key,
+// "orcbulkimport compare", which check a destination against the source it
+// was migrated from: item counts, how many of the source's keys it has, and
+// whether a sample of values match. Exits with 1 if anything differs.
+func compareCommand(args []string) {
+	if (len(args) == 0) == (*sourceKey == "") {
+		log.Fatalf("Usage: orcbulkimport compare [-compare-samples n] [-compare-report file] <files> | -source-key key -compare-collections a,b")
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	result := &compareResult{Destination: *host, Generated: time.Now().UTC()}
+	collections := make(map[string]*collectionComparison)
+	collection := func(name string) *collectionComparison {
+		c := collections[name]
+		if c == nil {
+			c = &collectionComparison{Name: name, keys: make(map[string]bool)}
+			collections[name] = c
+		}
+		return c
+	}
+
+	if len(args) > 0 {
+		if err := setupFormat(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		result.Source = strings.Join(args, ", ")
+		for _, filename := range args {
+			if err := readCompareFile(filename, collection); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+	} else {
+		if *compareCollections == "" {
+			log.Fatalf("Error: -source-key needs -compare-collections")
+		}
+		from := *sourceHost
+		if from == "" {
+			from = *host
+		}
+		result.Source = from
+		for _, name := range strings.Split(*compareCollections, ",") {
+			c := collection(name)
+			err := listItems(from, *sourceKey, name, true, func(key string, value json.RawMessage) {
+				c.add(key, value)
+			})
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+	}
+
+	differs := false
+	var names []string
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := collections[name]
+		if err := c.compare(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		result.Collections = append(result.Collections, c)
+		if c.Covered < c.SourceCount || c.Matching < c.Sampled {
+			differs = true
+		}
+	}
+
+	if err := writeCompareReport(result); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if differs {
+		os.Exit(1)
+	}
+}
+
+func readCompareFile(filename string, collection func(string) *collectionComparison) error {
+	records, _, file, err := openRecords(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for n := 1; ; n++ {
+		line, err := records.ReadRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %v: %v", filename, err)
+		}
+		var item struct {
+			Path struct {
+				Collection string `json:"collection"`
+				Key        string `json:"key"`
+			} `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(line, &item); err != nil {
+			return fmt.Errorf("%v:%v: %v", filename, n, err)
+		}
+		collection(item.Path.Collection).add(item.Path.Key, item.Value)
+	}
+}
+
+// Lists the destination's keys for the collection and checks its sample.
+func (c *collectionComparison) compare() error {
+	covered := make(map[string]bool)
+	err := listItems(*host, *apiKey, c.Name, false, func(key string, value json.RawMessage) {
+		c.DestinationCount++
+		if c.keys[key] {
+			covered[key] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c.Covered = len(covered)
+	c.Coverage = 100
+	if c.SourceCount > 0 {
+		c.Coverage = 100 * float64(c.Covered) / float64(c.SourceCount)
+	}
+	for key := range c.keys {
+		if !covered[key] {
+			c.Missing = append(c.Missing, key)
+		}
+	}
+	sort.Strings(c.Missing)
+	if len(c.Missing) > maxReportedDiffs {
+		c.Missing = c.Missing[:maxReportedDiffs]
+	}
+
+	sort.Slice(c.samples, func(i, j int) bool { return c.samples[i].key < c.samples[j].key })
+	for _, sample := range c.samples {
+		c.Sampled++
+		if !covered[sample.key] {
+			c.Diffs = append(c.Diffs, sampleDiff{Key: sample.key, Missing: true})
+			continue
+		}
+		var dest json.RawMessage
+		_, err := jsonReply("GET", url.PathEscape(c.Name)+"/"+url.PathEscape(sample.key), nil, 200, &dest)
+		if err != nil {
+			return fmt.Errorf("getting %v/%v: %v", c.Name, sample.key, err)
+		}
+		fields, err := diffValues(sample.value, dest)
+		if err != nil {
+			return fmt.Errorf("%v/%v: %v", c.Name, sample.key, err)
+		}
+		if len(fields) == 0 {
+			c.Matching++
+		} else {
+			c.Diffs = append(c.Diffs, sampleDiff{Key: sample.key, Fields: fields})
+		}
+	}
+	return nil
+}
+
+// Pages through a collection of an app with the LIST API.
+func listItems(app, key, collection string, values bool, fn func(key string, value json.RawMessage)) error {
+	path := fmt.Sprintf("%v?limit=100&values=%v", url.PathEscape(collection), values)
+	for path != "" {
+		req, err := http.NewRequest("GET", apiPath(app, path), nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(key, "")
+		setAuditHeaders(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("listing %v on %v: %v", collection, app, err)
+		}
+
+		var page struct {
+			Results []struct {
+				Path struct {
+					Key string `json:"key"`
+				} `json:"path"`
+				Value json.RawMessage `json:"value"`
+			} `json:"results"`
+			Next string `json:"next"`
+		}
+		if resp.StatusCode != 200 {
+			err = bulk.ParseError(resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("listing %v on %v: %v", collection, app, err)
+		}
+
+		for _, result := range page.Results {
+			fn(result.Path.Key, result.Value)
+		}
+		path = nextPage(page.Next)
+	}
+	return nil
+}
+
+// Returns the dotted paths of the fields that differ between two documents.
+// Numbers are compared by their text, so ones that differ past what a
+// float64 holds, such as large ids, aren't taken to be equal.
+func diffValues(a, b json.RawMessage) ([]string, error) {
+	var va, vb interface{}
+	if err := decodeJSON(a, &va); err != nil {
+		return nil, err
+	}
+	if err := decodeJSON(b, &vb); err != nil {
+		return nil, err
+	}
+	var fields []string
+	diffFields(&fields, "", va, vb)
+	sort.Strings(fields)
+	if len(fields) > maxReportedDiffs {
+		fields = append(fields[:maxReportedDiffs], fmt.Sprintf("and %v more", len(fields)-maxReportedDiffs))
+	}
+	return fields, nil
+}
+
+func diffFields(fields *[]string, path string, a, b interface{}) {
+	ma, okA := a.(map[string]interface{})
+	mb, okB := b.(map[string]interface{})
+	if !okA || !okB {
+		if !reflect.DeepEqual(a, b) {
+			if path == "" {
+				path = "(document)"
+			}
+			*fields = append(*fields, path)
+		}
+		return
+	}
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+	for name, value := range ma {
+		diffFields(fields, prefix+name, value, mb[name])
+	}
+	for name, value := range mb {
+		if _, ok := ma[name]; !ok {
+			diffFields(fields, prefix+name, nil, value)
+		}
+	}
+}
+
+func writeCompareReport(result *compareResult) error {
+	var out io.Writer = os.Stdout
+	if *compareReport != "" {
+		file, err := os.Create(*compareReport)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if strings.HasSuffix(*compareReport, ".html") {
+		return compareTemplate.Execute(out, result)
+	}
+	body, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(body, '\n'))
+	return err
+}
+
+var compareTemplate = template.Must(template.New("compare").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.2f%%", f) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Comparison of {{.Source}} and {{.Destination}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+td.num { text-align: right; }
+.bad { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Comparison of {{.Source}} and {{.Destination}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+<table>
+<tr><th>Collection</th><th>Source</th><th>Destination</th><th>Key coverage</th><th>Samples matching</th><th>Differences</th></tr>
+{{range .Collections}}<tr{{if or (lt .Covered .SourceCount) (lt .Matching .Sampled)}} class="bad"{{end}}>
+<td>{{.Name}}</td>
+<td class="num">{{.SourceCount}}</td>
+<td class="num">{{.DestinationCount}}</td>
+<td class="num">{{percent .Coverage}}</td>
+<td class="num">{{.Matching}} of {{.Sampled}}</td>
+<td>{{if .Missing}}Missing keys: {{range $i, $k := .Missing}}{{if $i}}, {{end}}{{$k}}{{end}}<br>{{end}}
+{{range .Diffs}}{{.Key}}: {{if .Missing}}missing{{else}}{{range $i, $f := .Fields}}{{if $i}}, {{end}}{{$f}}{{end}}{{end}}<br>
+{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/moediddy/db/bulkimport"
+)
+
+var concat = flag.Bool("concat", false, "import all the input files as one stream, as if they were a single file")
+
+// Reads several inputs one after the other as a single stream of records.
+type concatReader struct {
+	names []string
+	index int
+
+	current recordReader
+	closer  io.Closer
+	line    int
+
+	// How far through the inputs reading has got, for progress reports
+	// from other goroutines.
+	mu     sync.Mutex
+	done   int64
+	offset inputOffset
+}
+
+func (r *concatReader) ReadRecord() ([]byte, error) {
+	for {
+		if r.current == nil {
+			if r.index == len(r.names) {
+				return nil, io.EOF
+			}
+			records, _, closer, err := openRecords(r.names[r.index])
+			if err != nil {
+				return nil, err
+			}
+			r.current, r.closer, r.line = records, closer, 0
+			r.mu.Lock()
+			r.offset, _ = closer.(inputOffset)
+			r.mu.Unlock()
+		}
+
+		line, err := r.current.ReadRecord()
+		if err == io.EOF {
+			r.Close()
+			r.index++
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", r.names[r.index], err)
+		}
+		r.line++
+		return line, nil
+	}
+}
+
+// Returns the file and line the last record came from.
+func (r *concatReader) Source() (string, int) {
+	if src, ok := r.current.(recordSource); ok {
+		file, line := src.Source()
+		if file == "" {
+			file = r.names[r.index]
+		}
+		return file, line
+	}
+	return r.names[r.index], r.line
+}
+
+// Returns how far through the inputs, as stored, reading has got.
+func (r *concatReader) Offset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset := r.done
+	if r.offset != nil {
+		offset += r.offset.Offset()
+	}
+	return offset
+}
+
+func (r *concatReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	r.mu.Lock()
+	if r.offset != nil {
+		r.done += r.offset.Offset()
+		r.offset = nil
+	}
+	r.mu.Unlock()
+	err := r.closer.Close()
+	r.current, r.closer = nil, nil
+	return err
+}
+
+// The files as a single stream under the given name, so batches run across
+// the file boundaries and the totals are for all of them.
+func concatStream(name string, names []string) *bulkimport.Stream {
+	return newStream(name, func() (recordReader, int64, io.Closer, error) {
+		var size int64
+		for _, name := range names {
+			info, err := os.Stat(name)
+			if err != nil || !info.Mode().IsRegular() {
+				size = -1
+				break
+			}
+			size += info.Size()
+		}
+
+		records := &concatReader{names: names}
+		return records, size, records, nil
+	})
+}
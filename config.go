@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	configFile = flag.String("config", "", "a YAML, TOML or JSON file of settings, such as profiles, redaction profiles, pipelines, sink profiles, tenants and per collection rules, that are better reviewed than passed as flags; ~/.orcbulkimport.yaml, .toml or .json if there is one")
+	profile    = flag.String("profile", "", "the -config profile of flags to use, such as a host, key, workers, rate limits and collection; the one named default if there is one")
+)
+
+// The prefix of the environment variables that set flags: ORCBULKIMPORT_KEY
+// for -key, ORCBULKIMPORT_RATE_LIMIT for -rate-limit and so on.
+const envPrefix = "ORCBULKIMPORT_"
+
+// The config files read without a -config, in the home directory.
+var defaultConfigFiles = []string{".orcbulkimport.yaml", ".orcbulkimport.yml", ".orcbulkimport.toml", ".orcbulkimport.json"}
+
+// The settings read from -config.
+var config struct {
+	Profiles          map[string]map[string]json.RawMessage `json:"profiles"`
+	RedactionProfiles map[string]ruleList                   `json:"redaction-profiles"`
+	Pipeline          *pipelineConfig                       `json:"pipeline"`
+	SinkProfiles      map[string]sinkProfile                `json:"sink-profiles"`
+	Tenants           map[string]*tenant                    `json:"tenants"`
+	Collections       map[string]*collectionConfig          `json:"collections"`
+}
+
+// A list of rules, given either as a list or as one comma separated string
+// such as "mask email, drop ssn".
+type ruleList []string
+
+func (r *ruleList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*r = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rules must be a list or a comma separated string")
+	}
+	for _, rule := range strings.Split(s, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			*r = append(*r, rule)
+		}
+	}
+	return nil
+}
+
+// Whether loadConfig has run, the commands each calling it.
+var configLoaded bool
+
+// Reads -config into config, and sets the flags not given on the command
+// line from the environment, then from the -profile, then the key as
+// setupKey finds it and the API's endpoint.
+func loadConfig() error {
+	if configLoaded {
+		return nil
+	}
+	configLoaded = true
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	keyGiven := given["key"]
+	if err := setFlagsFromEnv(given); err != nil {
+		return err
+	}
+	if err := readConfig(given); err != nil {
+		return err
+	}
+	if err := setupKey(keyGiven); err != nil {
+		return err
+	}
+	return setupEndpoint()
+}
+
+// Reads the -config, or the one in the home directory, and sets the flags
+// not given from its -profile. YAML and TOML are parsed into the same
+// values JSON decodes to, so they're round tripped through JSON to fill in
+// the struct.
+func readConfig(given map[string]bool) error {
+	name := *configFile
+	if name == "" {
+		name = defaultConfigFile()
+	}
+	if name == "" {
+		if *profile != "" {
+			return fmt.Errorf("-profile %v needs the -config to list profiles", *profile)
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	parse := parseYAML
+	if strings.HasSuffix(strings.ToLower(name), ".toml") {
+		parse = parseTOML
+	}
+	doc, err := parse(data)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	if doc != nil {
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		if err := json.Unmarshal(body, &config); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	if err := applyProfile(given); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	return nil
+}
+
+// The config file in the home directory, if there is one.
+func defaultConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range defaultConfigFiles {
+		path := filepath.Join(home, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// The environment variable that sets a flag.
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Sets the flags not given from their environment variables, marking them
+// given so the profile leaves them alone.
+func setFlagsFromEnv(given map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(flagEnv(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("$%v: %v", flagEnv(f.Name), setErr)
+		}
+		given[f.Name] = true
+	})
+	return err
+}
+
+// Sets the flags not given from the -profile, or the default one.
+func applyProfile(given map[string]bool) error {
+	name := *profile
+	settings := config.Profiles[name]
+	if name == "" {
+		name, settings = "default", config.Profiles["default"]
+	} else if settings == nil {
+		var names []string
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("-profile %v isn't there, there are no profiles", name)
+		}
+		return fmt.Errorf("-profile %v isn't one of %v", name, strings.Join(names, ", "))
+	}
+
+	flags := make([]string, 0, len(settings))
+	for name := range settings {
+		flags = append(flags, name)
+	}
+	sort.Strings(flags)
+	for _, flagName := range flags {
+		if flagName == "config" || flagName == "profile" {
+			return fmt.Errorf("profile %v can't set -%v", name, flagName)
+		}
+		if flag.Lookup(flagName) == nil {
+			return fmt.Errorf("profile %v: there's no -%v flag", name, flagName)
+		}
+		if given[flagName] {
+			continue
+		}
+		value, err := profileValue(settings[flagName])
+		if err != nil {
+			return fmt.Errorf("profile %v: %v: %v", name, flagName, err)
+		}
+		if err := flag.Set(flagName, value); err != nil {
+			return fmt.Errorf("profile %v: %v: %v", name, flagName, err)
+		}
+	}
+	return nil
+}
+
+// The flag value a profile setting stands for: strings as they are, numbers
+// and booleans as written, and lists joined with commas, as the flags that
+// take several values are given.
+func profileValue(raw json.RawMessage) (string, error) {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, nil
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		values := make([]string, len(list))
+		for i, element := range list {
+			value, err := profileValue(element)
+			if err != nil {
+				return "", err
+			}
+			values[i] = value
+		}
+		return strings.Join(values, ","), nil
+	}
+	switch raw[0] {
+	case '{':
+		return "", fmt.Errorf("should be a value or a list of them")
+	case 'n':
+		return "", nil
+	}
+	return string(raw), nil
+}
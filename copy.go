@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/moediddy/db/bulkimport"
+)
+
+// The collections copy reads from, by input name, which stand in for files
+// for openRecords.
+var copySources map[string]*copySource
+
+// A collection copy pages through with the LIST API, on the -source-host.
+type copySource struct {
+	collection string
+	from       *tenant
+}
+
+// Implements "orcbulkimport copy [-source-host host] [-source-key key]
+// <collection>[=<destination collection>] ...", which imports each
+// collection of the source app into the destination, under the name after
+// the = if there is one. The collections are read as export does and their
+// items imported as files are, so -workers, -rps, -checkpoint and the rest
+// apply; -resume-by-key is the safer way to resume a copy of a collection
+// that's still being written to.
+func copyCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport copy [-source-host host] [-source-key key] <collection>[=<destination collection>] ...")
+	}
+	if *format != "json" {
+		log.Fatalf("Error: copy reads export stream items, leave out -format")
+	}
+	if *collection != "" {
+		log.Fatalf("Error: copy takes its destination collections as source=destination arguments, leave out -collection")
+	}
+	from := &tenant{Host: *sourceHost, Key: *sourceKey, name: "source"}
+	if from.Host == "" {
+		from.Host = *host
+	}
+	if from.Key == "" {
+		from.Key = *apiKey
+	}
+
+	copySources = make(map[string]*copySource)
+	var inputs, routes []string
+	for _, arg := range args {
+		name, destination := arg, ""
+		if i := strings.LastIndex(arg, "="); i >= 0 {
+			name, destination = arg[:i], arg[i+1:]
+			if name == "" || destination == "" {
+				log.Fatalf("Error: %q should be collection=destination collection", arg)
+			}
+			routes = append(routes, arg)
+		}
+		if copySources[name] != nil {
+			log.Fatalf("Error: copy has %v more than once", name)
+		}
+		if (destination == "" || destination == name) && from.Host == *host && from.Key == *apiKey {
+			log.Fatalf("Error: copy would write %v back over itself, give a -source-host or -source-key or a destination collection", name)
+		}
+		copySources[name] = &copySource{collection: name, from: from}
+		inputs = append(inputs, name)
+	}
+	if routes != nil {
+		// Items are readdressed as -collection routes readdress files'.
+		flag.Set("collection", strings.Join(routes, ","))
+	}
+	runImport(inputs)
+}
+
+// Starts paging through the collection, returning its items as records.
+func (s *copySource) open() (recordReader, io.Closer) {
+	ctx, cancel := context.WithCancel(withTenant(context.Background(), s.from))
+	r := &copyReader{lines: make(chan []byte, exportPageSize), cancel: cancel}
+	log.Printf("Copying %v from %v", s.collection, s.from.Host)
+	go func() {
+		defer close(r.lines)
+		// Failed listings are retried as batches are, from after the last
+		// page read.
+		var from exportRange
+		for attempt := 0; ; attempt++ {
+			err := listRange(ctx, s.collection, from, func(lines []byte, _ int, last string, _ bool) error {
+				for len(lines) > 0 {
+					i := bytes.IndexByte(lines, '\n')
+					select {
+					case r.lines <- lines[:i+1]:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					lines = lines[i+1:]
+				}
+				if last != "" {
+					from.After, attempt = last, 0
+				}
+				return nil
+			})
+			if err == nil || attempt == *retries || !retryable(err) || ctx.Err() != nil {
+				r.err = err
+				return
+			}
+			delay := bulkimport.RetryDelay(err, attempt+1, *retryBackoff, *retryMaxBackoff)
+			logCode(codeRetrying, "Error listing %v: %v, retrying in %v (%v of %v)", s.collection, err, delay.Round(time.Millisecond), attempt+1, *retries)
+			time.Sleep(delay)
+		}
+	}()
+	return r, r
+}
+
+// Reads the items of a copySource as its pages come in.
+type copyReader struct {
+	lines  chan []byte
+	cancel context.CancelFunc
+	// Why paging stopped, set before lines is closed.
+	err error
+}
+
+func (r *copyReader) ReadRecord() ([]byte, error) {
+	line, ok := <-r.lines
+	if ok {
+		return line, nil
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("listing: %v", r.err)
+	}
+	return nil, io.EOF
+}
+
+func (r *copyReader) Close() error {
+	r.cancel()
+	return nil
+}
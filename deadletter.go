@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+var deadLetter = flag.Bool("dead-letter", true, "write the records that fail to import to <input>.failed, an export stream with the server's error added to each item, to fix and import again")
+
+// The -dead-letter files written so far, by input.
+var deadLetters = &deadLetterFiles{files: make(map[string]*deadLetterFile)}
+
+type deadLetterFiles struct {
+	mu    sync.Mutex
+	files map[string]*deadLetterFile
+}
+
+type deadLetterFile struct {
+	file    *os.File
+	writer  *bufio.Writer
+	records int
+}
+
+// Why a record is in the dead-letter file, added to it as its "error" member.
+type deadLetterError struct {
+	Source  string      `json:"source"`
+	Message interface{} `json:"message"`
+}
+
+// Removes the dead-letter files left by earlier imports of the inputs, so
+// one that is there afterwards is always from this run.
+func startDeadLetters(inputs []string) {
+	if !*deadLetter {
+		return
+	}
+	for _, name := range inputs {
+		if err := os.Remove(localName(name) + ".failed"); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing dead letters: %v", err)
+		}
+	}
+}
+
+// Writes record i of the batch to the dead-letter file of the input it came
+// from, along with the reason it failed.
+func (d *deadLetterFiles) write(b *batch, i int, reason interface{}) {
+	if !*deadLetter || i >= len(b.records) {
+		return
+	}
+	record := b.records[i]
+	line := record.source
+	if line == nil {
+		line = b.Line(i)
+	}
+	d.writeRecord(line, record.pos, reason)
+}
+
+// Writes a record to the dead-letter file of the input it came from.
+func (d *deadLetterFiles) writeRecord(line []byte, pos recordPos, reason interface{}) {
+	if !*deadLetter {
+		return
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[len(line)-1] != '}' {
+		return
+	}
+	reasonJSON, err := json.Marshal(deadLetterError{fmt.Sprintf("%v:%v", pos.file, pos.line), reason})
+	if err != nil {
+		log.Printf("Error writing dead letter: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f := d.file(pos.file)
+	if f == nil {
+		return
+	}
+	f.writer.Write(line[:len(line)-1])
+	if len(line) > 2 {
+		f.writer.WriteString(",")
+	}
+	f.writer.WriteString(`"error":`)
+	f.writer.Write(reasonJSON)
+	f.writer.WriteString("}\n")
+	f.records++
+}
+
+// Writes a record that isn't a JSON object to the dead-letter file, as an
+// object with the record as read in its "line" member.
+func (d *deadLetterFiles) writeInvalid(raw rawRecord, err error) {
+	line, jsonErr := json.Marshal(map[string]interface{}{
+		"line":  string(bytes.TrimRight(raw.line, "\r\n")),
+		"error": deadLetterError{fmt.Sprintf("%v:%v", raw.pos.file, raw.pos.line), err.Error()},
+	})
+	if jsonErr != nil {
+		log.Printf("Error writing dead letter: %v", jsonErr)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f := d.file(raw.pos.file)
+	if f == nil {
+		return
+	}
+	f.writer.Write(line)
+	f.writer.WriteString("\n")
+	f.records++
+}
+
+// Returns the dead-letter file of the input, creating it the first time.
+func (d *deadLetterFiles) file(name string) *deadLetterFile {
+	f := d.files[name]
+	if f == nil {
+		file, err := os.Create(localName(name) + ".failed")
+		if err != nil {
+			log.Printf("Error writing dead letter: %v", err)
+			return nil
+		}
+		f = &deadLetterFile{file: file, writer: bufio.NewWriter(file)}
+		d.files[name] = f
+	}
+	return f
+}
+
+// Writes every record of the batch to the dead-letter files.
+func (d *deadLetterFiles) writeAll(b *batch, reason interface{}) {
+	for i := range b.records {
+		d.write(b, i, reason)
+	}
+}
+
+func (d *deadLetterFiles) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, f := range d.files {
+		err := f.writer.Flush()
+		if closeErr := f.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Printf("Error writing dead letters: %v", err)
+			continue
+		}
+		log.Printf("Wrote %v failed records from %v to %v", f.records, name, f.file.Name())
+	}
+}
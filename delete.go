@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/moediddy/db/bulk"
+)
+
+// A key to delete, with where it was read.
+type deleteKey struct {
+	id  itemID
+	pos recordPos
+}
+
+// Implements "orcbulkimport delete [-collection name] <files>", which
+// deletes the items the files list from the destination, sending -workers
+// DELETE requests at once and retrying them as an import retries batches.
+// Each line of a file is an export stream item, the way export writes them,
+// or a key: "collection/key", or with -collection just the key. The keys
+// that couldn't be deleted are logged and written to file.undeleted.
+func deleteCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport delete [-collection name] <key files>")
+	}
+	if strings.ContainsAny(*collection, "=,") {
+		log.Fatalf("Error: delete takes a single -collection")
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupRateLimit(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	failed := false
+	for _, name := range args {
+		keys, err := readDeleteKeys(name)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		deleted, missing, undeleted := deleteKeys(keys)
+		log.Printf("Deleted %v of the %v keys in %v, %v of them already gone", deleted+missing, len(keys), name, missing)
+
+		out := name + ".undeleted"
+		if len(undeleted) == 0 {
+			// Leave none from an earlier delete behind.
+			if err := os.Remove(out); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error: %v", err)
+			}
+			continue
+		}
+		failed = true
+		var lines bytes.Buffer
+		for _, key := range undeleted {
+			fmt.Fprintf(&lines, "%v/%v\n", key.id.collection, key.id.key)
+		}
+		if err := ioutil.WriteFile(out, lines.Bytes(), 0644); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		log.Printf("Wrote the %v keys that couldn't be deleted to %v", len(undeleted), out)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Reads the keys listed in a file.
+func readDeleteKeys(name string) ([]deleteKey, error) {
+	input, _, err := openInput(name)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	var keys []deleteKey
+	reader := bufio.NewReader(input)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			id, parseErr := parseDeleteKey(line)
+			if parseErr != nil {
+				return nil, fmt.Errorf("%v:%v: %v", name, n, parseErr)
+			}
+			keys = append(keys, deleteKey{id, recordPos{name, n}})
+		}
+		if err == io.EOF {
+			return keys, nil
+		}
+	}
+}
+
+// Reads the key from a line of a key file.
+func parseDeleteKey(line []byte) (itemID, error) {
+	if line[0] == '{' {
+		var item struct {
+			Path struct {
+				Collection string `json:"collection"`
+				Key        string `json:"key"`
+			} `json:"path"`
+		}
+		if err := json.Unmarshal(line, &item); err != nil {
+			return itemID{}, err
+		}
+		id := itemID{item.Path.Collection, item.Path.Key}
+		if *collection != "" {
+			id.collection = *collection
+		}
+		if id.collection == "" || id.key == "" {
+			return itemID{}, errors.New("item has no collection or key, is it in the export stream format?")
+		}
+		return id, nil
+	}
+	if *collection != "" {
+		return itemID{*collection, string(line)}, nil
+	}
+	i := bytes.IndexByte(line, '/')
+	if i <= 0 || i == len(line)-1 {
+		return itemID{}, fmt.Errorf("%q should be collection/key, or give the -collection", line)
+	}
+	return itemID{string(line[:i]), string(line[i+1:])}, nil
+}
+
+// Deletes the keys with -workers requests at once, returning how many were
+// deleted, how many were already gone and those that couldn't be deleted.
+func deleteKeys(keys []deleteKey) (deleted, missing int, undeleted []deleteKey) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan deleteKey)
+	for i := 0; i < *workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				found, err := deleteItem(key.id)
+				mu.Lock()
+				switch {
+				case err != nil:
+					logCode(errorCode(err), "Error: deleting %v/%v from %v:%v: %v", key.id.collection, key.id.key, key.pos.file, key.pos.line, err)
+					undeleted = append(undeleted, key)
+				case found:
+					deleted++
+				default:
+					missing++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+	return deleted, missing, undeleted
+}
+
+// Deletes an item, retrying the -retries times if the request fails in a
+// way that's worth retrying. Returns whether the item was there.
+func deleteItem(id itemID) (bool, error) {
+	var found bool
+	err := retryRequest(fmt.Sprintf("deleting %v/%v", id.collection, id.key), func() error {
+		var err error
+		found, err = sendDelete(id)
+		return err
+	})
+	return found, err
+}
+
+func sendDelete(id itemID) (bool, error) {
+	resp, err := doRequest("DELETE", url.PathEscape(id.collection)+"/"+url.PathEscape(id.key), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 404:
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	case resp.StatusCode/100 != 2:
+		return false, bulk.ParseError(resp)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return true, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	compressionDictionary = flag.String("compression-dictionary", "", "compress request bodies with zstd against a dictionary, if the destination takes dcz bodies: train to build one from a sample of the inputs, or a file saved with -dictionary-out")
+	dictionarySize        = flag.String("dictionary-size", "110KB", "the size of the dictionary -compression-dictionary train builds")
+	dictionarySample      = flag.Int("dictionary-sample", 10000, "how many records -compression-dictionary train samples, taken evenly from the start of each input")
+	dictionaryOut         = flag.String("dictionary-out", "", "save the dictionary -compression-dictionary train builds to this file, for later runs")
+	dictionaryPath        = flag.String("dictionary-path", "_dictionaries", "where under the -base-path the dictionary is uploaded, as <path>/<its SHA-256 in hex>, before bodies compressed with it are sent")
+)
+
+// The dictionary request bodies are compressed against, nil when they
+// aren't compressed.
+var bodyDictionary *compressionDict
+
+type compressionDict struct {
+	data    []byte
+	sum     [32]byte
+	encoder *zstdEncoder
+
+	// Body bytes before and after compression, for the totals.
+	in, out int64
+}
+
+// Sets up the -compression-dictionary once the destination's capabilities
+// are known. Bodies are sent as RFC 9842 dcz, dictionary compressed zstd,
+// and the destination is given the dictionary first.
+func setupDictionary(inputs []string) error {
+	if *compressionDictionary == "" {
+		return nil
+	}
+	if *shadow {
+		return errors.New("-shadow doesn't upload the -compression-dictionary, leave it out")
+	}
+	supported := false
+	for _, c := range serverCapabilities.Compressions {
+		supported = supported || strings.EqualFold(c, "dcz")
+	}
+	if !supported && *dictionaryOut == "" {
+		log.Printf("Warning: the destination doesn't take dcz request bodies, sending them uncompressed")
+		return nil
+	}
+
+	var data []byte
+	var err error
+	if *compressionDictionary == "train" {
+		if data, err = trainFromInputs(inputs); err != nil {
+			return err
+		}
+		if *dictionaryOut != "" {
+			if err := ioutil.WriteFile(*dictionaryOut, data, 0644); err != nil {
+				return err
+			}
+		}
+	} else if data, err = ioutil.ReadFile(*compressionDictionary); err != nil {
+		return err
+	}
+	if !supported {
+		log.Printf("Warning: the destination doesn't take dcz request bodies, sending them uncompressed")
+		return nil
+	}
+
+	d := &compressionDict{data: data, sum: sha256.Sum256(data), encoder: newZstdEncoder(data)}
+	if err := d.upload(); err != nil {
+		return err
+	}
+	bodyDictionary = d
+	return nil
+}
+
+// Samples records from the start of each input, after the transforms, and
+// trains a dictionary on them.
+func trainFromInputs(inputs []string) ([]byte, error) {
+	size, err := parseByteSize(*dictionarySize)
+	if err != nil {
+		return nil, fmt.Errorf("-dictionary-size: %v", err)
+	}
+	if size < 1<<10 {
+		return nil, errors.New("-dictionary-size must be at least 1KB")
+	}
+	perInput := (*dictionarySample + len(inputs) - 1) / len(inputs)
+
+	var samples [][]byte
+	for _, name := range inputs {
+		if name == stdinName {
+			return nil, errors.New("-compression-dictionary train can't sample stdin, which would then be read twice; train on a file with -dictionary-out instead")
+		}
+		records, _, file, err := openRecords(name)
+		if err != nil {
+			return nil, err
+		}
+		for n := 1; n <= perInput; n++ {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%v: %v", name, err)
+			}
+			if line, err = applyTransforms(line, recordPos{name, n}); err == nil {
+				samples = append(samples, line)
+			}
+		}
+		file.Close()
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("-compression-dictionary train found no records to sample")
+	}
+
+	dict := trainDictionary(samples, int(size))
+	log.Printf("Trained a %v dictionary on %v records", formatBytes(int64(len(dict))), len(samples))
+	return dict, nil
+}
+
+// Builds a raw content dictionary from the samples by picking the segments
+// made of the most widely shared content, in the manner of zstd's COVER
+// trainer: the samples are split into as many epochs as the dictionary has
+// segments and the best segment of each is taken. Content counts once per
+// sample it appears in and once taken scores nothing more.
+func trainDictionary(samples [][]byte, size int) []byte {
+	const (
+		dmer    = 8
+		segment = 128
+	)
+	// A hundred times the dictionary's size is plenty to train on, and
+	// keeps the counts in bounds with large documents.
+	total := 0
+	for i, sample := range samples {
+		if total += len(sample); total > 100*size {
+			samples = samples[:i+1]
+			break
+		}
+	}
+	data := bytes.Join(samples, nil)
+	if len(data) <= size {
+		return data
+	}
+
+	// How many samples each run of dmer bytes appears in.
+	type count struct{ samples, last int32 }
+	counts := make(map[uint64]count)
+	for i, sample := range samples {
+		for p := 0; p+dmer <= len(sample); p++ {
+			key := binary.LittleEndian.Uint64(sample[p:])
+			if c := counts[key]; c.last != int32(i+1) {
+				counts[key] = count{c.samples + 1, int32(i + 1)}
+			}
+		}
+	}
+
+	type pick struct{ start, score int }
+	var picks []pick
+	epochs := size / segment
+	epochSize := len(data) / epochs
+	scores := make([]int, epochSize+1)
+	for e := 0; e < epochs; e++ {
+		begin, end := e*epochSize, (e+1)*epochSize
+		if end+dmer > len(data) {
+			end = len(data) - dmer
+		}
+		if end-begin < segment {
+			continue
+		}
+
+		// Slides a window over the epoch, scoring it by the counts of the
+		// dmers starting in it.
+		scores = scores[:0]
+		for p := begin; p < end; p++ {
+			score := 0
+			if c := counts[binary.LittleEndian.Uint64(data[p:])]; c.samples > 1 {
+				score = int(c.samples)
+			}
+			scores = append(scores, score)
+		}
+		window := segment - dmer + 1
+		sum := 0
+		for _, s := range scores[:window] {
+			sum += s
+		}
+		best := pick{begin, sum}
+		for p := window; p < len(scores); p++ {
+			sum += scores[p] - scores[p-window]
+			if sum > best.score {
+				best = pick{begin + p - window + 1, sum}
+			}
+		}
+		if best.score == 0 {
+			continue
+		}
+		picks = append(picks, best)
+		for p := best.start; p < best.start+window; p++ {
+			delete(counts, binary.LittleEndian.Uint64(data[p:]))
+		}
+	}
+
+	// The best segments go last, where matches are nearest and cheapest.
+	sort.SliceStable(picks, func(i, j int) bool { return picks[i].score < picks[j].score })
+	var dict []byte
+	for _, p := range picks {
+		dict = append(dict, data[p.start:p.start+segment]...)
+	}
+	return dict
+}
+
+// Puts the dictionary on each destination, so it can decode the bodies
+// compressed against it.
+func (d *compressionDict) upload() error {
+	path := strings.Trim(*dictionaryPath, "/") + "/" + hex.EncodeToString(d.sum[:])
+	headers := map[string]string{"Content-Type": "application/octet-stream"}
+	destinations := []*tenant{nil}
+	if tenants != nil {
+		destinations = destinations[:0]
+		for _, t := range tenants {
+			destinations = append(destinations, t)
+		}
+	}
+	for _, t := range destinations {
+		resp, err := doRequestContext(withTenant(context.Background(), t), "PUT", path, headers, bytes.NewReader(d.data))
+		if err != nil {
+			return fmt.Errorf("uploading the -compression-dictionary: %v", err)
+		}
+		if resp.StatusCode/100 != 2 {
+			err := bulk.ParseError(resp)
+			resp.Body.Close()
+			return fmt.Errorf("uploading the -compression-dictionary: %v", err)
+		}
+		resp.Body.Close()
+	}
+	log.Printf("Compressing request bodies with a %v dictionary", formatBytes(int64(len(d.data))))
+	return nil
+}
+
+// The header RFC 9842 puts before a dcz body, in the form of a skippable
+// zstd frame holding the dictionary's SHA-256.
+var dczHeader = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+func (d *compressionDict) compress(body []byte) []byte {
+	out := append(append([]byte(nil), dczHeader...), d.sum[:]...)
+	out = append(out, d.encoder.compress(body)...)
+	atomic.AddInt64(&d.in, int64(len(body)))
+	atomic.AddInt64(&d.out, int64(len(out)))
+	return out
+}
+
+// The Available-Dictionary header naming the dictionary.
+func (d *compressionDict) header() string {
+	return ":" + base64.StdEncoding.EncodeToString(d.sum[:]) + ":"
+}
+
+// Returns the body to send for the batch, compressed against the
+// dictionary if there is one or with -compress-requests, and its
+// Content-Encoding.
+func (b *batch) payload() ([]byte, string) {
+	switch {
+	case bodyDictionary != nil:
+		b.encodeOnce.Do(func() {
+			b.encoded = bodyDictionary.compress(b.body)
+		})
+		return b.encoded, "dcz"
+	case gzipping():
+		b.encodeOnce.Do(func() {
+			b.encoded = gzipBody(b.body)
+		})
+		return b.encoded, "gzip"
+	}
+	return b.body, ""
+}
+
+// Logs how much the dictionary saved.
+func finishDictionary() {
+	d := bodyDictionary
+	if d == nil || d.in == 0 {
+		return
+	}
+	log.Printf("Compressed %v of request bodies to %v (%.0f%%) with the dictionary",
+		formatBytes(d.in), formatBytes(d.out), 100*float64(d.out)/float64(d.in))
+}
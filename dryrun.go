@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var dryRun = flag.Bool("dry-run", false, "read, validate, transform and batch every input as usual but send nothing, reporting the batches, records and bytes that would have been sent; exits with 1 if any record is invalid or doesn't match the -schema")
+
+// What a dry run would have sent.
+var dryRunSink struct {
+	mu                      sync.Mutex
+	batches, records, bytes int64
+	largest                 int
+	collections             map[string]int
+}
+
+func setupDryRun() error {
+	if !*dryRun {
+		return nil
+	}
+	switch {
+	case *shadow:
+		return errors.New("-dry-run and -shadow can't both be set, -shadow times sends -dry-run doesn't make")
+	case *replayResponses != "" || *recordResponses != "":
+		return errors.New("-dry-run has no responses to record or replay")
+	case *previewConflicts:
+		return errors.New("-preview-conflicts looks up keys on the destination, which -dry-run doesn't contact")
+	case anyCreateOnly():
+		return errors.New("-dry-run can't look up existing keys for create-only, use -mode upsert")
+	case *atomicPerFile:
+		return errors.New("-dry-run can't stage and promote -atomic-per-file writes")
+	case *checkpointFile != "":
+		return errors.New("-dry-run would checkpoint records it never sent, leave out -checkpoint")
+	case *journalFile != "":
+		return errors.New("-dry-run would journal batches it never sent, leave out -journal")
+	case *hashStore != "":
+		return errors.New("-dry-run would record hashes of items it never wrote, leave out -hash-store")
+	case *registryCollection != "":
+		return errors.New("-dry-run doesn't write the run to a -registry-collection, leave it out")
+	case *metadataFile != "":
+		return errors.New("-dry-run doesn't write the -metadata, leave it out")
+	case *compressionDictionary != "":
+		return errors.New("-dry-run doesn't upload the -compression-dictionary, leave it out")
+	case *slackWebhook != "":
+		return errors.New("-dry-run doesn't post to the -slack-webhook, leave it out")
+	}
+	dryRunSink.collections = make(map[string]int)
+	log.Printf("Dry run, nothing will be sent")
+	return nil
+}
+
+// Checks a record is an item the server would take, as the server would,
+// logging it and counting it as invalid if not.
+func dryRunValid(line []byte, pos recordPos) bool {
+	if _, _, err := scanItemPath(line); err != nil {
+		logCode(codeRecordInvalid, "Invalid record at %v:%v: %v", pos.file, pos.line, err)
+		atomic.AddInt64(&invalidCount, 1)
+		return false
+	}
+	return true
+}
+
+// Counts a batch as sent and answers it as a server that accepted all of
+// it would.
+func dryRunPost(b *batch) map[string]interface{} {
+	dryRunSink.mu.Lock()
+	dryRunSink.batches++
+	dryRunSink.records += int64(len(b.records))
+	dryRunSink.bytes += int64(len(b.body))
+	if len(b.body) > dryRunSink.largest {
+		dryRunSink.largest = len(b.body)
+	}
+	for i := range b.records {
+		collection, _, _ := scanItemPath(b.Line(i))
+		dryRunSink.collections[collection]++
+	}
+	dryRunSink.mu.Unlock()
+
+	results := make([]interface{}, len(b.records))
+	for i := range results {
+		results[i] = map[string]interface{}{"status": "success"}
+	}
+	return map[string]interface{}{
+		"status":        "success",
+		"success_count": float64(len(b.records)),
+		"results":       results,
+	}
+}
+
+// Reports what the dry run would have sent, exiting with 1 if any record
+// was invalid or didn't match the -schema.
+func finishDryRun() {
+	if !*dryRun {
+		return
+	}
+	s := &dryRunSink
+	invalid, violations := atomic.LoadInt64(&invalidCount), atomic.LoadInt64(&schemaViolationCount)
+	log.Printf("Dry run would send %v records in %v batches, %v, the largest %v; %v records were invalid",
+		s.records, s.batches, formatBytes(s.bytes), formatBytes(int64(s.largest)), invalid)
+	if documentSchema != nil {
+		log.Printf("Dry run found %v records that don't match the -schema", violations)
+	}
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var counts []string
+	for _, name := range names {
+		counts = append(counts, fmt.Sprintf("%v %v", name, s.collections[name]))
+	}
+	if len(counts) > 0 {
+		log.Printf("Dry run records by collection: %v", strings.Join(counts, ", "))
+	}
+	if invalid > 0 || violations > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"unicode/utf8"
+)
+
+var fixEncoding = flag.Bool("fix-encoding", false, "repair text that was decoded with the wrong character set: bytes that aren't UTF-8 are read as Windows-1252, and strings that went through UTF-8 read as Windows-1252 or Latin-1, such as \"CafÃ©\", are decoded back, as often happens to exports from older systems")
+
+// The characters Windows-1252 has in place of Latin-1's C1 controls. The
+// five bytes it leaves undefined are read as Latin-1 does.
+var windows1252 = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8a: 'Š', 0x8b: '‹', 0x8c: 'Œ', 0x8e: 'Ž',
+	0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+	0x98: '˜', 0x99: '™', 0x9a: 'š', 0x9b: '›', 0x9c: 'œ', 0x9e: 'ž', 0x9f: 'Ÿ',
+}
+
+// The Windows-1252 bytes of its characters above Latin-1.
+var windows1252Bytes = make(map[rune]byte)
+
+func init() {
+	for b, r := range windows1252 {
+		windows1252Bytes[r] = b
+	}
+}
+
+// How many times a string is decoded again, for text that was wrongly
+// decoded more than once.
+const maxMojibakeRounds = 3
+
+// Reads the bytes of a record that aren't UTF-8 as Windows-1252, leaving the
+// rest alone.
+func fixCharset(record []byte) []byte {
+	if utf8.Valid(record) {
+		return record
+	}
+	fixed := make([]byte, 0, len(record)+len(record)/8)
+	var encoded [utf8.UTFMax]byte
+	for i := 0; i < len(record); {
+		r, size := utf8.DecodeRune(record[i:])
+		if r == utf8.RuneError && size <= 1 {
+			r = rune(record[i])
+			if c, ok := windows1252[record[i]]; ok {
+				r = c
+			}
+		}
+		fixed = append(fixed, encoded[:utf8.EncodeRune(encoded[:], r)]...)
+		i += size
+	}
+	return fixed
+}
+
+// Decodes a string that was UTF-8 wrongly read as Windows-1252 or Latin-1
+// back to what it was. Strings with characters neither has, or whose bytes
+// aren't UTF-8, weren't decoded that way and are left as they are.
+func fixMojibake(s string) string {
+	for round := 0; round < maxMojibakeRounds; round++ {
+		raw := make([]byte, 0, len(s))
+		multibyte := false
+		for _, r := range s {
+			switch b, ok := windows1252Bytes[r]; {
+			case ok:
+				raw = append(raw, b)
+			case r <= 0xff:
+				raw = append(raw, byte(r))
+			default:
+				return s
+			}
+			multibyte = multibyte || r >= 0x80
+		}
+		if !multibyte || !utf8.Valid(raw) {
+			return s
+		}
+		s = string(raw)
+	}
+	return s
+}
+
+// The transform repairing the strings of a document for -fix-encoding.
+func fixEncodingTransform(item map[string]interface{}, pos recordPos) error {
+	if value := itemValue(item); value != nil {
+		fixStrings(value)
+	}
+	return nil
+}
+
+// Repairs the strings in a decoded value, returning it.
+func fixStrings(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return fixMojibake(v)
+	case map[string]interface{}:
+		for name, field := range v {
+			v[name] = fixStrings(field)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = fixStrings(element)
+		}
+	}
+	return v
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	schemeFlag = flag.String("scheme", "", "the scheme to reach the API with, http for local dev servers and test stubs; https unless -unix-socket is set")
+	port       = flag.Int("port", 0, "the port on -host to connect to, if it isn't the scheme's")
+	basePath   = flag.String("base-path", "/v0", "the path the API is under, for gateways that mount it below a prefix")
+	apiURL     = flag.String("url", "", "the API's URL, such as http://localhost:8080/v0, in place of -scheme, -host, -port and -base-path; without a path it's under /v0")
+)
+
+// Works out the API's scheme, host and base path from -url or the flags for
+// each, so the rest only look at -host and the base path.
+func setupEndpoint() error {
+	if *apiURL != "" {
+		for _, name := range []string{"scheme", "host", "port", "base-path"} {
+			if flagGiven(name) {
+				return fmt.Errorf("-url can't be used with -%v", name)
+			}
+		}
+		u, err := url.Parse(*apiURL)
+		if err != nil {
+			return fmt.Errorf("-url: %v", err)
+		}
+		if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("-url %v isn't a URL like https://host:port/v0", *apiURL)
+		}
+		*schemeFlag, *host = u.Scheme, u.Host
+		if u.Path != "" && u.Path != "/" {
+			*basePath = u.Path
+		}
+	}
+
+	switch *schemeFlag {
+	case "", "http":
+	case "https":
+		if *unixSocket != "" {
+			return errors.New("-unix-socket speaks plain HTTP to its gateway, -scheme https doesn't apply")
+		}
+	default:
+		return fmt.Errorf("-scheme %v isn't http or https", *schemeFlag)
+	}
+
+	if *port < 0 || *port > 65535 {
+		return fmt.Errorf("-port %v isn't between 1 and 65535", *port)
+	}
+	if *port != 0 {
+		if _, _, err := net.SplitHostPort(*host); err == nil {
+			return fmt.Errorf("-host %v already has a port, leave out -port", *host)
+		}
+		*host = net.JoinHostPort(*host, strconv.Itoa(*port))
+	}
+	*basePath = "/" + strings.Trim(*basePath, "/")
+
+	if apiScheme() == "http" && *unixSocket == "" && !isLoopback(*host) {
+		log.Printf("Warning: the api key goes to %v in plain HTTP", *host)
+	}
+	return nil
+}
+
+// Whether the host, with or without a port, is this machine.
+func isLoopback(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The URL of a path on the host: under the -base-path, or from the root if
+// it starts with a slash.
+func apiPath(host, path string) string {
+	if strings.HasPrefix(path, "/") {
+		return apiScheme() + "://" + host + path
+	}
+	return apiScheme() + "://" + host + strings.TrimSuffix(*basePath, "/") + "/" + path
+}
+
+// The path under the -base-path a listing's next page is at. The server
+// may not know about a gateway's prefix, so a next link under /v0/ is taken
+// to be under the -base-path too.
+func nextPage(next string) string {
+	if base := strings.TrimSuffix(*basePath, "/") + "/"; strings.HasPrefix(next, base) {
+		return next[len(base):]
+	}
+	return strings.TrimPrefix(next, "/v0/")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var (
+	enrichURL     = flag.String("enrich-url", "", "POST records, in chunks, to this service and import the items it sends back in their place")
+	enrichTimeout = flag.Duration("enrich-timeout", 10*time.Second, "how long an -enrich-url request may take")
+	enrichRetries = flag.Int("enrich-retries", 2, "how many times to retry a failed -enrich-url request")
+)
+
+// Enrichment services never get the API credentials either.
+var enrichClient = &http.Client{}
+
+// Sends records to the -enrich-url service as an export stream and returns
+// what it answers with, which must be an export stream of the same number
+// of items in the same order.
+func enrich(lines [][]byte) ([][]byte, error) {
+	body := bytes.Join(lines, nil)
+
+	var err error
+	for attempt := 0; attempt <= *enrichRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var enriched [][]byte
+		if enriched, err = postEnrich(body); err == nil {
+			if len(enriched) != len(lines) {
+				// Not worth retrying, the service means it.
+				return nil, fmt.Errorf("enrichment returned %v items for %v", len(enriched), len(lines))
+			}
+			return enriched, nil
+		}
+	}
+	return nil, fmt.Errorf("enrichment failed: %v", err)
+}
+
+func postEnrich(body []byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *enrichTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", *enrichURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/orchestrate-export-stream+json")
+	req.Header.Set("User-Agent", "orcbulkimport")
+
+	resp, err := enrichClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("%v", resp.Status)
+	}
+
+	var lines [][]byte
+	records := &lineReader{reader: bufio.NewReader(resp.Body)}
+	for {
+		line, err := records.ReadRecord()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+}
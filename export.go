@@ -0,0 +1,337 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	exportGzip   = flag.Bool("export-gzip", false, "gzip the files export writes")
+	exportSplits = flag.String("export-splits", "", "comma separated keys splitting each collection export pages through into ranges, fetched in parallel by -workers")
+)
+
+// The pages of a collection export asks for.
+const exportPageSize = 100
+
+// Where an export has got to, kept in the -checkpoint file so -resume picks
+// up after the last page written.
+type exportCheckpoint struct {
+	Collections map[string][]*exportRange `json:"collections"`
+	// The collections whose parts have been joined into their export, so
+	// -resume after a later one fails to join doesn't look for them.
+	Joined map[string]bool `json:"joined,omitempty"`
+
+	mu sync.Mutex
+}
+
+// A range of a collection's keys, from Start up to Before, the last page of
+// it written ending with After and leaving Size bytes in its part file.
+type exportRange struct {
+	Start  string `json:"start,omitempty"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+	Size   int64  `json:"size"`
+	Items  int    `json:"items"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// Implements "orcbulkimport export [-out-dir dir] [-export-gzip] <collections>",
+// which pages through each collection with the LIST API and writes its
+// items to <collection>.json in the -out-dir, as an export stream that
+// imports back as it was. With -export-splits the collection's key ranges
+// are fetched in parallel, each into a part file, and joined in key order
+// once they're all done.
+func exportCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport export [-out-dir dir] [-export-gzip] [-export-splits keys] [-checkpoint file [-resume]] <collections>")
+	}
+	if *resume && *checkpointFile == "" {
+		log.Fatalf("Error: -resume needs the -checkpoint of the export to resume")
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	state, err := loadExportCheckpoint(args)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	type exportJob struct {
+		collection string
+		part       int
+		r          *exportRange
+	}
+	jobs := make(chan exportJob)
+	var failed int32
+	var wg sync.WaitGroup
+	for i := 0; i < *workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := state.exportRange(job.collection, job.part, job.r); err != nil {
+					log.Printf("Error: exporting %v: %v", job.collection, err)
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	for _, collection := range args {
+		for i, r := range state.Collections[collection] {
+			if !r.Done {
+				jobs <- exportJob{collection, i, r}
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if failed != 0 {
+		log.Fatalf("Error: the export is incomplete, run it again with -resume to pick it up")
+	}
+
+	for _, collection := range args {
+		if state.Joined[collection] {
+			log.Printf("Skipping %v, its export was written already", collection)
+			continue
+		}
+		name, items, err := joinExportParts(collection, state.Collections[collection])
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if err := state.joined(collection); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		log.Printf("Exported %v items from %v to %v", items, collection, name)
+	}
+	if *checkpointFile != "" {
+		if err := os.Remove(*checkpointFile); err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}
+}
+
+// Loads the -checkpoint to -resume, or splits the collections into their
+// ranges afresh.
+func loadExportCheckpoint(collections []string) (*exportCheckpoint, error) {
+	state := &exportCheckpoint{Collections: make(map[string][]*exportRange)}
+	if *resume {
+		data, err := ioutil.ReadFile(*checkpointFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("%v: %v", *checkpointFile, err)
+		}
+	}
+
+	var splits []string
+	if *exportSplits != "" {
+		splits = strings.Split(*exportSplits, ",")
+		if !sort.StringsAreSorted(splits) {
+			return nil, errors.New("-export-splits should be in key order")
+		}
+	}
+	for _, collection := range collections {
+		if state.Collections[collection] != nil {
+			continue
+		}
+		if *resume {
+			log.Printf("Warning: the -checkpoint has nothing for %v, exporting all of it", collection)
+		}
+		start := ""
+		for _, split := range splits {
+			state.Collections[collection] = append(state.Collections[collection], &exportRange{Start: start, Before: split})
+			start = split
+		}
+		state.Collections[collection] = append(state.Collections[collection], &exportRange{Start: start})
+	}
+	return state, state.save()
+}
+
+// Writes the checkpoint, if there's a file for it, by renaming a complete
+// copy into place.
+func (c *exportCheckpoint) save() error {
+	if *checkpointFile == "" {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := *checkpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *checkpointFile)
+}
+
+// Checkpoints that the collection's parts have been joined.
+func (c *exportCheckpoint) joined(collection string) error {
+	c.mu.Lock()
+	if c.Joined == nil {
+		c.Joined = make(map[string]bool)
+	}
+	c.Joined[collection] = true
+	c.mu.Unlock()
+	return c.save()
+}
+
+// The file a collection's range is written to before they're joined.
+func exportPartName(collection string, part int) string {
+	return filepath.Join(*outDir, fmt.Sprintf("%v.json.part%v", collection, part))
+}
+
+// Pages through a range of the collection, appending each page to the
+// range's part file and checkpointing after it.
+func (c *exportCheckpoint) exportRange(collection string, part int, r *exportRange) error {
+	file, err := os.OpenFile(exportPartName(collection, part), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Anything past the last checkpointed page is from a page cut short.
+	if err := file.Truncate(r.Size); err != nil {
+		return err
+	}
+	if _, err := file.Seek(r.Size, io.SeekStart); err != nil {
+		return err
+	}
+
+	return listRange(context.Background(), collection, *r, func(lines []byte, items int, last string, done bool) error {
+		if len(lines) > 0 {
+			if err := writeExportPage(file, lines); err != nil {
+				return err
+			}
+		}
+		size, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		r.Size, r.Items, r.Done = size, r.Items+items, done
+		if last != "" {
+			r.After = last
+		}
+		c.mu.Unlock()
+		return c.save()
+	})
+}
+
+// Pages through a range of a collection with the LIST API, from after the
+// range's last page if it has one, on the host and with the key the ctx
+// gives. Each page's items are handed to page as export stream lines, with
+// the last key and whether there are more pages.
+func listRange(ctx context.Context, collection string, r exportRange, page func(lines []byte, items int, last string, done bool) error) error {
+	query := url.Values{"limit": {fmt.Sprint(exportPageSize)}, "values": {"true"}}
+	switch {
+	case r.After != "":
+		query.Set("afterKey", r.After)
+	case r.Start != "":
+		query.Set("startKey", r.Start)
+	}
+	if r.Before != "" {
+		query.Set("beforeKey", r.Before)
+	}
+	path := url.PathEscape(collection) + "?" + query.Encode()
+	for path != "" {
+		var list struct {
+			Results []struct {
+				Path  map[string]interface{} `json:"path"`
+				Value json.RawMessage        `json:"value"`
+			} `json:"results"`
+			Next string `json:"next"`
+		}
+		if _, err := jsonReplyContext(ctx, "GET", path, nil, nil, 200, &list); err != nil {
+			return err
+		}
+
+		var lines []byte
+		last := ""
+		for _, result := range list.Results {
+			result.Path["kind"] = "item"
+			line, err := json.Marshal(map[string]interface{}{"kind": "item", "path": result.Path, "value": result.Value})
+			if err != nil {
+				return err
+			}
+			lines = append(append(lines, line...), '\n')
+			last, _ = result.Path["key"].(string)
+		}
+		if err := page(lines, len(list.Results), last, list.Next == ""); err != nil {
+			return err
+		}
+		path = nextPage(list.Next)
+	}
+	return nil
+}
+
+// Appends a page to a part file. With -export-gzip each page is a gzip
+// member of its own, so the part can be cut after any of them and the
+// members joined still make one gzip file.
+func writeExportPage(file *os.File, lines []byte) error {
+	if !*exportGzip {
+		_, err := file.Write(lines)
+		return err
+	}
+	writer := gzip.NewWriter(file)
+	if _, err := writer.Write(lines); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Joins a collection's part files, in key order, into its export file.
+func joinExportParts(collection string, ranges []*exportRange) (string, int, error) {
+	name := filepath.Join(*outDir, collection+".json")
+	if *exportGzip {
+		name += ".gz"
+	}
+	if len(ranges) == 1 {
+		return name, ranges[0].Items, os.Rename(exportPartName(collection, 0), name)
+	}
+	out, err := os.Create(name)
+	if err != nil {
+		return "", 0, err
+	}
+	items := 0
+	for i, r := range ranges {
+		part, err := os.Open(exportPartName(collection, i))
+		if err != nil {
+			out.Close()
+			return "", 0, err
+		}
+		_, err = io.Copy(out, part)
+		part.Close()
+		if err != nil {
+			out.Close()
+			return "", 0, err
+		}
+		items += r.Items
+	}
+	if err := out.Close(); err != nil {
+		return "", 0, err
+	}
+	for i := range ranges {
+		os.Remove(exportPartName(collection, i))
+	}
+	return name, items, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var fetchPages = flag.Bool("fetch-pages", false, "fetch the page each -format feed entry links to and add its title and meta tags")
+
+var (
+	htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlMetaPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	htmlAttrPattern  = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Author      string   `xml:"author"`
+	Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Categories  []string `xml:"category"`
+}
+
+type atomEntry struct {
+	ID        string `xml:"id"`
+	Title     string `xml:"title"`
+	Summary   string `xml:"summary"`
+	Content   string `xml:"content"`
+	Updated   string `xml:"updated"`
+	Published string `xml:"published"`
+	Links     []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Authors []struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Categories []struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+}
+
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// Sitemap indexes that list indexes are followed this many deep. The
+// protocol doesn't nest them at all, so deeper is taken to be a loop.
+const maxSitemapDepth = 4
+
+// A sitemap to read, and how many indexes deep it was found.
+type queuedSitemap struct {
+	url   string
+	depth int
+}
+
+// Reads an RSS or Atom feed, or an XML sitemap, emitting a document per
+// entry. Sitemap indexes are followed to the sitemaps they list.
+type feedReader struct {
+	decoder *xml.Decoder
+
+	// Sitemaps found in an index that are still to be read, and how deep
+	// the one being read is, 0 for the input itself.
+	sitemaps []queuedSitemap
+	depth    int
+	// Every sitemap queued, so one listed again isn't read twice.
+	seen map[string]bool
+	// The elements the decoder is inside, so an entry is only taken where
+	// its format puts it: an <image><url> in an RSS channel isn't a
+	// sitemap's url.
+	open  []string
+	count int
+}
+
+// The element each kind of entry is found in. RSS 1.0 has its items in
+// the RDF root, beside the channel rather than inside it.
+var feedEntryParents = map[string][]string{
+	"item":    {"channel", "RDF"},
+	"entry":   {"feed"},
+	"url":     {"urlset"},
+	"sitemap": {"sitemapindex"},
+}
+
+// Whether the element starting is an entry, from the one it's in.
+func (r *feedReader) isEntry(name string) bool {
+	if len(r.open) == 0 {
+		return false
+	}
+	parent := r.open[len(r.open)-1]
+	for _, p := range feedEntryParents[name] {
+		if p == parent {
+			return true
+		}
+	}
+	return false
+}
+
+func newFeedReader(reader *bufio.Reader) recordReader {
+	return &feedReader{decoder: xml.NewDecoder(reader)}
+}
+
+func (r *feedReader) ReadRecord() ([]byte, error) {
+	for {
+		t, err := r.decoder.Token()
+		if err == io.EOF && len(r.sitemaps) > 0 {
+			if err = r.nextSitemap(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var start xml.StartElement
+		switch t := t.(type) {
+		case xml.StartElement:
+			start = t
+		case xml.EndElement:
+			if len(r.open) > 0 {
+				r.open = r.open[:len(r.open)-1]
+			}
+			continue
+		default:
+			continue
+		}
+		if !r.isEntry(start.Name.Local) {
+			r.open = append(r.open, start.Name.Local)
+			continue
+		}
+
+		var doc map[string]interface{}
+		var id string
+		switch start.Name.Local {
+		case "item":
+			var item rssItem
+			if err := r.decoder.DecodeElement(&item, &start); err != nil {
+				return nil, err
+			}
+			doc, id = item.document()
+		case "entry":
+			var entry atomEntry
+			if err := r.decoder.DecodeElement(&entry, &start); err != nil {
+				return nil, err
+			}
+			doc, id = entry.document()
+		case "url":
+			var u sitemapURL
+			if err := r.decoder.DecodeElement(&u, &start); err != nil {
+				return nil, err
+			}
+			doc, id = u.document()
+		case "sitemap":
+			var u sitemapURL
+			if err := r.decoder.DecodeElement(&u, &start); err != nil {
+				return nil, err
+			}
+			r.queueSitemap(strings.TrimSpace(u.Loc))
+			continue
+		}
+
+		r.count++
+		if len(doc) == 0 {
+			log.Printf("Skipping feed entry %v, it has nothing to import", r.count)
+			continue
+		}
+		if link, _ := doc["link"].(string); *fetchPages && link != "" {
+			if page, err := fetchPageMetadata(link); err != nil {
+				log.Printf("Error fetching %v: %v", link, err)
+			} else {
+				doc["page"] = page
+			}
+		}
+
+		record, err := r.item(id, doc)
+		if err != nil {
+			log.Printf("Skipping feed entry %v: %v", id, err)
+			continue
+		}
+		return record, nil
+	}
+}
+
+func (r *feedReader) Source() (string, int) { return "", r.count }
+
+// Entries are keyed by a hash of their id or link unless there is a
+// -key-field, so re-importing a feed updates rather than duplicates them.
+func (r *feedReader) item(id string, doc map[string]interface{}) ([]byte, error) {
+	if *keyField != "" || id == "" {
+		return newItem(doc)
+	}
+	sum := sha1.Sum([]byte(id))
+	return newKeyedItem(hex.EncodeToString(sum[:]), doc)
+}
+
+// Queues a sitemap listed in the one being read, unless it has been already
+// or it would be too deep.
+func (r *feedReader) queueSitemap(url string) {
+	switch {
+	case url == "":
+	case r.seen[url]:
+		log.Printf("Skipping sitemap %v, it was listed already", url)
+	case r.depth >= maxSitemapDepth:
+		log.Printf("Skipping sitemap %v, sitemap indexes nest more than %v deep", url, maxSitemapDepth)
+	default:
+		if r.seen == nil {
+			r.seen = make(map[string]bool)
+		}
+		r.seen[url] = true
+		r.sitemaps = append(r.sitemaps, queuedSitemap{url, r.depth + 1})
+	}
+}
+
+func (r *feedReader) nextSitemap() error {
+	url := r.sitemaps[0].url
+	r.depth = r.sitemaps[0].depth
+	r.sitemaps = r.sitemaps[1:]
+
+	log.Printf("Reading sitemap %v", url)
+	resp, err := fetchURL(url)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	r.decoder = xml.NewDecoder(bytes.NewReader(body))
+	r.open = nil
+	return nil
+}
+
+func (item *rssItem) document() (map[string]interface{}, string) {
+	doc := make(map[string]interface{})
+	setNonEmpty(doc, "title", item.Title)
+	setNonEmpty(doc, "link", item.Link)
+	setNonEmpty(doc, "description", item.Description)
+	setNonEmpty(doc, "guid", item.GUID)
+	setNonEmpty(doc, "author", item.Author)
+	if item.Author == "" {
+		setNonEmpty(doc, "author", item.Creator)
+	}
+	if len(item.Categories) > 0 {
+		doc["categories"] = item.Categories
+	}
+	setFeedTime(doc, "published", item.PubDate)
+
+	id := strings.TrimSpace(item.GUID)
+	if id == "" {
+		id = strings.TrimSpace(item.Link)
+	}
+	return doc, id
+}
+
+func (entry *atomEntry) document() (map[string]interface{}, string) {
+	doc := make(map[string]interface{})
+	setNonEmpty(doc, "id", entry.ID)
+	setNonEmpty(doc, "title", entry.Title)
+	setNonEmpty(doc, "summary", entry.Summary)
+	setNonEmpty(doc, "content", entry.Content)
+	for _, link := range entry.Links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			setNonEmpty(doc, "link", link.Href)
+			break
+		}
+	}
+
+	var authors, categories []string
+	for _, a := range entry.Authors {
+		authors = append(authors, strings.TrimSpace(a.Name))
+	}
+	for _, c := range entry.Categories {
+		categories = append(categories, c.Term)
+	}
+	if len(authors) > 0 {
+		doc["authors"] = authors
+	}
+	if len(categories) > 0 {
+		doc["categories"] = categories
+	}
+	setFeedTime(doc, "published", entry.Published)
+	setFeedTime(doc, "updated", entry.Updated)
+
+	id := strings.TrimSpace(entry.ID)
+	if link, _ := doc["link"].(string); id == "" {
+		id = link
+	}
+	return doc, id
+}
+
+func (u *sitemapURL) document() (map[string]interface{}, string) {
+	doc := make(map[string]interface{})
+	setNonEmpty(doc, "link", u.Loc)
+	setNonEmpty(doc, "change_freq", u.ChangeFreq)
+	setNonEmpty(doc, "priority", u.Priority)
+	setFeedTime(doc, "updated", u.LastMod)
+	return doc, strings.TrimSpace(u.Loc)
+}
+
+// Fetches a page and pulls its title and meta tags out of the markup.
+func fetchPageMetadata(url string) (map[string]interface{}, error) {
+	resp, err := fetchURL(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The head is all that's wanted, so don't read huge pages in full.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 512*1024))
+	if err != nil {
+		return nil, err
+	}
+	markup := string(body)
+	if i := strings.Index(strings.ToLower(markup), "</head>"); i >= 0 {
+		markup = markup[:i]
+	}
+
+	page := make(map[string]interface{})
+	if m := htmlTitlePattern.FindStringSubmatch(markup); m != nil {
+		setNonEmpty(page, "title", html.UnescapeString(m[1]))
+	}
+	for name, content := range htmlMetaTags(markup) {
+		setNonEmpty(page, name, content)
+	}
+	return page, nil
+}
+
+// Returns the content of each <meta> tag in the markup, keyed by its
+// lowercased name or property attribute.
+func htmlMetaTags(markup string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range htmlMetaPattern.FindAllString(markup, -1) {
+		attrs := make(map[string]string)
+		for _, m := range htmlAttrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+		}
+		name := attrs["name"]
+		if name == "" {
+			name = attrs["property"]
+		}
+		if name != "" {
+			tags[strings.ToLower(name)] = attrs["content"]
+		}
+	}
+	return tags
+}
+
+func setNonEmpty(doc map[string]interface{}, field, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		doc[field] = value
+	}
+}
+
+var feedTimeLayouts = []string{
+	time.RFC1123Z, time.RFC1123, time.RFC3339, time.RFC822Z, time.RFC822,
+	"Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "2006-01-02",
+}
+
+// Normalises the many date formats feeds use to RFC 3339, keeping the raw
+// value if it can't be parsed.
+func setFeedTime(doc map[string]interface{}, field, value string) {
+	value = strings.TrimSpace(value)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			doc[field] = t.Format(time.RFC3339)
+			return
+		}
+	}
+	setNonEmpty(doc, field, value)
+}
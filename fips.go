@@ -0,0 +1,17 @@
+//go:build fips
+
+// Building with -tags fips runs the Go Cryptographic Module in FIPS 140-3
+// mode, which needs Go 1.24 or later, and limits the TLS settings and
+// checksums to approved algorithms.
+
+//go:debug fips140=on
+
+package main
+
+import "crypto/fips140"
+
+const fipsBuild = true
+
+func fipsEnabled() bool {
+	return fips140.Enabled()
+}
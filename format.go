@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+var (
+	format     = flag.String("format", "json", "the input format (json, proto, csv, tsv, delimited, fixed, apache-combined, syslog, geojson, feed, markdown)")
+	collection = flag.String("collection", "", "the collection to import into, readdressing export stream items, or comma separated file=collection routes sending each input to its own, with a collection name for the rest")
+	keyField   = flag.String("key-field", "", "the document field, or csv or tsv column, to use as the item key (a random key is generated when empty)")
+	readBuffer = flag.String("read-buffer", defaultReadBuffer(), "the size of the buffer inputs are read through")
+)
+
+// A recordReader yields the input one export stream item at a time. Every
+// record returned is a complete JSON line, including the trailing newline.
+type recordReader interface {
+	ReadRecord() ([]byte, error)
+}
+
+// Implemented by readers that know where their records come from.
+type recordSource interface {
+	// Returns the file, if it differs from the input name, and the line
+	// (or record number for formats that aren't line oriented) of the last
+	// record read.
+	Source() (string, int)
+}
+
+// An inputFormat describes how to set up and decode one -format.
+type inputFormat struct {
+	// Validates flags and loads anything the format needs, may be nil.
+	setup func() error
+
+	// Returns a reader decoding records from the input.
+	open func(reader *bufio.Reader) recordReader
+
+	// Set instead of open for formats that read the named path themselves,
+	// returning the reader and the input size.
+	openPath func(name string) (recordReader, int64, error)
+
+	// Set for formats producing bare documents that newItem wraps, which
+	// need a -collection to import into.
+	documents bool
+}
+
+var formats = map[string]*inputFormat{
+	"json": {
+		open: func(reader *bufio.Reader) recordReader { return &lineReader{reader: reader} },
+	},
+	"proto": {
+		setup:     setupProto,
+		open:      newProtoReader,
+		documents: true,
+	},
+	"csv": {
+		setup:     setupText,
+		open:      newDelimitedReader,
+		documents: true,
+	},
+	"tsv": {
+		setup:     setupText,
+		open:      newDelimitedReader,
+		documents: true,
+	},
+	"delimited": {
+		setup:     setupText,
+		open:      newDelimitedReader,
+		documents: true,
+	},
+	"fixed": {
+		setup:     setupText,
+		open:      newFixedReader,
+		documents: true,
+	},
+	"apache-combined": {
+		open:      newApacheReader,
+		documents: true,
+	},
+	"syslog": {
+		open:      newSyslogReader,
+		documents: true,
+	},
+	"geojson": {
+		open:      newGeoJSONReader,
+		documents: true,
+	},
+	"feed": {
+		open:      newFeedReader,
+		documents: true,
+	},
+	"markdown": {
+		openPath:  openDocuments,
+		documents: true,
+	},
+}
+
+// Validates the format flags and loads anything the chosen format needs
+// before any file is opened.
+func setupFormat() error {
+	f := formats[*format]
+	if f == nil {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err := parseCollections(); err != nil {
+		return err
+	}
+	if f.documents && *collection == "" {
+		return fmt.Errorf("-collection is required for -format %v", *format)
+	}
+	if f.setup != nil {
+		return f.setup()
+	}
+	return nil
+}
+
+// Opens the named input, returning a recordReader decoding the configured
+// format, the input size in bytes (-1 if unknown) and what to close when done.
+func openRecords(name string) (recordReader, int64, io.Closer, error) {
+	if source := copySources[name]; source != nil {
+		records, closer := source.open()
+		return records, -1, closer, nil
+	}
+	f := formats[*format]
+	if f.openPath != nil {
+		records, size, err := f.openPath(name)
+		return records, size, ioutil.NopCloser(nil), err
+	}
+
+	bufferSize, err := parseByteSize(*readBuffer)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("-read-buffer: %v", err)
+	}
+	file, size, err := openInput(name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return f.open(bufio.NewReaderSize(file, int(bufferSize))), size, file, nil
+}
+
+// Reads an Orchestrate export stream, which is already one item per line.
+type lineReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (r *lineReader) ReadRecord() ([]byte, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		r.line++
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err == io.EOF {
+				// The last line of the file may be missing its newline.
+				return append(line, '\n'), nil
+			}
+			return line, err
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *lineReader) Source() (string, int) { return "", r.line }
+
+// Wraps a decoded document in an export stream item addressed to the
+// configured collection, keyed by the -key-field value if there is one.
+func newItem(value map[string]interface{}) ([]byte, error) {
+	key, err := itemKey(value)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyedItem(key, value)
+}
+
+// Wraps a decoded document in an export stream item with the given key.
+func newKeyedItem(key string, value map[string]interface{}) ([]byte, error) {
+	item := map[string]interface{}{
+		"kind": "item",
+		"path": map[string]interface{}{
+			"collection": defaultCollection,
+			"kind":       "item",
+			"key":        key,
+		},
+		"value": value,
+	}
+
+	line, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func itemKey(value map[string]interface{}) (string, error) {
+	if *keyField == "" {
+		return randomKey(), nil
+	}
+	return fieldKey(value, *keyField)
+}
+
+// Returns the document's field as a key.
+func fieldKey(value map[string]interface{}, field string) (string, error) {
+	if key, ok := keyString(value[field]); ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("document has no %q field to use as a key", field)
+}
+
+// Formats a field's value as a key, false if it's missing or empty.
+func keyString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+func randomKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id"`
+	Geometry   json.RawMessage        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// Streams the features out of a GeoJSON FeatureCollection, or a file holding
+// a single Feature, without holding the whole collection in memory. Each
+// feature becomes a document of its properties plus the geometry.
+type geoJSONReader struct {
+	decoder *json.Decoder
+	started bool
+	single  *geoJSONFeature
+	count   int
+}
+
+func newGeoJSONReader(reader *bufio.Reader) recordReader {
+	decoder := json.NewDecoder(reader)
+	// Coordinates and properties keep the precision they were written with.
+	decoder.UseNumber()
+	return &geoJSONReader{decoder: decoder}
+}
+
+func (r *geoJSONReader) ReadRecord() ([]byte, error) {
+	if !r.started {
+		r.started = true
+		if err := r.findFeatures(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		var feature geoJSONFeature
+		switch {
+		case r.single != nil:
+			feature, r.single = *r.single, nil
+			r.decoder = json.NewDecoder(eofReader{})
+		case r.decoder.More():
+			if err := r.decoder.Decode(&feature); err != nil {
+				return nil, fmt.Errorf("geojson: feature %v: %v", r.count+1, err)
+			}
+		default:
+			return nil, io.EOF
+		}
+		r.count++
+
+		record, err := featureItem(&feature)
+		if err != nil {
+			log.Printf("Skipping feature %v: %v", r.count, err)
+			continue
+		}
+		return record, nil
+	}
+}
+
+func (r *geoJSONReader) Source() (string, int) { return "", r.count }
+
+// Advances the decoder into the "features" array of the top level object,
+// skipping any other members.
+func (r *geoJSONReader) findFeatures() error {
+	if t, err := r.decoder.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return fmt.Errorf("geojson: expected an object, found %v", t)
+	}
+
+	members := make(map[string]json.RawMessage)
+	for r.decoder.More() {
+		t, err := r.decoder.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := t.(string)
+
+		if name == "features" {
+			if t, err := r.decoder.Token(); err != nil {
+				return err
+			} else if t != json.Delim('[') {
+				return fmt.Errorf("geojson: expected features to be an array, found %v", t)
+			}
+			return nil
+		}
+
+		var value json.RawMessage
+		if err := r.decoder.Decode(&value); err != nil {
+			return err
+		}
+		members[name] = value
+	}
+
+	// There was no features array, so this had better be a lone Feature.
+	object, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	r.single = &geoJSONFeature{}
+	if err := decodeJSON(object, r.single); err != nil {
+		return err
+	}
+	if r.single.Type != "Feature" {
+		return fmt.Errorf("geojson: expected a FeatureCollection or Feature, found %q", r.single.Type)
+	}
+	return nil
+}
+
+func featureItem(feature *geoJSONFeature) ([]byte, error) {
+	doc := feature.Properties
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	if feature.Geometry != nil {
+		doc["geometry"] = feature.Geometry
+	}
+
+	// Without a -key-field the feature's own id is the natural key.
+	// A number is written as it is in the input, as a -key-field's would be.
+	if key, ok := keyString(feature.ID); *keyField == "" && ok {
+		return newKeyedItem(key, doc)
+	}
+	return newItem(doc)
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+	"github.com/moediddy/db/bulkimport"
+)
+
+var targetErrorRate = flag.String("target-error-rate", "", "keep the share of requests that fail with a 429, a 5xx or a timeout under this, such as 0.1%, by governing the send rate: it's cut when errors overdraw the budget and raised again while they don't, up to any -rps")
+
+const (
+	// The send rate is raised, if the window's failures were within the
+	// target, once per window.
+	governorWindow = 2 * time.Second
+	// After a cut, the destination is given this long to recover before
+	// failures can cut the rate again.
+	governorSettle = time.Second
+	// How much a cut keeps of the rate and how much a raise adds.
+	governorCut   = 0.75
+	governorRaise = 1.1
+	// The governor never slows to less than this many requests a second.
+	minGovernedRate = 0.1
+)
+
+// Governs the send rate by -target-error-rate, nil without one.
+var governor *errorGovernor
+
+// Every request earns the error budget the target rate of an error, up to
+// one error's worth, and every failed one spends a whole error. Overdrawing
+// the budget cuts the rate limit, starting from the rate requests were being
+// sent at, and a window with failures within the target raises it while the
+// limit is what's holding requests back.
+type errorGovernor struct {
+	target float64
+	// The -rps, 0 for none.
+	max float64
+
+	mu     sync.Mutex
+	budget float64
+	// The current limit, 0 until the first cut.
+	rate float64
+	// When the limit was last cut. Requests started before then ran at the
+	// old rate, so their failures don't count, and the ones for the
+	// governorSettle after it are forgiven.
+	cut time.Time
+	// The window's requests and failures, when it started and how many
+	// requests the limiter had held back by then.
+	sent, failed int
+	started      time.Time
+	delayed      int64
+}
+
+func setupGovernor() error {
+	if *targetErrorRate == "" {
+		return nil
+	}
+	target, err := parseRate(*targetErrorRate)
+	if err != nil {
+		return fmt.Errorf("-target-error-rate: %v", err)
+	}
+	if target == 0 || target == 1 {
+		return errors.New("-target-error-rate must be more than 0% and less than 100%")
+	}
+	if limiter == nil {
+		limiter = &rateLimiter{last: time.Now()}
+	}
+	governor = &errorGovernor{target: target, max: *rps, rate: *rps, budget: 1, started: time.Now()}
+	return nil
+}
+
+// Whether a request's failure counts against the error budget: the
+// destination being overloaded or failing, rather than the batch.
+func budgetError(err error) bool {
+	return err == bulkimport.ErrTimedOut || errors.Is(err, bulk.ErrRateLimited) || errors.Is(err, bulk.ErrServer)
+}
+
+// Records how a request started at the given time went.
+func (g *errorGovernor) observe(started time.Time, err error) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sent++
+	g.budget = math.Min(1, g.budget+g.target)
+	if budgetError(err) && !started.Before(g.cut) {
+		g.failed++
+		g.budget--
+	}
+
+	elapsed := time.Since(g.started)
+	if g.budget < 0 && time.Since(g.cut) < governorSettle {
+		g.budget = 0
+	}
+	switch {
+	case g.budget < 0:
+		rate := g.rate
+		if observed := float64(g.sent) / elapsed.Seconds(); rate == 0 || elapsed >= time.Second && observed < rate {
+			rate = observed
+		}
+		g.setRate(math.Max(minGovernedRate, rate*governorCut))
+		g.cut, g.budget = time.Now(), 0
+		logCode(codeErrorBudget, "Slowing to %.1f requests/s, %v of %v requests failed against a -target-error-rate of %v",
+			g.rate, g.failed, g.sent, *targetErrorRate)
+		g.reset()
+	case elapsed >= governorWindow:
+		if float64(g.failed) <= g.target*float64(g.sent) && g.rate > 0 && atomic.LoadInt64(&limiter.delayed) > g.delayed && (g.max == 0 || g.rate < g.max) {
+			raised := g.rate * governorRaise
+			if g.max > 0 {
+				raised = math.Min(raised, g.max)
+			}
+			g.setRate(raised)
+		}
+		g.reset()
+	}
+}
+
+func (g *errorGovernor) setRate(rate float64) {
+	g.rate = rate
+	limiter.setRate(rate)
+}
+
+// Starts the next window.
+func (g *errorGovernor) reset() {
+	g.sent, g.failed, g.started = 0, 0, time.Now()
+	g.delayed = atomic.LoadInt64(&limiter.delayed)
+}
+
+// Logs where the rate ended up.
+func finishGovernor() {
+	g := governor
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.rate == 0 {
+		log.Printf("No server errors used up the -target-error-rate budget, the send rate wasn't limited")
+		return
+	}
+	log.Printf("The -target-error-rate governor ended at %.1f requests/s", g.rate)
+}
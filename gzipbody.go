@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var compressRequests = flag.Bool("compress-requests", false, "gzip request bodies and send them with Content-Encoding: gzip, which cuts the upload several times over for text heavy records; they go uncompressed if the destination doesn't list gzip or answers 415 Unsupported Media Type")
+
+// Whether bodies are being gzipped, 1 until the destination turns them
+// down, and the bytes of those it took before and after compression.
+var gzipBodies struct {
+	on      int32
+	in, out int64
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// Sets up -compress-requests once the destination's capabilities are
+// known.
+func setupCompressRequests() error {
+	if !*compressRequests {
+		return nil
+	}
+	if *compressionDictionary != "" {
+		return errors.New("-compress-requests can't be used with -compression-dictionary, which compresses the bodies already")
+	}
+	if caps := serverCapabilities.Compressions; len(caps) > 0 {
+		supported := false
+		for _, c := range caps {
+			supported = supported || strings.EqualFold(c, "gzip")
+		}
+		if !supported {
+			log.Printf("Warning: the destination doesn't take gzip request bodies, sending them uncompressed")
+			return nil
+		}
+	}
+	gzipBodies.on = 1
+	return nil
+}
+
+func gzipping() bool {
+	return atomic.LoadInt32(&gzipBodies.on) == 1
+}
+
+// Stops gzipping bodies after the destination refused one.
+func refuseGzip() {
+	if atomic.CompareAndSwapInt32(&gzipBodies.on, 1, 0) {
+		log.Printf("The server doesn't accept gzip request bodies, sending them uncompressed")
+	}
+}
+
+func gzipBody(body []byte) []byte {
+	var out bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	w.Reset(&out)
+	// Writing to a buffer can't fail.
+	w.Write(body)
+	w.Close()
+	gzipWriters.Put(w)
+	return out.Bytes()
+}
+
+// Counts a gzipped body the destination took, for the totals.
+func countGzipped(body, payload []byte) {
+	atomic.AddInt64(&gzipBodies.in, int64(len(body)))
+	atomic.AddInt64(&gzipBodies.out, int64(len(payload)))
+}
+
+// Logs how much gzip saved.
+func finishCompressRequests() {
+	if gzipBodies.in == 0 {
+		return
+	}
+	log.Printf("Compressed %v of request bodies to %v (%.0f%%) with gzip",
+		formatBytes(gzipBodies.in), formatBytes(gzipBodies.out), 100*float64(gzipBodies.out)/float64(gzipBodies.in))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+var hashStore = flag.String("hash-store", "", "a file of content hashes from earlier imports; items whose content is unchanged are skipped")
+
+// The -hash-store contents, loaded by setupHashes. Nil when not in use, in
+// which case its methods do nothing.
+var hashes *contentHashes
+
+// Maps "collection/key" to the SHA-256 of the value last imported there.
+// Hashes are only committed once the server acknowledges the item, so a
+// failed item is retried by the next run.
+type contentHashes struct {
+	path   string
+	mu     sync.Mutex
+	hashes map[string]string
+	dirty  bool
+}
+
+func setupHashes() error {
+	if *hashStore == "" {
+		return nil
+	}
+
+	hashes = &contentHashes{path: *hashStore, hashes: make(map[string]string)}
+	data, err := ioutil.ReadFile(*hashStore)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &hashes.hashes); err != nil {
+		return errors.New(*hashStore + ": " + err.Error())
+	}
+	log.Printf("Loaded %v content hashes from %v", len(hashes.hashes), *hashStore)
+	return nil
+}
+
+// Hashes an export stream item, reporting whether it differs from what was
+// imported last time.
+func (h *contentHashes) check(line []byte) (id, hash string, changed bool, err error) {
+	var item struct {
+		Path struct {
+			Collection string `json:"collection"`
+			Key        string `json:"key"`
+		} `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(line, &item); err != nil {
+		return "", "", false, err
+	}
+
+	// Re-encoding sorts the keys, so the hash doesn't depend on field order.
+	// Numbers keep their text, so a change past a float64's precision still
+	// changes the hash.
+	var value interface{}
+	if err := decodeJSON(item.Value, &value); err != nil {
+		return "", "", false, err
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return "", "", false, err
+	}
+	sum := sha256.Sum256(canonical)
+
+	id = item.Path.Collection + "/" + item.Path.Key
+	hash = hex.EncodeToString(sum[:])
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return id, hash, h.hashes[id] != hash, nil
+}
+
+// Records that an item was imported.
+func (h *contentHashes) commit(record batchRecord) {
+	if h == nil || record.id == "" {
+		return
+	}
+	h.mu.Lock()
+	h.hashes[record.id] = record.hash
+	h.dirty = true
+	h.mu.Unlock()
+}
+
+// Writes the hashes back out, replacing the file atomically.
+func (h *contentHashes) save() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return
+	}
+
+	data, err := json.Marshal(h.hashes)
+	if err == nil {
+		tmp := h.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, h.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving content hashes: %v", err)
+	}
+}
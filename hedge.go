@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var hedge = flag.Bool("hedge", false, "send a second copy of a batch whose response headers are slower than the 95th percentile so far, taking whichever answers first")
+
+// How long recent requests took to get their response headers.
+var headerLatency = &latencyTracker{}
+
+// How many hedged copies have been sent.
+var hedges int64
+
+// Hedging waits for this many samples before it trusts the percentile.
+const minLatencySamples = 20
+
+// Keeps the most recent latencies in a ring.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [200]time.Duration
+	n       int
+}
+
+func (l *latencyTracker) add(d time.Duration) {
+	l.mu.Lock()
+	l.samples[l.n%len(l.samples)] = d
+	l.n++
+	l.mu.Unlock()
+}
+
+// Returns the pth percentile of the recent latencies, false if there aren't
+// enough of them yet.
+func (l *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	n := l.n
+	if n > len(l.samples) {
+		n = len(l.samples)
+	}
+	sorted := append([]time.Duration(nil), l.samples[:n]...)
+	l.mu.Unlock()
+
+	if n < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(n-1))], true
+}
+
+func setupHedging() error {
+	if *hedge && anyCreateOnly() {
+		// A second copy of a create-only write would fail on the first.
+		return errors.New("-hedge needs -mode upsert, other writes aren't safe to send twice")
+	}
+	return nil
+}
+
+// Returns how long to wait for response headers before hedging, false when
+// not hedging.
+func hedgeDelay() (time.Duration, bool) {
+	if !*hedge {
+		return 0, false
+	}
+	return headerLatency.percentile(0.95)
+}
+
+// Makes one POST of a batch with the client, recording how long the
+// response headers took and closing headers, if there is one, once they
+// arrive.
+func postBatch(ctx context.Context, client *http.Client, b *batch, headers chan struct{}) (map[string]interface{}, error) {
+	ctx = withTenant(ctx, b.tenant)
+	started := time.Now()
+	var once sync.Once
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			once.Do(func() {
+				headerLatency.add(time.Since(started))
+				if headers != nil {
+					close(headers)
+				}
+			})
+		},
+	})
+
+	for {
+		body := make(map[string]interface{})
+		contentType := bulkSink.contentType()
+		payload, encoding := b.payload()
+		_, err := jsonReplyWith(ctx, client, bulkSink.Method, bulkSink.Endpoint, bulkHeaders(contentType, payload, encoding), bytes.NewReader(payload), bulkSink.Status, &body)
+		if bulk.StatusCode(err) == http.StatusUnsupportedMediaType && encoding == "gzip" {
+			refuseGzip()
+			continue
+		}
+		if err == nil && encoding == "gzip" {
+			countGzipped(b.body, payload)
+		}
+		if bulk.StatusCode(err) == http.StatusUnsupportedMediaType && bulkSink.refused(contentType) {
+			continue
+		}
+		return body, err
+	}
+}
+
+type postResult struct {
+	body map[string]interface{}
+	err  error
+}
+
+// Posts a batch and, if its response headers haven't arrived after delay,
+// posts it again. The first success wins and the other attempt is cancelled.
+func hedgedPost(ctx context.Context, client *http.Client, b *batch, delay time.Duration) (map[string]interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan postResult, 2)
+	post := func(headers chan struct{}) {
+		body, err := postBatch(ctx, client, b, headers)
+		results <- postResult{body, err}
+	}
+
+	headers := make(chan struct{})
+	go post(headers)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.body, r.err
+	case <-headers:
+		r := <-results
+		return r.body, r.err
+	case <-timer.C:
+	}
+
+	n := atomic.AddInt64(&hedges, 1)
+	if n == 1 || n%100 == 0 {
+		log.Printf("Hedging %v after %v without a response (%v hedged so far)", b, delay.Round(time.Millisecond), n)
+	}
+	go post(nil)
+
+	first := <-results
+	if first.err == nil {
+		return first.body, nil
+	}
+	second := <-results
+	if second.err == nil {
+		return second.body, nil
+	}
+	return first.body, first.err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long fetching a remote input waits for the response headers, and then
+// for each read of the body. A download takes as long as it needs, so long
+// as it keeps arriving.
+const fetchTimeout = 60 * time.Second
+
+// Used for fetching remote inputs, which never get the API credentials.
+// Requests go through fetch, which adds the fetchTimeout for the body.
+var fetchClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: fetchTimeout,
+	// Enough for the -read-ahead range requests to run in parallel.
+	MaxIdleConnsPerHost: 16,
+	ForceAttemptHTTP2:   true,
+}}
+
+// Makes a request with the fetchClient, failing a read of the response body
+// that gets nothing for the fetchTimeout.
+func fetch(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := fetchClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &idleTimeoutBody{body: resp.Body, cancel: cancel}
+	body.timer = time.AfterFunc(fetchTimeout, func() {
+		atomic.StoreInt32(&body.idle, 1)
+		cancel()
+	})
+	body.timer.Stop()
+	resp.Body = body
+	return resp, nil
+}
+
+// A response body whose reads are given up on after the fetchTimeout. Only
+// time spent in Read counts, so a reader held up by the senders doesn't
+// time out.
+type idleTimeoutBody struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+	timer  *time.Timer
+	// Set once a read has timed out.
+	idle int32
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(fetchTimeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if err != nil && atomic.LoadInt32(&b.idle) == 1 {
+		err = fmt.Errorf("nothing arrived for %v", fetchTimeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+// The input name standing for stdin.
+const stdinName = "-"
+
+// Returns the files to import, stdin when none are given.
+func importInputs(args []string) ([]string, error) {
+	if len(args) == 0 {
+		args = []string{stdinName}
+	}
+	stdin := 0
+	for _, name := range args {
+		if name == stdinName {
+			stdin++
+		}
+	}
+	switch {
+	case stdin == 0:
+		return args, nil
+	case stdin > 1:
+		return nil, errors.New("stdin can only be imported once")
+	case *soak > 0:
+		return nil, errors.New("-soak can't read stdin over again")
+	case *resume:
+		return nil, errors.New("-resume can't tell if stdin is what the -checkpoint was written for")
+	}
+	if stats, err := os.Stdin.Stat(); err == nil && stats.Mode()&os.ModeCharDevice != 0 {
+		log.Printf("Reading records from stdin")
+	}
+	return args, nil
+}
+
+// The name to give files written for an input, such as its dead letters.
+func localName(name string) string {
+	if name == stdinName {
+		return "stdin"
+	}
+	return name
+}
+
+// Opens an input as openRawInput does, decompressing it if it's gzip, bzip2,
+// zstd or xz compressed, which is told by its extension or magic number. The
+// size is of the input as stored, and so is the reader's offset.
+func openInput(name string) (*inputReader, int64, error) {
+	raw, size, err := openRawInput(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	input := &inputReader{raw: &countingReader{reader: raw}, closer: raw}
+	buffered := bufio.NewReader(input.raw)
+	input.Reader = buffered
+
+	magic, _ := buffered.Peek(6)
+	for _, c := range compressions {
+		if !strings.HasSuffix(name, c.ext) && !bytes.HasPrefix(magic, c.magic) {
+			continue
+		}
+		r, err := c.open(buffered)
+		if err != nil {
+			raw.Close()
+			return nil, 0, fmt.Errorf("%v: %v", name, err)
+		}
+		input.Reader = r
+		if closer, ok := r.(io.Closer); ok {
+			input.closer = multiCloser{closer, raw}
+		}
+		break
+	}
+	return input, size, nil
+}
+
+// The compressions inputs can be in.
+var compressions = []struct {
+	ext   string
+	magic []byte
+	open  func(*bufio.Reader) (io.Reader, error)
+}{
+	{".gz", []byte{0x1f, 0x8b}, func(r *bufio.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	{".bz2", []byte("BZh"), func(r *bufio.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }},
+	{".zst", zstdMagic, newZstdReader},
+	{".xz", xzMagic, newXZReader},
+}
+
+// An opened input, decompressed if need be.
+type inputReader struct {
+	io.Reader
+	raw    *countingReader
+	closer io.Closer
+}
+
+func (r *inputReader) Close() error { return r.closer.Close() }
+
+// Returns how many bytes of the input as stored have been read.
+func (r *inputReader) Offset() int64 { return r.raw.count() }
+
+// Implemented by inputs that know how far through them reading has got.
+type inputOffset interface {
+	Offset() int64
+}
+
+// Counts the bytes read through it. The count can be read while another
+// goroutine reads.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) count() int64 { return atomic.LoadInt64(&r.n) }
+
+// Closes each in turn, returning the first error.
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var first error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Opens a file, http(s) URL or, for "-", stdin for reading, returning its
+// size in bytes or -1 if that is unknown.
+func openRawInput(name string) (io.ReadCloser, int64, error) {
+	if name == stdinName {
+		return ioutil.NopCloser(os.Stdin), -1, nil
+	}
+	if isURL(name) {
+		resp, err := fetchURL(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if *readAhead > 0 {
+			return newPrefetchReader(name, resp), resp.ContentLength, nil
+		}
+		return resp.Body, resp.ContentLength, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	stats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stats.Size(), nil
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// Performs a GET, treating any status but 200 as an error.
+func fetchURL(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "orcbulkimport")
+
+	resp, err := fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %v: %v", url, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	topRecords    = flag.Int("top", 10, "how many of the largest records inspect lists")
+	sizeThreshold = flag.String("size-threshold", "1MB", "inspect counts the records larger than this")
+)
+
+type sizedRecord struct {
+	size       int
+	pos        recordPos
+	collection string
+	key        string
+}
+
+// Keeps the largest records seen, smallest on top.
+type sizeHeap []sizedRecord
+
+func (h sizeHeap) Len() int            { return len(h) }
+func (h sizeHeap) Less(i, j int) bool  { return h[i].size < h[j].size }
+func (h sizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x interface{}) { *h = append(*h, x.(sizedRecord)) }
+func (h *sizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Implements "orcbulkimport inspect <files>", which reports the record size
+// distribution and the largest records so oversized payloads can be dealt
+// with before they're rejected mid-import, and the anomalies in the
+// records that would make for bad data once imported.
+func inspectCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport inspect [-top n] [-size-threshold size] <files>")
+	}
+	if err := setupFormat(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	threshold, err := parseByteSize(*sizeThreshold)
+	if err != nil {
+		log.Fatalf("Error: -size-threshold: %v", err)
+	}
+
+	// Bucket i counts records of less than 1KB << i, the last one the rest.
+	buckets := make([]int, 12)
+	var count, over int
+	var total int64
+	largest := &sizeHeap{}
+	profile := newRecordProfile()
+
+	for _, filename := range args {
+		records, _, file, err := openRecords(filename)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		n := 0
+		for {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading %v: %v", filename, err)
+			}
+			n++
+			pos := recordPos{filename, n}
+			if src, ok := records.(recordSource); ok {
+				if name, line := src.Source(); name != "" {
+					pos = recordPos{name, line}
+				} else {
+					pos.line = line
+				}
+			}
+			profile.add(line, pos)
+
+			size := len(line)
+			count++
+			total += int64(size)
+			if int64(size) > threshold {
+				over++
+			}
+			b := 0
+			for b < len(buckets)-1 && size >= 1024<<uint(b) {
+				b++
+			}
+			buckets[b]++
+
+			if largest.Len() < *topRecords || (largest.Len() > 0 && size > (*largest)[0].size) {
+				rec := sizedRecord{size: size, pos: pos}
+				rec.collection, rec.key, _ = itemPath(line)
+				heap.Push(largest, rec)
+				if largest.Len() > *topRecords {
+					heap.Pop(largest)
+				}
+			}
+		}
+		file.Close()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "%v records, %v total", count, formatBytes(total))
+	if count > 0 {
+		fmt.Fprintf(w, ", %v average", formatBytes(total/int64(count)))
+	}
+	fmt.Fprintf(w, "\n%v records larger than %v\n\n", over, formatBytes(threshold))
+
+	fmt.Fprintln(w, "SIZE\tRECORDS\t")
+	for i, n := range buckets {
+		label := "< " + formatBytes(1024<<uint(i))
+		if i == len(buckets)-1 {
+			label = ">= " + formatBytes(1024<<uint(i-1))
+		}
+		bar := ""
+		if count > 0 {
+			bar = strings.Repeat("#", (n*50+count-1)/count)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", label, n, bar)
+	}
+
+	top := []sizedRecord(*largest)
+	sort.Slice(top, func(i, j int) bool { return top[i].size > top[j].size })
+	if len(top) > 0 {
+		fmt.Fprintln(w, "\nSIZE\tCOLLECTION\tKEY\tSOURCE")
+		for _, rec := range top {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v:%v\n", formatBytes(int64(rec.size)), rec.collection, rec.key, rec.pos.file, rec.pos.line)
+		}
+	}
+	w.Flush()
+
+	// In a table of its own, as its columns are nothing like the others.
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	profile.write(w)
+	w.Flush()
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
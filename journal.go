@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var journalFile = flag.String("journal", "", "append a line of JSON to this file for every input boundary and acknowledged batch")
+
+// The open -journal, nil when there isn't one.
+var journal *runJournal
+
+type runJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// One line of the journal.
+type journalEntry struct {
+	Time time.Time `json:"time"`
+	// start, file, batch or end.
+	Type  string `json:"type"`
+	Run   string `json:"run"`
+	Label string `json:"label,omitempty"`
+
+	// The input stream, a file or with -concat the whole set of them.
+	Stream string `json:"stream,omitempty"`
+	// For file entries, the file that starts at this point of the stream.
+	File string `json:"file,omitempty"`
+	// The batch, numbered from 1 within the stream. For file entries, the
+	// batch the file's first record goes in.
+	Batch int `json:"batch,omitempty"`
+	// For file entries, how many records of the stream came before it.
+	Records int `json:"records,omitempty"`
+
+	// For batch entries, where the batch's records came from.
+	First string `json:"first,omitempty"`
+	Last  string `json:"last,omitempty"`
+
+	Imported int    `json:"imported,omitempty"`
+	Errors   int    `json:"errors,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// For batch entries, the items the destination acknowledged, which
+	// verify-journal checks are there.
+	Items []journalItem `json:"items,omitempty"`
+}
+
+// An acknowledged item, with the ref the destination gave it if it said.
+type journalItem struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Ref        string `json:"ref,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+}
+
+func setupJournal() error {
+	if *journalFile == "" {
+		return nil
+	}
+	file, err := os.OpenFile(*journalFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	journal = &runJournal{file: file}
+	journal.write(journalEntry{Type: "start"})
+	return nil
+}
+
+// Appends an entry, one write per line so concurrent runs sharing a journal
+// don't interleave within lines.
+func (j *runJournal) write(entry journalEntry) {
+	if j == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Run = runID
+	entry.Label = *label
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error writing journal: %v", err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing journal: %v", err)
+	}
+}
+
+// Adds record i of the batch to the items of its batch entry, with the ref
+// from its result.
+func (j *runJournal) item(items []journalItem, b *batch, i int, result map[string]interface{}) []journalItem {
+	if j == nil {
+		return items
+	}
+	collection, key, err := scanItemPath(b.Line(i))
+	if err != nil {
+		return items
+	}
+	item := journalItem{Collection: collection, Key: key, Ref: resultRef(result)}
+	if t := b.records[i].tenant; t != nil {
+		item.Tenant = t.name
+	}
+	return append(items, item)
+}
+
+// Finds the ref in an item's result, which gives it with the item's path.
+func resultRef(result map[string]interface{}) string {
+	for _, name := range []string{"item", "path"} {
+		path, _ := result[name].(map[string]interface{})
+		if inner, ok := path["path"].(map[string]interface{}); ok {
+			path = inner
+		}
+		if ref, ok := path["ref"].(string); ok {
+			return ref
+		}
+	}
+	return ""
+}
+
+func (j *runJournal) close() {
+	if j == nil {
+		return
+	}
+	j.write(journalEntry{Type: "end"})
+	if err := j.file.Close(); err != nil {
+		log.Printf("Error writing journal: %v", err)
+	}
+}
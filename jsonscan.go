@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A validating scanner for export stream lines. It checks the syntax of the
+// whole line but only picks out the item's collection and key, without
+// building any values, which makes validation passes over huge inputs
+// several times faster than decoding them with encoding/json.
+type jsonScanner struct {
+	data []byte
+	pos  int
+
+	// The raw collection and key. They keep their quotes when they contain
+	// escape sequences, which a string without them can't start with.
+	collection, key []byte
+}
+
+// Where in an item the value being scanned is.
+const (
+	scanItem = iota
+	scanPath
+	scanOther
+)
+
+// Deeper nesting is rejected rather than risking the stack.
+const maxScanDepth = 10000
+
+// Validates an export stream line and returns the collection and key it's
+// addressed to.
+func scanItemPath(line []byte) (string, string, error) {
+	s := &jsonScanner{data: line}
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] != '{' {
+		return "", "", s.syntaxError("expected an object")
+	}
+	if err := s.value(0, scanItem); err != nil {
+		return "", "", err
+	}
+	s.skipSpace()
+	if s.pos < len(s.data) {
+		return "", "", s.syntaxError("unexpected data after the item")
+	}
+	if len(s.collection) == 0 || len(s.key) == 0 {
+		return "", "", errors.New("item has no collection or key")
+	}
+	collection, err := unquoteScanned(s.collection)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := unquoteScanned(s.key)
+	if err != nil {
+		return "", "", err
+	}
+	return collection, key, nil
+}
+
+// Validates that a line is a JSON object, of any shape.
+func scanObject(line []byte) error {
+	s := &jsonScanner{data: line}
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] != '{' {
+		return s.syntaxError("expected an object")
+	}
+	if err := s.value(0, scanOther); err != nil {
+		return err
+	}
+	s.skipSpace()
+	if s.pos < len(s.data) {
+		return s.syntaxError("unexpected data after the object")
+	}
+	return nil
+}
+
+func unquoteScanned(raw []byte) (string, error) {
+	if raw[0] != '"' {
+		return string(raw), nil
+	}
+	var s string
+	err := json.Unmarshal(raw, &s)
+	return s, err
+}
+
+func (s *jsonScanner) syntaxError(msg string) error {
+	if s.pos >= len(s.data) {
+		return fmt.Errorf("unexpected end of JSON, %v", msg)
+	}
+	return fmt.Errorf("invalid character %q at offset %v, %v", s.data[s.pos], s.pos, msg)
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *jsonScanner) value(depth, role int) error {
+	if depth > maxScanDepth {
+		return errors.New("JSON nested too deeply")
+	}
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return s.syntaxError("expected a value")
+	}
+	switch c := s.data[s.pos]; {
+	case c == '{':
+		return s.object(depth, role)
+	case c == '[':
+		return s.array(depth)
+	case c == '"':
+		_, _, err := s.str()
+		return err
+	case c == '-' || (c >= '0' && c <= '9'):
+		return s.number()
+	case c == 't':
+		return s.literal("true")
+	case c == 'f':
+		return s.literal("false")
+	case c == 'n':
+		return s.literal("null")
+	}
+	return s.syntaxError("expected a value")
+}
+
+func (s *jsonScanner) object(depth, role int) error {
+	s.pos++ // {
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		s.skipSpace()
+		if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+			return s.syntaxError("expected a member name")
+		}
+		name, _, err := s.str()
+		if err != nil {
+			return err
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) || s.data[s.pos] != ':' {
+			return s.syntaxError("expected a colon")
+		}
+		s.pos++
+		s.skipSpace()
+
+		child := scanOther
+		var capture *[]byte
+		switch {
+		case role == scanItem && string(name) == "path":
+			child = scanPath
+		case role == scanPath && string(name) == "collection":
+			capture = &s.collection
+		case role == scanPath && string(name) == "key":
+			capture = &s.key
+		}
+		if capture != nil && s.pos < len(s.data) && s.data[s.pos] == '"' {
+			start := s.pos
+			value, escaped, err := s.str()
+			if err != nil {
+				return err
+			}
+			if escaped {
+				value = s.data[start:s.pos]
+			}
+			*capture = value
+		} else if err := s.value(depth+1, child); err != nil {
+			return err
+		}
+
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return s.syntaxError("expected a comma or closing brace")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.syntaxError("expected a comma or closing brace")
+		}
+	}
+}
+
+func (s *jsonScanner) array(depth int) error {
+	s.pos++ // [
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == ']' {
+		s.pos++
+		return nil
+	}
+	for {
+		if err := s.value(depth+1, scanOther); err != nil {
+			return err
+		}
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return s.syntaxError("expected a comma or closing bracket")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+		case ']':
+			s.pos++
+			return nil
+		default:
+			return s.syntaxError("expected a comma or closing bracket")
+		}
+	}
+}
+
+// Scans a string, returning its contents without the quotes and whether it
+// contains escape sequences.
+func (s *jsonScanner) str() ([]byte, bool, error) {
+	s.pos++ // "
+	start := s.pos
+	escaped := false
+	for {
+		// Jump straight to the next byte that needs a closer look.
+		i := bytes.IndexAny(s.data[s.pos:], "\"\\")
+		if i < 0 {
+			s.pos = len(s.data)
+			return nil, false, s.syntaxError("unterminated string")
+		}
+		for j, c := range s.data[s.pos : s.pos+i] {
+			if c < 0x20 {
+				s.pos += j
+				return nil, false, s.syntaxError("control character in string")
+			}
+		}
+		s.pos += i
+		if s.data[s.pos] == '"' {
+			s.pos++
+			return s.data[start : s.pos-1], escaped, nil
+		}
+
+		escaped = true
+		s.pos++ // backslash
+		if s.pos >= len(s.data) {
+			return nil, false, s.syntaxError("unterminated string")
+		}
+		switch s.data[s.pos] {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			s.pos++
+		case 'u':
+			s.pos++
+			for n := 0; n < 4; n++ {
+				if s.pos >= len(s.data) || !isHexDigit(s.data[s.pos]) {
+					return nil, false, s.syntaxError("invalid unicode escape")
+				}
+				s.pos++
+			}
+		default:
+			return nil, false, s.syntaxError("invalid escape")
+		}
+	}
+}
+
+func (s *jsonScanner) number() error {
+	if s.data[s.pos] == '-' {
+		s.pos++
+	}
+	switch {
+	case s.pos < len(s.data) && s.data[s.pos] == '0':
+		s.pos++
+	case s.pos < len(s.data) && s.data[s.pos] >= '1' && s.data[s.pos] <= '9':
+		s.digits()
+	default:
+		return s.syntaxError("invalid number")
+	}
+	if s.pos < len(s.data) && s.data[s.pos] == '.' {
+		s.pos++
+		if s.digits() == 0 {
+			return s.syntaxError("invalid number")
+		}
+	}
+	if s.pos < len(s.data) && (s.data[s.pos] == 'e' || s.data[s.pos] == 'E') {
+		s.pos++
+		if s.pos < len(s.data) && (s.data[s.pos] == '+' || s.data[s.pos] == '-') {
+			s.pos++
+		}
+		if s.digits() == 0 {
+			return s.syntaxError("invalid number")
+		}
+	}
+	return nil
+}
+
+func (s *jsonScanner) digits() int {
+	start := s.pos
+	for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+		s.pos++
+	}
+	return s.pos - start
+}
+
+func (s *jsonScanner) literal(word string) error {
+	if !bytes.HasPrefix(s.data[s.pos:], []byte(word)) {
+		return s.syntaxError("invalid literal")
+	}
+	s.pos += len(word)
+	return nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+var (
+	schemaFile       = flag.String("schema", "", "a JSON Schema every record's document is checked against before it's sent, supporting type, enum, const, properties, required, additionalProperties, items, the length, size and range keywords, pattern, allOf, anyOf, oneOf, not and local $refs")
+	schemaViolations = flag.String("schema-violations", "skip", "what to do with records that don't match the -schema: skip logs and leaves them out, fail stops the import at the first, dead-letter also writes them to the -dead-letter file")
+)
+
+// The compiled -schema, nil without one.
+var documentSchema *jsonSchema
+
+// How many records didn't match the -schema.
+var schemaViolationCount int64
+
+// A JSON Schema compiled for checking. Keywords it doesn't know are
+// ignored, as the spec has them be annotations.
+type jsonSchema struct {
+	// A schema of true or false, accepting everything or nothing.
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	minProperties        int
+	maxProperties        int
+
+	items    *jsonSchema
+	minItems int
+	maxItems int
+	unique   bool
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         float64
+
+	allOf, anyOf, oneOf []*jsonSchema
+	not                 *jsonSchema
+
+	// A $ref, resolved once the whole schema is compiled.
+	ref      string
+	resolved *jsonSchema
+}
+
+func setupSchema() error {
+	switch *schemaViolations {
+	case "skip", "fail":
+	case "dead-letter":
+		if !*deadLetter && *schemaFile != "" {
+			return errors.New("-schema-violations dead-letter needs -dead-letter")
+		}
+	default:
+		return fmt.Errorf("unknown -schema-violations %q", *schemaViolations)
+	}
+	if *schemaFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*schemaFile)
+	if err != nil {
+		return err
+	}
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("%v: %v", *schemaFile, err)
+	}
+	c := &schemaCompiler{root: root, refs: make(map[string]*jsonSchema)}
+	schema, err := c.compile(root, "#")
+	if err == nil {
+		err = c.resolve()
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", *schemaFile, err)
+	}
+	documentSchema = schema
+	return nil
+}
+
+type schemaCompiler struct {
+	root interface{}
+	// The schemas $refs point to, by ref, and those still to resolve.
+	refs    map[string]*jsonSchema
+	pending []*jsonSchema
+}
+
+func (c *schemaCompiler) compile(v interface{}, at string) (*jsonSchema, error) {
+	s := &jsonSchema{minLength: 0, maxLength: -1, maxItems: -1, maxProperties: -1}
+	if b, ok := v.(bool); ok {
+		s.always = &b
+		return s, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: a schema should be an object or a boolean", at)
+	}
+
+	if ref, ok := m["$ref"].(string); ok {
+		s.ref = ref
+		c.pending = append(c.pending, s)
+		return s, nil
+	}
+	switch t := m["type"].(type) {
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, e := range t {
+			name, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v/type: types should be strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("%v/type: should be a string or an array of them", at)
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("%v/type: unknown type %q", at, t)
+		}
+	}
+	if e, ok := m["enum"].([]interface{}); ok {
+		s.enum = e
+	}
+	if constant, ok := m["const"]; ok {
+		s.constant = &constant
+	}
+
+	var err error
+	if props, ok := m["properties"].(map[string]interface{}); ok {
+		s.properties = make(map[string]*jsonSchema)
+		for name, p := range props {
+			if s.properties[name], err = c.compile(p, at+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if required, ok := m["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				s.required = append(s.required, name)
+			}
+		}
+	}
+	if additional, ok := m["additionalProperties"]; ok {
+		if s.additionalProperties, err = c.compile(additional, at+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if items, ok := m["items"]; ok {
+		if s.items, err = c.compile(items, at+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	if u, ok := m["uniqueItems"].(bool); ok {
+		s.unique = u
+	}
+	if p, ok := m["pattern"].(string); ok {
+		if s.pattern, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("%v/pattern: %v", at, err)
+		}
+	}
+	for keyword, target := range map[string]*int{
+		"minLength": &s.minLength, "maxLength": &s.maxLength,
+		"minItems": &s.minItems, "maxItems": &s.maxItems,
+		"minProperties": &s.minProperties, "maxProperties": &s.maxProperties,
+	} {
+		if n, ok := m[keyword].(float64); ok {
+			*target = int(n)
+		}
+	}
+	for keyword, target := range map[string]**float64{
+		"minimum": &s.minimum, "maximum": &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum, "exclusiveMaximum": &s.exclusiveMaximum,
+	} {
+		if n, ok := m[keyword].(float64); ok {
+			*target = &n
+		}
+	}
+	if n, ok := m["multipleOf"].(float64); ok && n > 0 {
+		s.multipleOf = n
+	}
+	for keyword, target := range map[string]*[]*jsonSchema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		list, ok := m[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		for i, e := range list {
+			sub, err := c.compile(e, at+"/"+keyword+"/"+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			*target = append(*target, sub)
+		}
+	}
+	if not, ok := m["not"]; ok {
+		if s.not, err = c.compile(not, at+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Resolves the $refs, which may only point within the schema, as
+// "#/definitions/name" or "#/$defs/name".
+func (c *schemaCompiler) resolve() error {
+	for len(c.pending) > 0 {
+		s := c.pending[0]
+		c.pending = c.pending[1:]
+		if target := c.refs[s.ref]; target != nil {
+			s.resolved = target
+			continue
+		}
+		if !strings.HasPrefix(s.ref, "#") {
+			return fmt.Errorf("$ref %q: only refs within the schema are supported", s.ref)
+		}
+		v := c.root
+		for _, part := range strings.Split(strings.TrimPrefix(s.ref, "#"), "/")[1:] {
+			part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("$ref %q doesn't point to a schema", s.ref)
+			}
+			if v, ok = m[part]; !ok {
+				return fmt.Errorf("$ref %q doesn't point to a schema", s.ref)
+			}
+		}
+		target, err := c.compile(v, s.ref)
+		if err != nil {
+			return err
+		}
+		c.refs[s.ref] = target
+		s.resolved = target
+	}
+	return nil
+}
+
+// Checks a value against the schema, returning where and why it doesn't
+// match.
+func (s *jsonSchema) check(v interface{}, at string) error {
+	if s.resolved != nil {
+		return s.resolved.check(v, at)
+	}
+	if s.always != nil {
+		if !*s.always {
+			return fmt.Errorf("%v: not allowed", at)
+		}
+		return nil
+	}
+	if len(s.types) > 0 && !matchesType(v, s.types) {
+		return fmt.Errorf("%v: should be %v, not %v", at, strings.Join(s.types, " or "), jsonType(v))
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v: isn't one of the allowed values", at)
+		}
+	}
+	if s.constant != nil && !reflect.DeepEqual(*s.constant, v) {
+		return fmt.Errorf("%v: should be %v", at, *s.constant)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if err := s.checkObject(v, at); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.checkArray(v, at); err != nil {
+			return err
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		switch {
+		case n < s.minLength:
+			return fmt.Errorf("%v: should be at least %v characters", at, s.minLength)
+		case s.maxLength >= 0 && n > s.maxLength:
+			return fmt.Errorf("%v: should be at most %v characters", at, s.maxLength)
+		case s.pattern != nil && !s.pattern.MatchString(v):
+			return fmt.Errorf("%v: doesn't match %v", at, s.pattern)
+		}
+	case float64:
+		switch {
+		case s.minimum != nil && v < *s.minimum:
+			return fmt.Errorf("%v: should be at least %v", at, *s.minimum)
+		case s.maximum != nil && v > *s.maximum:
+			return fmt.Errorf("%v: should be at most %v", at, *s.maximum)
+		case s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum:
+			return fmt.Errorf("%v: should be more than %v", at, *s.exclusiveMinimum)
+		case s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum:
+			return fmt.Errorf("%v: should be less than %v", at, *s.exclusiveMaximum)
+		case s.multipleOf > 0 && math.Abs(math.Remainder(v, s.multipleOf)) > 1e-9:
+			return fmt.Errorf("%v: should be a multiple of %v", at, s.multipleOf)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.check(v, at); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.check(v, at) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%v: matches none of anyOf", at)
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.check(v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%v: matches %v of oneOf, not one", at, matched)
+		}
+	}
+	if s.not != nil && s.not.check(v, at) == nil {
+		return fmt.Errorf("%v: matches the schema it should not", at)
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkObject(v map[string]interface{}, at string) error {
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			return fmt.Errorf("%v: is missing %q", at, name)
+		}
+	}
+	switch {
+	case len(v) < s.minProperties:
+		return fmt.Errorf("%v: should have at least %v properties", at, s.minProperties)
+	case s.maxProperties >= 0 && len(v) > s.maxProperties:
+		return fmt.Errorf("%v: should have at most %v properties", at, s.maxProperties)
+	}
+	// In order, so the same record always reports the same violation.
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub := s.properties[name]
+		if sub == nil {
+			if sub = s.additionalProperties; sub == nil {
+				continue
+			}
+		}
+		if err := sub.check(v[name], at+"/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkArray(v []interface{}, at string) error {
+	switch {
+	case len(v) < s.minItems:
+		return fmt.Errorf("%v: should have at least %v items", at, s.minItems)
+	case s.maxItems >= 0 && len(v) > s.maxItems:
+		return fmt.Errorf("%v: should have at most %v items", at, s.maxItems)
+	}
+	if s.items != nil {
+		for i, e := range v {
+			if err := s.items.check(e, at+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	if s.unique {
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if reflect.DeepEqual(v[i], v[j]) {
+					return fmt.Errorf("%v: items %v and %v are the same", at, i, j)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchesType(v interface{}, types []string) bool {
+	actual := jsonType(v)
+	for _, t := range types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// The JSON Schema type of a decoded value, integer for whole numbers.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Checks a record's document against the -schema, reporting it as
+// -schema-violations says if it doesn't match.
+func checkSchema(line []byte, pos recordPos) bool {
+	if documentSchema == nil {
+		return true
+	}
+	var item map[string]interface{}
+	err := json.Unmarshal(line, &item)
+	if err == nil {
+		err = documentSchema.check(item["value"], "value")
+	}
+	if err == nil {
+		return true
+	}
+	atomic.AddInt64(&schemaViolationCount, 1)
+	if *schemaViolations == "fail" {
+		logCode(codeSchemaViolation, "Error: record at %v:%v doesn't match the -schema: %v, stopping as -schema-violations is fail", pos.file, pos.line, err)
+		os.Exit(1)
+	}
+	logCode(codeSchemaViolation, "Record at %v:%v doesn't match the -schema: %v", pos.file, pos.line, err)
+	if *schemaViolations == "dead-letter" {
+		deadLetters.writeRecord(line, pos, "doesn't match the -schema: "+err.Error())
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+var (
+	label      = flag.String("label", "", "a name for the version of the dataset being imported, such as v2025-06-01, recorded in the registry and -journal and compared with \"runs diff\"")
+	labelField = flag.String("label-field", "", "also stamp the -label onto every document in this field")
+)
+
+// How many of a collection's items a run imported.
+type collectionCount struct {
+	Imported int `json:"imported"`
+	Errors   int `json:"errors"`
+}
+
+func newLabelTransform() (transform, error) {
+	if *label == "" {
+		return nil, fmt.Errorf("-label-field needs a -label")
+	}
+	return func(item map[string]interface{}, pos recordPos) error {
+		if value := itemValue(item); value != nil {
+			value[*labelField] = *label
+		}
+		return nil
+	}, nil
+}
+
+// Works out the collection of each record of a batch, for the per
+// collection counts of a labeled run or -report-html.
+func batchCollections(b *batch) []string {
+	if *label == "" && *reportHTML == "" {
+		return nil
+	}
+	collections := make([]string, len(b.records))
+	for i := range b.records {
+		collections[i], _, _ = scanItemPath(b.Line(i))
+	}
+	return collections
+}
+
+// Adds a batch's outcome to the per collection counts.
+// Results are the server's per item results, nil when the status covers the
+// whole batch.
+func (r *runRecord) countCollections(b *batch, results []interface{}, succeeded bool) {
+	collections := batchCollections(b)
+	if r == nil || collections == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Collections == nil {
+		r.Collections = make(map[string]*collectionCount)
+	}
+	for i, collection := range collections {
+		count := r.Collections[collection]
+		if count == nil {
+			count = &collectionCount{}
+			r.Collections[collection] = count
+		}
+		ok := succeeded
+		if results != nil {
+			ok = false
+			if i < len(results) {
+				result, _ := results[i].(map[string]interface{})
+				ok = result["status"] == "success"
+			}
+		}
+		if ok {
+			count.Imported++
+		} else {
+			count.Errors++
+		}
+	}
+}
+
+// Finds the latest run with the given label, or the run with that ID.
+func findLabeledRun(runs []*runRecord, name string) (*runRecord, error) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Label == name || runs[i].ID == name {
+			return runs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no run labeled %v", name)
+}
+
+// Implements "orcbulkimport runs diff <label> <label>", comparing how many
+// items two labeled runs imported into each collection.
+func runsDiff(from, to string) {
+	runs, err := listRuns()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	a, err := findLabeledRun(runs, from)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	b, err := findLabeledRun(runs, to)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	var names []string
+	for name := range a.Collections {
+		names = append(names, name)
+	}
+	for name := range b.Collections {
+		if _, ok := a.Collections[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "COLLECTION\t%v\t%v\tCHANGE\n", from, to)
+	var totalA, totalB int
+	for _, name := range names {
+		var countA, countB int
+		if c := a.Collections[name]; c != nil {
+			countA = c.Imported
+		}
+		if c := b.Collections[name]; c != nil {
+			countB = c.Imported
+		}
+		totalA += countA
+		totalB += countB
+		fmt.Fprintf(w, "%v\t%v\t%v\t%+d\n", name, countA, countB, countB-countA)
+	}
+	fmt.Fprintf(w, "(total)\t%v\t%v\t%+d\n", totalA, totalB, totalB-totalA)
+	w.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logFormat = flag.String("log-format", "text", "text, or json for a line of JSON per event, with batch_sent, batch_acked, item_failure and file_done events carrying their file, positions and counts, and every other log line as a log event")
+
+// Whether -log-format json is on.
+var jsonLogs bool
+
+// One line of -log-format json.
+type logEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Code  eventCode `json:"code"`
+	// For log events, error, warning or info by the line's prefix, and the
+	// line itself.
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	Run    string `json:"run,omitempty"`
+	File   string `json:"file,omitempty"`
+	Batch  int    `json:"batch,omitempty"`
+	First  string `json:"first,omitempty"`
+	Last   string `json:"last,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+
+	Records  int         `json:"records,omitempty"`
+	Imported int         `json:"imported,omitempty"`
+	Errors   int         `json:"errors,omitempty"`
+	Attempt  int         `json:"attempt,omitempty"`
+	Error    interface{} `json:"error,omitempty"`
+}
+
+func setupLogFormat() error {
+	switch *logFormat {
+	case "text":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("unknown -log-format %q", *logFormat)
+	}
+	jsonLogs = true
+	log.SetFlags(0)
+	log.SetOutput(&jsonLogWriter{out: os.Stderr})
+	return nil
+}
+
+// Turns each log line into a log event.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (w *jsonLogWriter) Write(b []byte) (int, error) {
+	level, message := logLevel(strings.TrimRight(string(b), "\n"))
+	code := codeInfo
+	switch level {
+	case "error":
+		code = codeError
+	case "warning":
+		code = codeWarning
+	}
+	if err := w.write(logEvent{Event: "log", Code: code, Level: level, Message: message}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Returns a log line's level by its prefix, and the line without it.
+func logLevel(message string) (string, string) {
+	switch {
+	case strings.HasPrefix(message, "Error: "):
+		return "error", strings.TrimPrefix(message, "Error: ")
+	case strings.HasPrefix(message, "Warning: "):
+		return "warning", strings.TrimPrefix(message, "Warning: ")
+	}
+	return "info", message
+}
+
+func (w *jsonLogWriter) write(event logEvent) error {
+	event.Time = time.Now().UTC()
+	event.Run = runID
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.out.Write(append(line, '\n'))
+	return err
+}
+
+// Writes an event with -log-format json, doing nothing otherwise.
+func emit(event logEvent) {
+	if !jsonLogs {
+		return
+	}
+	if w, ok := log.Writer().(*jsonLogWriter); ok {
+		w.write(event)
+	}
+}
+
+// Fills in where a batch's records came from.
+func batchEvent(event string, code eventCode, b *batch) logEvent {
+	e := logEvent{Event: event, Code: code, Batch: b.seq, Records: len(b.records), Bytes: len(b.body)}
+	if len(b.records) > 0 {
+		first, last := b.records[0].pos, b.records[len(b.records)-1].pos
+		e.File = first.file
+		e.First = fmt.Sprintf("%v:%v", first.file, first.line)
+		e.Last = fmt.Sprintf("%v:%v", last.file, last.line)
+	}
+	return e
+}
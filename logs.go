@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	apacheCombinedPattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}|-) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+	// RFC 5424 and the older BSD (RFC 3164) syslog formats. Files written by
+	// syslog daemons usually have the priority stripped.
+	syslog5424Pattern = regexp.MustCompile(`^(?:<(\d{1,3})>)?1 (\S+) (\S+) (\S+) (\S+) (\S+) (-|(?:\[(?:[^\]"\\]|\\.|"(?:[^"\\]|\\.)*")*\])+) ?(.*)$`)
+	syslog3164Pattern = regexp.MustCompile(`^(?:<(\d{1,3})>)?([A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) (\S+) ([^:\[\s]+)?(?:\[([^\]]*)\])?: ?(.*)$`)
+
+	errUnrecognizedLine = errors.New("line does not match the log format")
+)
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Reads a log file one line at a time, parsing each line into an event
+// document with a RFC 3339 timestamp field.
+type logReader struct {
+	reader *bufio.Reader
+	parse  func(line string) (map[string]interface{}, error)
+	line   int
+}
+
+func newApacheReader(reader *bufio.Reader) recordReader {
+	return &logReader{reader: reader, parse: parseApacheCombined}
+}
+
+func newSyslogReader(reader *bufio.Reader) recordReader {
+	return &logReader{reader: reader, parse: parseSyslog}
+}
+
+func (r *logReader) ReadRecord() ([]byte, error) {
+	for {
+		line, err := r.reader.ReadString('\n')
+		if line == "" && err != nil {
+			return nil, err
+		}
+		r.line++
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		doc, err := r.parse(line)
+		if err == nil {
+			var record []byte
+			if record, err = newItem(doc); err == nil {
+				return record, nil
+			}
+		}
+		log.Printf("Skipping line %v: %v", r.line, err)
+	}
+}
+
+func (r *logReader) Source() (string, int) { return "", r.line }
+
+func parseApacheCombined(line string) (map[string]interface{}, error) {
+	m := apacheCombinedPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, errUnrecognizedLine
+	}
+
+	ts, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[4])
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{
+		"remote_host": m[1],
+		"timestamp":   ts.Format(time.RFC3339),
+		"request":     m[5],
+	}
+	setUnlessDash(doc, "ident", m[2])
+	setUnlessDash(doc, "user", m[3])
+	if parts := strings.Fields(m[5]); len(parts) == 3 {
+		doc["method"], doc["path"], doc["protocol"] = parts[0], parts[1], parts[2]
+	}
+	if status, err := strconv.Atoi(m[6]); err == nil {
+		doc["status"] = status
+	}
+	if size, err := strconv.ParseInt(m[7], 10, 64); err == nil {
+		doc["bytes"] = size
+	}
+	setUnlessDash(doc, "referer", m[8])
+	setUnlessDash(doc, "user_agent", m[9])
+	return doc, nil
+}
+
+func parseSyslog(line string) (map[string]interface{}, error) {
+	if m := syslog5424Pattern.FindStringSubmatch(line); m != nil {
+		ts, err := time.Parse(time.RFC3339Nano, m[2])
+		if err != nil {
+			return nil, err
+		}
+		doc := map[string]interface{}{
+			"timestamp": ts.Format(time.RFC3339Nano),
+			"message":   strings.TrimPrefix(m[8], "\ufeff"),
+		}
+		setPriority(doc, m[1])
+		setUnlessDash(doc, "hostname", m[3])
+		setUnlessDash(doc, "app_name", m[4])
+		setUnlessDash(doc, "proc_id", m[5])
+		setUnlessDash(doc, "msg_id", m[6])
+		setUnlessDash(doc, "structured_data", m[7])
+		return doc, nil
+	}
+
+	if m := syslog3164Pattern.FindStringSubmatch(line); m != nil {
+		ts, err := time.ParseInLocation(time.Stamp, m[2], time.Local)
+		if err != nil {
+			return nil, err
+		}
+
+		// BSD syslog timestamps have no year, assume the most recent one
+		// that doesn't put the event in the future.
+		now := time.Now()
+		ts = ts.AddDate(now.Year(), 0, 0)
+		if ts.After(now.Add(24 * time.Hour)) {
+			ts = ts.AddDate(-1, 0, 0)
+		}
+
+		doc := map[string]interface{}{
+			"timestamp": ts.Format(time.RFC3339),
+			"hostname":  m[3],
+			"message":   m[6],
+		}
+		setPriority(doc, m[1])
+		if m[4] != "" {
+			doc["app_name"] = m[4]
+		}
+		if m[5] != "" {
+			doc["proc_id"] = m[5]
+		}
+		return doc, nil
+	}
+
+	return nil, errUnrecognizedLine
+}
+
+func setPriority(doc map[string]interface{}, pri string) {
+	if p, err := strconv.Atoi(pri); err == nil && p < 192 {
+		doc["facility"] = p / 8
+		doc["severity"] = syslogSeverities[p%8]
+	}
+}
+
+func setUnlessDash(doc map[string]interface{}, field, value string) {
+	if value != "" && value != "-" {
+		doc[field] = value
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// An LZMA2 decoder for the blocks of .xz inputs. LZMA2 is a sequence of
+// chunks, each either stored or LZMA compressed, sharing a dictionary.
+
+type lzma2Decoder struct {
+	r    *xzCountingReader
+	dict lzDict
+	lzma *lzmaState
+
+	needDictReset bool
+	needProps     bool
+	packed        []byte
+}
+
+func newLZMA2Decoder(r *xzCountingReader, dictSize uint32) *lzma2Decoder {
+	return &lzma2Decoder{r: r, dict: lzDict{size: int(dictSize)}, needDictReset: true, needProps: true}
+}
+
+// Decodes the next chunk, returning nil at the end of the data.
+func (d *lzma2Decoder) chunk() ([]byte, error) {
+	control, err := d.r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if control == 0 {
+		return nil, nil
+	}
+	if control == 1 || control >= 0xe0 {
+		d.dict.reset()
+		d.needDictReset = false
+		d.needProps = true
+	} else if d.needDictReset {
+		return nil, errXZCorrupt
+	}
+	d.dict.out = d.dict.out[:0]
+
+	if control < 0x80 {
+		// Stored.
+		if control > 2 {
+			return nil, errXZCorrupt
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(d.r, size[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data, err := d.read(int(binary.BigEndian.Uint16(size[:])) + 1)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range data {
+			d.dict.put(b)
+		}
+		return d.dict.out, nil
+	}
+
+	var sizes [4]byte
+	if _, err := io.ReadFull(d.r, sizes[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	unpacked := int(control&0x1f)<<16 | int(binary.BigEndian.Uint16(sizes[:])) + 1
+	packed := int(binary.BigEndian.Uint16(sizes[2:])) + 1
+	reset := control >> 5 & 3
+	if reset >= 2 {
+		props, err := d.r.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if props >= 9*5*5 {
+			return nil, errXZCorrupt
+		}
+		lc, lp, pb := uint(props%9), uint(props/9%5), uint(props/45)
+		if lc+lp > 4 {
+			return nil, errXZCorrupt
+		}
+		d.lzma = newLZMAState(lc, lp, pb)
+		d.needProps = false
+	} else if d.needProps {
+		return nil, errXZCorrupt
+	} else if reset == 1 {
+		d.lzma.reset()
+	}
+
+	data, err := d.read(packed)
+	if err != nil {
+		return nil, err
+	}
+	var rc rangeDecoder
+	if err := rc.init(data); err != nil {
+		return nil, err
+	}
+	if err := d.lzma.decode(&rc, &d.dict, unpacked); err != nil {
+		return nil, err
+	}
+	if !rc.finished() {
+		return nil, errXZCorrupt
+	}
+	return d.dict.out, nil
+}
+
+func (d *lzma2Decoder) read(n int) ([]byte, error) {
+	if cap(d.packed) < n {
+		d.packed = make([]byte, n)
+	}
+	d.packed = d.packed[:n]
+	if _, err := io.ReadFull(d.r, d.packed); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return d.packed, nil
+}
+
+// The sliding dictionary matches copy from. It grows as data is decoded
+// up to its size, then wraps around.
+type lzDict struct {
+	buf   []byte
+	size  int
+	pos   int
+	full  bool
+	total int64
+	// What the current chunk has decoded.
+	out []byte
+}
+
+func (d *lzDict) reset() {
+	d.buf, d.pos, d.full, d.total = d.buf[:0], 0, false, 0
+}
+
+func (d *lzDict) put(b byte) {
+	if !d.full {
+		d.buf = append(d.buf, b)
+		if len(d.buf) == d.size {
+			d.full = true
+		}
+	} else {
+		d.buf[d.pos] = b
+		if d.pos++; d.pos == d.size {
+			d.pos = 0
+		}
+	}
+	d.total++
+	d.out = append(d.out, b)
+}
+
+// Returns the byte dist back from the end, or 0 before the start.
+func (d *lzDict) get(dist int) byte {
+	if !d.full {
+		if i := len(d.buf) - dist; i >= 0 {
+			return d.buf[i]
+		}
+		return 0
+	}
+	i := d.pos - dist
+	if i < 0 {
+		i += d.size
+	}
+	return d.buf[i]
+}
+
+func (d *lzDict) filled() int {
+	if d.full {
+		return d.size
+	}
+	return len(d.buf)
+}
+
+// The LZMA decoder's probabilities and state, which LZMA2 chunks carry on
+// or reset.
+type lzmaState struct {
+	lc, lp, pb uint
+
+	state int
+	reps  [4]uint32
+
+	isMatch    [12 << 4]uint16
+	isRep      [12]uint16
+	isRepG0    [12]uint16
+	isRepG1    [12]uint16
+	isRepG2    [12]uint16
+	isRep0Long [12 << 4]uint16
+	posSlot    [4][64]uint16
+	posSpecial [115]uint16
+	align      [16]uint16
+	matchLen   lzmaLengths
+	repLen     lzmaLengths
+	literal    []uint16
+}
+
+type lzmaLengths struct {
+	choice, choice2 uint16
+	low, mid        [16][8]uint16
+	high            [256]uint16
+}
+
+func newLZMAState(lc, lp, pb uint) *lzmaState {
+	s := &lzmaState{lc: lc, lp: lp, pb: pb, literal: make([]uint16, 0x300<<(lc+lp))}
+	s.reset()
+	return s
+}
+
+func (s *lzmaState) reset() {
+	s.state, s.reps = 0, [4]uint32{}
+	for _, probs := range [][]uint16{
+		s.isMatch[:], s.isRep[:], s.isRepG0[:], s.isRepG1[:], s.isRepG2[:], s.isRep0Long[:],
+		s.posSpecial[:], s.align[:], s.literal,
+	} {
+		initProbs(probs)
+	}
+	for i := range s.posSlot {
+		initProbs(s.posSlot[i][:])
+	}
+	for _, l := range []*lzmaLengths{&s.matchLen, &s.repLen} {
+		l.choice, l.choice2 = 1024, 1024
+		for i := range l.low {
+			initProbs(l.low[i][:])
+			initProbs(l.mid[i][:])
+		}
+		initProbs(l.high[:])
+	}
+}
+
+func initProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = 1024
+	}
+}
+
+// Decodes n bytes into the dictionary.
+func (s *lzmaState) decode(rc *rangeDecoder, d *lzDict, n int) error {
+	posMask := uint32(1)<<s.pb - 1
+	for n > 0 {
+		posState := uint32(d.total) & posMask
+		if rc.bit(&s.isMatch[s.state<<4|int(posState)]) == 0 {
+			s.literalByte(rc, d)
+			n--
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&s.isRep[s.state]) != 0 {
+			if d.filled() == 0 {
+				return errXZCorrupt
+			}
+			if rc.bit(&s.isRepG0[s.state]) == 0 {
+				if rc.bit(&s.isRep0Long[s.state<<4|int(posState)]) == 0 {
+					// A single byte from the last distance.
+					if s.state < 7 {
+						s.state = 9
+					} else {
+						s.state = 11
+					}
+					d.put(d.get(int(s.reps[0]) + 1))
+					n--
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&s.isRepG1[s.state]) == 0 {
+					dist = s.reps[1]
+				} else {
+					if rc.bit(&s.isRepG2[s.state]) == 0 {
+						dist = s.reps[2]
+					} else {
+						dist = s.reps[3]
+						s.reps[3] = s.reps[2]
+					}
+					s.reps[2] = s.reps[1]
+				}
+				s.reps[1], s.reps[0] = s.reps[0], dist
+			}
+			length = s.repLen.decode(rc, posState)
+			if s.state < 7 {
+				s.state = 8
+			} else {
+				s.state = 11
+			}
+		} else {
+			s.reps[3], s.reps[2], s.reps[1] = s.reps[2], s.reps[1], s.reps[0]
+			length = s.matchLen.decode(rc, posState)
+			if s.state < 7 {
+				s.state = 7
+			} else {
+				s.state = 10
+			}
+			s.reps[0] = s.distance(rc, length)
+		}
+
+		length += 2
+		if int(s.reps[0]) >= d.filled() || int(length) > n {
+			return errXZCorrupt
+		}
+		dist := int(s.reps[0]) + 1
+		for i := uint32(0); i < length; i++ {
+			d.put(d.get(dist))
+		}
+		n -= int(length)
+	}
+	if rc.bad {
+		return errXZCorrupt
+	}
+	return nil
+}
+
+func (s *lzmaState) literalByte(rc *rangeDecoder, d *lzDict) {
+	prev := uint32(d.get(1))
+	litState := (uint32(d.total)&(1<<s.lp-1))<<s.lc | prev>>(8-s.lc)
+	probs := s.literal[0x300*litState : 0x300*(litState+1)]
+
+	symbol := uint32(1)
+	if s.state >= 7 {
+		// After a match, the byte at the last distance guides decoding
+		// for as long as it agrees.
+		match := uint32(d.get(int(s.reps[0]) + 1))
+		for symbol < 0x100 {
+			matchBit := match >> 7 & 1
+			match <<= 1
+			b := rc.bit(&probs[(1+matchBit)<<8+symbol])
+			symbol = symbol<<1 | b
+			if b != matchBit {
+				break
+			}
+		}
+	}
+	for symbol < 0x100 {
+		symbol = symbol<<1 | rc.bit(&probs[symbol])
+	}
+	d.put(byte(symbol))
+
+	switch {
+	case s.state < 4:
+		s.state = 0
+	case s.state < 10:
+		s.state -= 3
+	default:
+		s.state -= 6
+	}
+}
+
+func (s *lzmaState) distance(rc *rangeDecoder, length uint32) uint32 {
+	lenState := length
+	if lenState > 3 {
+		lenState = 3
+	}
+	slot := rc.tree(s.posSlot[lenState][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	direct := uint(slot>>1 - 1)
+	dist := (2 | slot&1) << direct
+	if slot < 14 {
+		return dist + rc.reverseTree(s.posSpecial[dist-slot:], direct)
+	}
+	dist += rc.direct(direct-4) << 4
+	return dist + rc.reverseTree(s.align[:], 4)
+}
+
+func (l *lzmaLengths) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return rc.tree(l.low[posState][:], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 8 + rc.tree(l.mid[posState][:], 3)
+	}
+	return 16 + rc.tree(l.high[:], 8)
+}
+
+// LZMA's range decoder, over one chunk's compressed data.
+type rangeDecoder struct {
+	data []byte
+	pos  int
+	rng  uint32
+	code uint32
+	// Set if decoding ran past the data.
+	bad bool
+}
+
+func (rc *rangeDecoder) init(data []byte) error {
+	if len(data) < 5 || data[0] != 0 {
+		return errXZCorrupt
+	}
+	*rc = rangeDecoder{data: data, pos: 5, rng: 0xffffffff, code: binary.BigEndian.Uint32(data[1:])}
+	return nil
+}
+
+// Whether the chunk's data has all been used, as it should be at its end.
+func (rc *rangeDecoder) finished() bool {
+	return !rc.bad && rc.pos == len(rc.data) && rc.code == 0
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		rc.code <<= 8
+		if rc.pos < len(rc.data) {
+			rc.code |= uint32(rc.data[rc.pos])
+			rc.pos++
+		} else {
+			rc.bad = true
+		}
+	}
+}
+
+func (rc *rangeDecoder) bit(prob *uint16) uint32 {
+	bound := (rc.rng >> 11) * uint32(*prob)
+	var b uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*prob += (2048 - *prob) >> 5
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*prob -= *prob >> 5
+		b = 1
+	}
+	rc.normalize()
+	return b
+}
+
+func (rc *rangeDecoder) tree(probs []uint16, bits uint) uint32 {
+	m := uint32(1)
+	for i := uint(0); i < bits; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rc *rangeDecoder) reverseTree(probs []uint16, bits uint) uint32 {
+	m, symbol := uint32(1), uint32(0)
+	for i := uint(0); i < bits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		symbol |= b << i
+	}
+	return symbol
+}
+
+func (rc *rangeDecoder) direct(bits uint) uint32 {
+	var v uint32
+	for i := uint(0); i < bits; i++ {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - rc.code>>31
+		rc.code += rc.rng & t
+		rc.normalize()
+		v = v<<1 + t + 1
+	}
+	return v
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var documentExtensions = map[string]string{
+	".md":       "markdown",
+	".markdown": "markdown",
+	".html":     "html",
+	".htm":      "html",
+}
+
+// Walks a directory of Markdown and HTML files, importing each file as a
+// document made of its front-matter fields plus the body as "content". Files
+// are keyed by their path relative to the directory, without the extension.
+type documentReader struct {
+	root    string
+	files   []string
+	current string
+}
+
+// Lists the documents under root, which may also be a single file, and
+// returns their total size.
+func openDocuments(root string) (recordReader, int64, error) {
+	r := &documentReader{root: root}
+	var size int64
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := documentExtensions[strings.ToLower(filepath.Ext(path))]; ok {
+			r.files = append(r.files, path)
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Strings(r.files)
+	return r, size, nil
+}
+
+func (r *documentReader) ReadRecord() ([]byte, error) {
+	for len(r.files) > 0 {
+		path := r.files[0]
+		r.files = r.files[1:]
+		r.current = path
+
+		record, err := r.document(path)
+		if err != nil {
+			log.Printf("Skipping %v: %v", path, err)
+			continue
+		}
+		return record, nil
+	}
+	return nil, io.EOF
+}
+
+func (r *documentReader) Source() (string, int) { return r.current, 1 }
+
+func (r *documentReader) document(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, body, err := splitFrontMatter(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := documentExtensions[strings.ToLower(filepath.Ext(path))]
+	if kind == "html" {
+		addHTMLMetadata(doc, body)
+	}
+
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil || rel == "." {
+		rel = filepath.Base(path)
+	}
+	rel = filepath.ToSlash(rel)
+
+	doc["content"] = string(body)
+	doc["format"] = kind
+	doc["path"] = rel
+
+	if *keyField != "" {
+		return newItem(doc)
+	}
+	return newKeyedItem(strings.TrimSuffix(rel, filepath.Ext(rel)), doc)
+}
+
+// Separates a leading YAML front-matter block, delimited by --- lines, from
+// the rest of the file.
+func splitFrontMatter(data []byte) (map[string]interface{}, []byte, error) {
+	doc := make(map[string]interface{})
+
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	if !bytes.HasPrefix(data, []byte("---\n")) && !bytes.HasPrefix(data, []byte("---\r\n")) {
+		return doc, data, nil
+	}
+
+	rest := data[bytes.IndexByte(data, '\n')+1:]
+	end := bytes.Index(rest, []byte("\n---"))
+	if bytes.HasPrefix(rest, []byte("---")) {
+		end = -1
+	} else if end < 0 {
+		return doc, data, nil
+	}
+	front, body := rest[:end+1], rest[end+4:]
+	if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		body = body[i+1:]
+	} else {
+		body = nil
+	}
+
+	v, err := parseYAML(front)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fields, ok := v.(map[string]interface{}); ok {
+		doc = fields
+	}
+	return doc, body, nil
+}
+
+// Fills in a title and description from the page head when the front
+// matter didn't provide them.
+func addHTMLMetadata(doc map[string]interface{}, body []byte) {
+	if _, ok := doc["title"]; !ok {
+		if m := htmlTitlePattern.FindSubmatch(body); m != nil {
+			setNonEmpty(doc, "title", html.UnescapeString(string(m[1])))
+		}
+	}
+	if _, ok := doc["description"]; !ok {
+		setNonEmpty(doc, "description", htmlMetaTags(string(body))["description"])
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+var (
+	mergeStrategy       = flag.String("merge", "", "when inputs share keys, import only one record per key: newest-wins (by -merge-timestamp-field), first-wins or last-wins, in the order the inputs are given")
+	mergeTimestampField = flag.String("merge-timestamp-field", "", "the document field -merge newest-wins compares, an RFC 3339 time or seconds (or milliseconds) since the epoch")
+)
+
+// The record that won each key, found by setupMerge. When nil every record
+// is imported.
+var mergeWinners map[itemID]*mergeWinner
+
+type mergeWinner struct {
+	pos       recordPos
+	timestamp time.Time
+}
+
+// Reads all the inputs before the import to find the record that wins
+// each key, so the import can leave out the others whichever order they're
+// sent in. This holds every key in memory.
+func setupMerge(inputs []string) error {
+	switch *mergeStrategy {
+	case "":
+		if *mergeTimestampField != "" {
+			return errors.New("-merge-timestamp-field needs -merge newest-wins")
+		}
+		return nil
+	case "newest-wins":
+		if *mergeTimestampField == "" {
+			return errors.New("-merge newest-wins needs a -merge-timestamp-field")
+		}
+	case "first-wins", "last-wins":
+		if *mergeTimestampField != "" {
+			return fmt.Errorf("-merge %v doesn't compare a -merge-timestamp-field", *mergeStrategy)
+		}
+	default:
+		return fmt.Errorf("unknown -merge strategy %q", *mergeStrategy)
+	}
+	if formats[*format].documents && *keyField == "" {
+		return fmt.Errorf("-merge needs a -key-field, -format %v records otherwise get random keys", *format)
+	}
+	for _, name := range inputs {
+		if name == stdinName {
+			return errors.New("-merge can't read stdin twice, once to pick the winners and again to import them")
+		}
+	}
+
+	started := time.Now()
+	mergeWinners = make(map[itemID]*mergeWinner)
+	records, conflicts, untimed := 0, 0, 0
+	for _, name := range inputs {
+		reader, _, file, err := openRecords(name)
+		if err != nil {
+			return err
+		}
+		src, _ := reader.(recordSource)
+		for n := 1; ; n++ {
+			line, err := reader.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("%v: %v", name, err)
+			}
+			pos := recordPos{name, n}
+			if src != nil {
+				var source string
+				if source, pos.line = src.Source(); source != "" {
+					pos.file = source
+				}
+			}
+			collection, key, err := scanItemPath(line)
+			if err != nil {
+				// Left for the import to skip and report.
+				continue
+			}
+			if routed := collectionFor(pos.file); routed != "" {
+				collection = routed
+			}
+			records++
+
+			var timestamp time.Time
+			if *mergeStrategy == "newest-wins" {
+				if timestamp, err = mergeTimestamp(line); err != nil {
+					untimed++
+				}
+			}
+			id := itemID{collection, key}
+			winner := mergeWinners[id]
+			if winner == nil {
+				mergeWinners[id] = &mergeWinner{pos, timestamp}
+				continue
+			}
+			conflicts++
+			switch *mergeStrategy {
+			case "newest-wins":
+				// A tie goes to the later record, as with last-wins.
+				if !timestamp.Before(winner.timestamp) {
+					*winner = mergeWinner{pos, timestamp}
+				}
+			case "last-wins":
+				*winner = mergeWinner{pos, timestamp}
+			}
+		}
+		file.Close()
+	}
+
+	log.Printf("Merged %v records in %v: %v keys, %v records lose to another with the same key",
+		records, time.Since(started).Round(time.Millisecond), len(mergeWinners), conflicts)
+	if untimed > 0 {
+		log.Printf("Warning: %v records have no usable %v, they lose to any record with the same key that has one", untimed, *mergeTimestampField)
+	}
+	return nil
+}
+
+// Reports whether the record is the one its key's merge picked.
+func mergeWins(line []byte, pos recordPos) bool {
+	if mergeWinners == nil {
+		return true
+	}
+	collection, key, err := scanItemPath(line)
+	if err != nil {
+		return true
+	}
+	if routed := collectionFor(pos.file); routed != "" {
+		collection = routed
+	}
+	winner := mergeWinners[itemID{collection, key}]
+	// Keys the merge didn't see, such as random ones, can't conflict.
+	return winner == nil || winner.pos == pos
+}
+
+// Reads the -merge-timestamp-field of a record.
+func mergeTimestamp(line []byte) (time.Time, error) {
+	var item map[string]interface{}
+	if err := json.Unmarshal(line, &item); err != nil {
+		return time.Time{}, err
+	}
+	value := itemValue(item)
+	if value == nil {
+		return time.Time{}, errors.New("no value")
+	}
+	doc, field, ok := lookupField(value, *mergeTimestampField)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no %v", *mergeTimestampField)
+	}
+	switch v := doc[field].(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, nil
+		}
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			return epochTime(seconds), nil
+		}
+		return time.Time{}, fmt.Errorf("%v %q isn't a time", *mergeTimestampField, v)
+	case float64:
+		return epochTime(v), nil
+	}
+	return time.Time{}, fmt.Errorf("%v isn't a time", *mergeTimestampField)
+}
+
+// Converts seconds since the epoch, or milliseconds when the number is too
+// large to be seconds, to a time.
+func epochTime(v float64) time.Time {
+	if v > 1e11 {
+		v /= 1000
+	}
+	return time.Unix(0, int64(v*1e9))
+}
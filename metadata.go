@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	metadataFile      = flag.String("metadata", "", "before importing, restore the collection metadata saved in this file by \"orcbulkimport metadata save\"")
+	metadataEndpoints = flag.String("metadata-endpoints", "search-mapping=_mapping,aliases=_aliases", "the collection metadata metadata save and restore handle, as comma separated name=path pairs with the path under each collection")
+)
+
+// Collection metadata as saved by "orcbulkimport metadata save": for each
+// collection, the body of each metadata endpoint that has one.
+type savedMetadata struct {
+	Host        string                                `json:"host"`
+	Saved       time.Time                             `json:"saved"`
+	Collections map[string]map[string]json.RawMessage `json:"collections"`
+}
+
+type metadataEndpoint struct {
+	name, path string
+}
+
+func parseMetadataEndpoints() ([]metadataEndpoint, error) {
+	var endpoints []metadataEndpoint
+	for _, pair := range strings.Split(*metadataEndpoints, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("-metadata-endpoints: %q isn't name=path", pair)
+		}
+		endpoints = append(endpoints, metadataEndpoint{parts[0], strings.Trim(parts[1], "/")})
+	}
+	return endpoints, nil
+}
+
+// Implements "orcbulkimport metadata save <file> <collections>" and
+// "orcbulkimport metadata restore <file>", which copy the metadata of
+// collections, such as search mappings and aliases, that the documents
+// alone don't bring along.
+func metadataCommand(args []string) {
+	switch {
+	case len(args) >= 3 && args[0] == "save":
+	case len(args) == 2 && args[0] == "restore":
+	default:
+		log.Fatalf("Usage: orcbulkimport metadata [save <file> <collections> | restore <file>]")
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if args[0] == "restore" {
+		if err := restoreMetadata(args[1]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	saved, err := fetchMetadata(args[2:])
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	body, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(args[1], append(body, '\n'), 0644)
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// Reads the metadata of the collections. Endpoints the destination doesn't
+// have, which answer 404, are left out.
+func fetchMetadata(collections []string) (*savedMetadata, error) {
+	endpoints, err := parseMetadataEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	saved := &savedMetadata{Host: *host, Saved: time.Now().UTC(), Collections: make(map[string]map[string]json.RawMessage)}
+	for _, collection := range collections {
+		found := make(map[string]json.RawMessage)
+		var names []string
+		for _, endpoint := range endpoints {
+			var body json.RawMessage
+			_, err := jsonReply("GET", collection+"/"+endpoint.path, nil, 200, &body)
+			if bulk.StatusCode(err) == 404 {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%v %v: %v", collection, endpoint.name, err)
+			}
+			found[endpoint.name] = body
+			names = append(names, endpoint.name)
+		}
+		if len(names) == 0 {
+			log.Printf("The destination has no metadata for %v", collection)
+		} else {
+			log.Printf("Saved the %v of %v", strings.Join(names, ", "), collection)
+		}
+		saved.Collections[collection] = found
+	}
+	return saved, nil
+}
+
+// Puts the saved metadata back on each collection.
+func restoreMetadata(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	saved := &savedMetadata{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	endpoints, err := parseMetadataEndpoints()
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]string)
+	for _, endpoint := range endpoints {
+		paths[endpoint.name] = endpoint.path
+	}
+
+	var collections []string
+	for collection := range saved.Collections {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	for _, collection := range collections {
+		var names []string
+		for kind := range saved.Collections[collection] {
+			names = append(names, kind)
+		}
+		sort.Strings(names)
+		for _, kind := range names {
+			path, ok := paths[kind]
+			if !ok {
+				return fmt.Errorf("%v: no -metadata-endpoints path for %v", name, kind)
+			}
+			if err := putMetadata(collection+"/"+path, saved.Collections[collection][kind]); err != nil {
+				return fmt.Errorf("restoring %v %v: %v", collection, kind, err)
+			}
+		}
+		log.Printf("Restored the %v of %v", strings.Join(names, ", "), collection)
+	}
+	return nil
+}
+
+func putMetadata(path string, body json.RawMessage) error {
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := doRequest("PUT", path, headers, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return bulk.ParseError(resp)
+	}
+	return nil
+}
+
+// Restores the -metadata before the import, so documents are indexed with
+// the mappings they had.
+func setupMetadata() error {
+	if *metadataFile == "" {
+		return nil
+	}
+	switch {
+	case *shadow:
+		return errors.New("-shadow doesn't write the -metadata, leave it out")
+	case replay != nil:
+		return errors.New("-replay-responses can't restore the -metadata")
+	}
+	return restoreMetadata(*metadataFile)
+}
@@ -0,0 +1,9 @@
+//go:build !fips
+
+package main
+
+const fipsBuild = false
+
+func fipsEnabled() bool {
+	return false
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
-	"bufio"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"sync"
 	"time"
+
+	"github.com/moediddy/db/bulk"
+	"github.com/moediddy/db/bulkimport"
 )
 
 // For older go releases (specifically 1.2 and earlier) there is an issue with
@@ -26,195 +29,849 @@ import (
 import _ "crypto/sha512"
 
 var (
-	apiKey                = flag.String("key", "00000000-0000-0000-0000-000000000000", "the api key")
-	workerCount           = flag.Int("workers", 8, "the number of worker procs")
+	apiKey                = flag.String("key", "00000000-0000-0000-0000-000000000000", "the api key; $ORC_API_KEY or -key-file keep it out of ps and shell history")
+	workerCount           = flag.Int("workers", bulkimport.DefaultWorkers(resources.cpus), "the number of worker procs")
 	host                  = flag.String("host", "api.orchestrate.io", "the Orchestrate API host to use")
-	reqs                  = make(chan Request, 100)
 	dialTimeout           = 3 * time.Second
 	responseHeaderTimeout = 60 * time.Second
-	wg                    sync.WaitGroup
-	client                *http.Client
+	requestTimeout        = flag.Duration("request-timeout", 30*time.Second, "give up on a request after this long and send its batch again, 0 to wait forever")
+	slowRequestThreshold  = flag.Duration("slow-request-threshold", 10*time.Second, "log requests still running after this long, 0 to disable")
+	// The client requests are sent with. An import's batches go with the
+	// one its batchSender is given.
+	client *http.Client
 )
 
-type Request struct {
-	reader   io.Reader
-	respChan chan Response
+// A batch of export stream lines sent in a single request.
+type batch struct {
+	// The batch's number within its stream, from 1.
+	seq     int
+	body    []byte
+	records []batchRecord
+	// Set on the pieces of a batch split after a partial response.
+	part bool
+	// The app the batch goes to, with -tenant-field.
+	tenant *tenant
+	// The -batch-group its records are of.
+	group string
+	// The stream the importer is filling the batch for.
+	stream *streamState
+
+	// The body compressed against the -compression-dictionary or with
+	// -compress-requests, made once for every attempt at sending the batch.
+	encodeOnce sync.Once
+	encoded    []byte
+}
+
+// What is known about each record of a batch, in the order they were added.
+type batchRecord struct {
+	pos recordPos
+	// Where the record's line starts in the batch body.
+	offset int
+
+	// The "collection/key" and content hash, when -hash-store is in use.
+	id   string
+	hash string
+
+	// The record as read, for the -dead-letter file, if transforms changed it.
+	source []byte
+
+	// The app the record goes to, with -tenant-field.
+	tenant *tenant
+	// The record's -batch-group.
+	group string
+}
+
+// Describes the batch by where its records came from, for logging.
+func (b *batch) String() string {
+	if len(b.records) == 0 {
+		return "empty batch"
+	}
+	first, last := b.records[0].pos, b.records[len(b.records)-1].pos
+	if first.file != last.file {
+		return fmt.Sprintf("batch of %v records from %v:%v to %v:%v", len(b.records), first.file, first.line, last.file, last.line)
+	}
+	return fmt.Sprintf("batch of %v records from %v:%v-%v", len(b.records), first.file, first.line, last.line)
+}
+
+func (b *batch) add(line []byte, record batchRecord) {
+	record.offset = len(b.body)
+	b.body = append(b.body, line...)
+	b.records = append(b.records, record)
+}
+
+// Adds a record the importer has validated, noting in the -journal where
+// the stream moves on to another file.
+func (b *batch) Add(record bulkimport.Record) {
+	r, s := record.Meta.(batchRecord), b.stream
+	if file := r.pos.file; file != s.lastFile {
+		journal.write(journalEntry{Type: "file", Stream: s.name, File: file, Batch: s.batches + 1, Records: s.count})
+		s.lastFile = file
+	}
+	s.routed[r.tenant]++
+	s.count++
+	b.add(record.Line, r)
+}
+
+func (b *batch) Len() int {
+	return len(b.records)
+}
+
+// Numbers the batch once the importer queues it.
+func (b *batch) Seal(seq int) {
+	b.seq = seq
+	b.stream.batches = seq
+	watchdog.queued()
+}
+
+// Returns the line of the batch body holding record i.
+func (b *batch) Line(i int) []byte {
+	end := len(b.body)
+	if i+1 < len(b.records) {
+		end = b.records[i+1].offset
+	}
+	return b.body[b.records[i].offset:end]
+}
+
+// Splits the batch into its first n records and the rest.
+func (b *batch) Split(n int) (bulkimport.Batch, bulkimport.Batch) {
+	head := &batch{seq: b.seq, body: b.body[:b.records[n].offset], records: b.records[:n], part: true, tenant: b.tenant, group: b.group, stream: b.stream}
+	tail := &batch{seq: b.seq, part: true, tenant: b.tenant, group: b.group, stream: b.stream}
+	for _, record := range b.records[n:] {
+		end := len(b.body)
+		if i := len(tail.records) + n + 1; i < len(b.records) {
+			end = b.records[i].offset
+		}
+		tail.add(b.body[record.offset:end], record)
+	}
+	return head, tail
 }
 
-type Response struct {
-	body  map[string]interface{}
-	err   *error
-	eof   bool
-	total int
+// Subcommands, run as "orcbulkimport <command> [flags] [args]". Without one
+// the arguments are the files to import.
+var commands = map[string]func(args []string){
+	"codes":          codesCommand,
+	"compare":        compareCommand,
+	"copy":           copyCommand,
+	"delete":         deleteCommand,
+	"export":         exportCommand,
+	"inspect":        inspectCommand,
+	"repair":         repairCommand,
+	"metadata":       metadataCommand,
+	"runs":           runsCommand,
+	"sort":           sortCommand,
+	"split":          splitCommand,
+	"validate":       validateCommand,
+	"verify":         verifyCommand,
+	"verify-journal": verifyJournalCommand,
 }
 
 func main() {
-	flag.Parse()
+	args := os.Args[1:]
+	var command func(args []string)
+	if len(args) > 0 {
+		if command = commands[args[0]]; command != nil {
+			args = args[1:]
+		}
+	}
+	flag.CommandLine.Parse(args)
+	// Before anything else, the -profile and environment can set any flag.
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupLogFormat(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
 
-	client = &http.Client{Transport: &http.Transport{
-		MaxIdleConnsPerHost:   *workerCount,
-		ResponseHeaderTimeout: responseHeaderTimeout,
-		Dial: func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, dialTimeout)
-		},
-	}}
+	// Older go releases don't know about cgroup quotas.
+	if resources.cpus < runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(resources.cpus)
+	}
+
+	if command != nil {
+		command(flag.Args())
+		return
+	}
+	inputs, err := importInputs(flag.Args())
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	runImport(inputs)
+}
+
+// Imports the inputs, as orcbulkimport does without a command.
+func runImport(inputs []string) {
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupFormat(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupValidation(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupSchema(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupBatching(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupSmallFiles(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupReadAhead(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupCoalesce(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupBatchGroup(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupAtomic(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupCheckpoint(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupTenants(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupDryRun(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupCollections(inputs); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupMerge(inputs); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupTransforms(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupSinkProfile(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupHashes(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupPassthrough(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if *preview > 0 {
+		previewCommand(inputs)
+		return
+	}
+
+	if err := setupFaults(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupAdaptive(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupRateLimit(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupGovernor(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupProgress(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := startAdmin(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
 
-	startRequestHandlerPool()
+	if err := setupMode(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupHedging(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupChecksum(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupTrace(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupShadow(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupWatchdog(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := probeCapabilities(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	if *previewConflicts {
+		previewConflictsCommand(inputs)
+		return
+	}
+	if err := setupMetadata(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupDictionary(inputs); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if err := setupCompressRequests(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
 
-	for _, file := range flag.Args() {
-		wg.Add(1)
-		go func(file string) {
-			importFile(file)
-		}(file)
+	prewarmConnections()
+	measureShadowLatency()
+	importer, err := newImporter()
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	watchdog.waiting = importer.Queued
+	startRun(inputs)
+	startDeadLetters(inputs)
+	startReport()
+	startQuotaGuard(currentRun.inputSize())
+	startSlack()
+	if err := setupJournal(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	startShutdownHandler()
+	startWatchdog()
+
+	coalesced, single := coalesceInputs(inputs)
+	// Why the import stopped early, such as an invalid record with
+	// -invalid-records fail.
+	var importErr error
+	importAll := func() {
+		var streams []*bulkimport.Stream
+		if *concat {
+			streams = append(streams, concatStream(fmt.Sprintf("%v files", len(inputs)), inputs))
+		} else {
+			for _, names := range coalesced {
+				streams = append(streams, concatStream(coalescedName(names), names))
+			}
+			for _, file := range single {
+				streams = append(streams, fileStream(file))
+			}
+		}
+		// Stopping isn't an error, the import finishes as it would at the
+		// end of its inputs. Nor does one that failed: what was imported is
+		// saved for a resume before it exits.
+		if err := importer.Run(stopping, streams); err != nil && err != stopping.Err() {
+			importErr = err
+			stop()
+		}
 	}
 
-	wg.Wait()
-	close(reqs)
+	readers := len(coalesced) + len(single)
+	if *concat {
+		readers = 1
+	}
+	startStages(readers)
+	started := time.Now()
+	startProgress()
+	var soakErr error
+	if *soak > 0 {
+		soakErr = runSoak(importAll)
+	} else {
+		importAll()
+	}
+	finishProgress()
+
+	finishShadow(time.Since(started))
+	finishDictionary()
+	finishCompressRequests()
+	finishAdaptive()
+	finishGovernor()
+	logStages()
+	logHandshakes()
+	hashes.save()
+	checkpoints.save()
+	currentRun.finish()
+	writeReport(currentRun)
+	finishSlack(currentRun)
+	deadLetters.close()
+	closeArchives()
+	journal.close()
+	recorder.close()
+	finishDryRun()
+	if importErr != nil {
+		log.Fatalf("Error: %v\n", importErr)
+	}
+	if soakErr != nil {
+		log.Fatalf("Error: %v\n", soakErr)
+	}
+	exitIfStopped()
 }
 
 func hello(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprintln(res, "Hello, Orchestrate")
 }
 
-func startRequestHandlerPool() {
-	for i := 0; i < *workerCount; i++ {
-		go handleRequests(reqs)
+// Makes the importer that runs the import's pipeline, with its validating,
+// batching and sending, as the flags say.
+func newImporter() (*bulkimport.Importer, error) {
+	config := bulkimport.Config{
+		Workers:         senderCount(),
+		Validators:      *validateWorkers,
+		Retries:         *retries,
+		RetryBackoff:    *retryBackoff,
+		RetryMaxBackoff: *retryMaxBackoff,
+		Validate:        validateStream,
+		NewBatch:        newStreamBatch,
+		Send:            (&batchSender{client: client}).send,
+		Progress: bulkimport.ProgressFuncs{
+			OnChunkRead:      chunkRead,
+			OnChunkValidated: chunkValidated,
+			OnStreamRead:     streamRead,
+			OnBatchRetry:     batchRetry,
+			OnBatchDone:      batchDone,
+			OnStreamDone:     streamDone,
+		},
+	}
+	// A Config's 0 is its default, where the flags' is none.
+	if config.Retries == 0 {
+		config.Retries = -1
 	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = -1
+	}
+	if config.RetryMaxBackoff == 0 {
+		config.RetryMaxBackoff = -1
+	}
+	return bulkimport.New(config)
+}
+
+// What the import keeps about each of its streams, as the Stream's Meta.
+type streamState struct {
+	name     string
+	fileSize int64
+	// How far through the input reading has got, if that's known.
+	offset func() int64
+
+	// The records batched and the batches queued so far, the file the last
+	// record came from and how many records went to each tenant.
+	count, batches int
+	lastFile       string
+	routed         map[*tenant]int
+	// The records validation left out.
+	unchanged, exists, dropped, skipped, invalid, violations, resumed, merged int
+
+	// How the stream's batches went.
+	importCount, errorCount, unsent int
+}
+
+// Records are batched with others going to the same tenant, with
+// -tenant-field, and of the same -batch-group.
+type batchKey struct {
+	tenant *tenant
+	group  string
+}
+
+// The stream of an input's records.
+func fileStream(filename string) *bulkimport.Stream {
+	return newStream(filename, func() (recordReader, int64, io.Closer, error) {
+		return openRecords(filename)
+	})
+}
+
+// A stream of records, usually a single file, under the given name, opened
+// with open once the importer reads it.
+func newStream(name string, open func() (recordReader, int64, io.Closer, error)) *bulkimport.Stream {
+	state := &streamState{name: name, routed: make(map[*tenant]int)}
+	return &bulkimport.Stream{Name: name, Meta: state, Open: func() (bulkimport.Reader, error) {
+		records, fileSize, file, err := open()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Importing %v", name)
+		state.fileSize = fileSize
+		if input, ok := file.(inputOffset); ok && fileSize > 0 {
+			state.offset = input.Offset
+		}
+		progress.start(name, state.offset, fileSize)
+		return &streamReader{state: state, records: records, file: file}, nil
+	}}
 }
 
-func importFile(filename string) {
-	file, err := os.Open(filename)
+// Reads a stream's records for the importer, each with where it came from.
+type streamReader struct {
+	state   *streamState
+	records recordReader
+	file    io.Closer
+	n       int
+}
 
+func (r *streamReader) Read() (bulkimport.Record, error) {
+	line, err := r.records.ReadRecord()
 	if err != nil {
-		log.Printf("Error: %v\n", err)
-		return
+		return bulkimport.Record{}, err
 	}
-	defer file.Close()
+	r.n++
+	return bulkimport.Record{Line: line, Meta: recordPosition(r.state.name, r.n, r.records)}, nil
+}
 
-	stats, _ := file.Stat()
-	fileSize := stats.Size()
+func (r *streamReader) Close() error {
+	return r.file.Close()
+}
 
-	log.Printf("Importing %v", filename)
+// Whether the input is small enough to read whole, as -small-file-size
+// says.
+func (r *streamReader) ReadWhole() bool {
+	return isSmallFile(r.state.fileSize)
+}
 
-	reader := bufio.NewReaderSize(file, 1024*1024)
+func newStreamBatch(stream *bulkimport.Stream, key interface{}) bulkimport.Batch {
+	k := key.(batchKey)
+	return &batch{tenant: k.tenant, group: k.group, stream: stream.Meta.(*streamState)}
+}
 
-	var resps = make(chan Response, 100)
-	go handleResponses(filename, fileSize, resps)
+func chunkRead(stream *bulkimport.Stream, chunk bulkimport.Chunk) {
+	progress.readRecords(stream.Name, len(chunk.Records), false)
+	stages.read.add(len(chunk.Records), chunk.Bytes, chunk.Reading, chunk.Handoff)
+}
 
-	var pReader *io.PipeReader
-	var pWriter *io.PipeWriter
-	var i int
-	for i = 0; err == nil; i++ {
-		if i%250 == 0 {
-			if pWriter != nil {
-				pWriter.Close()
-			}
-			pReader, pWriter = io.Pipe()
-			reqs <- Request{pReader, resps}
-		}
+// Counts the records validation left out of a chunk, and writes its lines
+// for the -config pipeline's file sinks.
+func chunkValidated(stream *bulkimport.Stream, chunk *bulkimport.Chunk) {
+	s, result := stream.Meta.(*streamState), chunk.Meta.(validateResult)
+	s.unchanged += result.unchanged
+	s.exists += result.exists
+	s.dropped += result.dropped
+	s.skipped += result.skipped
+	s.invalid += result.invalid
+	s.violations += result.violations
+	s.resumed += result.resumed
+	s.merged += result.merged
+	writeArchived(result.archived)
+}
 
-		var line []byte
-		line, err = reader.ReadBytes('\n')
-		pWriter.Write(line)
+// Logs how reading a stream went once its batches are all queued.
+func streamRead(stream *bulkimport.Stream, err error) {
+	s, filename := stream.Meta.(*streamState), stream.Name
+	progress.readRecords(filename, 0, true)
+	if tenants != nil {
+		logTenants(filename, s.routed)
 	}
 
-	if pWriter != nil {
-		pWriter.Close()
+	// Any other error fails the stream, in streamDone.
+	switch err {
+	case io.EOF:
+	case context.Canceled:
+		log.Printf("Stopped reading %v", filename)
+	default:
+		log.Printf("Stopped reading %v at an error", filename)
 	}
 
-	if err != nil && err != io.EOF {
-		log.Panicf("Scanner error: %v\n", err)
+	if s.resumed > 0 {
+		log.Printf("Skipped %v records from %v the -checkpoint has as imported", s.resumed, filename)
+	}
+	if s.merged > 0 {
+		log.Printf("Skipped %v records from %v that lost the -merge to another with the same key", s.merged, filename)
+	}
+	if s.unchanged > 0 {
+		log.Printf("Skipped %v unchanged items from %v", s.unchanged, filename)
+	}
+	if s.dropped > 0 {
+		log.Printf("Dropped %v records from %v in transforms", s.dropped, filename)
 	}
+	if s.invalid > 0 {
+		log.Printf("Skipped %v invalid records from %v", s.invalid, filename)
+	}
+	if s.violations > 0 {
+		log.Printf("Skipped %v records from %v that don't match the -schema", s.violations, filename)
+	}
+	if s.exists > 0 {
+		log.Printf("Skipped %v items from %v that already exist", s.exists, filename)
+	}
+}
+
+// Sends the import's batches with its client.
+type batchSender struct {
+	client *http.Client
+}
 
-	resps <- Response{nil, nil, true, i-1}
+// Makes one attempt at sending a batch for the importer. The attempt runs
+// in the watchdog's context rather than ctx, so batches already being sent
+// when the import stops are finished.
+func (s *batchSender) send(ctx context.Context, info bulkimport.BatchInfo) (interface{}, int, error) {
+	b := info.Batch.(*batch)
+	quota.wait()
+	concurrency.acquire()
+	sent := batchEvent("batch_sent", codeBatchSent, b)
+	sent.Attempt = info.Attempt
+	emit(sent)
+	started := time.Now()
+	watchdog.sendingRequest(1)
+	body, err := s.sendBatch(b)
+	watchdog.sendingRequest(-1)
+	concurrency.release(time.Since(started), err)
+	governor.observe(started, err)
+	sizer.sent(len(b.body), time.Since(started), err)
+	stages.send.add(len(b.records), len(b.body), time.Since(started), started.Sub(info.Queued))
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, processedCount(body, len(b.records)), nil
 }
 
-func handleRequests(reqs chan Request) {
-	for req := range reqs {
-		var err error
+// Returns how many of a batch's items the server got to, from the length of
+// its results: a server that times out partway through a batch answers for
+// the items it did. A response without results covers the whole batch.
+func processedCount(body map[string]interface{}, size int) int {
+	results, ok := body["results"].([]interface{})
+	if !ok {
+		return size
+	}
+	return len(results)
+}
 
-		body := make(map[string]interface{})
+// Makes one attempt at sending a batch, or answers it from the
+// -replay-responses trace, the -shadow sink or for -dry-run.
+func (s *batchSender) sendBatch(b *batch) (map[string]interface{}, error) {
+	if replay != nil {
+		return replay.answer(b)
+	}
+	if *shadow {
+		return shadowPost(b), nil
+	}
+	if *dryRun {
+		return dryRunPost(b), nil
+	}
+	body, err := s.attemptBatch(b)
+	recorder.record(b, body, err)
+	return body, err
+}
 
-		if resp, err := jsonReply("POST", "", req.reader, 200, &body); err != nil {
-			log.Printf("Error %v %v\n", err, resp)
-			continue
-		}
+// Sends a batch, logging it if it's slow and giving up on it after
+// -request-timeout.
+func (s *batchSender) attemptBatch(b *batch) (map[string]interface{}, error) {
+	attempt := watchdog.context()
+	ctx := attempt
+	if *requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *requestTimeout)
+		defer cancel()
+	}
+	if *slowRequestThreshold > 0 {
+		started := time.Now()
+		slow := time.AfterFunc(*slowRequestThreshold, func() {
+			logCode(codeSlowRequest, "Slow request for %v, still waiting after %v", b, time.Since(started).Round(time.Millisecond))
+		})
+		defer slow.Stop()
+	}
 
-		req.respChan <- Response{body, &err, false, 0}
+	var body map[string]interface{}
+	var err error
+	if delay, ok := hedgeDelay(); ok {
+		body, err = hedgedPost(ctx, s.client, b, delay)
+	} else {
+		body, err = postBatch(ctx, s.client, b, nil)
+	}
+	if err != nil && sending.Err() != nil {
+		return nil, fmt.Errorf("abandoned %v on shutdown", b)
+	}
+	if err != nil && attempt.Err() != nil {
+		return nil, fmt.Errorf("gave up on %v, the import stalled", b)
 	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, bulkimport.ErrTimedOut
+	}
+	return body, err
 }
 
-func handleResponses(filename string, fileSize int64, resps chan Response) {
-	var importCount, errorCount, totalCount int
-	eof := false
+// Logs why a batch is being sent again.
+func batchRetry(info bulkimport.BatchInfo, err error, delay time.Duration) {
+	var partial *bulkimport.PartialError
+	switch {
+	case errors.As(err, &partial):
+		log.Printf("Server processed only %v of the %v, sending the rest again", partial.Processed, info.Batch)
+	case err == bulkimport.ErrTimedOut:
+		logCode(codeRetrying, "Request for %v timed out after %v, retrying", info.Batch, *requestTimeout)
+	default:
+		logCode(codeRetrying, "Error sending %v: %v, retrying in %v (%v of %v)", info.Batch, err, delay.Round(time.Millisecond), info.Retries, *retries)
+	}
+}
 
-	for resp := range resps {
-		if resp.eof {
-			eof = true
-			totalCount = resp.total
-		}
+// Counts, logs and journals how a batch went, and checkpoints the records
+// it imported.
+func batchDone(info bulkimport.BatchInfo, reply interface{}, err error) {
+	s, b := info.Stream.Meta.(*streamState), info.Batch.(*batch)
+	filename := s.name
+	watchdog.answered(!info.Partial)
+	if err == bulkimport.ErrUnsent {
+		// Neither imported nor failed, left for a resume.
+		s.unsent += len(b.records)
+		return
+	}
 
-		if resp.err != nil {
-			switch err := (*resp.err).(type) {
-			case OrchestrateError:
-				errorCount++
-				log.Printf("Error: %v", err)
-			}
-		}
+	var batchImported, batchErrors int
+	var journaled []journalItem
+	// Which of the batch's records the server says it imported, and
+	// whether any were.
+	var imported []bool
+	anyImported := false
+	if err != nil {
+		batchErrors += len(b.records)
+		logCode(errorCode(err), "Error: %v", err)
+		currentRun.countCollections(b, nil, false)
+		report.error(err, len(b.records))
+		deadLetters.writeAll(b, err.Error())
+	}
 
-		if resp.body != nil {
+	if body, _ := reply.(map[string]interface{}); body != nil {
+		results, _ := body["results"].([]interface{})
+		imported = make([]bool, len(b.records))
 
-			if resp.body["status"] != "success" {
-				log.Printf("%v: %v", resp.body["status"], resp.body["message"])
+		if body["status"] != "success" {
+			log.Printf("%v: %v", body["status"], body["message"])
+		}
 
-				for _, result := range resp.body["results"].([]interface{}) {
-					resultMap := result.(map[string]interface{})
-					if resultMap["status"].(string) == "failure" {
-						log.Printf("Item failure: %v", resultMap["error"])
-						errorCount++
-					}
+		for i, result := range results {
+			resultMap, _ := result.(map[string]interface{})
+			switch resultMap["status"] {
+			case "failure":
+				if jsonLogs && i < len(b.records) {
+					pos := b.records[i].pos
+					emit(logEvent{Event: "item_failure", Code: codeItemFailed, Level: "error", File: pos.file, Line: pos.line, Batch: b.seq, Error: resultMap["error"]})
+				} else {
+					log.Printf("Item failure: %v", resultMap["error"])
+				}
+				report.error(resultMap["error"], 1)
+				deadLetters.write(b, i, resultMap["error"])
+				batchErrors++
+			case "success":
+				if i < len(b.records) {
+					imported[i], anyImported = true, true
+					hashes.commit(b.records[i])
+					journaled = journal.item(journaled, b, i, resultMap)
 				}
 			}
-
-			importCount += int(resp.body["success_count"].(float64))
 		}
-
-		if importCount%1000 == 0 {
-			log.Printf("Progress imported %v items from %v", importCount, filename)
+		if results == nil && body["status"] == "success" {
+			for i, record := range b.records {
+				imported[i], anyImported = true, true
+				hashes.commit(record)
+				journaled = journal.item(journaled, b, i, nil)
+			}
+		} else if results == nil {
+			// The server took none of the batch.
+			batchErrors += len(b.records)
+			report.error(body["message"], len(b.records))
+			deadLetters.writeAll(b, body["message"])
 		}
 
-		if eof && importCount >= totalCount - errorCount {
-			close(resps)
-		}
+		successCount, _ := body["success_count"].(float64)
+		batchImported = int(successCount)
+		currentRun.countCollections(b, results, body["status"] == "success")
+	}
+
+	if anyImported {
+		checkpoints.acknowledged(filename, b, imported)
+	}
+	report.batch(batchImported, batchErrors)
+	s.importCount += batchImported
+	s.errorCount += batchErrors
+	first, last := b.records[0].pos, b.records[len(b.records)-1].pos
+	entry := journalEntry{
+		Type:     "batch",
+		Stream:   filename,
+		Batch:    b.seq,
+		First:    fmt.Sprintf("%v:%v", first.file, first.line),
+		Last:     fmt.Sprintf("%v:%v", last.file, last.line),
+		Imported: batchImported,
+		Errors:   batchErrors,
+		Items:    journaled,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	journal.write(entry)
+
+	acked := batchEvent("batch_acked", codeBatchAcked, b)
+	acked.Imported, acked.Errors = batchImported, batchErrors
+	if err != nil {
+		acked.Error = entry.Error
+	}
+	if s.offset != nil {
+		acked.Offset = s.offset()
 	}
+	emit(acked)
 
-	log.Printf("Done importing %v items from %v (with %v errors)", importCount, filename, errorCount)
+	progress.update(filename, s.importCount, s.errorCount)
+}
 
-	wg.Done()
+// Logs and records how a stream went once all its batches are done with,
+// or that it couldn't be opened.
+func streamDone(stream *bulkimport.Stream, err error) {
+	s, filename := stream.Meta.(*streamState), stream.Name
+	if err != nil {
+		// It couldn't be opened, or reading it failed after the records
+		// counted.
+		logCode(codeInputFailed, "Error: %v", err)
+		progress.finish(filename, s.importCount, s.errorCount)
+		currentRun.finishInput(filename, s.importCount, s.errorCount, s.count, err)
+		journal.write(journalEntry{Type: "file", Stream: filename, File: filename, Error: err.Error()})
+		finishStaged(filename, false)
+		return
+	}
+
+	if jsonLogs {
+		emit(logEvent{Event: "file_done", Code: codeFileDone, File: filename, Records: s.count, Imported: s.importCount, Errors: s.errorCount})
+	} else {
+		log.Printf("Done importing %v items from %v (with %v errors)", s.importCount, filename, s.errorCount)
+	}
+	if s.unsent > 0 {
+		log.Printf("Left %v records from %v unsent when stopping", s.unsent, filename)
+	}
+	progress.finish(filename, s.importCount, s.errorCount)
+	currentRun.finishInput(filename, s.importCount, s.errorCount, s.count, nil)
+	skipped := s.skipped + s.invalid + s.violations
+	finishStaged(filename, s.errorCount == 0 && skipped == 0 && s.importCount == s.count)
 }
 
 // Executes an HTTP request.
 func doRequest(
 	method, trailing string, headers map[string]string, body io.Reader,
 ) (*http.Response, error) {
-	url := "https://" + *host + "/v0/" + trailing
+	return doRequestContext(context.Background(), method, trailing, headers, body)
+}
+
+// Executes an HTTP request that is abandoned when ctx is done.
+func doRequestContext(
+	ctx context.Context, method, trailing string, headers map[string]string, body io.Reader,
+) (*http.Response, error) {
+	return doRequestWith(ctx, client, method, trailing, headers, body)
+}
+
+// Like doRequestContext, but sent with the given client.
+func doRequestWith(
+	ctx context.Context, client *http.Client, method, trailing string, headers map[string]string, body io.Reader,
+) (*http.Response, error) {
+	if err := limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	host, key := destination(ctx)
+	url := apiPath(host, trailing)
 
 	// Create the new Request.
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
 	// Ensure that the query gets the authToken as username.
-	req.SetBasicAuth(*apiKey, "")
+	req.SetBasicAuth(key, "")
 
 	// Add any headers that the client provided.
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
-	req.Header.Add("User-Agent", "orcbulkimport")
+	setAuditHeaders(req)
 
-	req.Header.Add("Content-Type", "application/orchestrate-export-stream+json")
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Add("Content-Type", "application/orchestrate-export-stream+json")
+	}
 
 	return client.Do(req)
 }
@@ -227,7 +884,21 @@ func doRequest(
 func jsonReply(
 	method, path string, body io.Reader, status int, value interface{},
 ) (*http.Response, error) {
-	resp, err := doRequest(method, path, nil, body)
+	return jsonReplyContext(context.Background(), method, path, nil, body, status, value)
+}
+
+// Like jsonReply, but abandoned when ctx is done and with extra headers.
+func jsonReplyContext(
+	ctx context.Context, method, path string, headers map[string]string, body io.Reader, status int, value interface{},
+) (*http.Response, error) {
+	return jsonReplyWith(ctx, client, method, path, headers, body, status, value)
+}
+
+// Like jsonReplyContext, but sent with the given client.
+func jsonReplyWith(
+	ctx context.Context, client *http.Client, method, path string, headers map[string]string, body io.Reader, status int, value interface{},
+) (*http.Response, error) {
+	resp, err := doRequestWith(ctx, client, method, path, headers, body)
 	if err != nil {
 		return nil, err
 	}
@@ -235,22 +906,28 @@ func jsonReply(
 
 	// Ensure that the returned status was expected.
 	if resp.StatusCode != status {
-		return nil, newError(resp)
+		return nil, bulk.ParseError(resp)
+	}
+
+	// Check the body against any digest the server sent before decoding it.
+	reader, err := verifyResponse(resp)
+	if err != nil {
+		return nil, err
 	}
 
 	// See what kind of encoding the server is replying with.
 	var decoder *json.Decoder
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
-		gzipReader, err := gzip.NewReader(resp.Body)
+		gzipReader, err := gzip.NewReader(reader)
 		if err != nil {
 			return nil, err
 		}
 		decoder = json.NewDecoder(gzipReader)
 	case "deflate":
-		decoder = json.NewDecoder(flate.NewReader(resp.Body))
+		decoder = json.NewDecoder(flate.NewReader(reader))
 	default:
-		decoder = json.NewDecoder(resp.Body)
+		decoder = json.NewDecoder(reader)
 	}
 
 	// Decode the body into a json object.
@@ -261,38 +938,3 @@ func jsonReply(
 	// Success!
 	return resp, nil
 }
-
-func newError(resp *http.Response) error {
-	// We need to ensure that the body is read no matter what otherwise
-	// connections won't be reused.
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-	oe := &OrchestrateError{
-		Status:     resp.Status,
-		StatusCode: resp.StatusCode,
-	}
-	if err := json.Unmarshal(body, oe); err != nil {
-		oe.Message = string(body)
-		return oe
-	}
-
-	return oe
-}
-
-type OrchestrateError struct {
-	// The status string returned from the HTTP call.
-	Status string `json:"-"`
-
-	// The status, as an integer, returned from the HTTP call.
-	StatusCode int `json:"-"`
-
-	// The Orchestrate specific message representing the error.
-	Message string `json:"message"`
-}
-
-// Convert the error to a meaningful string.
-func (e OrchestrateError) Error() string {
-	return fmt.Sprintf("%s (%d): %s", e.Status, e.StatusCode, e.Message)
-}
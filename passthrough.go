@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+var passthrough = flag.Bool("passthrough", false, "send every export stream line byte for byte as it was read, only checking it's an item: nothing is decoded, transformed or re-encoded, so flags that would change records can't be given")
+
+// Checks nothing set up would change the records -passthrough sends as read.
+func setupPassthrough() error {
+	if !*passthrough {
+		return nil
+	}
+	switch {
+	case *format != "json":
+		return fmt.Errorf("-passthrough sends export stream lines as they are, -format %v has to build them", *format)
+	case transforming():
+		return errors.New("-passthrough sends records untouched, leave out the transforms: -collection, -script, -provenance, -redaction-profile, -fix-encoding and the like")
+	case *enrichURL != "":
+		return errors.New("-passthrough sends records untouched, leave out -enrich-url")
+	case *schemaFile != "":
+		return errors.New("-passthrough doesn't decode records to check them against the -schema")
+	case *mergeStrategy != "":
+		return errors.New("-passthrough doesn't decode records to -merge them")
+	case *hashStore != "":
+		return errors.New("-passthrough doesn't decode records to hash them for the -hash-store")
+	case *tenantField != "":
+		return errors.New("-passthrough doesn't decode records to route them by -tenant-field")
+	case anyCreateOnly():
+		return errors.New("-passthrough sends every record, it can't look up existing keys for create-only")
+	}
+	return nil
+}
+
+// Validates a chunk of records for -passthrough, leaving the lines of the
+// items as they were read.
+func passthroughChunk(raws []rawRecord) (validateResult, error) {
+	var result validateResult
+	observeSchema(raws)
+	for _, raw := range raws {
+		if checkpoints.imported(raw.pos) {
+			result.resumed++
+			continue
+		}
+		collection, key, err := scanItemPath(raw.line)
+		valid, err := recordValid(raw, err)
+		if err != nil {
+			return result, err
+		}
+		if !valid {
+			result.invalid++
+			continue
+		}
+		if checkpoints.importedKey(nil, raw.line) {
+			result.resumed++
+			continue
+		}
+		record := batchRecord{pos: raw.pos}
+		if grouping != nil {
+			record.group = grouping(collection, key)
+		}
+		result.records = append(result.records, checkedRecord{raw.line, record})
+	}
+	return result, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A pipeline from the -config, routing each record through named stages
+// after the flag transforms. A stage transforms the record and either hands
+// it on to one or more stages, a copy to each, or ends at a sink:
+//
+//	pipeline:
+//	  start: scrub
+//	  stages:
+//	    scrub:
+//	      transforms: redact pii
+//	      to: migrate, archive
+//	    migrate:
+//	      sink: orchestrate
+//	    archive:
+//	      transforms: provenance
+//	      sink: file compliance/{input}.jsonl
+//
+// The orchestrate sink is the import itself, "orchestrate <profile>" sending
+// with one of the -config sink-profiles; records that don't reach it aren't
+// sent. A file sink appends the records to a file, {input} standing
+// for the name of the input they were read from.
+type pipelineConfig struct {
+	Start  string                    `json:"start"`
+	Stages map[string]*pipelineStage `json:"stages"`
+}
+
+type pipelineStage struct {
+	// "redact <profile>", "script <file>" or "provenance".
+	Transforms ruleList `json:"transforms"`
+	To         ruleList `json:"to"`
+	Sink       string   `json:"sink"`
+}
+
+// The pipeline set up from the -config, nil when there isn't one.
+var pipeline *pipelineNode
+
+type pipelineNode struct {
+	name       string
+	transforms []transform
+	next       []*pipelineNode
+	send       bool
+	file       string
+}
+
+// What a record became on its way through the pipeline.
+type pipelineOutput struct {
+	// The item to import, if it reached the orchestrate sink.
+	send map[string]interface{}
+	// Lines for the file sinks, written in input order as chunks are batched.
+	archived []archivedLine
+}
+
+type archivedLine struct {
+	path string
+	line []byte
+}
+
+// Builds the -config pipeline, checking every stage is reachable only once
+// along any path and that a record can't be imported twice.
+func setupPipeline() error {
+	p := config.Pipeline
+	if p == nil {
+		return nil
+	}
+	if p.Stages[p.Start] == nil {
+		return fmt.Errorf("pipeline: no start stage %q", p.Start)
+	}
+
+	nodes := make(map[string]*pipelineNode)
+	for name, stage := range p.Stages {
+		node := &pipelineNode{name: name}
+		for _, spec := range stage.Transforms {
+			t, err := newPipelineTransform(spec)
+			if err != nil {
+				return fmt.Errorf("pipeline stage %v: %v", name, err)
+			}
+			node.transforms = append(node.transforms, t)
+		}
+		switch fields := strings.Fields(stage.Sink); {
+		case len(stage.To) > 0 && stage.Sink != "":
+			return fmt.Errorf("pipeline stage %v: has both a sink and stages to go to", name)
+		case len(stage.To) > 0:
+		case len(fields) == 1 && fields[0] == "orchestrate":
+			node.send = true
+		case len(fields) == 2 && fields[0] == "orchestrate":
+			node.send = true
+			pipelineSinkProfile = fields[1]
+		case len(fields) == 2 && fields[0] == "file":
+			node.file = fields[1]
+		case stage.Sink == "":
+			return fmt.Errorf("pipeline stage %v: needs a sink or stages to go to", name)
+		default:
+			return fmt.Errorf("pipeline stage %v: unknown sink %q", name, stage.Sink)
+		}
+		nodes[name] = node
+	}
+	for name, stage := range p.Stages {
+		for _, to := range stage.To {
+			next := nodes[to]
+			if next == nil {
+				return fmt.Errorf("pipeline stage %v: no stage %q", name, to)
+			}
+			nodes[name].next = append(nodes[name].next, next)
+		}
+	}
+
+	sends, err := nodes[p.Start].countSends(nil)
+	if err != nil {
+		return err
+	}
+	if sends > 1 {
+		return errors.New("pipeline: records can reach the orchestrate sink more than once")
+	}
+	if sends == 0 {
+		log.Printf("Warning: the pipeline has no orchestrate sink, nothing will be imported")
+	}
+	pipeline = nodes[p.Start]
+	return nil
+}
+
+// Counts the paths from the node to the orchestrate sink, failing on cycles.
+func (n *pipelineNode) countSends(path []string) (int, error) {
+	for _, name := range path {
+		if name == n.name {
+			return 0, fmt.Errorf("pipeline: stage %v leads back to itself", n.name)
+		}
+	}
+	sends := 0
+	if n.send {
+		sends++
+	}
+	for _, next := range n.next {
+		count, err := next.countSends(append(path, n.name))
+		if err != nil {
+			return 0, err
+		}
+		sends += count
+	}
+	return sends, nil
+}
+
+func newPipelineTransform(spec string) (transform, error) {
+	fields := strings.Fields(spec)
+	switch {
+	case len(fields) == 2 && fields[0] == "redact":
+		return newRedactionTransform(fields[1])
+	case len(fields) == 2 && fields[0] == "script":
+		return newScriptTransform(fields[1])
+	case len(fields) == 1 && fields[0] == "provenance":
+		return addProvenance, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q", spec)
+}
+
+// Runs an item through the node and the stages after it. A transform
+// dropping the record only ends the branch it's on.
+func (n *pipelineNode) run(item map[string]interface{}, pos recordPos, out *pipelineOutput) error {
+	for _, t := range n.transforms {
+		if err := t(item, pos); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case n.send:
+		if *atomicPerFile {
+			if err := stageItem(item, pos); err != nil {
+				return err
+			}
+		}
+		out.send = item
+	case n.file != "":
+		line, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		path := strings.Replace(n.file, "{input}", filepath.Base(localName(pos.file)), -1)
+		out.archived = append(out.archived, archivedLine{path, append(line, '\n')})
+	}
+
+	for i, next := range n.next {
+		branch := item
+		if i < len(n.next)-1 {
+			branch = copyValue(item).(map[string]interface{})
+		}
+		if err := next.run(branch, pos, out); err != nil && err != errDropRecord {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the maps and slices of a decoded JSON value.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyValue(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyValue(e)
+		}
+		return c
+	}
+	return v
+}
+
+// The open file sinks, by path.
+var archives = struct {
+	sync.Mutex
+	files map[string]*archiveFile
+}{files: make(map[string]*archiveFile)}
+
+type archiveFile struct {
+	file    *os.File
+	writer  *bufio.Writer
+	records int
+}
+
+// Appends lines to their file sinks, except on a -shadow run.
+func writeArchived(lines []archivedLine) {
+	if len(lines) == 0 || *shadow {
+		return
+	}
+	archives.Lock()
+	defer archives.Unlock()
+	for _, l := range lines {
+		f := archives.files[l.path]
+		if f == nil {
+			if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+				log.Fatalf("Error: pipeline file sink: %v", err)
+			}
+			file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatalf("Error: pipeline file sink: %v", err)
+			}
+			f = &archiveFile{file: file, writer: bufio.NewWriter(file)}
+			archives.files[l.path] = f
+		}
+		if _, err := f.writer.Write(l.line); err != nil {
+			log.Fatalf("Error: pipeline file sink %v: %v", l.path, err)
+		}
+		f.records++
+	}
+}
+
+func closeArchives() {
+	archives.Lock()
+	defer archives.Unlock()
+	for path, f := range archives.files {
+		err := f.writer.Flush()
+		if closeErr := f.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Printf("Error writing %v: %v", path, err)
+			continue
+		}
+		log.Printf("Wrote %v records to %v", f.records, path)
+	}
+}
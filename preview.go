@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/url"
+	"sort"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	preview          = flag.Int("preview", 0, "instead of importing, run the first n records through the transforms and print the items they'd be sent as, with their collections and keys, sending nothing")
+	previewRandom    = flag.Bool("preview-random", false, "-preview a random sample of the inputs' records instead of the first")
+	previewConflicts = flag.Bool("preview-conflicts", false, "instead of importing, report how many of the input's keys already exist on the destination and would be overwritten")
+	previewSample    = flag.Int("preview-sample", 1000, "how many random input keys -preview-conflicts looks up, 0 to page through the destination collections and check every key")
+)
+
+// At most this many of the keys found are listed as examples.
+const previewExamples = 10
+
+// Reads the inputs as they would be imported, after the transforms, and
+// reports how many of their keys the destination already has.
+func previewConflictsCommand(names []string) {
+	keys := make(map[string]map[string]bool)
+	var sample []itemID
+	total := 0
+	for _, name := range names {
+		records, _, file, err := openRecords(name)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		src, _ := records.(recordSource)
+		for n := 1; ; n++ {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading %v: %v", name, err)
+			}
+			pos := recordPos{name, n}
+			if src != nil {
+				if source, sourceLine := src.Source(); source != "" {
+					pos = recordPos{source, sourceLine}
+				}
+			}
+			if line, err = applyTransforms(line, pos); err != nil {
+				continue
+			}
+			collection, key, err := scanItemPath(line)
+			if err != nil {
+				continue
+			}
+
+			total++
+			id := itemID{collection, key}
+			if *previewSample == 0 {
+				if keys[collection] == nil {
+					keys[collection] = make(map[string]bool)
+				}
+				keys[collection][key] = true
+			} else if len(sample) < *previewSample {
+				sample = append(sample, id)
+			} else if i := rand.Intn(total); i < len(sample) {
+				sample[i] = id
+			}
+		}
+		file.Close()
+	}
+
+	var found []string
+	checked := 0
+	if *previewSample == 0 {
+		for collection, inCollection := range keys {
+			checked += len(inCollection)
+			err := listItems(*host, *apiKey, collection, false, func(key string, _ json.RawMessage) {
+				if inCollection[key] {
+					found = append(found, collection+"/"+key)
+				}
+			})
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+	} else {
+		checked = len(sample)
+		for _, id := range sample {
+			exists, err := keyExists(id)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if exists {
+				found = append(found, id.collection+"/"+id.key)
+			}
+		}
+	}
+	sort.Strings(found)
+
+	if checked == total {
+		fmt.Printf("%v of %v keys already exist on %v and would be replaced\n", len(found), total, *host)
+	} else {
+		estimate := 0
+		if checked > 0 {
+			estimate = len(found) * total / checked
+		}
+		fmt.Printf("%v of %v sampled keys already exist on %v, so about %v of the %v documents would be replaced\n",
+			len(found), checked, *host, estimate, total)
+	}
+	for i, id := range found {
+		if i == previewExamples {
+			fmt.Printf("  and %v more\n", len(found)-i)
+			break
+		}
+		fmt.Printf("  %v\n", id)
+	}
+}
+
+// A record read for -preview.
+type previewRecord struct {
+	line []byte
+	pos  recordPos
+	// The record's place in the inputs.
+	n int
+}
+
+// Runs -preview records through the transforms and -enrich-url as an import
+// would, printing each as it would be sent, or why it wouldn't be.
+func previewCommand(names []string) {
+	if *previewConflicts {
+		log.Fatalf("Error: -preview and -preview-conflicts can't both be set")
+	}
+	var sample []previewRecord
+	total := 0
+read:
+	for _, name := range names {
+		records, _, file, err := openRecords(name)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		src, _ := records.(recordSource)
+		for n := 1; ; n++ {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading %v: %v", name, err)
+			}
+			pos := recordPos{name, n}
+			if src != nil {
+				if source, sourceLine := src.Source(); source != "" {
+					pos = recordPos{source, sourceLine}
+				}
+			}
+			total++
+			record := previewRecord{append([]byte(nil), line...), pos, total}
+			switch {
+			case len(sample) < *preview:
+				sample = append(sample, record)
+			case !*previewRandom:
+				file.Close()
+				break read
+			default:
+				if i := rand.Intn(total); i < len(sample) {
+					sample[i] = record
+				}
+			}
+		}
+		file.Close()
+	}
+	if *previewRandom {
+		// In the order they were read.
+		sort.Slice(sample, func(i, j int) bool {
+			return sample[i].n < sample[j].n
+		})
+	}
+
+	for _, record := range sample {
+		fmt.Printf("%v:%v", record.pos.file, record.pos.line)
+		line, err := previewTransform(record)
+		if err != nil {
+			fmt.Printf(" not sent: %v\n\n", err)
+			continue
+		}
+		collection, key, err := scanItemPath(line)
+		if err != nil {
+			fmt.Printf(" invalid: %v\n%s\n", err, line)
+			continue
+		}
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, bytes.TrimSpace(line), "", "  ") != nil {
+			pretty.Reset()
+			pretty.Write(line)
+		}
+		fmt.Printf(" -> %v/%v\n%s\n\n", collection, key, bytes.TrimSpace(pretty.Bytes()))
+	}
+	if *previewRandom {
+		fmt.Printf("%v records sampled from %v\n", len(sample), total)
+	}
+}
+
+// Transforms and enriches a record for -preview.
+func previewTransform(record previewRecord) ([]byte, error) {
+	if err := scanObject(record.line); err != nil {
+		return nil, err
+	}
+	line, err := applyTransforms(record.line, record.pos)
+	if err == errDropRecord {
+		return nil, errors.New("dropped by the transforms")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *enrichURL != "" {
+		enriched, err := enrich([][]byte{line})
+		if err != nil {
+			return nil, err
+		}
+		line = enriched[0]
+	}
+	return line, nil
+}
+
+type itemID struct {
+	collection, key string
+}
+
+// Looks up an item on the destination.
+func keyExists(id itemID) (bool, error) {
+	resp, err := doRequest("GET", url.PathEscape(id.collection)+"/"+url.PathEscape(id.key), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		io.Copy(ioutil.Discard, resp.Body)
+		return true, nil
+	case 404:
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	return false, fmt.Errorf("checking %v/%v: %v", id.collection, id.key, bulk.ParseError(resp))
+}
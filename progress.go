@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	progressMode     = flag.String("progress", "auto", "how to show progress: bar redraws a line on the terminal, log logs a line per input every -progress-interval, auto picks bar when stderr is a terminal and log otherwise")
+	progressInterval = flag.Duration("progress-interval", 10*time.Second, "how often -progress log reports each input")
+	quiet            = flag.Bool("quiet", false, "show no progress and no summary table, only what goes wrong")
+)
+
+// Tracks each input's progress for the display and the final summary.
+var progress = &progressTracker{inputs: make(map[string]*inputProgress)}
+
+type progressTracker struct {
+	mu     sync.Mutex
+	inputs map[string]*inputProgress
+	order  []string
+	bar    bool
+	// The width of the bar line last drawn, erased before anything else is
+	// written to the terminal.
+	drawn int
+	stop  chan struct{}
+}
+
+type inputProgress struct {
+	name     string
+	size     int64
+	offset   func() int64
+	read     int64
+	records  int
+	readAll  bool
+	imported int
+	errors   int
+	started  time.Time
+	finished time.Time
+}
+
+func setupProgress() error {
+	switch *progressMode {
+	case "auto":
+		stats, err := os.Stderr.Stat()
+		progress.bar = err == nil && stats.Mode()&os.ModeCharDevice != 0 && !jsonLogs
+	case "bar":
+		if jsonLogs {
+			return errors.New("-progress bar can't be drawn among -log-format json lines")
+		}
+		progress.bar = true
+	case "log":
+	default:
+		return fmt.Errorf("unknown -progress %q", *progressMode)
+	}
+	if *progressInterval <= 0 {
+		return errors.New("-progress-interval must be positive")
+	}
+	return nil
+}
+
+// Starts redrawing the bar or logging progress.
+func startProgress() {
+	// With -log-format json the progress is in the batch_acked events.
+	if *quiet || jsonLogs {
+		return
+	}
+	progress.stop = make(chan struct{})
+	interval := *progressInterval
+	if progress.bar {
+		log.SetOutput(progressWriter{os.Stderr})
+		interval = 250 * time.Millisecond
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if progress.bar {
+					progress.draw()
+				} else {
+					progress.logInputs()
+				}
+			case <-progress.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Starts tracking an input. The offset, if there is one, gives how much of
+// the size has been read.
+func (p *progressTracker) start(name string, offset func() int64, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inputs[name] == nil {
+		p.order = append(p.order, name)
+	}
+	p.inputs[name] = &inputProgress{name: name, size: size, offset: offset, started: time.Now()}
+}
+
+func (p *progressTracker) update(name string, imported, errors int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if input := p.inputs[name]; input != nil {
+		input.imported, input.errors = imported, errors
+	}
+}
+
+// Counts records read from the input, ahead of their being imported, and
+// whether that's all of them.
+func (p *progressTracker) readRecords(name string, n int, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if input := p.inputs[name]; input != nil {
+		input.records += n
+		input.readAll = all
+	}
+}
+
+func (p *progressTracker) finish(name string, imported, errors int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if input := p.inputs[name]; input != nil {
+		input.imported, input.errors = imported, errors
+		input.finished = time.Now()
+		input.read = input.size
+		input.offset = nil
+	}
+}
+
+// How much of the input has been read, sampling the offset.
+func (input *inputProgress) readBytes() int64 {
+	if input.offset != nil {
+		input.read = input.offset()
+	}
+	return input.read
+}
+
+func (input *inputProgress) elapsed() time.Duration {
+	if !input.finished.IsZero() {
+		return input.finished.Sub(input.started)
+	}
+	return time.Since(input.started)
+}
+
+// How much of the input has been imported: the share of the records read
+// that have been answered for, scaled until they've all been read by the
+// share of the input read, since reading runs ahead of sending.
+func (input *inputProgress) fraction() float64 {
+	switch {
+	case !input.finished.IsZero():
+		return 1
+	case input.records == 0:
+		return 0
+	}
+	f := float64(input.imported+input.errors) / float64(input.records)
+	if !input.readAll {
+		if input.size <= 0 {
+			return 0
+		}
+		f *= float64(input.readBytes()) / float64(input.size)
+	}
+	return math.Min(f, 1)
+}
+
+// Estimates the time left from the fraction done so far.
+func eta(elapsed time.Duration, fraction float64) string {
+	if fraction <= 0 {
+		return "?"
+	}
+	return time.Duration(float64(elapsed) * (1 - fraction) / fraction).Round(time.Second).String()
+}
+
+// Logs a line for each input still being imported.
+func (p *progressTracker) logInputs() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range p.order {
+		input := p.inputs[name]
+		if !input.finished.IsZero() {
+			continue
+		}
+		elapsed := input.elapsed()
+		rate := float64(input.imported) / elapsed.Seconds()
+		if read := input.readBytes(); input.size > 0 {
+			log.Printf("Progress imported %v items from %v, %.0f%% of %v read, %.0f records/s, ETA %v%v",
+				input.imported, name, 100*float64(read)/float64(input.size), formatBytes(input.size), rate,
+				eta(elapsed, input.fraction()), limiter.progress())
+		} else {
+			log.Printf("Progress imported %v items from %v, %.0f records/s%v", input.imported, name, rate, limiter.progress())
+		}
+	}
+}
+
+// The bar line across all the inputs.
+func (p *progressTracker) line() string {
+	var read, size int64
+	var weighted float64
+	imported, errors, done := 0, 0, 0
+	var started time.Time
+	for _, name := range p.order {
+		input := p.inputs[name]
+		imported += input.imported
+		errors += input.errors
+		if !input.finished.IsZero() {
+			done++
+		}
+		if input.size > 0 {
+			read += input.readBytes()
+			size += input.size
+			weighted += input.fraction() * float64(input.size)
+		}
+		if started.IsZero() || input.started.Before(started) {
+			started = input.started
+		}
+	}
+	elapsed := time.Since(started)
+	const width = 30
+	fraction := 0.0
+	if size > 0 {
+		fraction = weighted / float64(size)
+	}
+	filled := int(fraction * width)
+	if filled > width {
+		filled = width
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	line := fmt.Sprintf("[%v] %3.0f%% %v/%v read, %.0f records/s, ETA %v, %v items, %v errors, %v of %v inputs done",
+		bar, 100*fraction, formatBytes(read), formatBytes(size), float64(imported)/elapsed.Seconds(),
+		eta(elapsed, fraction), imported, errors, done, len(p.order))
+	return line + limiter.progress()
+}
+
+// Redraws the bar in place.
+func (p *progressTracker) draw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.order) == 0 {
+		return
+	}
+	p.eraseLocked()
+	line := p.line()
+	fmt.Fprint(os.Stderr, line)
+	p.drawn = len(line)
+}
+
+func (p *progressTracker) eraseLocked() {
+	if p.drawn > 0 {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		p.drawn = 0
+	}
+}
+
+// Writes log lines above the bar, which is drawn again on the next tick.
+type progressWriter struct{ out io.Writer }
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.eraseLocked()
+	return w.out.Write(b)
+}
+
+// Stops the display and writes a table of how each input went.
+func finishProgress() {
+	if progress.stop == nil {
+		return
+	}
+	close(progress.stop)
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.eraseLocked()
+	log.SetOutput(os.Stderr)
+	if len(progress.order) == 0 {
+		return
+	}
+
+	names := append([]string(nil), progress.order...)
+	sort.Strings(names)
+	table := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "input\titems\terrors\tsize\ttime\trecords/s\tMB/s")
+	for _, name := range names {
+		input := progress.inputs[name]
+		elapsed := input.elapsed()
+		size, mbs := "?", "?"
+		if input.size > 0 {
+			size = formatBytes(input.size)
+			mbs = fmt.Sprintf("%.1f", float64(input.size)/(1<<20)/elapsed.Seconds())
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%.0f\t%v\n", name, input.imported, input.errors, size,
+			elapsed.Round(time.Millisecond), float64(input.imported)/elapsed.Seconds(), mbs)
+	}
+	table.Flush()
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	protoDescriptor = flag.String("proto-descriptor", "", "the FileDescriptorSet (protoc --descriptor_set_out) describing -format proto input")
+	protoMessage    = flag.String("proto-message", "", "the fully qualified message type of each -format proto record")
+
+	// The resolved -proto-message type, set up by setupProto.
+	protoMessageType *protoMessageDesc
+)
+
+// Field types and labels from google/protobuf/descriptor.proto.
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+var errProtoTruncated = errors.New("proto: truncated message")
+
+type protoMessageDesc struct {
+	name     string
+	fields   map[int]*protoFieldDesc
+	mapEntry bool
+}
+
+type protoFieldDesc struct {
+	name     string
+	jsonName string
+	number   int
+	label    int
+	typ      int
+	typeName string
+
+	// Resolved from typeName once every file has been read.
+	message *protoMessageDesc
+	enum    map[int32]string
+}
+
+// A table of every message and enum found in a descriptor set, keyed by
+// fully qualified name with a leading dot as used by type_name.
+type protoTypes struct {
+	messages map[string]*protoMessageDesc
+	enums    map[string]map[int32]string
+}
+
+func setupProto() error {
+	if *protoDescriptor == "" || *protoMessage == "" {
+		return errors.New("-format proto requires -proto-descriptor and -proto-message")
+	}
+
+	data, err := ioutil.ReadFile(*protoDescriptor)
+	if err != nil {
+		return err
+	}
+
+	types := &protoTypes{
+		messages: make(map[string]*protoMessageDesc),
+		enums:    make(map[string]map[int32]string),
+	}
+	err = protoFields(data, func(num, wt int, v uint64, b []byte) error {
+		if num == 1 && wt == 2 {
+			return types.addFile(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v: %v", *protoDescriptor, err)
+	}
+
+	for _, m := range types.messages {
+		for _, f := range m.fields {
+			switch f.typ {
+			case protoTypeMessage, protoTypeGroup:
+				if f.message = types.messages[f.typeName]; f.message == nil {
+					return fmt.Errorf("%v: unknown message type %v", *protoDescriptor, f.typeName)
+				}
+			case protoTypeEnum:
+				if f.enum = types.enums[f.typeName]; f.enum == nil {
+					return fmt.Errorf("%v: unknown enum type %v", *protoDescriptor, f.typeName)
+				}
+			}
+		}
+	}
+
+	name := "." + strings.TrimPrefix(*protoMessage, ".")
+	if protoMessageType = types.messages[name]; protoMessageType == nil {
+		return fmt.Errorf("%v: no message type %v", *protoDescriptor, *protoMessage)
+	}
+	return nil
+}
+
+// Parses a FileDescriptorProto.
+func (t *protoTypes) addFile(data []byte) error {
+	var pkg string
+	var messages, enums [][]byte
+	err := protoFields(data, func(num, wt int, v uint64, b []byte) error {
+		switch {
+		case num == 2 && wt == 2:
+			pkg = string(b)
+		case num == 4 && wt == 2:
+			messages = append(messages, b)
+		case num == 5 && wt == 2:
+			enums = append(enums, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	scope := ""
+	if pkg != "" {
+		scope = "." + pkg
+	}
+	for _, b := range messages {
+		if err := t.addMessage(scope, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err := t.addEnum(scope, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses a DescriptorProto along with any nested types.
+func (t *protoTypes) addMessage(scope string, data []byte) error {
+	m := &protoMessageDesc{fields: make(map[int]*protoFieldDesc)}
+	var nested, enums [][]byte
+	err := protoFields(data, func(num, wt int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wt == 2:
+			m.name = scope + "." + string(b)
+		case num == 2 && wt == 2:
+			f, err := parseProtoField(b)
+			if err != nil {
+				return err
+			}
+			m.fields[f.number] = f
+		case num == 3 && wt == 2:
+			nested = append(nested, b)
+		case num == 4 && wt == 2:
+			enums = append(enums, b)
+		case num == 7 && wt == 2:
+			// MessageOptions.map_entry
+			return protoFields(b, func(num, wt int, v uint64, b []byte) error {
+				if num == 7 && wt == 0 {
+					m.mapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.messages[m.name] = m
+	for _, b := range nested {
+		if err := t.addMessage(m.name, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err := t.addEnum(m.name, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses an EnumDescriptorProto.
+func (t *protoTypes) addEnum(scope string, data []byte) error {
+	var name string
+	values := make(map[int32]string)
+	err := protoFields(data, func(num, wt int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wt == 2:
+			name = scope + "." + string(b)
+		case num == 2 && wt == 2:
+			var valueName string
+			var number int32
+			err := protoFields(b, func(num, wt int, v uint64, b []byte) error {
+				switch {
+				case num == 1 && wt == 2:
+					valueName = string(b)
+				case num == 2 && wt == 0:
+					number = int32(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			values[number] = valueName
+		}
+		return nil
+	})
+	t.enums[name] = values
+	return err
+}
+
+// Parses a FieldDescriptorProto.
+func parseProtoField(data []byte) (*protoFieldDesc, error) {
+	f := &protoFieldDesc{}
+	err := protoFields(data, func(num, wt int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wt == 2:
+			f.name = string(b)
+		case num == 3 && wt == 0:
+			f.number = int(v)
+		case num == 4 && wt == 0:
+			f.label = int(v)
+		case num == 5 && wt == 0:
+			f.typ = int(v)
+		case num == 6 && wt == 2:
+			f.typeName = string(b)
+		case num == 10 && wt == 2:
+			f.jsonName = string(b)
+		}
+		return nil
+	})
+	if f.jsonName == "" {
+		f.jsonName = protoJSONName(f.name)
+	}
+	return f, err
+}
+
+// The lowerCamelCase name protoc derives when json_name is not set.
+func protoJSONName(name string) string {
+	var out []byte
+	upper := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '_':
+			upper = true
+		case upper && 'a' <= c && c <= 'z':
+			out = append(out, c-'a'+'A')
+			upper = false
+		default:
+			out = append(out, c)
+			upper = false
+		}
+	}
+	return string(out)
+}
+
+// Walks the fields of an encoded message. For varint and fixed width wire
+// types the value is passed as v, for length delimited fields as b.
+func protoFields(data []byte, fn func(num, wt int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+
+		num, wt := int(tag>>3), int(tag&7)
+		var v uint64
+		var b []byte
+		switch wt {
+		case 0:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errProtoTruncated
+			}
+			b, data = data[n:n+int(l)], data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", wt)
+		}
+
+		if err := fn(num, wt, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes a message into its proto3 JSON mapping.
+func decodeProto(m *protoMessageDesc, data []byte) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	err := protoFields(data, func(num, wt int, v uint64, b []byte) error {
+		f := m.fields[num]
+		if f == nil {
+			return nil
+		}
+
+		switch {
+		case f.message != nil && f.message.mapEntry:
+			k, val, err := decodeProtoMapEntry(f.message, b)
+			if err != nil {
+				return err
+			}
+			entries, _ := doc[f.jsonName].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				doc[f.jsonName] = entries
+			}
+			entries[k] = val
+		case f.label == protoLabelRepeated:
+			values, _ := doc[f.jsonName].([]interface{})
+			if wt == 2 && isPackable(f.typ) {
+				packed, err := decodeProtoPacked(f, b)
+				if err != nil {
+					return err
+				}
+				values = append(values, packed...)
+			} else {
+				val, err := decodeProtoValue(f, v, b)
+				if err != nil {
+					return err
+				}
+				values = append(values, val)
+			}
+			doc[f.jsonName] = values
+		default:
+			val, err := decodeProtoValue(f, v, b)
+			if err != nil {
+				return err
+			}
+			doc[f.jsonName] = val
+		}
+		return nil
+	})
+	return doc, err
+}
+
+func decodeProtoMapEntry(m *protoMessageDesc, data []byte) (string, interface{}, error) {
+	entry, err := decodeProto(m, data)
+	if err != nil {
+		return "", nil, err
+	}
+	key := ""
+	if f := m.fields[1]; f != nil && entry[f.jsonName] != nil {
+		key = fmt.Sprint(entry[f.jsonName])
+	}
+	var value interface{}
+	if f := m.fields[2]; f != nil {
+		value = entry[f.jsonName]
+	}
+	return key, value, nil
+}
+
+func isPackable(typ int) bool {
+	switch typ {
+	case protoTypeString, protoTypeBytes, protoTypeMessage, protoTypeGroup:
+		return false
+	}
+	return true
+}
+
+func decodeProtoPacked(f *protoFieldDesc, data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		var v uint64
+		switch f.typ {
+		case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+			if len(data) < 8 {
+				return nil, errProtoTruncated
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+			if len(data) < 4 {
+				return nil, errProtoTruncated
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			var n int
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return nil, errProtoTruncated
+			}
+			data = data[n:]
+		}
+		val, err := decodeProtoValue(f, v, nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+	}
+	return values, nil
+}
+
+func decodeProtoValue(f *protoFieldDesc, v uint64, b []byte) (interface{}, error) {
+	switch f.typ {
+	case protoTypeDouble:
+		return protoFloat(math.Float64frombits(v)), nil
+	case protoTypeFloat:
+		return protoFloat(float64(math.Float32frombits(uint32(v)))), nil
+	case protoTypeInt64, protoTypeSfixed64:
+		// 64 bit integers are strings in JSON so no precision is lost.
+		return strconv.FormatInt(int64(v), 10), nil
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(v, 10), nil
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10), nil
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(v), nil
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(v), nil
+	case protoTypeSint32:
+		return int32(uint32(v)>>1) ^ -int32(v&1), nil
+	case protoTypeBool:
+		return v != 0, nil
+	case protoTypeString:
+		return string(b), nil
+	case protoTypeBytes:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case protoTypeEnum:
+		if name, ok := f.enum[int32(v)]; ok {
+			return name, nil
+		}
+		return int32(v), nil
+	case protoTypeMessage:
+		return decodeProto(f.message, b)
+	}
+	return nil, fmt.Errorf("proto: field %v has unsupported type %d", f.name, f.typ)
+}
+
+// JSON has no representation for NaN or the infinities.
+func protoFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+// The largest record a length prefix can give, so a corrupt one fails
+// instead of allocating whatever it says.
+const maxProtoRecord = 64 << 20
+
+// Records are read this much at a time, so a length prefix that's more than
+// the rest of the input fails on reaching its end, not on allocating it.
+const protoReadChunk = 64 << 10
+
+// Reads a record of the given size.
+func readProtoRecord(reader io.Reader, size int) ([]byte, error) {
+	n := size
+	if n > protoReadChunk {
+		n = protoReadChunk
+	}
+	data := make([]byte, 0, n)
+	for len(data) < size {
+		n := size - len(data)
+		if n > protoReadChunk {
+			n = protoReadChunk
+		}
+		start := len(data)
+		data = append(data, make([]byte, n)...)
+		if _, err := io.ReadFull(reader, data[start:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errProtoTruncated
+			}
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Reads a stream of varint length prefixed messages, as written by
+// writeDelimitedTo in the protobuf libraries.
+type protoReader struct {
+	reader  *bufio.Reader
+	message *protoMessageDesc
+	count   int
+}
+
+func newProtoReader(reader *bufio.Reader) recordReader {
+	return &protoReader{reader: reader, message: protoMessageType}
+}
+
+func (r *protoReader) Source() (string, int) { return "", r.count }
+
+func (r *protoReader) ReadRecord() ([]byte, error) {
+	for {
+		size, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errProtoTruncated
+			}
+			return nil, err
+		}
+
+		if size > maxProtoRecord {
+			return nil, fmt.Errorf("proto: record %v is %v, more than the %v a record can be", r.count+1, formatBytes(int64(size)), formatBytes(maxProtoRecord))
+		}
+		data, err := readProtoRecord(r.reader, int(size))
+		if err != nil {
+			return nil, err
+		}
+		r.count++
+
+		doc, err := decodeProto(r.message, data)
+		if err == nil {
+			var line []byte
+			if line, err = newItem(doc); err == nil {
+				return line, nil
+			}
+		}
+		log.Printf("Skipping proto record %v: %v", r.count, err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+var proxyFlag = flag.String("proxy", "", "send API requests through this proxy, an http://, https:// or socks5:// URL with any user:password in it; without it $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY are followed, and direct ignores them")
+
+// The proxies a proxy URL can be for.
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true, "socks5h": true}
+
+// Returns the transport's Proxy function for -proxy, nil for none.
+func newProxy() (func(*http.Request) (*url.URL, error), error) {
+	switch *proxyFlag {
+	case "":
+		if *unixSocket != "" {
+			return nil, nil
+		}
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	if *unixSocket != "" {
+		return nil, errors.New("-proxy doesn't apply to -unix-socket")
+	}
+	proxy, err := url.Parse(*proxyFlag)
+	if err != nil {
+		return nil, fmt.Errorf("-proxy: %v", err)
+	}
+	if !proxySchemes[proxy.Scheme] || proxy.Host == "" {
+		return nil, fmt.Errorf("-proxy %v isn't an http://, https:// or socks5:// URL", proxy.Redacted())
+	}
+	log.Printf("Sending requests through the proxy at %v", proxy.Redacted())
+	return http.ProxyURL(proxy), nil
+}
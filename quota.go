@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	quotaPath     = flag.String("quota-path", "_usage", "the destination's usage and limits endpoint, under the -base-path, checked before and during the run; empty to not check")
+	quotaWarn     = flag.Float64("quota-warn", 80, "warn when any usage reaches this percentage of its limit")
+	quotaPause    = flag.Float64("quota-pause", 95, "stop sending while any usage is at or above this percentage of its limit, until it drops or the limit resets")
+	quotaInterval = flag.Duration("quota-interval", time.Minute, "how often to check the -quota-path during the run")
+)
+
+// A usage figure from the quota endpoint, such as storage or requests. The
+// endpoint answers with an object of these by name, storage in bytes.
+type quotaUsage struct {
+	Used  float64    `json:"used"`
+	Limit float64    `json:"limit"`
+	Reset *time.Time `json:"reset,omitempty"`
+}
+
+func (u quotaUsage) percent() float64 {
+	if u.Limit <= 0 {
+		return 0
+	}
+	return 100 * u.Used / u.Limit
+}
+
+// Holds the senders while usage is over -quota-pause.
+var quota = &quotaGuard{}
+
+type quotaGuard struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	warned map[string]bool
+}
+
+// Checks the destination's usage before the run starts, warning if the
+// inputs might not fit in the storage left, and keeps checking during it.
+// Does nothing when the destination has no usage endpoint.
+func startQuotaGuard(inputSize int64) {
+	if *quotaPath == "" || replay != nil || *dryRun {
+		return
+	}
+	quota.cond = sync.NewCond(&quota.mu)
+	quota.warned = make(map[string]bool)
+
+	usage, err := fetchUsage()
+	if err != nil {
+		if bulk.StatusCode(err) == 404 {
+			log.Printf("The destination has no usage endpoint, not checking quotas")
+		} else {
+			log.Printf("Warning: checking usage: %v, not checking quotas", err)
+		}
+		return
+	}
+	if storage, ok := usage["storage"]; ok && storage.Limit > 0 && inputSize > 0 && storage.Used+float64(inputSize) > storage.Limit {
+		log.Printf("Warning: the inputs are %v and only %v of storage is left", formatBytes(inputSize), formatBytes(int64(storage.Limit-storage.Used)))
+	}
+	quota.update(usage)
+
+	go func() {
+		for {
+			time.Sleep(*quotaInterval)
+			usage, err := fetchUsage()
+			if err != nil {
+				log.Printf("Warning: checking usage: %v", err)
+				continue
+			}
+			quota.update(usage)
+		}
+	}()
+}
+
+func fetchUsage() (map[string]quotaUsage, error) {
+	usage := make(map[string]quotaUsage)
+	_, err := jsonReply("GET", *quotaPath, nil, 200, &usage)
+	return usage, err
+}
+
+// Warns about usage over -quota-warn and pauses the senders while any is
+// over -quota-pause. A limit that resets is waited on until it does.
+func (q *quotaGuard) update(usage map[string]quotaUsage) {
+	var names []string
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	paused := false
+	for _, name := range names {
+		u := usage[name]
+		percent := u.percent()
+		if percent >= *quotaWarn && !q.warned[name] {
+			log.Printf("Warning: %v usage is at %.1f%% of its limit", name, percent)
+			q.warned[name] = true
+		} else if percent < *quotaWarn {
+			q.warned[name] = false
+		}
+		if percent >= *quotaPause && (u.Reset == nil || u.Reset.After(time.Now())) {
+			if !q.paused {
+				log.Printf("Pausing: %v usage is at %.1f%% of its limit%v", name, percent, resetSuffix(u))
+			}
+			paused = true
+		}
+	}
+	if q.paused && !paused {
+		log.Printf("Resuming, usage is back under %v%%", *quotaPause)
+	}
+	q.paused = paused
+	q.cond.Broadcast()
+}
+
+func resetSuffix(u quotaUsage) string {
+	if u.Reset == nil {
+		return ""
+	}
+	return fmt.Sprintf(", which resets at %v", u.Reset.Local().Format("15:04:05"))
+}
+
+// Blocks while the senders are paused.
+func (q *quotaGuard) wait() {
+	if q.cond == nil {
+		return
+	}
+	q.mu.Lock()
+	for q.paused {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	rps      = flag.Float64("rps", 0, "the most requests per second to send the destination, shared by all the workers; 0 for no limit")
+	rpsBurst = flag.Int("rps-burst", 0, "how many requests -rps lets through at once after a quiet spell (defaults to one second's worth)")
+)
+
+// Holds requests to the -rps rate, nil when there's no limit.
+var limiter *rateLimiter
+
+// A token bucket: each request takes a token, and tokens come back at the
+// rate up to the burst. A rate of 0, until the -target-error-rate governor
+// sets one, lets every request through.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// Requests that had to wait and how long they waited in all.
+	delayed int64
+	waited  int64
+}
+
+func setupRateLimit() error {
+	if *rps < 0 || *rpsBurst < 0 {
+		return errors.New("-rps and -rps-burst can't be negative")
+	}
+	if *rps == 0 {
+		if *rpsBurst != 0 {
+			return errors.New("-rps-burst needs an -rps")
+		}
+		return nil
+	}
+	burst := float64(*rpsBurst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(*rps))
+	}
+	limiter = &rateLimiter{rate: *rps, burst: burst, tokens: burst, last: time.Now()}
+	return nil
+}
+
+// Waits for a token, giving up when ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// Taking the token now, even if it's yet to come, queues the requests
+	// in the order they arrive.
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&l.delayed, 1)
+	atomic.AddInt64(&l.waited, int64(delay))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Changes the rate, with a burst of one second's worth unless -rps-burst
+// sets it.
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.rate = rate
+	if *rpsBurst == 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// What /status reports of the limiter.
+type rateLimitStatus struct {
+	RPS     float64 `json:"rps"`
+	Burst   float64 `json:"burst"`
+	Delayed int64   `json:"delayed"`
+	Waited  string  `json:"waited"`
+}
+
+func (l *rateLimiter) status() *rateLimitStatus {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	rate, burst := l.rate, l.burst
+	l.mu.Unlock()
+	return &rateLimitStatus{
+		RPS:     rate,
+		Burst:   burst,
+		Delayed: atomic.LoadInt64(&l.delayed),
+		Waited:  time.Duration(atomic.LoadInt64(&l.waited)).Round(time.Millisecond).String(),
+	}
+}
+
+// Describes how much the limiter has held requests back, for the progress
+// lines, or nothing without one.
+func (l *rateLimiter) progress() string {
+	if l == nil {
+		return ""
+	}
+	by := "-rps"
+	if governor != nil {
+		by = "-target-error-rate"
+	}
+	return fmt.Sprintf(", %v requests held %v by %v", atomic.LoadInt64(&l.delayed),
+		time.Duration(atomic.LoadInt64(&l.waited)).Round(time.Millisecond), by)
+}
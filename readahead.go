@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	readAhead          = flag.Int("read-ahead", 4, "how many chunks of an http(s) input are downloaded ahead of the records being read, by parallel range requests where the server takes them, so a slow link's latency overlaps with sending; 0 reads the response as it arrives")
+	readAheadChunkFlag = flag.String("read-ahead-chunk", "4MB", "the size of each -read-ahead chunk")
+
+	// The -read-ahead-chunk in bytes, set up front for the commands that
+	// don't call setupReadAhead.
+	readAheadChunk int64 = 4 << 20
+)
+
+// A failed range request is tried this many times in all.
+const rangeAttempts = 3
+
+func setupReadAhead() error {
+	if *readAhead < 0 {
+		return errors.New("-read-ahead can't be negative")
+	}
+	n, err := parseByteSize(*readAheadChunkFlag)
+	if err != nil {
+		return fmt.Errorf("-read-ahead-chunk: %v", err)
+	}
+	if n < 1 {
+		return errors.New("-read-ahead-chunk must be at least 1 byte")
+	}
+	readAheadChunk = n
+	return nil
+}
+
+// The result of downloading one chunk.
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// Reads an http(s) input a chunk at a time, with up to -read-ahead chunks
+// downloading or downloaded ahead of the reader. A server that takes range
+// requests has the chunks after the first fetched in parallel, otherwise
+// the response is read ahead in the background.
+type prefetchReader struct {
+	// The chunks in input order, each filled when it has downloaded.
+	chunks chan chan chunkResult
+	done   chan struct{}
+	body   io.Closer
+	closed sync.Once
+
+	current []byte
+	err     error
+}
+
+func newPrefetchReader(url string, resp *http.Response) *prefetchReader {
+	r := &prefetchReader{
+		chunks: make(chan chan chunkResult, *readAhead),
+		done:   make(chan struct{}),
+		body:   resp.Body,
+	}
+	size := resp.ContentLength
+	if resp.Header.Get("Accept-Ranges") == "bytes" && size > readAheadChunk {
+		go r.fetchRanges(url, resp, size)
+	} else {
+		go r.fetchStream(resp.Body)
+	}
+	return r
+}
+
+// Queues the next chunk, false if the reader has been closed.
+func (r *prefetchReader) queue(chunk chan chunkResult) bool {
+	select {
+	case r.chunks <- chunk:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// Reads the response a chunk at a time.
+func (r *prefetchReader) fetchStream(body io.Reader) {
+	defer close(r.chunks)
+	for {
+		data := make([]byte, readAheadChunk)
+		n, err := io.ReadFull(body, data)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		chunk := make(chan chunkResult, 1)
+		chunk <- chunkResult{data[:n], err}
+		if !r.queue(chunk) || err != nil {
+			return
+		}
+	}
+}
+
+// Reads the first chunk from the response and requests the others by range,
+// each as soon as there's room for it ahead of the reader.
+func (r *prefetchReader) fetchRanges(url string, resp *http.Response, size int64) {
+	defer close(r.chunks)
+	// The first chunk's response has to be given up on partway through.
+	defer resp.Body.Close()
+	// Later ranges must be of the same version of the input.
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	first := make(chan chunkResult, 1)
+	data := make([]byte, readAheadChunk)
+	n, err := io.ReadFull(resp.Body, data)
+	first <- chunkResult{data[:n], err}
+	if !r.queue(first) || err != nil {
+		return
+	}
+	for start := readAheadChunk; start < size; start += readAheadChunk {
+		end := start + readAheadChunk
+		if end > size {
+			end = size
+		}
+		chunk := make(chan chunkResult, 1)
+		if !r.queue(chunk) {
+			return
+		}
+		go func(start, end int64) {
+			data, err := fetchRange(url, validator, start, end)
+			chunk <- chunkResult{data, err}
+		}(start, end)
+	}
+	last := make(chan chunkResult, 1)
+	last <- chunkResult{err: io.EOF}
+	r.queue(last)
+}
+
+// Downloads the bytes of the input from start up to end, retrying failures.
+func fetchRange(url, validator string, start, end int64) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < rangeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var data []byte
+		if data, err = getRange(url, validator, start, end); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func getRange(url, validator string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "orcbulkimport")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", start, end-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, fmt.Errorf("GET %v: the input changed while it was being read", url)
+	default:
+		return nil, fmt.Errorf("GET %v bytes %v-%v: %v", url, start, end-1, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start {
+		return nil, fmt.Errorf("GET %v bytes %v-%v: got %v bytes", url, start, end-1, len(data))
+	}
+	return data, nil
+}
+
+func (r *prefetchReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		chunk, ok := <-r.chunks
+		if !ok {
+			return 0, io.ErrUnexpectedEOF
+		}
+		result := <-chunk
+		r.current, r.err = result.data, result.err
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *prefetchReader) Close() error {
+	r.closed.Do(func() { close(r.done) })
+	return r.body.Close()
+}
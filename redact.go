@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var redactionProfile = flag.String("redaction-profile", "", "redact documents with this profile from the -config redaction-profiles")
+
+// The text masked values are replaced with.
+const redactedValue = "[redacted]"
+
+// One rule of a profile, such as "mask email". Fields are dotted paths.
+type redaction struct {
+	action string
+	field  string
+}
+
+// Sets up the transform applying the -redaction-profile rules: "mask"
+// replaces a field's value, "hash" replaces it with its SHA-256 so it can
+// still be joined on, and "drop" removes it.
+func newRedactionTransform(profile string) (transform, error) {
+	rules, ok := config.RedactionProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("no redaction profile %q in the -config", profile)
+	}
+
+	var redactions []redaction
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("redaction profile %v: rule %q isn't an action and a field", profile, rule)
+		}
+		switch fields[0] {
+		case "mask", "hash", "drop":
+		default:
+			return nil, fmt.Errorf("redaction profile %v: unknown action %q", profile, fields[0])
+		}
+		redactions = append(redactions, redaction{fields[0], fields[1]})
+	}
+
+	return func(item map[string]interface{}, pos recordPos) error {
+		value := itemValue(item)
+		if value == nil {
+			return nil
+		}
+		for _, r := range redactions {
+			doc, name, ok := lookupField(value, r.field)
+			if !ok {
+				continue
+			}
+			switch r.action {
+			case "mask":
+				doc[name] = redactedValue
+			case "hash":
+				sum := sha256.Sum256([]byte(fmt.Sprint(doc[name])))
+				doc[name] = hex.EncodeToString(sum[:])
+			case "drop":
+				delete(doc, name)
+			}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var repairFixes fixFlags
+
+func init() {
+	flag.Var(&repairFixes, "fix", "a rule repair applies to every failed record instead of asking about each, may be repeated: \"truncate field n\", \"delete field\", \"set field json\" or \"drop-invalid-utf8\", with fields dotted paths in the document")
+}
+
+// A flag.Value collecting repeated -fix rules.
+type fixFlags []string
+
+func (f *fixFlags) String() string { return strings.Join(*f, "; ") }
+
+func (f *fixFlags) Set(value string) error {
+	if _, err := parseFix(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// Changes a record, returning it fixed.
+type fix func(line []byte) ([]byte, error)
+
+func parseFix(spec string) (fix, error) {
+	fields := strings.Fields(spec)
+	switch {
+	case len(fields) == 1 && fields[0] == "drop-invalid-utf8":
+		return func(line []byte) ([]byte, error) { return bytes.ToValidUTF8(line, nil), nil }, nil
+	case len(fields) == 3 && fields[0] == "truncate":
+		n, err := strconv.Atoi(fields[2])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("fix %q: the length should be a number of characters", spec)
+		}
+		return documentFix(fields[1], func(doc map[string]interface{}, name string) error {
+			s, ok := doc[name].(string)
+			if !ok {
+				return fmt.Errorf("%v isn't a string", fields[1])
+			}
+			if utf8.RuneCountInString(s) > n {
+				doc[name] = string([]rune(s)[:n])
+			}
+			return nil
+		}), nil
+	case len(fields) == 2 && fields[0] == "delete":
+		return documentFix(fields[1], func(doc map[string]interface{}, name string) error {
+			delete(doc, name)
+			return nil
+		}), nil
+	case len(fields) >= 3 && fields[0] == "set":
+		var value interface{}
+		raw := strings.TrimSpace(strings.SplitN(strings.TrimSpace(spec), " ", 3)[2])
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			return nil, fmt.Errorf("fix %q: the value should be JSON: %v", spec, err)
+		}
+		return documentFix(fields[1], func(doc map[string]interface{}, name string) error {
+			doc[name] = value
+			return nil
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown fix %q", spec)
+}
+
+// A fix of the document field at the path, which should be there.
+func documentFix(path string, change func(doc map[string]interface{}, name string) error) fix {
+	return func(line []byte) ([]byte, error) {
+		var item map[string]interface{}
+		if err := decodeJSON(line, &item); err != nil {
+			return nil, err
+		}
+		value := itemValue(item)
+		if value == nil {
+			return nil, errors.New("record has no document")
+		}
+		doc, name, ok := lookupField(value, path)
+		if !ok {
+			return line, nil
+		}
+		if err := change(doc, name); err != nil {
+			return nil, err
+		}
+		return json.Marshal(item)
+	}
+}
+
+// A record from a -dead-letter file: the item as it failed, or the line as
+// read if it wasn't an item, with why it failed.
+type failedRecord struct {
+	line   []byte
+	source string
+	reason string
+}
+
+// Implements "orcbulkimport repair file.failed", which imports the records
+// of a -dead-letter file again once they're fixed. Without -fix it shows
+// each record with its error and asks what to do; with -fix it applies the
+// rules to every one. Each record is checked and sent on its own, and those
+// still failing are written to file.unrepaired.
+func repairCommand(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: orcbulkimport repair [-fix rule ...] <file.failed>")
+	}
+	var fixes []fix
+	for _, spec := range repairFixes {
+		f, _ := parseFix(spec)
+		fixes = append(fixes, f)
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupSinkProfile(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	records, err := readFailedRecords(args[0])
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	var unrepaired []failedRecord
+	repaired, skipped := 0, 0
+	input := bufio.NewReader(os.Stdin)
+	for i, record := range records {
+		if fixes != nil {
+			err := autoRepair(record.line, fixes, record.source)
+			if err == nil {
+				repaired++
+				continue
+			}
+			record.reason = err.Error()
+			log.Printf("Couldn't repair the record from %v: %v", record.source, err)
+			unrepaired = append(unrepaired, record)
+			continue
+		}
+
+		ok, quit := repairInteractively(input, &record, i, len(records))
+		switch {
+		case ok:
+			repaired++
+		case quit:
+			unrepaired = append(unrepaired, records[i:]...)
+		default:
+			skipped++
+			unrepaired = append(unrepaired, record)
+		}
+		if quit {
+			break
+		}
+	}
+
+	log.Printf("Repaired and imported %v of %v records, %v skipped", repaired, len(records), skipped)
+	name := args[0] + ".unrepaired"
+	if len(unrepaired) == 0 {
+		// Leave none from an earlier repair behind.
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error: %v", err)
+		}
+	} else {
+		if err := writeFailedRecords(name, unrepaired); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		log.Printf("Wrote %v records still failing to %v", len(unrepaired), name)
+		os.Exit(1)
+	}
+}
+
+// Fixes and imports the record, returning why it still fails if it does.
+func autoRepair(line []byte, fixes []fix, source string) error {
+	for _, f := range fixes {
+		var err error
+		if line, err = f(line); err != nil {
+			return err
+		}
+	}
+	return reimport(line, source)
+}
+
+// Asks about the record until it's imported, skipped or the user quits.
+func repairInteractively(input *bufio.Reader, record *failedRecord, i, n int) (ok, quit bool) {
+	for {
+		fmt.Fprintf(os.Stderr, "\nRecord %v of %v, from %v: %v\n%s\n", i+1, n, record.source, record.reason, record.line)
+		fmt.Fprint(os.Stderr, "[r]etry, [e]dit, [f]ix with a rule, [s]kip, [q]uit? ")
+		answer, err := input.ReadString('\n')
+		if err != nil && answer == "" {
+			return false, true
+		}
+		var fixed []byte
+		switch strings.TrimSpace(answer) {
+		case "r", "retry":
+			fixed = record.line
+		case "e", "edit":
+			if fixed, err = editRecord(input, record.line); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				continue
+			}
+		case "f", "fix":
+			fmt.Fprint(os.Stderr, "Rule: ")
+			spec, _ := input.ReadString('\n')
+			f, err := parseFix(strings.TrimSpace(spec))
+			if err == nil {
+				fixed, err = f(record.line)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				continue
+			}
+		case "s", "skip":
+			return false, false
+		case "q", "quit":
+			return false, true
+		default:
+			continue
+		}
+
+		record.line = fixed
+		if err := reimport(fixed, record.source); err != nil {
+			record.reason = err.Error()
+			continue
+		}
+		fmt.Fprintln(os.Stderr, "Imported")
+		return true, false
+	}
+}
+
+// Edits the record in $EDITOR, or without one reads its replacement from
+// the terminal.
+func editRecord(input *bufio.Reader, line []byte) ([]byte, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		fmt.Fprint(os.Stderr, "Fixed record, on one line: ")
+		fixed, err := input.ReadBytes('\n')
+		if err != nil && len(fixed) == 0 {
+			return nil, err
+		}
+		return bytes.TrimSpace(fixed), nil
+	}
+
+	file, err := ioutil.TempFile("", "orcbulkimport-repair-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, line, "", "  ") != nil {
+		pretty.Reset()
+		pretty.Write(line)
+	}
+	pretty.WriteByte('\n')
+	_, err = file.Write(pretty.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(editor, file.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %v", editor, err)
+	}
+	edited, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	// Back on one line, as the export stream has it.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, edited); err != nil {
+		return bytes.TrimSpace(edited), nil
+	}
+	return compact.Bytes(), nil
+}
+
+// Checks the record and sends it in a batch of its own.
+func reimport(line []byte, source string) error {
+	if _, _, err := scanItemPath(line); err != nil {
+		return fmt.Errorf("invalid record: %v", err)
+	}
+	b := &batch{seq: 1}
+	b.add(append(append([]byte(nil), line...), '\n'), batchRecord{pos: recordPos{file: source}})
+	body, err := postBatch(context.Background(), client, b, nil)
+	if err != nil {
+		return err
+	}
+	results, _ := body["results"].([]interface{})
+	if len(results) == 0 {
+		if body["status"] == "success" {
+			return nil
+		}
+		return fmt.Errorf("%v: %v", body["status"], body["message"])
+	}
+	result, _ := results[0].(map[string]interface{})
+	if result["status"] != "success" {
+		if e, ok := result["error"].(map[string]interface{}); ok && e["message"] != nil {
+			return errors.New(fmt.Sprint(e["message"]))
+		}
+		return fmt.Errorf("%v", result["error"])
+	}
+	return nil
+}
+
+// Reads a -dead-letter file, taking its error off each item.
+func readFailedRecords(name string) ([]failedRecord, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []failedRecord
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var item map[string]json.RawMessage
+			if jsonErr := json.Unmarshal(line, &item); jsonErr != nil {
+				return nil, fmt.Errorf("%v:%v: %v", name, n, jsonErr)
+			}
+			var reason deadLetterError
+			json.Unmarshal(item["error"], &reason)
+			record := failedRecord{source: reason.Source, reason: fmt.Sprint(reason.Message)}
+			if record.source == "" {
+				record.source = fmt.Sprintf("%v:%v", name, n)
+			}
+			if m, ok := reason.Message.(map[string]interface{}); ok && m["message"] != nil {
+				record.reason = fmt.Sprint(m["message"])
+			}
+			var invalid string
+			if raw, ok := item["line"]; ok && len(item) == 2 && json.Unmarshal(raw, &invalid) == nil {
+				// A line that wasn't a JSON object, from -invalid-records
+				// dead-letter.
+				record.line = []byte(invalid)
+			} else {
+				delete(item, "error")
+				if record.line, err = json.Marshal(item); err != nil {
+					return nil, err
+				}
+			}
+			records = append(records, record)
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+	}
+}
+
+// Writes the records in the -dead-letter format, so they can be repaired
+// again.
+func writeFailedRecords(name string, records []failedRecord) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		reason := deadLetterError{record.source, record.reason}
+		var item map[string]interface{}
+		if json.Unmarshal(record.line, &item) != nil || item == nil {
+			item = map[string]interface{}{"line": string(record.line)}
+		}
+		item["error"] = reason
+		line, err := json.Marshal(item)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
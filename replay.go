@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/moediddy/db/bulkimport"
+)
+
+var (
+	recordResponses = flag.String("record-responses", "", "write every batch's response to this trace file, for -replay-responses")
+	replayResponses = flag.String("replay-responses", "", "answer batches from a trace written by -record-responses instead of sending them, to test the client without a network")
+)
+
+// One line of a response trace.
+type traceEntry struct {
+	// The batch, as the file and line of its first record and its length.
+	Batch string                 `json:"batch"`
+	Body  map[string]interface{} `json:"body,omitempty"`
+	Error string                 `json:"error,omitempty"`
+	// Set when the attempt timed out, so a replay retries it too.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// The open -record-responses trace, nil when there isn't one.
+var recorder *traceRecorder
+
+type traceRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// The responses of the -replay-responses trace by batch, each answered in
+// the order they were recorded. Nil when not replaying.
+var replay *responseTrace
+
+type responseTrace struct {
+	mu        sync.Mutex
+	responses map[string][]traceEntry
+}
+
+func setupTrace() error {
+	if *recordResponses != "" && *replayResponses != "" {
+		return errors.New("-record-responses and -replay-responses can't both be set")
+	}
+	if *recordResponses != "" {
+		file, err := os.Create(*recordResponses)
+		if err != nil {
+			return err
+		}
+		recorder = &traceRecorder{file: file, encoder: json.NewEncoder(file)}
+	}
+	if *replayResponses != "" {
+		trace, err := loadTrace(*replayResponses)
+		if err != nil {
+			return err
+		}
+		replay = trace
+	}
+	return nil
+}
+
+func loadTrace(filename string) (*responseTrace, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	trace := &responseTrace{responses: make(map[string][]traceEntry)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry traceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", filename, line, err)
+		}
+		trace.responses[entry.Batch] = append(trace.responses[entry.Batch], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Replaying responses for %v batches from %v", len(trace.responses), filename)
+	return trace, nil
+}
+
+// Identifies a batch by its contents' position so that runs over the same
+// input, however their batches are scheduled, can be matched up.
+func traceKey(b *batch) string {
+	if len(b.records) == 0 {
+		return ""
+	}
+	first := b.records[0].pos
+	return fmt.Sprintf("%v:%v+%v", first.file, first.line, len(b.records))
+}
+
+// Answers a batch with its next recorded response.
+func (t *responseTrace) answer(b *batch) (map[string]interface{}, error) {
+	key := traceKey(b)
+	t.mu.Lock()
+	responses := t.responses[key]
+	if len(responses) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %v", b)
+	}
+	entry := responses[0]
+	t.responses[key] = responses[1:]
+	t.mu.Unlock()
+
+	switch {
+	case entry.TimedOut:
+		return nil, bulkimport.ErrTimedOut
+	case entry.Error != "":
+		return nil, errors.New(entry.Error)
+	}
+	return entry.Body, nil
+}
+
+// Adds a batch's response to the trace.
+func (r *traceRecorder) record(b *batch, body map[string]interface{}, err error) {
+	if r == nil {
+		return
+	}
+	entry := traceEntry{Batch: traceKey(b), Body: body}
+	if err == bulkimport.ErrTimedOut {
+		entry.TimedOut = true
+	} else if err != nil {
+		entry.Body = nil
+		entry.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.encoder.Encode(entry); err != nil {
+		log.Printf("Error writing response trace: %v", err)
+	}
+}
+
+func (r *traceRecorder) close() {
+	if r == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		log.Printf("Error writing response trace: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reportHTML = flag.String("report-html", "", "write a self-contained HTML report of the run, with charts of throughput, errors and collections, to this file")
+
+// What the -report-html gathers while the run goes. The running totals are
+// kept for every run, -slack-webhook reports them too.
+var report = &runReport{errors: make(map[string]int)}
+
+type runReport struct {
+	mu       sync.Mutex
+	imported int
+	failed   int
+	errors   map[string]int
+	// The running totals, sampled every second.
+	samples []reportSample
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type reportSample struct {
+	at       time.Duration
+	imported int
+	failed   int
+}
+
+// The longest error text kept as a type, the rest varies too much to group.
+const maxErrorType = 100
+
+func startReport() {
+	if *reportHTML == "" {
+		return
+	}
+	report.stop, report.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(report.stopped)
+		started := time.Now()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report.sample(time.Since(started))
+			case <-report.stop:
+				report.sample(time.Since(started))
+				return
+			}
+		}
+	}()
+}
+
+// Returns the running totals.
+func (r *runReport) totals() (imported, failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.imported, r.failed
+}
+
+func (r *runReport) sample(at time.Duration) {
+	r.mu.Lock()
+	r.samples = append(r.samples, reportSample{at, r.imported, r.failed})
+	r.mu.Unlock()
+}
+
+// Adds a batch's counts to the report.
+func (r *runReport) batch(imported, failed int) {
+	r.mu.Lock()
+	r.imported += imported
+	r.failed += failed
+	r.mu.Unlock()
+}
+
+// Counts n items failing with the error, grouped by its code and text.
+func (r *runReport) error(err interface{}, n int) {
+	if *reportHTML == "" {
+		return
+	}
+	text := fmt.Sprint(err)
+	code := codeItemFailed
+	if e, ok := err.(map[string]interface{}); ok && e["message"] != nil {
+		// An item failure from the server.
+		text = fmt.Sprint(e["message"])
+	} else if e, ok := err.(error); ok {
+		code = errorCode(e)
+	}
+	if len(text) > maxErrorType {
+		text = text[:maxErrorType] + "…"
+	}
+	text = fmt.Sprintf("%v %v", code, text)
+	r.mu.Lock()
+	r.errors[text] += n
+	r.mu.Unlock()
+}
+
+type reportBar struct {
+	Label  string
+	Value  int
+	Other  int
+	Width  float64
+	Offset float64
+	Y      int
+}
+
+type reportPage struct {
+	Run      *runRecord
+	Duration string
+	Imported int
+	Failed   int
+	Rate     string
+
+	// The throughput chart, items a second.
+	Points   string
+	PeakRate int
+	Seconds  int
+
+	Errors      []reportBar
+	Collections []reportBar
+	ErrorsH     int
+	CollsH      int
+}
+
+// The chart area, in SVG units.
+const (
+	chartWidth  = 800
+	chartHeight = 200
+	barHeight   = 22
+)
+
+// Writes the -report-html once the run has finished.
+func writeReport(run *runRecord) {
+	if *reportHTML == "" {
+		return
+	}
+	// The sampler takes a last sample before it stops.
+	close(report.stop)
+	<-report.stopped
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	page := reportPage{Run: run, Imported: report.imported, Failed: report.failed}
+	last := report.samples[len(report.samples)-1]
+	page.Duration = last.at.Round(time.Second).String()
+	if last.at > 0 {
+		page.Rate = fmt.Sprintf("%.0f", float64(report.imported)/last.at.Seconds())
+	}
+
+	var rates []int
+	previous := reportSample{}
+	for _, s := range report.samples {
+		elapsed := (s.at - previous.at).Seconds()
+		rate := 0
+		if elapsed > 0 {
+			rate = int(float64(s.imported-previous.imported) / elapsed)
+		}
+		rates = append(rates, rate)
+		if rate > page.PeakRate {
+			page.PeakRate = rate
+		}
+		previous = s
+	}
+	page.Seconds = int(last.at.Seconds())
+	var points []string
+	for i, rate := range rates {
+		x := float64(chartWidth) * float64(i+1) / float64(len(rates))
+		y := float64(chartHeight)
+		if page.PeakRate > 0 {
+			y -= float64(chartHeight) * float64(rate) / float64(page.PeakRate)
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	page.Points = "0," + fmt.Sprint(chartHeight) + " " + strings.Join(points, " ")
+
+	max := 0
+	for text, n := range report.errors {
+		page.Errors = append(page.Errors, reportBar{Label: text, Value: n})
+		if n > max {
+			max = n
+		}
+	}
+	sort.Slice(page.Errors, func(i, j int) bool { return page.Errors[i].Value > page.Errors[j].Value })
+	for i := range page.Errors {
+		page.Errors[i].Width = float64(chartWidth/2) * float64(page.Errors[i].Value) / float64(max)
+		page.Errors[i].Y = i * barHeight
+	}
+	page.ErrorsH = len(page.Errors) * barHeight
+
+	max = 0
+	for name, count := range run.Collections {
+		page.Collections = append(page.Collections, reportBar{Label: name, Value: count.Imported, Other: count.Errors})
+		if count.Imported+count.Errors > max {
+			max = count.Imported + count.Errors
+		}
+	}
+	sort.Slice(page.Collections, func(i, j int) bool { return page.Collections[i].Label < page.Collections[j].Label })
+	for i := range page.Collections {
+		c := &page.Collections[i]
+		c.Offset = float64(chartWidth/2) * float64(c.Value) / float64(max)
+		c.Width = float64(chartWidth/2) * float64(c.Other) / float64(max)
+		c.Y = i * barHeight
+	}
+	page.CollsH = len(page.Collections) * barHeight
+
+	file, err := os.Create(*reportHTML)
+	if err == nil {
+		err = reportTemplate.Execute(file, page)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing report: %v", err)
+		return
+	}
+	log.Printf("Wrote report to %v", *reportHTML)
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Import run {{.Run.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.figures { display: flex; gap: 3em; margin: 1em 0 2em; }
+.figure b { display: block; font-size: 2em; }
+svg text { font-size: 12px; }
+.imported { fill: #4a8; }
+.failed { fill: #d55; }
+</style>
+</head>
+<body>
+<h1>Import run {{.Run.ID}}{{with .Run.Label}} ({{.}}){{end}}</h1>
+<p>{{.Run.Status}}, started {{.Run.Started.Format "2006-01-02 15:04:05 MST"}}</p>
+<div class="figures">
+<div class="figure"><b>{{.Imported}}</b>items imported</div>
+<div class="figure"><b>{{.Failed}}</b>items failed</div>
+<div class="figure"><b>{{.Duration}}</b>taken</div>
+{{with .Rate}}<div class="figure"><b>{{.}}</b>items a second</div>{{end}}
+</div>
+
+<h2>Throughput</h2>
+<svg width="860" height="240" viewBox="-40 -10 860 240">
+<polyline points="{{.Points}}" fill="none" stroke="#48c" stroke-width="2"/>
+<line x1="0" y1="200" x2="800" y2="200" stroke="#999"/>
+<line x1="0" y1="0" x2="0" y2="200" stroke="#999"/>
+<text x="-5" y="4" text-anchor="end">{{.PeakRate}}</text>
+<text x="-5" y="204" text-anchor="end">0</text>
+<text x="800" y="218" text-anchor="end">{{.Seconds}}s</text>
+<text x="0" y="218">items a second</text>
+</svg>
+
+<h2>Errors by type</h2>
+{{if .Errors}}<svg width="1100" height="{{.ErrorsH}}">
+{{range .Errors}}<rect class="failed" x="0" y="{{.Y}}" width="{{.Width}}" height="18"/>
+<text x="{{.Width}}" dx="6" y="{{.Y}}" dy="13">{{.Value}} {{.Label}}</text>
+{{end}}</svg>{{else}}<p>None.</p>{{end}}
+
+<h2>Collections</h2>
+{{if .Collections}}<svg width="1100" height="{{.CollsH}}">
+{{range .Collections}}<rect class="imported" x="0" y="{{.Y}}" width="{{.Offset}}" height="18"/>
+<rect class="failed" x="{{.Offset}}" y="{{.Y}}" width="{{.Width}}" height="18"/>
+<text x="{{.Offset}}" dx="{{.Width}}" y="{{.Y}}" dy="13"> {{.Label}}: {{.Value}} imported{{if .Other}}, {{.Other}} failed{{end}}</text>
+{{end}}</svg>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
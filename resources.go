@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// What the machine, or the container we're in, gives us to work with. Flag
+// defaults are derived from it so big machines are used fully and small
+// containers aren't overloaded.
+var resources = detectResources()
+
+type resourceLimits struct {
+	// CPUs available, after any cgroup quota.
+	cpus int
+	// Bytes of memory available, after any cgroup limit. 0 if unknown.
+	memory int64
+}
+
+func detectResources() resourceLimits {
+	r := resourceLimits{cpus: runtime.NumCPU()}
+	if quota := cgroupCPUQuota(); quota > 0 && quota < float64(r.cpus) {
+		r.cpus = int(math.Max(1, math.Ceil(quota)))
+	}
+
+	r.memory = availableMemory()
+	if limit := cgroupMemoryLimit(); limit > 0 && (r.memory == 0 || limit < r.memory) {
+		r.memory = limit
+	}
+	return r
+}
+
+func defaultReadBuffer() string {
+	switch {
+	case resources.memory == 0:
+		return "1MB"
+	case resources.memory < 512<<20:
+		return "256KB"
+	case resources.memory >= 8<<30:
+		return "4MB"
+	}
+	return "1MB"
+}
+
+// Sort spills at an eighth of available memory, at most 256MB.
+func defaultSortMemory() string {
+	if resources.memory == 0 || resources.memory/8 >= 256<<20 {
+		return "256MB"
+	}
+	mb := resources.memory / 8 >> 20
+	if mb < 16 {
+		mb = 16
+	}
+	return strconv.FormatInt(mb, 10) + "MB"
+}
+
+// Returns the CPU quota of our cgroup in CPUs, 0 if there isn't one. Handles
+// both cgroup v2 ("max 100000" or "200000 100000" in cpu.max) and v1.
+func cgroupCPUQuota() float64 {
+	if body, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(body))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				return quota / period
+			}
+		}
+		return 0
+	}
+
+	quota, err1 := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, err2 := readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return float64(quota) / float64(period)
+}
+
+// Returns the memory limit of our cgroup in bytes, 0 if there isn't one.
+func cgroupMemoryLimit() int64 {
+	if body, err := ioutil.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		if err != nil {
+			// "max"
+			return 0
+		}
+		return limit
+	}
+
+	limit, err := readCgroupInt("/sys/fs/cgroup/memory/memory.limit_in_bytes")
+	// v1 reports a huge number rather than nothing when there's no limit.
+	if err != nil || limit <= 0 || limit >= 1<<62 {
+		return 0
+	}
+	return limit
+}
+
+func readCgroupInt(name string) (int64, error) {
+	body, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+// Returns MemAvailable from /proc/meminfo, 0 where there's no such thing.
+func availableMemory() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+	"github.com/moediddy/db/bulkimport"
+)
+
+var (
+	retries         = flag.Int("retries", bulkimport.DefaultRetries, "how many times to resend a batch whose request failed with a network error, a 5xx or a 429 before counting its records as errors")
+	retryBackoff    = flag.Duration("retry-backoff", bulkimport.DefaultRetryBackoff, "how long to wait before the first retry, doubling for each one after")
+	retryMaxBackoff = flag.Duration("retry-max-backoff", bulkimport.DefaultRetryMaxBackoff, "the longest to wait between retries, unless the server's Retry-After asks for longer")
+)
+
+// Whether a failed request is worth sending again: the server was
+// unreachable, overloaded or briefly broken. Other client errors will fail
+// the same way every time.
+func retryable(err error) bool {
+	return bulk.Retryable(err)
+}
+
+// Sends a request the subcommands make one at a time, such as a DELETE or a
+// GET, retrying it the -retries times as a batch would be when it fails in a
+// way worth retrying. What names the request in the log.
+func retryRequest(what string, send func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := send()
+		if err == nil || attempt == *retries || !retryable(err) {
+			return err
+		}
+		delay := bulkimport.RetryDelay(err, attempt+1, *retryBackoff, *retryMaxBackoff)
+		logCode(codeRetrying, "Error %v: %v, retrying in %v (%v of %v)", what, err, delay.Round(time.Millisecond), attempt+1, *retries)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	registryDir        = flag.String("registry", defaultRegistryDir(), "the directory runs are recorded in, empty to disable")
+	registryCollection = flag.String("registry-collection", "", "also record each run as a document in this destination collection, e.g. _imports")
+)
+
+// Identifies this invocation, so anything it writes can be traced back to it.
+var runID = newRunID()
+
+// The run being recorded, set up by startRun.
+var currentRun *runRecord
+
+// Run IDs sort by start time and carry a random suffix to stay unique when
+// several imports start in the same second.
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+func defaultRegistryDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".orcbulkimport", "runs")
+}
+
+// What the registry keeps about a run.
+type runRecord struct {
+	ID       string            `json:"id"`
+	Label    string            `json:"label,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Status   string            `json:"status"`
+	Flags    map[string]string `json:"flags"`
+	Inputs   []*runInput       `json:"inputs"`
+
+	// Items imported into each collection, for labeled runs and -report-html.
+	Collections map[string]*collectionCount `json:"collections,omitempty"`
+
+	mu sync.Mutex
+}
+
+type runInput struct {
+	Name       string     `json:"name"`
+	Size       int64      `json:"size,omitempty"`
+	ModTime    *time.Time `json:"mod_time,omitempty"`
+	HeadSHA256 string     `json:"head_sha256,omitempty"`
+	Imported   int        `json:"imported"`
+	Errors     int        `json:"errors"`
+	Total      int        `json:"total"`
+	Error      string     `json:"error,omitempty"`
+	Code       eventCode  `json:"code,omitempty"`
+
+	// The types seen for each field, with -schema-drift.
+	Schema map[string][]string `json:"schema,omitempty"`
+}
+
+// Records the start of the run along with the flags it was given and a
+// fingerprint of every input.
+func startRun(inputs []string) {
+	currentRun = &runRecord{
+		ID:      runID,
+		Label:   *label,
+		Started: time.Now().UTC(),
+		Status:  "running",
+		Flags:   make(map[string]string),
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if f.Name == "key" {
+			value = "(redacted)"
+		}
+		currentRun.Flags[f.Name] = value
+	})
+
+	for _, name := range inputs {
+		currentRun.Inputs = append(currentRun.Inputs, fingerprint(name))
+	}
+
+	log.Printf("Starting run %v", runID)
+	currentRun.save()
+}
+
+// Identifies an input by size, modification time and a hash of its first
+// megabyte, which is enough to tell a regenerated export apart without
+// reading all of it.
+func fingerprint(name string) *runInput {
+	input := &runInput{Name: name}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return input
+	}
+	defer file.Close()
+
+	stats, err := file.Stat()
+	if err != nil || !stats.Mode().IsRegular() {
+		return input
+	}
+	input.Size = stats.Size()
+	modTime := stats.ModTime().UTC()
+	input.ModTime = &modTime
+
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, 1024*1024); err == nil || err == io.EOF {
+		input.HeadSHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
+	return input
+}
+
+// Returns the names of the run's inputs.
+func (r *runRecord) inputNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for _, input := range r.Inputs {
+		names = append(names, input.Name)
+	}
+	return names
+}
+
+// Returns the total size of the run's inputs, 0 if any is unknown.
+func (r *runRecord) inputSize() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var size int64
+	for _, input := range r.Inputs {
+		if input.Size == 0 {
+			return 0
+		}
+		size += input.Size
+	}
+	return size
+}
+
+// Records the outcome of importing one input.
+func (r *runRecord) finishInput(name string, imported, errors, total int, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	var found *runInput
+	for _, input := range r.Inputs {
+		if input.Name == name {
+			found = input
+		}
+	}
+	if found == nil {
+		// A stream of several inputs, with -concat.
+		found = &runInput{Name: name}
+		r.Inputs = append(r.Inputs, found)
+	}
+	found.Imported, found.Errors, found.Total = imported, errors, total
+	if err != nil {
+		found.Error, found.Code = err.Error(), codeInputFailed
+	}
+	r.mu.Unlock()
+	r.save()
+}
+
+// Records the end of the run, both locally and in the -registry-collection.
+func (r *runRecord) finish() {
+	if r == nil {
+		return
+	}
+	r.recordSchemas()
+	r.mu.Lock()
+	now := time.Now().UTC()
+	r.Finished = &now
+	r.Status = "complete"
+	for _, input := range r.Inputs {
+		if input.Errors > 0 || input.Error != "" {
+			r.Status = "complete with errors"
+		}
+	}
+	if isStopping() {
+		r.Status = "stopped"
+	}
+	r.mu.Unlock()
+	r.save()
+
+	if *registryCollection != "" {
+		body, _ := r.marshal()
+		headers := map[string]string{"Content-Type": "application/json"}
+		resp, err := doRequest("PUT", *registryCollection+"/"+r.ID, headers, bytes.NewReader(body))
+		if err == nil {
+			if resp.StatusCode/100 != 2 {
+				err = bulk.ParseError(resp)
+			}
+			resp.Body.Close()
+		}
+		if err != nil {
+			log.Printf("Error recording run in %v: %v", *registryCollection, err)
+		}
+	}
+}
+
+func (r *runRecord) marshal() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (r *runRecord) save() {
+	if *registryDir == "" {
+		return
+	}
+	body, err := r.marshal()
+	if err == nil {
+		if err = os.MkdirAll(*registryDir, 0700); err == nil {
+			err = ioutil.WriteFile(filepath.Join(*registryDir, r.ID+".json"), body, 0600)
+		}
+	}
+	if err != nil {
+		log.Printf("Error recording run: %v", err)
+	}
+}
+
+func loadRun(id string) (*runRecord, error) {
+	body, err := ioutil.ReadFile(filepath.Join(*registryDir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	r := &runRecord{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("%v: %v", id, err)
+	}
+	return r, nil
+}
+
+func listRuns() ([]*runRecord, error) {
+	names, err := filepath.Glob(filepath.Join(*registryDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var runs []*runRecord
+	for _, name := range names {
+		r, err := loadRun(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			log.Printf("Error: %v", err)
+			continue
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// Implements "orcbulkimport runs list", "orcbulkimport runs show <id>" and
+// "orcbulkimport runs diff <label> <label>".
+func runsCommand(args []string) {
+	if *registryDir == "" {
+		log.Fatalf("Error: no -registry directory")
+	}
+
+	switch {
+	case len(args) == 0 || args[0] == "list":
+		runs, err := listRuns()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLABEL\tSTARTED\tDURATION\tSTATUS\tINPUTS\tIMPORTED\tERRORS")
+		for _, r := range runs {
+			duration := "-"
+			if r.Finished != nil {
+				duration = r.Finished.Sub(r.Started).Round(time.Second).String()
+			}
+			var imported, errors int
+			for _, input := range r.Inputs {
+				imported += input.Imported
+				errors += input.Errors
+			}
+			runLabel := r.Label
+			if runLabel == "" {
+				runLabel = "-"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.ID, runLabel, r.Started.Local().Format("2006-01-02 15:04:05"),
+				duration, r.Status, len(r.Inputs), imported, errors)
+		}
+		w.Flush()
+
+	case args[0] == "show" && len(args) == 2:
+		r, err := loadRun(args[1])
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		body, _ := r.marshal()
+		fmt.Printf("%s\n", body)
+
+	case args[0] == "diff" && len(args) == 3:
+		runsDiff(args[1], args[2])
+
+	default:
+		log.Fatalf("Usage: orcbulkimport runs [list | show <id> | diff <label> <label>]")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var schemaDrift = flag.Bool("schema-drift", true, "record the fields of each input in the -registry and warn about any that appeared, disappeared or changed type since the last run of the same input")
+
+// Fields nested deeper than this are left out of the schema.
+const maxSchemaDepth = 8
+
+// At most this many differences are logged for an input.
+const maxDriftWarnings = 20
+
+// The types seen for each field, by input. Fields are "collection:path",
+// with "[]" standing for the elements of an array.
+var observedSchemas = struct {
+	sync.Mutex
+	inputs map[string]map[string]map[string]bool
+}{inputs: make(map[string]map[string]map[string]bool)}
+
+func schemaEnabled() bool {
+	return *schemaDrift && *registryDir != ""
+}
+
+// Adds the fields of a chunk of records to the schemas of their inputs.
+func observeSchema(raws []rawRecord) {
+	if !schemaEnabled() {
+		return
+	}
+	local := make(map[string]map[string]map[string]bool)
+	for _, raw := range raws {
+		var item struct {
+			Path struct {
+				Collection string `json:"collection"`
+			} `json:"path"`
+			Value interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(raw.line, &item); err != nil || item.Value == nil {
+			continue
+		}
+		fields := local[raw.pos.file]
+		if fields == nil {
+			fields = make(map[string]map[string]bool)
+			local[raw.pos.file] = fields
+		}
+		addSchemaFields(fields, item.Path.Collection+":", item.Value, 0)
+	}
+
+	observedSchemas.Lock()
+	defer observedSchemas.Unlock()
+	for file, fields := range local {
+		all := observedSchemas.inputs[file]
+		if all == nil {
+			observedSchemas.inputs[file] = fields
+			continue
+		}
+		for field, types := range fields {
+			if all[field] == nil {
+				all[field] = types
+				continue
+			}
+			for t := range types {
+				all[field][t] = true
+			}
+		}
+	}
+}
+
+func addSchemaFields(fields map[string]map[string]bool, path string, value interface{}, depth int) {
+	add := func(t string) {
+		if fields[path] == nil {
+			fields[path] = make(map[string]bool)
+		}
+		fields[path][t] = true
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if depth > 0 {
+			add("object")
+		}
+		if depth == maxSchemaDepth {
+			return
+		}
+		prefix := path
+		if depth > 0 {
+			prefix += "."
+		}
+		for name, field := range v {
+			addSchemaFields(fields, prefix+name, field, depth+1)
+		}
+	case []interface{}:
+		add("array")
+		if depth == maxSchemaDepth {
+			return
+		}
+		for _, element := range v {
+			addSchemaFields(fields, path+"[]", element, depth+1)
+		}
+	case string:
+		add("string")
+	case float64:
+		add("number")
+	case bool:
+		add("bool")
+	case nil:
+		add("null")
+	}
+}
+
+// Attaches the observed schemas to the run's inputs and warns about how
+// each differs from the last run of the same input.
+func (r *runRecord) recordSchemas() {
+	if r == nil || !schemaEnabled() {
+		return
+	}
+	observedSchemas.Lock()
+	schemas := make(map[string]map[string][]string)
+	for name, fields := range observedSchemas.inputs {
+		schema := make(map[string][]string)
+		for field, types := range fields {
+			for t := range types {
+				schema[field] = append(schema[field], t)
+			}
+			sort.Strings(schema[field])
+		}
+		schemas[name] = schema
+	}
+	observedSchemas.Unlock()
+
+	runs, err := listRuns()
+	if err != nil {
+		log.Printf("Error reading previous runs: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, input := range r.Inputs {
+		schema, ok := schemas[input.Name]
+		if !ok {
+			continue
+		}
+		input.Schema = schema
+		if id, previous := previousSchema(runs, r.ID, input.Name); previous != nil {
+			warnSchemaDrift(input.Name, id, previous, schema)
+		}
+	}
+}
+
+// Finds the schema of the latest earlier run to record one for the input.
+func previousSchema(runs []*runRecord, current, name string) (string, map[string][]string) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].ID >= current {
+			continue
+		}
+		for _, input := range runs[i].Inputs {
+			if input.Name == name && input.Schema != nil {
+				return runs[i].ID, input.Schema
+			}
+		}
+	}
+	return "", nil
+}
+
+func warnSchemaDrift(name, since string, previous, current map[string][]string) {
+	var changes []string
+	for field, types := range current {
+		old, ok := previous[field]
+		switch {
+		case !ok:
+			changes = append(changes, "new field "+field+" ("+strings.Join(types, "|")+")")
+		case strings.Join(old, "|") != strings.Join(types, "|"):
+			changes = append(changes, "field "+field+" was "+strings.Join(old, "|")+", now "+strings.Join(types, "|"))
+		}
+	}
+	for field := range previous {
+		if _, ok := current[field]; !ok {
+			changes = append(changes, "removed field "+field)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	sort.Strings(changes)
+
+	log.Printf("Warning: the schema of %v has changed since run %v", name, since)
+	for i, change := range changes {
+		if i == maxDriftWarnings {
+			log.Printf("Warning:   and %v more changes", len(changes)-i)
+			break
+		}
+		log.Printf("Warning:   %v", change)
+	}
+}
@@ -0,0 +1,1513 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	script         = flag.String("script", "", "a script, in a subset of Starlark, whose transform(record, path) function is run on every record")
+	scriptMaxSteps = flag.Int("script-max-steps", 1000000, "how many statements and loop iterations -script may run per record")
+)
+
+// Sets up the -script transform. The script is run once when it is loaded
+// and its globals are then frozen, so the transform function can be called
+// for many records at once. It's called with the record's document and,
+// if it takes a second parameter, the item's path. It may change them in
+// place or return a new document, and it drops the record by returning
+// False. The script can't reach anything outside itself.
+func newScriptTransform(name string) (transform, error) {
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	module, err := loadScript(name, string(src))
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := module.globals["transform"].(*scriptFunc)
+	if !ok {
+		return nil, fmt.Errorf("%v doesn't define a transform function", name)
+	}
+	if n := len(fn.def.params); n != 1 && n != 2 {
+		return nil, fmt.Errorf("%v: transform must take a record and optionally a path", name)
+	}
+
+	return func(item map[string]interface{}, pos recordPos) error {
+		record := toScript(item["value"])
+		args := []interface{}{record}
+		var path interface{}
+		if len(fn.def.params) == 2 {
+			path = toScript(item["path"])
+			args = append(args, path)
+		}
+
+		result, err := module.call(fn, args)
+		if err != nil {
+			return err
+		}
+		switch result := result.(type) {
+		case nil:
+		case bool:
+			if !result {
+				return errDropRecord
+			}
+		case *scriptDict:
+			record = result
+		default:
+			return fmt.Errorf("%v: transform returned a %v, not a dict, False or None", name, scriptType(result))
+		}
+
+		if item["value"], err = fromScript(record); err != nil {
+			return err
+		}
+		if path != nil {
+			if item["path"], err = fromScript(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// Values are nil, bool, float64, string or one of these.
+type (
+	scriptList struct {
+		elems  []interface{}
+		frozen bool
+	}
+	scriptDict struct {
+		m      map[string]interface{}
+		frozen bool
+	}
+	scriptFunc struct {
+		def *defStmt
+	}
+	scriptBuiltin struct {
+		name string
+		fn   func(t *scriptThread, args []interface{}) (interface{}, error)
+	}
+	// A method of a value, such as "abc".upper.
+	scriptMethod struct {
+		recv interface{}
+		name string
+	}
+)
+
+type scriptModule struct {
+	name    string
+	globals map[string]interface{}
+}
+
+// The state of one call into the module.
+type scriptThread struct {
+	module *scriptModule
+	steps  int
+	depth  int
+	// The bytes of the strings and lists the call has built.
+	allocated int
+}
+
+// The most a script can build into a single string or list, and in all for
+// one record, so a runaway one fails the record rather than using up the
+// memory. A list element is taken to be 16 bytes.
+const (
+	maxScriptValue  = 16 << 20
+	maxScriptAlloc  = 256 << 20
+	scriptElemBytes = 16
+)
+
+// An error that already says where it happened.
+type scriptError struct {
+	msg string
+}
+
+func (e *scriptError) Error() string { return e.msg }
+
+// Control flow out of a statement.
+const (
+	flowNext = iota
+	flowBreak
+	flowContinue
+	flowReturn
+)
+
+func loadScript(name, src string) (*scriptModule, error) {
+	stmts, err := parseScript(src)
+	if err != nil {
+		return nil, fmt.Errorf("%v:%v", name, err)
+	}
+	m := &scriptModule{name: name, globals: make(map[string]interface{})}
+	t := &scriptThread{module: m}
+	if _, _, err := t.execBlock(stmts, nil); err != nil {
+		return nil, err
+	}
+	for _, v := range m.globals {
+		freeze(v)
+	}
+	return m, nil
+}
+
+func (m *scriptModule) call(fn *scriptFunc, args []interface{}) (interface{}, error) {
+	t := &scriptThread{module: m}
+	return t.callFunc(fn, args, fn.def.line)
+}
+
+func (t *scriptThread) errorf(line int, format string, args ...interface{}) error {
+	return &scriptError{fmt.Sprintf("%v:%v: %v", t.module.name, line, fmt.Sprintf(format, args...))}
+}
+
+// Gives an error from a builtin the position of the code that called it.
+func (t *scriptThread) at(line int, err error) error {
+	if _, ok := err.(*scriptError); ok || err == nil || err == errDropRecord {
+		return err
+	}
+	return t.errorf(line, "%v", err)
+}
+
+func (t *scriptThread) step(line int) error {
+	t.steps++
+	if *scriptMaxSteps > 0 && t.steps > *scriptMaxSteps {
+		err := fmt.Errorf("script ran for more than %v steps", *scriptMaxSteps)
+		if line == 0 {
+			// Inside a builtin, which gets the line from its caller.
+			return err
+		}
+		return t.at(line, err)
+	}
+	return nil
+}
+
+// Counts a string or list of the given size in bytes that's about to be
+// built, failing if it's bigger than a value can be or the record has built
+// too much already.
+func (t *scriptThread) alloc(size int) error {
+	if size > maxScriptValue {
+		return fmt.Errorf("script built a string or list bigger than the %v one can be", formatBytes(maxScriptValue))
+	}
+	t.allocated += size
+	if t.allocated > maxScriptAlloc {
+		return fmt.Errorf("script built more than %v of strings and lists", formatBytes(maxScriptAlloc))
+	}
+	return nil
+}
+
+// How many times a value is repeated by *, failing if it's too big.
+func (t *scriptThread) repeat(size int, n float64) (int, error) {
+	if n != math.Trunc(n) {
+		return 0, fmt.Errorf("can't repeat a sequence %v times", n)
+	}
+	if n <= 0 || size == 0 {
+		return 0, nil
+	}
+	if n > maxScriptValue || int(n)*size > maxScriptValue {
+		return 0, t.alloc(maxScriptValue + 1)
+	}
+	return int(n), t.alloc(int(n) * size)
+}
+
+func (t *scriptThread) callFunc(fn *scriptFunc, args []interface{}, line int) (interface{}, error) {
+	if len(args) != len(fn.def.params) {
+		return nil, t.errorf(line, "%v takes %v arguments, got %v", fn.def.name, len(fn.def.params), len(args))
+	}
+	if t.depth >= 100 {
+		return nil, t.errorf(line, "calls nested too deeply")
+	}
+	locals := make(map[string]interface{})
+	for i, param := range fn.def.params {
+		locals[param] = args[i]
+	}
+	t.depth++
+	_, result, err := t.execBlock(fn.def.body, locals)
+	t.depth--
+	return result, err
+}
+
+// Runs statements with the given locals, nil at the top level where
+// assignments go to the globals.
+func (t *scriptThread) execBlock(stmts []scriptStmt, locals map[string]interface{}) (int, interface{}, error) {
+	for _, stmt := range stmts {
+		flow, result, err := t.exec(stmt, locals)
+		if err != nil || flow != flowNext {
+			return flow, result, err
+		}
+	}
+	return flowNext, nil, nil
+}
+
+func (t *scriptThread) exec(stmt scriptStmt, locals map[string]interface{}) (int, interface{}, error) {
+	switch s := stmt.(type) {
+	case *exprStmt:
+		if err := t.step(s.line); err != nil {
+			return 0, nil, err
+		}
+		_, err := t.eval(s.x, locals)
+		return flowNext, nil, err
+
+	case *assignStmt:
+		if err := t.step(s.line); err != nil {
+			return 0, nil, err
+		}
+		value, err := t.eval(s.value, locals)
+		if err != nil {
+			return 0, nil, err
+		}
+		if s.op != "=" {
+			current, err := t.eval(s.targets[0], locals)
+			if err != nil {
+				return 0, nil, err
+			}
+			if value, err = t.binary(s.line, s.op[:1], current, value); err != nil {
+				return 0, nil, err
+			}
+		}
+		return flowNext, nil, t.assign(s.line, s.targets, value, locals)
+
+	case *ifStmt:
+		if err := t.step(s.line); err != nil {
+			return 0, nil, err
+		}
+		cond, err := t.eval(s.cond, locals)
+		if err != nil {
+			return 0, nil, err
+		}
+		if truth(cond) {
+			return t.execBlock(s.body, locals)
+		}
+		return t.execBlock(s.elseBody, locals)
+
+	case *forStmt:
+		iter, err := t.eval(s.iter, locals)
+		if err != nil {
+			return 0, nil, err
+		}
+		elems, err := iterate(iter)
+		if err != nil {
+			return 0, nil, t.at(s.line, err)
+		}
+		for _, elem := range elems {
+			if err := t.step(s.line); err != nil {
+				return 0, nil, err
+			}
+			if err := t.assign(s.line, s.targets, elem, locals); err != nil {
+				return 0, nil, err
+			}
+			flow, result, err := t.execBlock(s.body, locals)
+			if err != nil || flow == flowReturn {
+				return flow, result, err
+			}
+			if flow == flowBreak {
+				break
+			}
+		}
+		return flowNext, nil, nil
+
+	case *returnStmt:
+		if locals == nil {
+			return 0, nil, t.errorf(s.line, "return outside a function")
+		}
+		var result interface{}
+		if s.value != nil {
+			var err error
+			if result, err = t.eval(s.value, locals); err != nil {
+				return 0, nil, err
+			}
+		}
+		return flowReturn, result, nil
+
+	case *branchStmt:
+		switch s.kind {
+		case "break":
+			return flowBreak, nil, nil
+		case "continue":
+			return flowContinue, nil, nil
+		}
+		return flowNext, nil, nil
+
+	case *defStmt:
+		t.module.globals[s.name] = &scriptFunc{def: s}
+		return flowNext, nil, nil
+	}
+	return 0, nil, fmt.Errorf("unknown statement %T", stmt)
+}
+
+func (t *scriptThread) assign(line int, targets []scriptExpr, value interface{}, locals map[string]interface{}) error {
+	if len(targets) > 1 {
+		elems, err := iterate(value)
+		if err != nil {
+			return t.at(line, err)
+		}
+		if len(elems) != len(targets) {
+			return t.errorf(line, "can't unpack %v values into %v", len(elems), len(targets))
+		}
+		for i := range targets {
+			if err := t.assign(line, targets[i:i+1], elems[i], locals); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch target := targets[0].(type) {
+	case *nameExpr:
+		if locals != nil {
+			locals[target.name] = value
+		} else {
+			t.module.globals[target.name] = value
+		}
+		return nil
+	case *indexExpr:
+		x, err := t.eval(target.x, locals)
+		if err != nil {
+			return err
+		}
+		index, err := t.eval(target.index, locals)
+		if err != nil {
+			return err
+		}
+		return t.at(line, setIndex(x, index, value))
+	}
+	return t.errorf(line, "can't assign to that")
+}
+
+func (t *scriptThread) eval(expr scriptExpr, locals map[string]interface{}) (interface{}, error) {
+	switch x := expr.(type) {
+	case *literalExpr:
+		return x.value, nil
+
+	case *nameExpr:
+		if v, ok := locals[x.name]; ok {
+			return v, nil
+		}
+		if v, ok := t.module.globals[x.name]; ok {
+			return v, nil
+		}
+		if b, ok := scriptBuiltins[x.name]; ok {
+			return b, nil
+		}
+		return nil, t.errorf(x.line, "undefined: %v", x.name)
+
+	case *attrExpr:
+		recv, err := t.eval(x.x, locals)
+		if err != nil {
+			return nil, err
+		}
+		if !hasMethod(recv, x.name) {
+			return nil, t.errorf(x.line, "%v has no .%v", scriptType(recv), x.name)
+		}
+		return &scriptMethod{recv: recv, name: x.name}, nil
+
+	case *indexExpr:
+		v, err := t.eval(x.x, locals)
+		if err != nil {
+			return nil, err
+		}
+		index, err := t.eval(x.index, locals)
+		if err != nil {
+			return nil, err
+		}
+		result, err := getIndex(v, index)
+		return result, t.at(x.line, err)
+
+	case *callExpr:
+		fn, err := t.eval(x.fn, locals)
+		if err != nil {
+			return nil, err
+		}
+		args := make([]interface{}, len(x.args))
+		for i, arg := range x.args {
+			if args[i], err = t.eval(arg, locals); err != nil {
+				return nil, err
+			}
+		}
+		var result interface{}
+		switch fn := fn.(type) {
+		case *scriptFunc:
+			return t.callFunc(fn, args, x.line)
+		case *scriptBuiltin:
+			result, err = fn.fn(t, args)
+		case *scriptMethod:
+			result, err = t.callMethod(fn.recv, fn.name, args)
+		default:
+			return nil, t.errorf(x.line, "can't call a %v", scriptType(fn))
+		}
+		return result, t.at(x.line, err)
+
+	case *unaryExpr:
+		v, err := t.eval(x.x, locals)
+		if err != nil {
+			return nil, err
+		}
+		if x.op == "not" {
+			return !truth(v), nil
+		}
+		n, ok := scriptFloat(v).(float64)
+		if !ok {
+			return nil, t.errorf(x.line, "can't apply %v to a %v", x.op, scriptType(v))
+		}
+		if x.op == "-" {
+			return -n, nil
+		}
+		return n, nil
+
+	case *binaryExpr:
+		a, err := t.eval(x.x, locals)
+		if err != nil {
+			return nil, err
+		}
+		// and and or only evaluate their right side when they need to.
+		switch x.op {
+		case "and":
+			if !truth(a) {
+				return a, nil
+			}
+			return t.eval(x.y, locals)
+		case "or":
+			if truth(a) {
+				return a, nil
+			}
+			return t.eval(x.y, locals)
+		}
+		b, err := t.eval(x.y, locals)
+		if err != nil {
+			return nil, err
+		}
+		return t.binary(x.line, x.op, a, b)
+
+	case *condExpr:
+		cond, err := t.eval(x.cond, locals)
+		if err != nil {
+			return nil, err
+		}
+		if truth(cond) {
+			return t.eval(x.then, locals)
+		}
+		return t.eval(x.elseVal, locals)
+
+	case *listExpr:
+		list := &scriptList{}
+		for _, elem := range x.elems {
+			v, err := t.eval(elem, locals)
+			if err != nil {
+				return nil, err
+			}
+			list.elems = append(list.elems, v)
+		}
+		return list, nil
+
+	case *dictExpr:
+		dict := &scriptDict{m: make(map[string]interface{})}
+		for i := range x.keys {
+			k, err := t.eval(x.keys[i], locals)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, t.errorf(x.line, "dict keys must be strings, not %v", scriptType(k))
+			}
+			if dict.m[key], err = t.eval(x.values[i], locals); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("unknown expression %T", expr)
+}
+
+func (t *scriptThread) binary(line int, op string, a, b interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return scriptEqual(a, b), nil
+	case "!=":
+		return !scriptEqual(a, b), nil
+	case "in", "not in":
+		found, err := contains(b, a)
+		if err != nil {
+			return nil, t.at(line, err)
+		}
+		return found == (op == "in"), nil
+	}
+	if x, y, ok := exactNumbers(a, b); ok {
+		switch op {
+		case "<":
+			return x.Cmp(y) < 0, nil
+		case "<=":
+			return x.Cmp(y) <= 0, nil
+		case ">":
+			return x.Cmp(y) > 0, nil
+		case ">=":
+			return x.Cmp(y) >= 0, nil
+		}
+	}
+	a, b = scriptFloat(a), scriptFloat(b)
+	if op == "*" {
+		// Repetition is the same either way around.
+		if _, ok := a.(float64); ok {
+			if _, ok := b.(float64); !ok {
+				a, b = b, a
+			}
+		}
+	}
+
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch op {
+			case "+":
+				return a + b, nil
+			case "-":
+				return a - b, nil
+			case "*":
+				return a * b, nil
+			case "/", "//", "%":
+				if b == 0 {
+					return nil, t.errorf(line, "division by zero")
+				}
+				switch op {
+				case "/":
+					return a / b, nil
+				case "//":
+					return math.Floor(a / b), nil
+				}
+				return a - b*math.Floor(a/b), nil
+			case "<":
+				return a < b, nil
+			case "<=":
+				return a <= b, nil
+			case ">":
+				return a > b, nil
+			case ">=":
+				return a >= b, nil
+			}
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			switch op {
+			case "+":
+				if err := t.alloc(len(a) + len(b)); err != nil {
+					return nil, t.at(line, err)
+				}
+				return a + b, nil
+			case "<":
+				return a < b, nil
+			case "<=":
+				return a <= b, nil
+			case ">":
+				return a > b, nil
+			case ">=":
+				return a >= b, nil
+			}
+		}
+		if n, ok := b.(float64); ok && op == "*" {
+			times, err := t.repeat(len(a), n)
+			if err != nil {
+				return nil, t.at(line, err)
+			}
+			return strings.Repeat(a, times), nil
+		}
+	case *scriptList:
+		if b, ok := b.(*scriptList); ok && op == "+" {
+			if err := t.alloc((len(a.elems) + len(b.elems)) * scriptElemBytes); err != nil {
+				return nil, t.at(line, err)
+			}
+			return &scriptList{elems: append(append([]interface{}(nil), a.elems...), b.elems...)}, nil
+		}
+		if n, ok := b.(float64); ok && op == "*" {
+			times, err := t.repeat(len(a.elems)*scriptElemBytes, n)
+			if err != nil {
+				return nil, t.at(line, err)
+			}
+			l := &scriptList{elems: make([]interface{}, 0, times*len(a.elems))}
+			for i := 0; i < times; i++ {
+				l.elems = append(l.elems, a.elems...)
+			}
+			return l, nil
+		}
+	}
+	return nil, t.errorf(line, "can't apply %v to a %v and a %v", op, scriptType(a), scriptType(b))
+}
+
+func truth(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case json.Number:
+		return scriptFloat(v) != 0.0
+	case string:
+		return v != ""
+	case *scriptList:
+		return len(v.elems) > 0
+	case *scriptDict:
+		return len(v.m) > 0
+	}
+	return true
+}
+
+func scriptType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "NoneType"
+	case bool:
+		return "bool"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case *scriptList:
+		return "list"
+	case *scriptDict:
+		return "dict"
+	}
+	return "function"
+}
+
+func scriptEqual(a, b interface{}) bool {
+	if x, y, ok := exactNumbers(a, b); ok {
+		return x.Cmp(y) == 0
+	}
+	switch a := a.(type) {
+	case *scriptList:
+		b, ok := b.(*scriptList)
+		if ok && a == b {
+			// As in Python, and so a list inside itself is equal to itself.
+			return true
+		}
+		if !ok || len(a.elems) != len(b.elems) {
+			return false
+		}
+		for i := range a.elems {
+			if !scriptEqual(a.elems[i], b.elems[i]) {
+				return false
+			}
+		}
+		return true
+	case *scriptDict:
+		b, ok := b.(*scriptDict)
+		if ok && a == b {
+			return true
+		}
+		if !ok || len(a.m) != len(b.m) {
+			return false
+		}
+		for k, v := range a.m {
+			w, ok := b.m[k]
+			if !ok || !scriptEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case nil, bool, float64, string:
+		return a == b
+	}
+	return false
+}
+
+// Returns the elements a for loop visits. Dicts give their keys in order.
+func iterate(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case *scriptList:
+		return append([]interface{}(nil), v.elems...), nil
+	case *scriptDict:
+		var keys []interface{}
+		for _, k := range sortedKeys(v) {
+			keys = append(keys, k)
+		}
+		return keys, nil
+	}
+	return nil, fmt.Errorf("can't iterate over a %v", scriptType(v))
+}
+
+func sortedKeys(d *scriptDict) []string {
+	keys := make([]string, 0, len(d.m))
+	for k := range d.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(container, v interface{}) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("can't look for a %v in a string", scriptType(v))
+		}
+		return strings.Contains(c, s), nil
+	case *scriptList:
+		for _, elem := range c.elems {
+			if scriptEqual(elem, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *scriptDict:
+		s, ok := v.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c.m[s]
+		return found, nil
+	}
+	return false, fmt.Errorf("can't look in a %v", scriptType(container))
+}
+
+func listIndex(list *scriptList, index interface{}) (int, error) {
+	n, ok := scriptFloat(index).(float64)
+	if !ok || n != math.Trunc(n) {
+		return 0, fmt.Errorf("list indexes must be integers, not %v", scriptType(index))
+	}
+	i := int(n)
+	if i < 0 {
+		i += len(list.elems)
+	}
+	if i < 0 || i >= len(list.elems) {
+		return 0, fmt.Errorf("index %v out of range", n)
+	}
+	return i, nil
+}
+
+func getIndex(v, index interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case *scriptList:
+		i, err := listIndex(v, index)
+		if err != nil {
+			return nil, err
+		}
+		return v.elems[i], nil
+	case *scriptDict:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("dict keys must be strings, not %v", scriptType(index))
+		}
+		value, ok := v.m[key]
+		if !ok {
+			return nil, fmt.Errorf("key %q not in dict", key)
+		}
+		return value, nil
+	case string:
+		runes := []rune(v)
+		i, err := listIndex(&scriptList{elems: make([]interface{}, len(runes))}, index)
+		if err != nil {
+			return nil, err
+		}
+		return string(runes[i]), nil
+	}
+	return nil, fmt.Errorf("can't index a %v", scriptType(v))
+}
+
+func setIndex(v, index, value interface{}) error {
+	switch v := v.(type) {
+	case *scriptList:
+		if v.frozen {
+			return errors.New("can't change a frozen list")
+		}
+		i, err := listIndex(v, index)
+		if err != nil {
+			return err
+		}
+		v.elems[i] = value
+		return nil
+	case *scriptDict:
+		if v.frozen {
+			return errors.New("can't change a frozen dict")
+		}
+		key, ok := index.(string)
+		if !ok {
+			return fmt.Errorf("dict keys must be strings, not %v", scriptType(index))
+		}
+		v.m[key] = value
+		return nil
+	}
+	return fmt.Errorf("can't assign to an index of a %v", scriptType(v))
+}
+
+// Makes the globals read only once the script is loaded, so concurrent
+// calls can share them.
+func freeze(v interface{}) {
+	switch v := v.(type) {
+	case *scriptList:
+		if !v.frozen {
+			v.frozen = true
+			for _, elem := range v.elems {
+				freeze(elem)
+			}
+		}
+	case *scriptDict:
+		if !v.frozen {
+			v.frozen = true
+			for _, elem := range v.m {
+				freeze(elem)
+			}
+		}
+	}
+}
+
+// Converts decoded JSON to script values.
+func toScript(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		d := &scriptDict{m: make(map[string]interface{}, len(v))}
+		for k, elem := range v {
+			d.m[k] = toScript(elem)
+		}
+		return d
+	case []interface{}:
+		l := &scriptList{elems: make([]interface{}, len(v))}
+		for i, elem := range v {
+			l.elems[i] = toScript(elem)
+		}
+		return l
+	case json.Number:
+		// Numbers a float64 can't hold exactly, such as 64-bit IDs, are
+		// kept as they were read unless the script does arithmetic on them.
+		if n, ok := floatNumber(v); ok {
+			return n
+		}
+		return v
+	case int:
+		return float64(v)
+	}
+	return v
+}
+
+// The float64 of a number, false if it can't be held exactly.
+func floatNumber(n json.Number) (float64, bool) {
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false
+	}
+	if s := n.String(); len(s) <= 15 && !strings.ContainsAny(s, ".eE") {
+		return f, true
+	}
+	exact, ok := new(big.Rat).SetString(n.String())
+	return f, ok && exact.Cmp(new(big.Rat).SetFloat64(f)) == 0
+}
+
+// A number for arithmetic, a float64 if it was kept as it was read.
+func scriptFloat(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		return f
+	}
+	return v
+}
+
+// Two numbers exactly, if they are and either was kept as it was read, so
+// IDs a float64 would round to the same value still compare as they should.
+func exactNumbers(a, b interface{}) (*big.Rat, *big.Rat, bool) {
+	_, aNumber := a.(json.Number)
+	_, bNumber := b.(json.Number)
+	if !aNumber && !bNumber {
+		return nil, nil, false
+	}
+	x, ok := exactNumber(a)
+	if !ok {
+		return nil, nil, false
+	}
+	y, ok := exactNumber(b)
+	return x, y, ok
+}
+
+func exactNumber(v interface{}) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(v.String())
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(v), true
+	}
+	return nil, false
+}
+
+// Converts script values back to something that can be marshaled as JSON.
+func fromScript(v interface{}) (interface{}, error) {
+	return fromScriptValue(v, make(map[interface{}]bool))
+}
+
+// Converts v, path holding the lists and dicts it's inside, as a list or
+// dict appended or assigned into itself would otherwise never end.
+func fromScriptValue(v interface{}, path map[interface{}]bool) (interface{}, error) {
+	switch v := v.(type) {
+	case *scriptDict:
+		if path[v] {
+			return nil, errors.New("a value can't contain itself")
+		}
+		path[v] = true
+		defer delete(path, v)
+		m := make(map[string]interface{}, len(v.m))
+		for k, elem := range v.m {
+			var err error
+			if m[k], err = fromScriptValue(elem, path); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case *scriptList:
+		if path[v] {
+			return nil, errors.New("a value can't contain itself")
+		}
+		path[v] = true
+		defer delete(path, v)
+		l := make([]interface{}, len(v.elems))
+		for i, elem := range v.elems {
+			var err error
+			if l[i], err = fromScriptValue(elem, path); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v can't be stored", v)
+		}
+		return v, nil
+	case nil, bool, string, json.Number:
+		return v, nil
+	}
+	return nil, fmt.Errorf("a %v can't be stored", scriptType(v))
+}
+
+// Formats a value the way str() does.
+func scriptString(v interface{}) string {
+	return formatScript(v, nil)
+}
+
+// Formats v, path holding the lists and dicts it's inside: one inside
+// itself is shown as [...] or {...}, as Python does.
+func formatScript(v interface{}, path map[interface{}]bool) string {
+	switch v.(type) {
+	case *scriptList, *scriptDict:
+		if path[v] {
+			if _, ok := v.(*scriptList); ok {
+				return "[...]"
+			}
+			return "{...}"
+		}
+		if path == nil {
+			path = make(map[interface{}]bool)
+		}
+		path[v] = true
+		defer delete(path, v)
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case json.Number:
+		return v.String()
+	case *scriptList:
+		parts := make([]string, len(v.elems))
+		for i, elem := range v.elems {
+			parts[i] = formatRepr(elem, path)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case *scriptDict:
+		var parts []string
+		for _, k := range sortedKeys(v) {
+			parts = append(parts, strconv.Quote(k)+": "+formatRepr(v.m[k], path))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case *scriptFunc:
+		return "<function " + v.def.name + ">"
+	case *scriptBuiltin:
+		return "<builtin " + v.name + ">"
+	}
+	return "<method>"
+}
+
+func scriptRepr(v interface{}) string {
+	return formatRepr(v, nil)
+}
+
+func formatRepr(v interface{}, path map[interface{}]bool) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return formatScript(v, path)
+}
+
+var scriptBuiltins map[string]*scriptBuiltin
+
+func init() {
+	builtins := map[string]func(t *scriptThread, args []interface{}) (interface{}, error){
+		"len": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("len takes one argument")
+			}
+			switch v := args[0].(type) {
+			case string:
+				return float64(len([]rune(v))), nil
+			case *scriptList:
+				return float64(len(v.elems)), nil
+			case *scriptDict:
+				return float64(len(v.m)), nil
+			}
+			return nil, fmt.Errorf("a %v has no len", scriptType(args[0]))
+		},
+		"str": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("str takes one argument")
+			}
+			return scriptString(args[0]), nil
+		},
+		"int": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			n, err := scriptNumber(args)
+			return math.Trunc(n), err
+		},
+		"float": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			return scriptNumber(args)
+		},
+		"bool": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			return len(args) == 1 && truth(args[0]), nil
+		},
+		"list": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			if len(args) == 0 {
+				return &scriptList{}, nil
+			}
+			elems, err := iterate(args[0])
+			return &scriptList{elems: elems}, err
+		},
+		"dict": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			return &scriptDict{m: make(map[string]interface{})}, nil
+		},
+		"sorted": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("sorted takes one argument")
+			}
+			elems, err := iterate(args[0])
+			if err != nil {
+				return nil, err
+			}
+			var sortErr error
+			sort.SliceStable(elems, func(i, j int) bool {
+				less, err := t.binary(0, "<", elems[i], elems[j])
+				if err != nil {
+					sortErr = errors.New("sorted needs all numbers or all strings")
+					return false
+				}
+				return less.(bool)
+			})
+			return &scriptList{elems: elems}, sortErr
+		},
+		"range": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			bounds := []float64{0, 0, 1}
+			if len(args) == 0 || len(args) > 3 {
+				return nil, errors.New("range takes one to three arguments")
+			}
+			for i, arg := range args {
+				n, ok := scriptFloat(arg).(float64)
+				if !ok {
+					return nil, errors.New("range takes numbers")
+				}
+				bounds[i] = n
+			}
+			if len(args) == 1 {
+				bounds[0], bounds[1] = 0, bounds[0]
+			}
+			start, stop, step := bounds[0], bounds[1], bounds[2]
+			if step == 0 {
+				return nil, errors.New("range step can't be zero")
+			}
+			list := &scriptList{}
+			for n := start; (step > 0 && n < stop) || (step < 0 && n > stop); n += step {
+				if err := t.step(0); err != nil {
+					return nil, err
+				}
+				list.elems = append(list.elems, n)
+			}
+			return list, nil
+		},
+		"min": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			return scriptExtreme(t, "<", args)
+		},
+		"max": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			return scriptExtreme(t, ">", args)
+		},
+		"abs": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("abs takes one argument")
+			}
+			n, ok := scriptFloat(args[0]).(float64)
+			if !ok {
+				return nil, fmt.Errorf("can't take abs of a %v", scriptType(args[0]))
+			}
+			return math.Abs(n), nil
+		},
+		"any": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			elems, err := scriptOneIterable("any", args)
+			for _, elem := range elems {
+				if truth(elem) {
+					return true, nil
+				}
+			}
+			return false, err
+		},
+		"all": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			elems, err := scriptOneIterable("all", args)
+			for _, elem := range elems {
+				if !truth(elem) {
+					return false, nil
+				}
+			}
+			return true, err
+		},
+		"enumerate": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			elems, err := scriptOneIterable("enumerate", args)
+			list := &scriptList{}
+			for i, elem := range elems {
+				list.elems = append(list.elems, &scriptList{elems: []interface{}{float64(i), elem}})
+			}
+			return list, err
+		},
+		"type": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("type takes one argument")
+			}
+			return scriptType(args[0]), nil
+		},
+		"fail": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			parts := make([]string, len(args))
+			for i, arg := range args {
+				parts[i] = scriptString(arg)
+			}
+			return nil, fmt.Errorf("fail: %v", strings.Join(parts, " "))
+		},
+		"print": func(t *scriptThread, args []interface{}) (interface{}, error) {
+			parts := make([]string, len(args))
+			for i, arg := range args {
+				parts[i] = scriptString(arg)
+			}
+			log.Printf("%v: %v", t.module.name, strings.Join(parts, " "))
+			return nil, nil
+		},
+	}
+
+	scriptBuiltins = make(map[string]*scriptBuiltin)
+	for name, fn := range builtins {
+		scriptBuiltins[name] = &scriptBuiltin{name: name, fn: fn}
+	}
+}
+
+func scriptNumber(args []interface{}) (float64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("takes one argument")
+	}
+	switch v := scriptFloat(args[0]).(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't a number", v)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("a %v isn't a number", scriptType(args[0]))
+}
+
+func scriptOneIterable(name string, args []interface{}) ([]interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%v takes one argument", name)
+	}
+	return iterate(args[0])
+}
+
+// Implements min and max, of either a list or the arguments.
+func scriptExtreme(t *scriptThread, op string, args []interface{}) (interface{}, error) {
+	elems := args
+	if len(args) == 1 {
+		var err error
+		if elems, err = iterate(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(elems) == 0 {
+		return nil, errors.New("no values")
+	}
+	best := elems[0]
+	for _, elem := range elems[1:] {
+		better, err := t.binary(0, op, elem, best)
+		if err != nil {
+			return nil, errors.New("values must be all numbers or all strings")
+		}
+		if better.(bool) {
+			best = elem
+		}
+	}
+	return best, nil
+}
+
+var scriptMethods = map[string][]string{
+	"string": {"lower", "upper", "strip", "lstrip", "rstrip", "split", "join", "replace", "startswith", "endswith", "find", "title"},
+	"list":   {"append", "extend", "pop", "index"},
+	"dict":   {"get", "keys", "values", "items", "pop", "setdefault", "update"},
+}
+
+func hasMethod(recv interface{}, name string) bool {
+	for _, method := range scriptMethods[scriptType(recv)] {
+		if method == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *scriptThread) callMethod(recv interface{}, name string, args []interface{}) (interface{}, error) {
+	switch recv := recv.(type) {
+	case string:
+		return t.stringMethod(recv, name, args)
+	case *scriptList:
+		return listMethod(recv, name, args)
+	case *scriptDict:
+		return dictMethod(recv, name, args)
+	}
+	return nil, fmt.Errorf("%v has no .%v", scriptType(recv), name)
+}
+
+func stringArgs(name string, args []interface{}, min, max int) ([]string, error) {
+	if len(args) < min || len(args) > max {
+		return nil, fmt.Errorf("%v takes %v to %v arguments", name, min, max)
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v takes strings, not a %v", name, scriptType(arg))
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+func (t *scriptThread) stringMethod(s, name string, args []interface{}) (interface{}, error) {
+	if name == "join" {
+		elems, err := scriptOneIterable("join", args)
+		if err != nil {
+			return nil, err
+		}
+		parts := make([]string, len(elems))
+		size := len(s) * len(elems)
+		for i, elem := range elems {
+			part, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("join takes strings, not a %v", scriptType(elem))
+			}
+			parts[i] = part
+			size += len(part)
+		}
+		if err := t.alloc(size); err != nil {
+			return nil, err
+		}
+		return strings.Join(parts, s), nil
+	}
+
+	max := map[string]int{"replace": 2, "startswith": 1, "endswith": 1, "find": 1, "split": 1, "strip": 1, "lstrip": 1, "rstrip": 1}[name]
+	min := map[string]int{"replace": 2, "startswith": 1, "endswith": 1, "find": 1}[name]
+	strs, err := stringArgs(name, args, min, max)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "lower":
+		return strings.ToLower(s), nil
+	case "upper":
+		return strings.ToUpper(s), nil
+	case "title":
+		return strings.Title(s), nil
+	case "strip", "lstrip", "rstrip":
+		cutset := " \t\r\n"
+		if len(strs) == 1 {
+			cutset = strs[0]
+		}
+		switch name {
+		case "lstrip":
+			return strings.TrimLeft(s, cutset), nil
+		case "rstrip":
+			return strings.TrimRight(s, cutset), nil
+		}
+		return strings.Trim(s, cutset), nil
+	case "split":
+		var parts []string
+		if len(strs) == 1 {
+			parts = strings.Split(s, strs[0])
+		} else {
+			parts = strings.Fields(s)
+		}
+		list := &scriptList{}
+		for _, part := range parts {
+			list.elems = append(list.elems, part)
+		}
+		return list, nil
+	case "replace":
+		if grows := len(strs[1]) - len(strs[0]); grows > 0 {
+			n := strings.Count(s, strs[0])
+			if n > maxScriptValue/grows {
+				n = maxScriptValue/grows + 1
+			}
+			if err := t.alloc(len(s) + n*grows); err != nil {
+				return nil, err
+			}
+		}
+		return strings.Replace(s, strs[0], strs[1], -1), nil
+	case "startswith":
+		return strings.HasPrefix(s, strs[0]), nil
+	case "endswith":
+		return strings.HasSuffix(s, strs[0]), nil
+	case "find":
+		i := strings.Index(s, strs[0])
+		if i > 0 {
+			i = len([]rune(s[:i]))
+		}
+		return float64(i), nil
+	}
+	return nil, fmt.Errorf("string has no .%v", name)
+}
+
+func listMethod(l *scriptList, name string, args []interface{}) (interface{}, error) {
+	if l.frozen && name != "index" {
+		return nil, errors.New("can't change a frozen list")
+	}
+	switch name {
+	case "append":
+		if len(args) != 1 {
+			return nil, errors.New("append takes one argument")
+		}
+		l.elems = append(l.elems, args[0])
+		return nil, nil
+	case "extend":
+		elems, err := scriptOneIterable("extend", args)
+		l.elems = append(l.elems, elems...)
+		return nil, err
+	case "pop":
+		if len(l.elems) == 0 {
+			return nil, errors.New("pop from an empty list")
+		}
+		i := len(l.elems) - 1
+		if len(args) == 1 {
+			var err error
+			if i, err = listIndex(l, args[0]); err != nil {
+				return nil, err
+			}
+		}
+		v := l.elems[i]
+		l.elems = append(l.elems[:i], l.elems[i+1:]...)
+		return v, nil
+	case "index":
+		if len(args) != 1 {
+			return nil, errors.New("index takes one argument")
+		}
+		for i, elem := range l.elems {
+			if scriptEqual(elem, args[0]) {
+				return float64(i), nil
+			}
+		}
+		return nil, fmt.Errorf("%v not in list", scriptRepr(args[0]))
+	}
+	return nil, fmt.Errorf("list has no .%v", name)
+}
+
+func dictMethod(d *scriptDict, name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "keys", "values", "items":
+		list := &scriptList{}
+		for _, k := range sortedKeys(d) {
+			switch name {
+			case "keys":
+				list.elems = append(list.elems, k)
+			case "values":
+				list.elems = append(list.elems, d.m[k])
+			default:
+				list.elems = append(list.elems, &scriptList{elems: []interface{}{k, d.m[k]}})
+			}
+		}
+		return list, nil
+	case "update":
+		if d.frozen {
+			return nil, errors.New("can't change a frozen dict")
+		}
+		if len(args) != 1 {
+			return nil, errors.New("update takes a dict")
+		}
+		other, ok := args[0].(*scriptDict)
+		if !ok {
+			return nil, errors.New("update takes a dict")
+		}
+		for k, v := range other.m {
+			d.m[k] = v
+		}
+		return nil, nil
+	}
+
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("%v takes a key and optionally a default", name)
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("dict keys must be strings, not %v", scriptType(args[0]))
+	}
+	var def interface{}
+	if len(args) == 2 {
+		def = args[1]
+	}
+	v, found := d.m[key]
+	switch name {
+	case "get":
+		if !found {
+			return def, nil
+		}
+		return v, nil
+	case "pop", "setdefault":
+		if d.frozen {
+			return nil, errors.New("can't change a frozen dict")
+		}
+		if name == "setdefault" {
+			if !found {
+				d.m[key] = def
+				return def, nil
+			}
+			return v, nil
+		}
+		if !found {
+			if len(args) == 1 {
+				return nil, fmt.Errorf("key %q not in dict", key)
+			}
+			return def, nil
+		}
+		delete(d.m, key)
+		return v, nil
+	}
+	return nil, fmt.Errorf("dict has no .%v", name)
+}
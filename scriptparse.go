@@ -0,0 +1,848 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The lexer and parser for -script files, which are written in a small
+// subset of Starlark: def, if/elif/else, for, return, break, continue and
+// pass; assignments to names, indexes and with +=, -= and *=; the usual
+// arithmetic, comparison, boolean, "in" and conditional expressions; and
+// list and dict literals.
+
+const (
+	tokEOF = iota
+	tokNewline
+	tokIndent
+	tokDedent
+	tokName
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind int
+	text string
+	num  float64
+	line int
+}
+
+type scriptLexer struct {
+	src    []rune
+	pos    int
+	line   int
+	indent []int
+	depth  int
+	tokens []token
+}
+
+func lexScript(src string) ([]token, error) {
+	l := &scriptLexer{src: []rune(src), line: 1, indent: []int{0}}
+	if err := l.lex(); err != nil {
+		return nil, err
+	}
+	return l.tokens, nil
+}
+
+func (l *scriptLexer) emit(kind int, text string) {
+	l.tokens = append(l.tokens, token{kind: kind, text: text, line: l.line})
+}
+
+func (l *scriptLexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%v: %v", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *scriptLexer) lex() error {
+	atLineStart := true
+	for {
+		if atLineStart && l.depth == 0 {
+			if err := l.lexIndent(); err != nil {
+				return err
+			}
+			atLineStart = false
+		}
+		if l.pos >= len(l.src) {
+			break
+		}
+
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			if l.depth == 0 && len(l.tokens) > 0 && l.tokens[len(l.tokens)-1].kind != tokNewline {
+				l.emit(tokNewline, "")
+			}
+			l.pos++
+			l.line++
+			// Lines continue inside brackets.
+			atLineStart = l.depth == 0
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '\\' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '\n':
+			l.pos += 2
+			l.line++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '"' || c == '\'':
+			s, err := l.lexString(c)
+			if err != nil {
+				return err
+			}
+			l.emit(tokString, s)
+		case unicode.IsDigit(c) || (c == '.' && l.pos+1 < len(l.src) && unicode.IsDigit(l.src[l.pos+1])):
+			start := l.pos
+			for l.pos < len(l.src) && (unicode.IsDigit(l.src[l.pos]) || l.src[l.pos] == '.' ||
+				l.src[l.pos] == 'e' || l.src[l.pos] == 'E' ||
+				((l.src[l.pos] == '+' || l.src[l.pos] == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E'))) {
+				l.pos++
+			}
+			text := string(l.src[start:l.pos])
+			n, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return l.errorf("invalid number %q", text)
+			}
+			l.tokens = append(l.tokens, token{kind: tokNumber, text: text, num: n, line: l.line})
+		case c == '_' || unicode.IsLetter(c):
+			start := l.pos
+			for l.pos < len(l.src) && (l.src[l.pos] == '_' || unicode.IsLetter(l.src[l.pos]) || unicode.IsDigit(l.src[l.pos])) {
+				l.pos++
+			}
+			l.emit(tokName, string(l.src[start:l.pos]))
+		default:
+			op := ""
+			if l.pos+1 < len(l.src) {
+				switch two := string(l.src[l.pos : l.pos+2]); two {
+				case "==", "!=", "<=", ">=", "//", "+=", "-=", "*=":
+					op = two
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%<>=()[]{},:.", c) {
+					return l.errorf("unexpected %q", c)
+				}
+				op = string(c)
+			}
+			switch op {
+			case "(", "[", "{":
+				l.depth++
+			case ")", "]", "}":
+				l.depth--
+			}
+			l.pos += len(op)
+			l.emit(tokOp, op)
+		}
+	}
+
+	if len(l.tokens) > 0 && l.tokens[len(l.tokens)-1].kind != tokNewline {
+		l.emit(tokNewline, "")
+	}
+	for len(l.indent) > 1 {
+		l.indent = l.indent[:len(l.indent)-1]
+		l.emit(tokDedent, "")
+	}
+	l.emit(tokEOF, "")
+	return nil
+}
+
+// Measures the indentation of the next line that has something on it,
+// emitting indents and dedents as it changes.
+func (l *scriptLexer) lexIndent() error {
+	for {
+		width := 0
+		for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+			if l.src[l.pos] == '\t' {
+				width += 8 - width%8
+			} else {
+				width++
+			}
+			l.pos++
+		}
+		if l.pos < len(l.src) && (l.src[l.pos] == '\r' || l.src[l.pos] == '\n' || l.src[l.pos] == '#') {
+			// Blank and comment lines don't count.
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+			if l.pos < len(l.src) {
+				l.pos++
+				l.line++
+			}
+			continue
+		}
+		if l.pos >= len(l.src) {
+			return nil
+		}
+
+		top := l.indent[len(l.indent)-1]
+		switch {
+		case width > top:
+			l.indent = append(l.indent, width)
+			l.emit(tokIndent, "")
+		case width < top:
+			for width < l.indent[len(l.indent)-1] {
+				l.indent = l.indent[:len(l.indent)-1]
+				l.emit(tokDedent, "")
+			}
+			if width != l.indent[len(l.indent)-1] {
+				return l.errorf("inconsistent indentation")
+			}
+		}
+		return nil
+	}
+}
+
+func (l *scriptLexer) lexString(quote rune) (string, error) {
+	l.pos++
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return "", l.errorf("unterminated string")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == quote {
+			return b.String(), nil
+		}
+		if c != '\\' {
+			b.WriteRune(c)
+			continue
+		}
+		if l.pos >= len(l.src) {
+			return "", l.errorf("unterminated string")
+		}
+		c = l.src[l.pos]
+		l.pos++
+		switch c {
+		case 'n':
+			b.WriteRune('\n')
+		case 't':
+			b.WriteRune('\t')
+		case 'r':
+			b.WriteRune('\r')
+		case '\\', '\'', '"':
+			b.WriteRune(c)
+		case 'u':
+			if l.pos+4 > len(l.src) {
+				return "", l.errorf("invalid unicode escape")
+			}
+			n, err := strconv.ParseUint(string(l.src[l.pos:l.pos+4]), 16, 32)
+			if err != nil {
+				return "", l.errorf("invalid unicode escape")
+			}
+			b.WriteRune(rune(n))
+			l.pos += 4
+		default:
+			return "", l.errorf("invalid escape \\%c", c)
+		}
+	}
+}
+
+// Syntax tree nodes. Every node knows its line for error messages.
+type (
+	scriptStmt interface{}
+	scriptExpr interface{}
+
+	exprStmt struct {
+		line int
+		x    scriptExpr
+	}
+	assignStmt struct {
+		line    int
+		targets []scriptExpr
+		op      string // =, += and so on
+		value   scriptExpr
+	}
+	ifStmt struct {
+		line     int
+		cond     scriptExpr
+		body     []scriptStmt
+		elseBody []scriptStmt
+	}
+	forStmt struct {
+		line    int
+		targets []scriptExpr
+		iter    scriptExpr
+		body    []scriptStmt
+	}
+	returnStmt struct {
+		line  int
+		value scriptExpr
+	}
+	branchStmt struct {
+		line int
+		kind string // break, continue or pass
+	}
+	defStmt struct {
+		line   int
+		name   string
+		params []string
+		body   []scriptStmt
+	}
+
+	literalExpr struct {
+		line  int
+		value interface{}
+	}
+	nameExpr struct {
+		line int
+		name string
+	}
+	attrExpr struct {
+		line int
+		x    scriptExpr
+		name string
+	}
+	indexExpr struct {
+		line     int
+		x, index scriptExpr
+	}
+	callExpr struct {
+		line int
+		fn   scriptExpr
+		args []scriptExpr
+	}
+	unaryExpr struct {
+		line int
+		op   string
+		x    scriptExpr
+	}
+	binaryExpr struct {
+		line int
+		op   string
+		x, y scriptExpr
+	}
+	condExpr struct {
+		line                int
+		cond, then, elseVal scriptExpr
+	}
+	listExpr struct {
+		line  int
+		elems []scriptExpr
+	}
+	dictExpr struct {
+		line         int
+		keys, values []scriptExpr
+	}
+)
+
+type scriptParser struct {
+	tokens []token
+	pos    int
+}
+
+func parseScript(src string) ([]scriptStmt, error) {
+	tokens, err := lexScript(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{tokens: tokens}
+	var stmts []scriptStmt
+	for p.peek().kind != tokEOF {
+		stmt, err := p.statement(true)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+func (p *scriptParser) peek() token { return p.tokens[p.pos] }
+
+func (p *scriptParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *scriptParser) is(kind int, text string) bool {
+	t := p.peek()
+	return t.kind == kind && t.text == text
+}
+
+func (p *scriptParser) accept(kind int, text string) bool {
+	if p.is(kind, text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(kind int, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *scriptParser) unexpected() error {
+	t := p.peek()
+	switch t.kind {
+	case tokEOF:
+		return fmt.Errorf("%v: unexpected end of script", t.line)
+	case tokNewline:
+		return fmt.Errorf("%v: unexpected end of line", t.line)
+	case tokIndent, tokDedent:
+		return fmt.Errorf("%v: unexpected indentation", t.line)
+	}
+	return fmt.Errorf("%v: unexpected %q", t.line, t.text)
+}
+
+var scriptKeywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "def": true, "elif": true, "else": true,
+	"for": true, "if": true, "in": true, "not": true, "or": true, "pass": true, "return": true,
+}
+
+func (p *scriptParser) statement(topLevel bool) (scriptStmt, error) {
+	t := p.peek()
+	if t.kind == tokName {
+		switch t.text {
+		case "def":
+			if !topLevel {
+				return nil, fmt.Errorf("%v: def is only allowed at the top level", t.line)
+			}
+			return p.def()
+		case "if":
+			p.next()
+			return p.ifRest(t.line)
+		case "for":
+			return p.forStmt()
+		}
+	}
+	stmt, err := p.simpleStatement()
+	if err != nil {
+		return nil, err
+	}
+	return stmt, p.expect(tokNewline, "")
+}
+
+func (p *scriptParser) simpleStatement() (scriptStmt, error) {
+	t := p.peek()
+	if t.kind == tokName {
+		switch t.text {
+		case "return":
+			p.next()
+			stmt := &returnStmt{line: t.line}
+			if p.peek().kind != tokNewline {
+				value, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				stmt.value = value
+			}
+			return stmt, nil
+		case "break", "continue", "pass":
+			p.next()
+			return &branchStmt{line: t.line, kind: t.text}, nil
+		}
+	}
+
+	targets, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if op.kind == tokOp && (op.text == "=" || op.text == "+=" || op.text == "-=" || op.text == "*=") {
+		p.next()
+		if op.text != "=" && len(targets) != 1 {
+			return nil, fmt.Errorf("%v: %v needs a single target", op.line, op.text)
+		}
+		for _, target := range targets {
+			switch target.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				return nil, fmt.Errorf("%v: can't assign to that", op.line)
+			}
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &assignStmt{line: op.line, targets: targets, op: op.text, value: value}, nil
+	}
+	if len(targets) != 1 {
+		return nil, p.unexpected()
+	}
+	return &exprStmt{line: t.line, x: targets[0]}, nil
+}
+
+func (p *scriptParser) exprList() ([]scriptExpr, error) {
+	var list []scriptExpr
+	for {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, x)
+		if !p.accept(tokOp, ",") {
+			return list, nil
+		}
+	}
+}
+
+// Parses the indented block after a colon, or a simple statement on the
+// same line.
+func (p *scriptParser) suite() ([]scriptStmt, error) {
+	if err := p.expect(tokOp, ":"); err != nil {
+		return nil, err
+	}
+	if !p.accept(tokNewline, "") {
+		stmt, err := p.simpleStatement()
+		if err != nil {
+			return nil, err
+		}
+		return []scriptStmt{stmt}, p.expect(tokNewline, "")
+	}
+	if err := p.expect(tokIndent, ""); err != nil {
+		return nil, err
+	}
+	var body []scriptStmt
+	for !p.accept(tokDedent, "") {
+		stmt, err := p.statement(false)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmt)
+	}
+	return body, nil
+}
+
+func (p *scriptParser) def() (scriptStmt, error) {
+	line := p.next().line
+	name := p.next()
+	if name.kind != tokName || scriptKeywords[name.text] {
+		return nil, fmt.Errorf("%v: expected a function name", line)
+	}
+	if err := p.expect(tokOp, "("); err != nil {
+		return nil, err
+	}
+	var params []string
+	for !p.accept(tokOp, ")") {
+		param := p.next()
+		if param.kind != tokName || scriptKeywords[param.text] {
+			return nil, fmt.Errorf("%v: expected a parameter name", param.line)
+		}
+		params = append(params, param.text)
+		if !p.is(tokOp, ")") {
+			if err := p.expect(tokOp, ","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	body, err := p.suite()
+	if err != nil {
+		return nil, err
+	}
+	return &defStmt{line: line, name: name.text, params: params, body: body}, nil
+}
+
+// Parses what follows an "if" or "elif".
+func (p *scriptParser) ifRest(line int) (scriptStmt, error) {
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.suite()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &ifStmt{line: line, cond: cond, body: body}
+	if t := p.peek(); p.accept(tokName, "elif") {
+		elif, err := p.ifRest(t.line)
+		if err != nil {
+			return nil, err
+		}
+		stmt.elseBody = []scriptStmt{elif}
+	} else if p.accept(tokName, "else") {
+		if stmt.elseBody, err = p.suite(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *scriptParser) forStmt() (scriptStmt, error) {
+	line := p.next().line
+	var targets []scriptExpr
+	for {
+		name := p.next()
+		if name.kind != tokName || scriptKeywords[name.text] {
+			return nil, fmt.Errorf("%v: expected a loop variable", line)
+		}
+		targets = append(targets, &nameExpr{line: name.line, name: name.text})
+		if !p.accept(tokOp, ",") {
+			break
+		}
+	}
+	if err := p.expect(tokName, "in"); err != nil {
+		return nil, err
+	}
+	iter, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.suite()
+	if err != nil {
+		return nil, err
+	}
+	return &forStmt{line: line, targets: targets, iter: iter, body: body}, nil
+}
+
+func (p *scriptParser) expr() (scriptExpr, error) {
+	x, err := p.orExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); p.accept(tokName, "if") {
+		cond, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokName, "else"); err != nil {
+			return nil, err
+		}
+		elseVal, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{line: t.line, cond: cond, then: x, elseVal: elseVal}, nil
+	}
+	return x, nil
+}
+
+func (p *scriptParser) orExpr() (scriptExpr, error) {
+	x, err := p.andExpr()
+	for err == nil {
+		t := p.peek()
+		if !p.accept(tokName, "or") {
+			break
+		}
+		var y scriptExpr
+		if y, err = p.andExpr(); err == nil {
+			x = &binaryExpr{line: t.line, op: "or", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *scriptParser) andExpr() (scriptExpr, error) {
+	x, err := p.notExpr()
+	for err == nil {
+		t := p.peek()
+		if !p.accept(tokName, "and") {
+			break
+		}
+		var y scriptExpr
+		if y, err = p.notExpr(); err == nil {
+			x = &binaryExpr{line: t.line, op: "and", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *scriptParser) notExpr() (scriptExpr, error) {
+	if t := p.peek(); p.accept(tokName, "not") {
+		x, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{line: t.line, op: "not", x: x}, nil
+	}
+	return p.comparison()
+}
+
+func (p *scriptParser) comparison() (scriptExpr, error) {
+	x, err := p.arith()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op := ""
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		op = t.text
+		p.next()
+	case t.kind == tokName && t.text == "in":
+		op = "in"
+		p.next()
+	case t.kind == tokName && t.text == "not" && p.tokens[p.pos+1].kind == tokName && p.tokens[p.pos+1].text == "in":
+		op = "not in"
+		p.pos += 2
+	default:
+		return x, nil
+	}
+	y, err := p.arith()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryExpr{line: t.line, op: op, x: x, y: y}, nil
+}
+
+func (p *scriptParser) arith() (scriptExpr, error) {
+	x, err := p.term()
+	for err == nil {
+		t := p.peek()
+		if !(t.kind == tokOp && (t.text == "+" || t.text == "-")) {
+			break
+		}
+		p.next()
+		var y scriptExpr
+		if y, err = p.term(); err == nil {
+			x = &binaryExpr{line: t.line, op: t.text, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *scriptParser) term() (scriptExpr, error) {
+	x, err := p.unary()
+	for err == nil {
+		t := p.peek()
+		if !(t.kind == tokOp && (t.text == "*" || t.text == "/" || t.text == "//" || t.text == "%")) {
+			break
+		}
+		p.next()
+		var y scriptExpr
+		if y, err = p.unary(); err == nil {
+			x = &binaryExpr{line: t.line, op: t.text, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *scriptParser) unary() (scriptExpr, error) {
+	if t := p.peek(); t.kind == tokOp && (t.text == "-" || t.text == "+") {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{line: t.line, op: t.text, x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *scriptParser) postfix() (scriptExpr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.accept(tokOp, "."):
+			name := p.next()
+			if name.kind != tokName {
+				return nil, fmt.Errorf("%v: expected a name after the dot", t.line)
+			}
+			x = &attrExpr{line: t.line, x: x, name: name.text}
+		case p.accept(tokOp, "["):
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokOp, "]"); err != nil {
+				return nil, err
+			}
+			x = &indexExpr{line: t.line, x: x, index: index}
+		case p.accept(tokOp, "("):
+			call := &callExpr{line: t.line, fn: x}
+			for !p.accept(tokOp, ")") {
+				arg, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+				if !p.is(tokOp, ")") {
+					if err := p.expect(tokOp, ","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			x = call
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literalExpr{line: t.line, value: t.num}, nil
+	case tokString:
+		return &literalExpr{line: t.line, value: t.text}, nil
+	case tokName:
+		switch t.text {
+		case "True":
+			return &literalExpr{line: t.line, value: true}, nil
+		case "False":
+			return &literalExpr{line: t.line, value: false}, nil
+		case "None":
+			return &literalExpr{line: t.line, value: nil}, nil
+		}
+		if scriptKeywords[t.text] {
+			p.pos--
+			return nil, p.unexpected()
+		}
+		return &nameExpr{line: t.line, name: t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(tokOp, ")")
+		case "[":
+			list := &listExpr{line: t.line}
+			for !p.accept(tokOp, "]") {
+				elem, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				list.elems = append(list.elems, elem)
+				if !p.is(tokOp, "]") {
+					if err := p.expect(tokOp, ","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return list, nil
+		case "{":
+			dict := &dictExpr{line: t.line}
+			for !p.accept(tokOp, "}") {
+				key, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(tokOp, ":"); err != nil {
+					return nil, err
+				}
+				value, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				dict.keys = append(dict.keys, key)
+				dict.values = append(dict.values, value)
+				if !p.is(tokOp, "}") {
+					if err := p.expect(tokOp, ","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return dict, nil
+		}
+	}
+	if t.kind != tokEOF {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	shadow          = flag.Bool("shadow", false, "rehearse the import: read, transform, batch and connect as usual, but answer each batch locally after a simulated delay instead of sending it")
+	shadowLatency   = flag.Duration("shadow-latency", 0, "the simulated round trip of a -shadow request, 0 to measure it against the API")
+	shadowBandwidth = flag.String("shadow-bandwidth", "10MB", "the simulated upload speed of -shadow requests, per second")
+)
+
+// The simulated send, set up by setupShadow.
+var shadowSink struct {
+	latency   time.Duration
+	bandwidth int64
+
+	batches, bytes int64
+	simulated      int64 // nanoseconds
+}
+
+func setupShadow() error {
+	if !*shadow {
+		return nil
+	}
+	switch {
+	case *atomicPerFile:
+		return errors.New("-shadow can't stage and promote -atomic-per-file writes")
+	case *hashStore != "":
+		return errors.New("-shadow would record hashes of items it never wrote, leave out -hash-store")
+	case *registryCollection != "":
+		return errors.New("-shadow doesn't write the run to a -registry-collection, leave it out")
+	}
+	n, err := parseByteSize(*shadowBandwidth)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return errors.New("-shadow-bandwidth must be more than nothing")
+	}
+	shadowSink.bandwidth = n
+	return nil
+}
+
+// Measures the round trip to the API, on a connection that's already open,
+// unless -shadow-latency gives one.
+func measureShadowLatency() {
+	if !*shadow {
+		return
+	}
+	if *shadowLatency > 0 {
+		shadowSink.latency = *shadowLatency
+		return
+	}
+
+	var samples []time.Duration
+	for i := 0; i < 5; i++ {
+		started := time.Now()
+		resp, err := doRequest("HEAD", "", nil, nil)
+		if err != nil {
+			log.Printf("Warning: measuring the round trip for -shadow: %v", err)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		samples = append(samples, time.Since(started))
+	}
+	if len(samples) == 0 {
+		shadowSink.latency = 100 * time.Millisecond
+		log.Printf("Warning: simulating a %v round trip", shadowSink.latency)
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	shadowSink.latency = samples[len(samples)/2]
+	log.Printf("Shadow run, simulating a %v round trip and %v/s uploads", shadowSink.latency.Round(time.Microsecond), formatBytes(shadowSink.bandwidth))
+}
+
+// Answers a batch as a server that accepted all of it would, after the time
+// the round trip and upload should take, give or take a fifth.
+func shadowPost(b *batch) map[string]interface{} {
+	delay := shadowSink.latency + time.Duration(int64(len(b.body))*int64(time.Second)/shadowSink.bandwidth)
+	delay = time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+	time.Sleep(delay)
+
+	atomic.AddInt64(&shadowSink.batches, 1)
+	atomic.AddInt64(&shadowSink.bytes, int64(len(b.body)))
+	atomic.AddInt64(&shadowSink.simulated, int64(delay))
+
+	results := make([]interface{}, len(b.records))
+	for i := range results {
+		results[i] = map[string]interface{}{"status": "success"}
+	}
+	return map[string]interface{}{
+		"status":        "success",
+		"success_count": float64(len(b.records)),
+		"results":       results,
+	}
+}
+
+// Reports what a shadow run would have sent.
+func finishShadow(elapsed time.Duration) {
+	if !*shadow {
+		return
+	}
+	batches := atomic.LoadInt64(&shadowSink.batches)
+	simulated := time.Duration(atomic.LoadInt64(&shadowSink.simulated))
+	log.Printf("Shadow run finished in %v: %v batches, %v, nothing written", elapsed.Round(time.Millisecond), batches, formatBytes(atomic.LoadInt64(&shadowSink.bytes)))
+	if batches > 0 {
+		log.Printf("Simulated requests averaged %v, %v in all across %v workers", (simulated / time.Duration(batches)).Round(time.Millisecond), simulated.Round(time.Millisecond), *workerCount)
+	}
+}
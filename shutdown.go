@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long an import stopped with Ctrl-C or SIGTERM waits for the batches it has sent and queued before abandoning them; 0 waits for them however long they take")
+
+var (
+	// Done once an import is told to stop: no more records are read, and
+	// failed batches aren't retried.
+	stopping, stop = context.WithCancel(context.Background())
+	// Done once the batches still being sent are given up on, which fails
+	// their requests.
+	sending, abandonSends = context.WithCancel(context.Background())
+
+	// The signal that stopped the import.
+	stopSignal struct {
+		sync.Mutex
+		os.Signal
+	}
+)
+
+// Catches SIGINT and SIGTERM for the import. The first stops reading and
+// lets the batches read so far finish, for -shutdown-timeout; the second
+// gives up on them at once. Either way the import then finishes as it would
+// at the end of its inputs, saving the checkpoint and writing the summary.
+func startShutdownHandler() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		stopSignal.Lock()
+		stopSignal.Signal = sig
+		stopSignal.Unlock()
+		stop()
+		if *shutdownTimeout > 0 {
+			log.Printf("Stopping on %v: finishing the batches already read, for up to %v; signal again to stop now", sig, *shutdownTimeout)
+			time.AfterFunc(*shutdownTimeout, func() {
+				log.Printf("Abandoning the batches still being sent after %v", *shutdownTimeout)
+				abandonSends()
+			})
+		} else {
+			log.Printf("Stopping on %v: finishing the batches already read; signal again to stop now", sig)
+		}
+		<-signals
+		log.Printf("Abandoning the batches still being sent")
+		abandonSends()
+	}()
+}
+
+// Whether the import has been told to stop.
+func isStopping() bool {
+	return stopping.Err() != nil
+}
+
+// Ends an import that was stopped by a signal, once everything is saved, as
+// a process killed by it would: SIGINT exits with 130, SIGTERM with 143.
+func exitIfStopped() {
+	stopSignal.Lock()
+	sig := stopSignal.Signal
+	stopSignal.Unlock()
+	if sig == nil {
+		return
+	}
+	if *checkpointFile != "" {
+		log.Printf("Stopped on %v before the end of the inputs; run again with -resume to import the rest", sig)
+	} else {
+		log.Printf("Stopped on %v before the end of the inputs", sig)
+	}
+	code := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(s)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var sinkProfileName = flag.String("sink-profile", "", "send batches as this profile from the -config sink-profiles describes, for bulk endpoints other than Orchestrate's export stream one")
+
+// How batches are sent, from the -config sink-profiles:
+//
+//	sink-profiles:
+//	  ndjson:
+//	    endpoint: /ingest/v2/bulk
+//	    content-type: application/x-ndjson, application/orchestrate-export-stream+json
+//	    status: 202
+//	    protocol: "2"
+//
+// The endpoint is under the -base-path unless it starts with a slash. Content types
+// are in order of preference; the next is tried when the server answers 415
+// Unsupported Media Type, and sticks for the rest of the run.
+type sinkProfile struct {
+	Method       string   `json:"method"`
+	Endpoint     string   `json:"endpoint"`
+	ContentTypes ruleList `json:"content-type"`
+	// The status a successful response has.
+	Status int `json:"status"`
+	// The bulk protocol version the profile speaks, so it can be picked
+	// when the destination reports its version.
+	Protocol string `json:"protocol"`
+
+	name string
+
+	// The content type in use, an index into ContentTypes.
+	current int32
+}
+
+// The profile batches are sent with, Orchestrate's unless -sink-profile or
+// the pipeline's orchestrate sink names another.
+var bulkSink = &sinkProfile{
+	Method:       "POST",
+	ContentTypes: ruleList{"application/orchestrate-export-stream+json"},
+	Status:       200,
+}
+
+// The profile the -config pipeline's orchestrate sink names, if any.
+var pipelineSinkProfile string
+
+func setupSinkProfile() error {
+	name := *sinkProfileName
+	switch {
+	case name != "" && pipelineSinkProfile != "" && name != pipelineSinkProfile:
+		return fmt.Errorf("-sink-profile %v and the pipeline's sink profile %v disagree", name, pipelineSinkProfile)
+	case name == "":
+		name = pipelineSinkProfile
+	}
+	if name == "" {
+		return nil
+	}
+	return useSinkProfile(name)
+}
+
+func useSinkProfile(name string) error {
+	profile, ok := config.SinkProfiles[name]
+	if !ok {
+		return fmt.Errorf("no sink profile %q in the -config", name)
+	}
+	if profile.Method != "" {
+		bulkSink.Method = strings.ToUpper(profile.Method)
+	}
+	if profile.Status != 0 {
+		bulkSink.Status = profile.Status
+	}
+	if len(profile.ContentTypes) > 0 {
+		bulkSink.ContentTypes = profile.ContentTypes
+	}
+	bulkSink.Endpoint = profile.Endpoint
+	bulkSink.name = name
+	if http.StatusText(bulkSink.Status) == "" {
+		return fmt.Errorf("sink profile %v: unknown status %v", name, bulkSink.Status)
+	}
+	return nil
+}
+
+func (p *sinkProfile) contentType() string {
+	return p.ContentTypes[atomic.LoadInt32(&p.current)]
+}
+
+// Moves on from a content type the server refused, reporting whether there
+// is another to try.
+func (p *sinkProfile) refused(contentType string) bool {
+	i := atomic.LoadInt32(&p.current)
+	if p.ContentTypes[i] != contentType {
+		// Another batch already moved on.
+		return true
+	}
+	if int(i)+1 >= len(p.ContentTypes) {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&p.current, i, i+1) {
+		log.Printf("The server doesn't accept %v, sending %v instead", contentType, p.ContentTypes[i+1])
+	}
+	return true
+}
+
+// Switches to the first of the profile's content types the destination
+// accepts, if the one in use isn't.
+func (p *sinkProfile) accept(accepted []string) {
+	current := p.contentType()
+	for _, t := range accepted {
+		if strings.EqualFold(t, current) {
+			return
+		}
+	}
+	for i, t := range p.ContentTypes {
+		for _, a := range accepted {
+			if strings.EqualFold(t, a) {
+				atomic.StoreInt32(&p.current, int32(i))
+				log.Printf("The destination doesn't accept %v, sending %v instead", current, t)
+				return
+			}
+		}
+	}
+	log.Printf("Warning: the destination only accepts %v, not %v", strings.Join(accepted, ", "), current)
+}
+
+// The headers a batch payload is sent with.
+func bulkHeaders(contentType string, payload []byte, encoding string) map[string]string {
+	headers := map[string]string{"Content-Type": contentType}
+	for k, v := range checksumHeaders(payload) {
+		headers[k] = v
+	}
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	if encoding == "dcz" {
+		headers["Available-Dictionary"] = bodyDictionary.header()
+	}
+	return headers
+}
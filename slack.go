@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	slackWebhook  = flag.String("slack-webhook", "", "post progress and a summary of the run to this Slack incoming webhook URL")
+	slackInterval = flag.Duration("slack-interval", 15*time.Minute, "how often to post progress to the -slack-webhook")
+	runURL        = flag.String("run-url", "", "a link to the run's logs or dashboard for notifications, with {run} replaced by the run ID")
+)
+
+// Webhook posts have their own client, they don't go to the API.
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+var slackStop, slackStopped chan struct{}
+
+// Announces the run and posts its progress every -slack-interval.
+func startSlack() {
+	if *slackWebhook == "" {
+		return
+	}
+	postSlack(map[string]interface{}{"text": fmt.Sprintf("Started import run %v%v of %v", runID, labelSuffix(), strings.Join(currentRun.inputNames(), ", "))})
+
+	slackStop, slackStopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(slackStopped)
+		started := time.Now()
+		ticker := time.NewTicker(*slackInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				imported, failed := report.totals()
+				elapsed := time.Since(started)
+				postSlack(map[string]interface{}{"text": fmt.Sprintf("Import run %v%v: %v imported, %v failed after %v (%.0f a second)",
+					runID, labelSuffix(), imported, failed, elapsed.Round(time.Second), float64(imported)/elapsed.Seconds())})
+			case <-slackStop:
+				return
+			}
+		}
+	}()
+}
+
+// Posts the summary card once the run has finished.
+func finishSlack(run *runRecord) {
+	if *slackWebhook == "" {
+		return
+	}
+	close(slackStop)
+	<-slackStopped
+
+	imported, failed := report.totals()
+	duration := "-"
+	if run.Finished != nil {
+		duration = run.Finished.Sub(run.Started).Round(time.Second).String()
+	}
+	field := func(name string, value interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": "mrkdwn", "text": fmt.Sprintf("*%v*\n%v", name, value)}
+	}
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "header",
+			"text": map[string]interface{}{"type": "plain_text", "text": fmt.Sprintf("Import run %v%v %v", run.ID, labelSuffix(), run.Status)},
+		},
+		map[string]interface{}{
+			"type": "section",
+			"fields": []interface{}{
+				field("Imported", imported),
+				field("Failed", failed),
+				field("Duration", duration),
+				field("Inputs", len(run.Inputs)),
+			},
+		},
+	}
+	if *runURL != "" {
+		text := "<" + strings.Replace(*runURL, "{run}", run.ID, -1) + "|View the run>"
+		if failed > 0 {
+			text = "<" + strings.Replace(*runURL, "{run}", run.ID, -1) + "|View the errors>"
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": text},
+		})
+	}
+	postSlack(map[string]interface{}{
+		"text":   fmt.Sprintf("Import run %v %v: %v imported, %v failed in %v", run.ID, run.Status, imported, failed, duration),
+		"blocks": blocks,
+	})
+}
+
+func labelSuffix() string {
+	if *label == "" {
+		return ""
+	}
+	return " (" + *label + ")"
+}
+
+// Posts a message to the -slack-webhook. Failures are only logged, a
+// notification isn't worth stopping an import for.
+func postSlack(message map[string]interface{}) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error posting to Slack: %v", err)
+		return
+	}
+	resp, err := slackClient.Post(*slackWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error posting to Slack: %v", err)
+		return
+	}
+	if resp.StatusCode != 200 {
+		err = bulk.ParseError(resp)
+		log.Printf("Error posting to Slack: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+var smallFileSize = flag.String("small-file-size", "256KB", "inputs of at most this size are read whole and validated in one go, rather than streamed through the validator pool, which is quicker for many small files; 0 streams them all")
+
+// The -small-file-size in bytes, 0 for none.
+var smallFileBytes int64
+
+func setupSmallFiles() error {
+	n, err := parseByteSize(*smallFileSize)
+	if err != nil {
+		return fmt.Errorf("-small-file-size: %v", err)
+	}
+	if n < 0 {
+		return errors.New("-small-file-size can't be negative")
+	}
+	smallFileBytes = n
+	return nil
+}
+
+// Whether an input of the size is read whole and validated in one go, the
+// records being too few for reading them alongside the validator pool to
+// be worth the handoffs. Streams of unknown size, such as stdin and copied
+// collections, aren't.
+func isSmallFile(size int64) bool {
+	return size > 0 && size <= smallFileBytes
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	soak         = flag.Duration("soak", 0, "import the files over and over for this long, reporting resource use and failing if it keeps growing")
+	soakInterval = flag.Duration("soak-interval", time.Minute, "how often -soak reports heap, goroutine and file descriptor use")
+)
+
+// A leak is reported once a pass ends above these margins over the first
+// pass this many times in a row. The first pass is the baseline because it
+// warms up the pools and connections.
+const (
+	soakStrikes        = 3
+	soakGoroutineSlack = 50
+	soakFDSlack        = 20
+	soakHeapSlack      = 64 << 20
+)
+
+type resourceUse struct {
+	heap       uint64
+	goroutines int
+	// Open file descriptors, -1 where they can't be counted.
+	fds int
+}
+
+func (u resourceUse) String() string {
+	fds := "unknown"
+	if u.fds >= 0 {
+		fds = fmt.Sprint(u.fds)
+	}
+	return fmt.Sprintf("heap %v, %v goroutines, %v open files", formatBytes(int64(u.heap)), u.goroutines, fds)
+}
+
+func measureResources(collect bool) resourceUse {
+	if collect {
+		runtime.GC()
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	use := resourceUse{heap: mem.HeapAlloc, goroutines: runtime.NumGoroutine(), fds: -1}
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		use.fds = len(fds)
+	}
+	return use
+}
+
+// Which resources have grown past their margin over the baseline.
+func (u resourceUse) grownFrom(base resourceUse) []string {
+	var grown []string
+	if u.heap > 2*base.heap+soakHeapSlack {
+		grown = append(grown, "heap")
+	}
+	if u.goroutines > base.goroutines+soakGoroutineSlack {
+		grown = append(grown, "goroutines")
+	}
+	if u.fds >= 0 && base.fds >= 0 && u.fds > base.fds+soakFDSlack {
+		grown = append(grown, "open files")
+	}
+	return grown
+}
+
+// Runs importAll until -soak has passed, checking resource use between
+// passes, when the pipeline is idle and anything still held has leaked.
+func runSoak(importAll func()) error {
+	deadline := time.Now().Add(*soak)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(*soakInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("Soak: %v", measureResources(false))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var base resourceUse
+	strikes := 0
+	for pass := 1; ; pass++ {
+		importAll()
+		use := measureResources(true)
+		log.Printf("Soak: pass %v done, %v", pass, use)
+		if isStopping() {
+			return nil
+		}
+
+		if pass == 1 {
+			base = use
+		} else if grown := use.grownFrom(base); len(grown) > 0 {
+			strikes++
+			if strikes == soakStrikes {
+				return fmt.Errorf("soak: %v kept growing, from %v after the first pass to %v", strings.Join(grown, " and "), base, use)
+			}
+		} else {
+			strikes = 0
+		}
+
+		if time.Now().After(deadline) {
+			log.Printf("Soak: finished %v passes in %v", pass, *soak)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+var (
+	sortBy     = flag.String("by", "key", "what sort orders items by: key (collection, then key)")
+	sortMemory = flag.String("sort-memory", defaultSortMemory(), "how much input sort holds in memory before spilling a sorted run to disk")
+	sortUnique = flag.Bool("unique", false, "have sort keep only the last item for each key")
+	output     = flag.String("output", "", "the file subcommands write their output to (stdout when empty)")
+)
+
+type sortRecord struct {
+	key  string
+	line []byte
+}
+
+func sortKey(line []byte) (string, error) {
+	collection, key, err := itemPath(line)
+	if err != nil {
+		return "", err
+	}
+	// A NUL can't appear in either part, so this orders by collection first.
+	return collection + "\x00" + key, nil
+}
+
+// Implements "orcbulkimport sort [-by key] <files>", an external merge sort
+// that orders huge export streams without holding them in memory. Sorting is
+// stable, so of several items with the same key the last one read stays last.
+func sortCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport sort [-by key] [-unique] [-output file] <files>")
+	}
+	if *sortBy != "key" {
+		log.Fatalf("Error: unknown -by %q", *sortBy)
+	}
+	if err := setupFormat(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	limit, err := parseByteSize(*sortMemory)
+	if err != nil {
+		log.Fatalf("Error: -sort-memory: %v", err)
+	}
+
+	var chunk []sortRecord
+	var chunkSize int64
+	var spills []string
+	defer func() {
+		for _, name := range spills {
+			os.Remove(name)
+		}
+	}()
+
+	for _, filename := range args {
+		records, _, file, err := openRecords(filename)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		for {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading %v: %v", filename, err)
+			}
+			key, err := sortKey(line)
+			if err != nil {
+				log.Printf("Skipping record from %v: %v", filename, err)
+				continue
+			}
+
+			chunk = append(chunk, sortRecord{key, line})
+			chunkSize += int64(len(line) + len(key))
+			if chunkSize >= limit {
+				name, err := spill(chunk)
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+				spills = append(spills, name)
+				chunk, chunkSize = nil, 0
+			}
+		}
+		file.Close()
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	w := bufio.NewWriterSize(out, 1024*1024)
+
+	sort.SliceStable(chunk, func(i, j int) bool { return chunk[i].key < chunk[j].key })
+	if len(spills) == 0 {
+		err = writeSorted(w, &sliceRun{records: chunk})
+	} else {
+		log.Printf("Merging %v sorted runs", len(spills)+1)
+		err = mergeRuns(w, spills, chunk)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// Sorts a chunk and writes it to a temporary file, returning its name.
+func spill(chunk []sortRecord) (string, error) {
+	sort.SliceStable(chunk, func(i, j int) bool { return chunk[i].key < chunk[j].key })
+
+	file, err := ioutil.TempFile("", "orcbulkimport-sort-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriterSize(file, 1024*1024)
+	for _, r := range chunk {
+		w.Write(r.line)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// A sorted run of records, either in memory or spilled to disk.
+type sortedRun interface {
+	next() (*sortRecord, error)
+}
+
+type sliceRun struct {
+	records []sortRecord
+}
+
+func (r *sliceRun) next() (*sortRecord, error) {
+	if len(r.records) == 0 {
+		return nil, io.EOF
+	}
+	rec := &r.records[0]
+	r.records = r.records[1:]
+	return rec, nil
+}
+
+type fileRun struct {
+	reader *lineReader
+}
+
+func (r *fileRun) next() (*sortRecord, error) {
+	line, err := r.reader.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+	key, err := sortKey(line)
+	if err != nil {
+		return nil, err
+	}
+	return &sortRecord{key, line}, nil
+}
+
+// Writes a single run, dropping all but the last of each key with -unique.
+func writeSorted(w io.Writer, run sortedRun) error {
+	var pending *sortRecord
+	for {
+		rec, err := run.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if pending != nil && !(*sortUnique && pending.key == rec.key) {
+			if _, err := w.Write(pending.line); err != nil {
+				return err
+			}
+		}
+		pending = rec
+	}
+	if pending != nil {
+		_, err := w.Write(pending.line)
+		return err
+	}
+	return nil
+}
+
+// The head of each run, ordered by key and then by run so equal keys come
+// out in input order.
+type mergeHeap []mergeHead
+
+type mergeHead struct {
+	rec *sortRecord
+	run int
+}
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].rec.key != h[j].rec.key {
+		return h[i].rec.key < h[j].rec.key
+	}
+	return h[i].run < h[j].run
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Merges the spilled runs, in the order they were written, with the final
+// in-memory chunk which holds the most recent input.
+func mergeRuns(w io.Writer, spills []string, last []sortRecord) error {
+	var runs []sortedRun
+	for _, name := range spills {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		runs = append(runs, &fileRun{reader: &lineReader{reader: bufio.NewReaderSize(file, 256*1024)}})
+	}
+	runs = append(runs, &sliceRun{records: last})
+
+	h := &mergeHeap{}
+	for i, run := range runs {
+		rec, err := run.next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(h, mergeHead{rec, i})
+	}
+
+	merged := &heapRun{h: h, runs: runs}
+	return writeSorted(w, merged)
+}
+
+// Presents the merge as a single sorted run.
+type heapRun struct {
+	h    *mergeHeap
+	runs []sortedRun
+}
+
+func (m *heapRun) next() (*sortRecord, error) {
+	if m.h.Len() == 0 {
+		return nil, io.EOF
+	}
+	head := heap.Pop(m.h).(mergeHead)
+	rec, err := m.runs[head.run].next()
+	if err == nil {
+		heap.Push(m.h, mergeHead{rec, head.run})
+	} else if err != io.EOF {
+		return nil, err
+	}
+	return head.rec, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	outDir    = flag.String("out-dir", ".", "the directory subcommands write their output files to")
+	shardSize = flag.String("shard-size", "", "start a new split output file once one reaches this size, e.g. 512MB")
+)
+
+// Parses a byte count with an optional KB, MB or GB suffix (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// One collection's output, possibly spread over several shard files.
+type splitOutput struct {
+	collection string
+	file       *os.File
+	writer     *bufio.Writer
+	shard      int
+	written    int64
+	items      int
+	files      []string
+}
+
+func (o *splitOutput) write(line []byte, limit int64) error {
+	if o.file == nil || (limit > 0 && o.written+int64(len(line)) > limit && o.written > 0) {
+		if err := o.close(); err != nil {
+			return err
+		}
+		o.shard++
+
+		name := o.collection + ".json"
+		if limit > 0 {
+			name = fmt.Sprintf("%v-%05d.json", o.collection, o.shard)
+		}
+		name = filepath.Join(*outDir, name)
+
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		o.file, o.writer, o.written = file, bufio.NewWriterSize(file, 1024*1024), 0
+		o.files = append(o.files, name)
+	}
+
+	n, err := o.writer.Write(line)
+	o.written += int64(n)
+	o.items++
+	return err
+}
+
+func (o *splitOutput) close() error {
+	if o.file == nil {
+		return nil
+	}
+	err := o.writer.Flush()
+	if cerr := o.file.Close(); err == nil {
+		err = cerr
+	}
+	o.file = nil
+	return err
+}
+
+// Implements "orcbulkimport split <files>", which partitions export streams
+// into one file per collection (per shard with -shard-size) under -out-dir.
+func splitCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport split [-out-dir dir] [-shard-size size] <files>")
+	}
+	if err := setupFormat(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	var limit int64
+	if *shardSize != "" {
+		var err error
+		if limit, err = parseByteSize(*shardSize); err != nil {
+			log.Fatalf("Error: -shard-size: %v", err)
+		}
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	outputs := make(map[string]*splitOutput)
+	for _, filename := range args {
+		records, _, file, err := openRecords(filename)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		for {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading %v: %v", filename, err)
+			}
+
+			collection, _, err := itemPath(line)
+			if err != nil {
+				log.Printf("Skipping record from %v: %v", filename, err)
+				continue
+			}
+
+			out := outputs[collection]
+			if out == nil {
+				// Collection names end up in file names, keep them tame.
+				out = &splitOutput{collection: strings.Map(safeFileRune, collection)}
+				outputs[collection] = out
+			}
+			if err := out.write(line, limit); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		file.Close()
+	}
+
+	var names []string
+	for name, out := range outputs {
+		if err := out.close(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out := outputs[name]
+		log.Printf("Wrote %v items from %v to %v", out.items, name, strings.Join(out.files, ", "))
+	}
+}
+
+func safeFileRune(r rune) rune {
+	if r == '/' || r == '\\' || r == 0 || r == ':' {
+		return '_'
+	}
+	return r
+}
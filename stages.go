@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// What each stage of the import has done: reading records from the inputs,
+// transforming and checking them in the validator pool, and sending batches.
+// Busy is the time spent on the work itself, summed over the goroutines
+// doing it. Waited is time lost to the queue between stages: for reading,
+// blocked on a full queue to the validators; for transforming, chunks
+// waiting for a validator; for sending, batches waiting for a sender.
+//
+// Senders that are rarely idle and batches that wait long call for more
+// -workers; reading that is busy while the other stages wait calls for the
+// input to be moved closer.
+var stages struct {
+	read, transform, send stageCounter
+	started               time.Time
+	// How many inputs are read at once.
+	readers int
+}
+
+type stageCounter struct {
+	records, bytes, busy, waited int64
+}
+
+func (s *stageCounter) add(records, bytes int, busy, waited time.Duration) {
+	atomic.AddInt64(&s.records, int64(records))
+	atomic.AddInt64(&s.bytes, int64(bytes))
+	atomic.AddInt64(&s.busy, int64(busy))
+	atomic.AddInt64(&s.waited, int64(waited))
+}
+
+// A stage as /status reports it. Utilization is the share of the stage's
+// goroutines' time spent busy.
+type stageStatus struct {
+	Records       int64   `json:"records"`
+	Bytes         int64   `json:"bytes"`
+	RecordsPerSec float64 `json:"records_per_sec"`
+	BytesPerSec   float64 `json:"bytes_per_sec"`
+	Busy          string  `json:"busy"`
+	Waited        string  `json:"waited"`
+	Utilization   float64 `json:"utilization"`
+}
+
+type stagesStatus struct {
+	Read      stageStatus `json:"read"`
+	Transform stageStatus `json:"transform"`
+	Send      stageStatus `json:"send"`
+}
+
+// Starts timing the stages, with the number of inputs read at once.
+func startStages(readers int) {
+	stages.started, stages.readers = time.Now(), readers
+}
+
+func (s *stageCounter) status(goroutines int) stageStatus {
+	elapsed := time.Since(stages.started).Seconds()
+	status := stageStatus{
+		Records: atomic.LoadInt64(&s.records),
+		Bytes:   atomic.LoadInt64(&s.bytes),
+		Busy:    time.Duration(atomic.LoadInt64(&s.busy)).Round(time.Millisecond).String(),
+		Waited:  time.Duration(atomic.LoadInt64(&s.waited)).Round(time.Millisecond).String(),
+	}
+	if !stages.started.IsZero() && elapsed > 0 {
+		status.RecordsPerSec = float64(status.Records) / elapsed
+		status.BytesPerSec = float64(status.Bytes) / elapsed
+		status.Utilization = time.Duration(atomic.LoadInt64(&s.busy)).Seconds() / elapsed / float64(goroutines)
+	}
+	return status
+}
+
+func currentStages() stagesStatus {
+	return stagesStatus{
+		Read:      stages.read.status(stages.readers),
+		Transform: stages.transform.status(*validateWorkers),
+		Send:      stages.send.status(senderCount()),
+	}
+}
+
+// Logs what each stage did over the import.
+func logStages() {
+	status := currentStages()
+	var parts []string
+	for _, stage := range []struct {
+		name string
+		s    stageStatus
+	}{{"read", status.Read}, {"transform", status.Transform}, {"send", status.Send}} {
+		parts = append(parts, fmt.Sprintf("%v %v/s, %.0f%% busy, %v waited",
+			stage.name, formatBytes(int64(stage.s.BytesPerSec)), 100*stage.s.Utilization, stage.s.Waited))
+	}
+	log.Printf("Stages: %v", strings.Join(parts, "; "))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+var (
+	tenantField   = flag.String("tenant-field", "", "split the import by this document field, sending each tenant's records to the destination app the -config tenants gives it")
+	defaultTenant = flag.String("default-tenant", "", "the -config tenant for records whose -tenant-field is missing or not a tenant; without it they're skipped")
+)
+
+// A destination app from the -config, for one value of the -tenant-field:
+//
+//	tenants:
+//	  acme:
+//	    host: api.aws-eu-west-1.orchestrate.io
+//	    key-env: ACME_API_KEY
+//
+// The host defaults to -host. The key can be given directly with key, but
+// key-env keeps it out of the file.
+type tenant struct {
+	Host   string `json:"host"`
+	Key    string `json:"key"`
+	KeyEnv string `json:"key-env"`
+
+	name string
+}
+
+// The tenants set up from the -config, nil unless -tenant-field is given.
+var tenants map[string]*tenant
+
+func setupTenants() error {
+	if *tenantField == "" {
+		if *defaultTenant != "" {
+			return errors.New("-default-tenant needs a -tenant-field")
+		}
+		return nil
+	}
+	switch {
+	case len(config.Tenants) == 0:
+		return errors.New("-tenant-field needs the -config to list tenants")
+	case *atomicPerFile:
+		return errors.New("-atomic-per-file can't promote the staged items of several tenants")
+	case *checkpointFile != "":
+		return errors.New("-checkpoint can't follow the batches of several tenants, which interleave")
+	case anyCreateOnly():
+		return errors.New("-mode create-only can't check keys across several tenants")
+	case *previewConflicts:
+		return errors.New("-preview-conflicts can't check keys across several tenants")
+	}
+
+	tenants = make(map[string]*tenant)
+	for name, t := range config.Tenants {
+		t.name = name
+		if t.Host == "" {
+			t.Host = *host
+		}
+		if t.KeyEnv != "" {
+			if t.Key = os.Getenv(t.KeyEnv); t.Key == "" {
+				return fmt.Errorf("tenant %v: $%v isn't set", name, t.KeyEnv)
+			}
+		}
+		if t.Key == "" {
+			return fmt.Errorf("tenant %v has no key or key-env", name)
+		}
+		if *unixSocket != "" && t.Host != *host {
+			return fmt.Errorf("tenant %v: -unix-socket sends everything to -host, not %v", name, t.Host)
+		}
+		tenants[name] = t
+	}
+	if *defaultTenant != "" && tenants[*defaultTenant] == nil {
+		return fmt.Errorf("-default-tenant %v isn't in the -config tenants", *defaultTenant)
+	}
+	return nil
+}
+
+// Works out which tenant a record goes to from its -tenant-field.
+func routeTenant(line []byte) (*tenant, error) {
+	var item map[string]interface{}
+	if err := decodeJSON(line, &item); err != nil {
+		return nil, err
+	}
+	var name string
+	if value := itemValue(item); value != nil {
+		if doc, field, ok := lookupField(value, *tenantField); ok {
+			switch v := doc[field].(type) {
+			case string:
+				name = v
+			case json.Number:
+				name = v.String()
+			}
+		}
+	}
+	if t := tenants[name]; t != nil {
+		return t, nil
+	}
+	if *defaultTenant != "" {
+		return tenants[*defaultTenant], nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no %v to route by", *tenantField)
+	}
+	return nil, fmt.Errorf("%v %q isn't a tenant", *tenantField, name)
+}
+
+type tenantKey struct{}
+
+// Sends the requests made with the context to the tenant's app.
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// Returns the host and key requests made with the context go to.
+func destination(ctx context.Context) (string, string) {
+	if t, ok := ctx.Value(tenantKey{}).(*tenant); ok {
+		return t.Host, t.Key
+	}
+	return *host, *apiKey
+}
+
+// Logs how many records of a stream went to each tenant.
+func logTenants(filename string, counts map[*tenant]int) {
+	var names []string
+	byName := make(map[string]int)
+	for t, n := range counts {
+		names = append(names, t.name)
+		byName[t.name] = n
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Routed %v records from %v to tenant %v", byName[name], filename, name)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	delimiter = flag.String("delimiter", ",", "the field delimiter for -format csv and delimited (a single character, or \\t); tsv is tab delimited unless this is given")
+	quote     = flag.String("quote", "\"", "the quote character for -format csv, tsv and delimited, or none to disable quoting; tsv is unquoted unless this is given")
+	widths    = flag.String("widths", "", "comma separated column widths for -format fixed")
+	columns   = flag.String("columns", "", "comma separated column names for text formats (read from the first line when empty)")
+
+	// Parsed from the flags above by setupText.
+	delimiterRune rune
+	quoteRune     rune
+	columnWidths  []int
+	columnNames   []string
+)
+
+func setupText() error {
+	if *columns != "" {
+		columnNames = strings.Split(*columns, ",")
+	}
+
+	switch *format {
+	case "csv", "tsv", "delimited":
+		d, q := *delimiter, *quote
+		if *format == "tsv" {
+			// Tab separated values are conventionally unquoted.
+			if !flagGiven("delimiter") {
+				d = "\t"
+			}
+			if !flagGiven("quote") {
+				q = "none"
+			}
+		}
+		if d == `\t` || d == "tab" {
+			d = "\t"
+		}
+		if utf8.RuneCountInString(d) != 1 {
+			return fmt.Errorf("-delimiter must be a single character, not %q", *delimiter)
+		}
+		delimiterRune, _ = utf8.DecodeRuneInString(d)
+
+		switch {
+		case q == "none" || q == "":
+			quoteRune = 0
+		case utf8.RuneCountInString(q) == 1:
+			quoteRune, _ = utf8.DecodeRuneInString(q)
+		default:
+			return fmt.Errorf("-quote must be a single character or none, not %q", *quote)
+		}
+		if quoteRune == delimiterRune {
+			return errors.New("-quote and -delimiter must differ")
+		}
+
+	case "fixed":
+		if *widths == "" {
+			return errors.New("-format fixed requires -widths")
+		}
+		for _, w := range strings.Split(*widths, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid column width %q", w)
+			}
+			columnWidths = append(columnWidths, n)
+		}
+		if columnNames != nil && len(columnNames) != len(columnWidths) {
+			return fmt.Errorf("%d -columns given for %d -widths", len(columnNames), len(columnWidths))
+		}
+	}
+	return nil
+}
+
+// Reads text records one row at a time, converting each row to a document
+// keyed by the column names.
+type textReader struct {
+	reader *bufio.Reader
+	split  func(r *textReader, line string) ([]string, error)
+	names  []string
+	line   int
+	start  int
+}
+
+func newDelimitedReader(reader *bufio.Reader) recordReader {
+	return &textReader{reader: reader, split: splitDelimited, names: columnNames}
+}
+
+func newFixedReader(reader *bufio.Reader) recordReader {
+	return &textReader{reader: reader, split: splitFixed, names: columnNames}
+}
+
+func (r *textReader) ReadRecord() ([]byte, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		r.start = r.line
+		fields, err := r.split(r, line)
+		if err != nil {
+			log.Printf("Skipping line %v: %v", r.line, err)
+			continue
+		}
+
+		if r.names == nil {
+			r.names = fields
+			continue
+		}
+		if len(fields) > len(r.names) {
+			log.Printf("Skipping line %v: %d fields for %d columns", r.line, len(fields), len(r.names))
+			continue
+		}
+
+		doc := make(map[string]interface{}, len(fields))
+		for i, field := range fields {
+			doc[r.names[i]] = field
+		}
+
+		record, err := newItem(doc)
+		if err != nil {
+			log.Printf("Skipping line %v: %v", r.line, err)
+			continue
+		}
+		return record, nil
+	}
+}
+
+func (r *textReader) Source() (string, int) { return "", r.start }
+
+// Returns the next line without its line ending.
+func (r *textReader) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if r.line++; r.line == 1 {
+		// Spreadsheets often start their exports with a byte order mark,
+		// which isn't part of the first column name.
+		line = strings.TrimPrefix(line, "\ufeff")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Splits a row on the delimiter, honouring the quote character. A quoted
+// field may contain delimiters, doubled quotes and line breaks.
+func splitDelimited(r *textReader, line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	quoted, start := false, r.line
+
+	for {
+		for i := 0; i < len(line); {
+			c, size := utf8.DecodeRuneInString(line[i:])
+			i += size
+
+			switch {
+			case quoted && c == quoteRune:
+				if strings.HasPrefix(line[i:], string(quoteRune)) {
+					field.WriteRune(c)
+					i += size
+				} else {
+					quoted = false
+				}
+			case quoted:
+				field.WriteRune(c)
+			case c == quoteRune && quoteRune != 0 && field.Len() == 0:
+				quoted = true
+			case c == delimiterRune:
+				fields = append(fields, field.String())
+				field.Reset()
+			default:
+				field.WriteRune(c)
+			}
+		}
+		if !quoted {
+			break
+		}
+
+		next, err := r.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("unterminated quoted field starting on line %v", start)
+		}
+		field.WriteByte('\n')
+		line = next
+	}
+
+	return append(fields, field.String()), nil
+}
+
+// Splits a row into the configured column widths, trimming the padding. A
+// short row yields fewer fields.
+func splitFixed(r *textReader, line string) ([]string, error) {
+	runes := []rune(line)
+	fields := make([]string, 0, len(columnWidths))
+	for _, w := range columnWidths {
+		if len(runes) == 0 {
+			break
+		}
+		if w > len(runes) {
+			w = len(runes)
+		}
+		fields = append(fields, strings.TrimSpace(string(runes[:w])))
+		runes = runes[w:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log"
+	"sync/atomic"
+)
+
+var tlsSessionCache = flag.Int("tls-session-cache", 256, "how many TLS sessions are kept to resume connections to the API with, which skips most of the handshake when a proxy or the server closes connections often; 0 turns resumption off")
+
+// The TLS handshakes made with the API, and how many of them resumed a
+// session rather than negotiating a new one.
+var handshakes struct {
+	total, resumed int64
+}
+
+// Adds session resumption, and counting the handshakes, to the TLS
+// settings.
+func setupSessionResumption(conf *tls.Config) error {
+	if *tlsSessionCache < 0 {
+		return errors.New("-tls-session-cache can't be negative")
+	}
+	if *tlsSessionCache > 0 {
+		conf.ClientSessionCache = tls.NewLRUClientSessionCache(*tlsSessionCache)
+	} else {
+		conf.SessionTicketsDisabled = true
+	}
+	// Called for every handshake, resumed or not, once the server is
+	// verified.
+	conf.VerifyConnection = func(state tls.ConnectionState) error {
+		atomic.AddInt64(&handshakes.total, 1)
+		if state.DidResume {
+			atomic.AddInt64(&handshakes.resumed, 1)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Logs how many handshakes the run made. Many more full handshakes than
+// workers means connections are being closed under them.
+func logHandshakes() {
+	total, resumed := atomic.LoadInt64(&handshakes.total), atomic.LoadInt64(&handshakes.resumed)
+	if total == 0 {
+		return
+	}
+	log.Printf("TLS handshakes: %v, %v of them resumed", total, resumed)
+	if full := total - resumed; full > int64(2*senderCount()) {
+		hint := "a proxy may be closing them, or not letting sessions resume"
+		if *tlsSessionCache == 0 {
+			hint = "leave out -tls-session-cache 0 to resume sessions"
+		}
+		log.Printf("Warning: %v full handshakes for %v workers, connections are being reopened; %v", full, senderCount(), hint)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This is a parser for the TOML config files use: [tables], [[arrays of
+// tables]], dotted and quoted keys, basic and literal strings, multi-line
+// ones too, integers, floats, booleans, arrays and inline tables. Dates and
+// times are returned as the strings they're written as, and numbers as
+// json.Number, as parseYAML returns them.
+
+var (
+	tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+	tomlDate    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}|$)|^\d{2}:\d{2}:\d{2}`)
+)
+
+type tomlParser struct {
+	text string
+	pos  int
+	// The tables given a [header], which can't be given another, and the
+	// inline tables and arrays, which can't be added to.
+	defined map[string]bool
+	closed  map[string]bool
+}
+
+func parseTOML(data []byte) (interface{}, error) {
+	p := &tomlParser{text: strings.Replace(string(data), "\r\n", "\n", -1), defined: make(map[string]bool), closed: make(map[string]bool)}
+	root := make(map[string]interface{})
+	table, tablePath := root, ""
+	for {
+		p.skipSpace(true)
+		if p.pos == len(p.text) {
+			return root, nil
+		}
+		var err error
+		if p.text[p.pos] == '[' {
+			table, tablePath, err = p.parseHeader(root)
+		} else {
+			err = p.parseKeyValue(table, tablePath)
+		}
+		if err == nil {
+			err = p.endLine()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: %v", p.line(), err)
+		}
+	}
+}
+
+// The line the parser is on, from 1.
+func (p *tomlParser) line() int {
+	return strings.Count(p.text[:p.pos], "\n") + 1
+}
+
+// Skips spaces and tabs and comments, and newlines too if asked to.
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == ' ' || c == '\t' || newlines && c == '\n':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Checks nothing but a comment follows on the line.
+func (p *tomlParser) endLine() error {
+	p.skipSpace(false)
+	if p.pos < len(p.text) && p.text[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q after the value", p.rest())
+	}
+	return nil
+}
+
+// The rest of the line, for errors.
+func (p *tomlParser) rest() string {
+	rest := p.text[p.pos:]
+	if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+// Parses a [table] or [[array of tables]] header, returning the table the
+// key/value pairs after it go in.
+func (p *tomlParser) parseHeader(root map[string]interface{}) (map[string]interface{}, string, error) {
+	array := strings.HasPrefix(p.text[p.pos:], "[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, "", err
+	}
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if !strings.HasPrefix(p.text[p.pos:], closing) {
+		return nil, "", fmt.Errorf("expected %v after the table name", closing)
+	}
+	p.pos += len(closing)
+
+	parent, parentPath, err := p.descend(root, "", keys[:len(keys)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	last := keys[len(keys)-1]
+	path := joinTOMLPath(parentPath, last)
+	if p.closed[path] {
+		return nil, "", fmt.Errorf("%v can't be extended", path)
+	}
+	if array {
+		list, ok := parent[last].([]interface{})
+		if _, exists := parent[last]; exists && !ok {
+			return nil, "", fmt.Errorf("%v is already defined", path)
+		}
+		table := make(map[string]interface{})
+		parent[last] = append(list, table)
+		// The new element's tables are its own.
+		for defined := range p.defined {
+			if strings.HasPrefix(defined, path+".") {
+				delete(p.defined, defined)
+			}
+		}
+		return table, path, nil
+	}
+
+	if p.defined[path] {
+		return nil, "", fmt.Errorf("table %v is defined twice", path)
+	}
+	p.defined[path] = true
+	table, _, err := p.descend(parent, parentPath, []string{last})
+	return table, path, err
+}
+
+// Finds the table the keys lead to from the given one, making any that
+// aren't there yet. An array of tables leads to its last element.
+func (p *tomlParser) descend(table map[string]interface{}, path string, keys []string) (map[string]interface{}, string, error) {
+	for _, key := range keys {
+		path = joinTOMLPath(path, key)
+		switch next := table[key].(type) {
+		case nil:
+			child := make(map[string]interface{})
+			table[key] = child
+			table = child
+		case map[string]interface{}:
+			if p.closed[path] {
+				return nil, "", fmt.Errorf("%v can't be extended", path)
+			}
+			table = next
+		case []interface{}:
+			child, ok := next[len(next)-1].(map[string]interface{})
+			if !ok || p.closed[path] {
+				return nil, "", fmt.Errorf("%v isn't a table", path)
+			}
+			table = child
+		default:
+			return nil, "", fmt.Errorf("%v isn't a table", path)
+		}
+	}
+	return table, path, nil
+}
+
+func joinTOMLPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Parses a key = value pair into the table.
+func (p *tomlParser) parseKeyValue(table map[string]interface{}, tablePath string) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if p.pos == len(p.text) || p.text[p.pos] != '=' {
+		return fmt.Errorf("expected = after %v", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpace(false)
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	parent, path, err := p.descend(table, tablePath, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	path = joinTOMLPath(path, last)
+	if _, exists := parent[last]; exists {
+		return fmt.Errorf("%v is defined twice", path)
+	}
+	parent[last] = value
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		p.closed[path] = true
+	}
+	return nil
+}
+
+// Parses a key of one or more parts separated by dots.
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		var key string
+		switch {
+		case strings.HasPrefix(p.text[p.pos:], `"`):
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case strings.HasPrefix(p.text[p.pos:], "'"):
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			key = tomlBareKey.FindString(p.text[p.pos:])
+			if key == "" {
+				return nil, fmt.Errorf("expected a key, not %q", p.rest())
+			}
+			p.pos += len(key)
+		}
+		keys = append(keys, key)
+		p.skipSpace(false)
+		if p.pos == len(p.text) || p.text[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	rest := p.text[p.pos:]
+	switch {
+	case rest == "" || rest[0] == '\n':
+		return nil, fmt.Errorf("expected a value")
+	case strings.HasPrefix(rest, `"""`):
+		return p.parseMultilineString(`"""`)
+	case strings.HasPrefix(rest, "'''"):
+		return p.parseMultilineString("'''")
+	case rest[0] == '"':
+		return p.parseBasicString()
+	case rest[0] == '\'':
+		return p.parseLiteralString()
+	case rest[0] == '[':
+		return p.parseArray()
+	case rest[0] == '{':
+		return p.parseInlineTable()
+	}
+
+	end := strings.IndexAny(rest, ",]}#\n")
+	if end < 0 {
+		end = len(rest)
+	}
+	token := strings.TrimRight(rest[:end], " \t")
+	if tomlDate.MatchString(token) {
+		p.pos += len(token)
+		return token, nil
+	}
+	if i := strings.IndexAny(token, " \t"); i >= 0 {
+		token = token[:i]
+	}
+	p.pos += len(token)
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return parseTOMLNumber(token)
+}
+
+func parseTOMLNumber(token string) (interface{}, error) {
+	n := strings.Replace(token, "_", "", -1)
+	unsigned := strings.TrimLeft(n, "+-")
+	if len(unsigned) > 2 && unsigned[0] == '0' && strings.ContainsRune("xob", rune(unsigned[1])) {
+		i, err := strconv.ParseInt(n, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", token)
+		}
+		return json.Number(strconv.FormatInt(i, 10)), nil
+	}
+	n = strings.TrimPrefix(n, "+")
+	if _, err := strconv.ParseFloat(n, 64); err != nil || strings.ContainsAny(unsigned, "infa") {
+		return nil, fmt.Errorf("bad value %q", token)
+	}
+	return json.Number(n), nil
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.text); {
+		switch c := p.text[p.pos]; c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\n':
+			return "", fmt.Errorf("unterminated string")
+		case '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	end := strings.IndexAny(p.text[p.pos+1:], "'\n")
+	if end < 0 || p.text[p.pos+1+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.text[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return s, nil
+}
+
+// Parses a string in triple quotes, which can run over several lines.
+func (p *tomlParser) parseMultilineString(quotes string) (string, error) {
+	p.pos += len(quotes)
+	// A newline straight after the opening quotes is left out.
+	if strings.HasPrefix(p.text[p.pos:], "\n") {
+		p.pos++
+	}
+	var b strings.Builder
+	for p.pos < len(p.text) {
+		if strings.HasPrefix(p.text[p.pos:], quotes) {
+			// Up to two quotes can end the string too.
+			end := p.pos + len(quotes)
+			for i := 0; i < 2 && end < len(p.text) && p.text[end] == quotes[0]; i++ {
+				end++
+			}
+			b.WriteString(p.text[p.pos : end-len(quotes)])
+			p.pos = end
+			return b.String(), nil
+		}
+		c := p.text[p.pos]
+		if c != '\\' || quotes == "'''" {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if rest := strings.TrimLeft(p.text[p.pos+1:], " \t"); strings.HasPrefix(rest, "\n") {
+			// A backslash at the end of a line trims the whitespace after
+			// it.
+			p.pos = len(p.text) - len(strings.TrimLeft(rest, " \t\n"))
+			continue
+		}
+		if err := p.parseEscape(&b); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+// Parses the backslash escape at the parser's position.
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.text) {
+		return fmt.Errorf("unterminated string")
+	}
+	c := p.text[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		digits := 4
+		if c == 'U' {
+			digits = 8
+		}
+		if p.pos+digits > len(p.text) {
+			return fmt.Errorf("bad \\%c escape", c)
+		}
+		r, err := strconv.ParseUint(p.text[p.pos:p.pos+digits], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("bad \\%c escape", c)
+		}
+		b.WriteRune(rune(r))
+		p.pos += digits
+	default:
+		return fmt.Errorf("bad escape \\%c", c)
+	}
+	return nil
+}
+
+// Parses an [array], whose values can be on several lines.
+func (p *tomlParser) parseArray() (interface{}, error) {
+	list := []interface{}{}
+	p.pos++
+	for {
+		p.skipSpace(true)
+		if p.pos < len(p.text) && p.text[p.pos] == ']' {
+			p.pos++
+			return list, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+		p.skipSpace(true)
+		switch {
+		case p.pos < len(p.text) && p.text[p.pos] == ',':
+			p.pos++
+		case p.pos < len(p.text) && p.text[p.pos] == ']':
+		default:
+			return nil, fmt.Errorf("unterminated array")
+		}
+	}
+}
+
+// Parses an {inline table}, which is all on one line.
+func (p *tomlParser) parseInlineTable() (interface{}, error) {
+	table := make(map[string]interface{})
+	inner := &tomlParser{defined: make(map[string]bool), closed: make(map[string]bool)}
+	p.pos++
+	for first := true; ; first = false {
+		p.skipSpace(false)
+		if p.pos < len(p.text) && p.text[p.pos] == '}' && first {
+			p.pos++
+			return table, nil
+		}
+		// The pairs are parsed as a table's are, sharing the text.
+		inner.text, inner.pos = p.text, p.pos
+		if err := inner.parseKeyValue(table, ""); err != nil {
+			return nil, err
+		}
+		p.pos = inner.pos
+		p.skipSpace(false)
+		switch {
+		case p.pos < len(p.text) && p.text[p.pos] == ',':
+			p.pos++
+		case p.pos < len(p.text) && p.text[p.pos] == '}':
+			p.pos++
+			return table, nil
+		default:
+			return nil, fmt.Errorf("unterminated inline table")
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"strings"
+)
+
+var provenance = flag.Bool("provenance", false, "add _source_file, _source_line and _import_run_id fields to every document")
+
+// A transform rewrites an export stream item in place before it is sent.
+// Returning an error skips the record, quietly if it's errDropRecord.
+type transform func(item map[string]interface{}, pos recordPos) error
+
+// Where a record was read from. The line is the record number for formats
+// that aren't line oriented.
+type recordPos struct {
+	file string
+	line int
+}
+
+// Returned by a transform that wants its record left out of the import.
+var errDropRecord = errors.New("record dropped")
+
+// The transforms enabled by the flags, applied in order.
+var transforms []transform
+
+// Sets up the transforms selected by the flags.
+func setupTransforms() error {
+	// First, so the transforms after it see the text as it should be.
+	if *fixEncoding {
+		transforms = append(transforms, fixEncodingTransform)
+	}
+	// Documents are already wrapped in the default collection.
+	if collectionRoutes != nil || defaultCollection != "" && !formats[*format].documents {
+		transforms = append(transforms, routeCollection)
+	}
+	if err := setupCollectionRules(); err != nil {
+		return err
+	}
+	if *assetFields != "" {
+		t, err := newAssetTransform()
+		if err != nil {
+			return err
+		}
+		transforms = append(transforms, t)
+	}
+	if *script != "" {
+		t, err := newScriptTransform(*script)
+		if err != nil {
+			return err
+		}
+		transforms = append(transforms, t)
+	}
+	if *redactionProfile != "" {
+		t, err := newRedactionTransform(*redactionProfile)
+		if err != nil {
+			return err
+		}
+		transforms = append(transforms, t)
+	}
+	if *labelField != "" {
+		t, err := newLabelTransform()
+		if err != nil {
+			return err
+		}
+		transforms = append(transforms, t)
+	}
+	if *provenance {
+		transforms = append(transforms, addProvenance)
+	}
+	// With a pipeline, records are staged as they reach the orchestrate
+	// sink instead.
+	if *atomicPerFile && config.Pipeline == nil {
+		transforms = append(transforms, stageItem)
+	}
+	return setupPipeline()
+}
+
+// Whether records are rewritten on their way to the import.
+func transforming() bool {
+	return len(transforms) > 0 || pipeline != nil
+}
+
+// Runs the transforms over a record, leaving it untouched if there are none.
+func applyTransforms(record []byte, pos recordPos) ([]byte, error) {
+	record, _, err := transformRecord(record, pos)
+	return record, err
+}
+
+// Runs the transforms and then the -config pipeline over a record, also
+// returning what the pipeline's file sinks should get. Records the pipeline
+// doesn't import are dropped.
+func transformRecord(record []byte, pos recordPos) ([]byte, []archivedLine, error) {
+	if !transforming() {
+		return record, nil, nil
+	}
+
+	if *fixEncoding {
+		// Before it's decoded, which would replace the bytes that aren't
+		// UTF-8.
+		record = fixCharset(record)
+	}
+	var item map[string]interface{}
+	if err := decodeJSON(record, &item); err != nil {
+		return nil, nil, err
+	}
+	for _, t := range transforms {
+		if err := t(item, pos); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var archived []archivedLine
+	if pipeline != nil {
+		var out pipelineOutput
+		if err := pipeline.run(item, pos, &out); err != nil {
+			return nil, out.archived, err
+		}
+		if item, archived = out.send, out.archived; item == nil {
+			return nil, archived, errDropRecord
+		}
+	}
+
+	record, err := json.Marshal(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(record, '\n'), archived, nil
+}
+
+// Decodes a record to rewrite, keeping its numbers as json.Number so they're
+// written back as they were read: a float64 would round 64-bit IDs and long
+// decimals.
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid character after the JSON value")
+	}
+	return nil
+}
+
+// Records where each document came from so bad data found later can be
+// traced to its origin.
+func addProvenance(item map[string]interface{}, pos recordPos) error {
+	if value := itemValue(item); value != nil {
+		value["_source_file"] = pos.file
+		value["_source_line"] = pos.line
+		value["_import_run_id"] = runID
+	}
+	return nil
+}
+
+// Returns the item's document, or nil if it has none.
+func itemValue(item map[string]interface{}) map[string]interface{} {
+	value, _ := item["value"].(map[string]interface{})
+	return value
+}
+
+// Looks up a dotted field path such as "thumbnail.path" in a document,
+// returning the object holding the last element along with its name.
+func lookupField(doc map[string]interface{}, path string) (map[string]interface{}, string, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		doc = next
+	}
+	name := parts[len(parts)-1]
+	_, ok := doc[name]
+	return doc, name, ok
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	prewarm         = flag.Int("prewarm", -1, "open this many connections to the API before sending anything, -1 for one per worker")
+	forceIPv4       = flag.Bool("force-ipv4", false, "only connect to the API over IPv4")
+	forceIPv6       = flag.Bool("force-ipv6", false, "only connect to the API over IPv6")
+	maxConnsPerHost = flag.Int("max-conns-per-host", 0, "never have more than this many connections open to the API, 0 for no limit; requests beyond it wait for a connection to free up")
+	unixSocket      = flag.String("unix-socket", "", "send requests over this unix domain socket, in plain HTTP, to a local gateway that handles TLS")
+
+	operator = flag.String("operator", "", "who is running the import, sent with every API request so the server's audit logs can attribute it")
+
+	tlsMinVersion = flag.String("tls-min-version", "1.2", "the oldest TLS version to accept from the API: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers    = flag.String("tls-ciphers", "", "a comma separated list of the cipher suites to offer for TLS 1.2 and older, by their Go names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; TLS 1.3 suites aren't configurable")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// The TLS 1.2 cipher suites a FIPS build may offer. TLS 1.3 suites are all
+// AES-GCM once the Go Cryptographic Module is in FIPS mode.
+var fipsCipherSuites = map[uint16]bool{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   true,
+}
+
+// Sets up the client used for all API requests.
+func setupClient() error {
+	if *forceIPv4 && *forceIPv6 {
+		return errors.New("-force-ipv4 and -force-ipv6 can't both be set")
+	}
+	if *unixSocket != "" && (*forceIPv4 || *forceIPv6) {
+		return errors.New("-force-ipv4 and -force-ipv6 don't apply to -unix-socket")
+	}
+	if strings.ContainsAny(*operator, "()\\\r\n") {
+		return errors.New("-operator can't contain parentheses, backslashes or line breaks")
+	}
+	if *maxConnsPerHost < 0 {
+		return errors.New("-max-conns-per-host can't be negative")
+	}
+
+	// The dialer tries IPv6 and IPv4 addresses in parallel, falling back
+	// from one family to the other after a short delay, so both dual stack
+	// and single stack hosts connect promptly.
+	dialer := &net.Dialer{
+		Timeout:       dialTimeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: 300 * time.Millisecond,
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch {
+		case *unixSocket != "":
+			// Requests still carry -host, the gateway decides where they go.
+			network, addr = "unix", *unixSocket
+		case *forceIPv4:
+			network = "tcp4"
+		case *forceIPv6:
+			network = "tcp6"
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return conns.track(conn), nil
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	proxy, err := newProxy()
+	if err != nil {
+		return err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 proxy,
+		MaxIdleConnsPerHost:   senderCount(),
+		MaxConnsPerHost:       *maxConnsPerHost,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+	}
+	if faults != nil {
+		transport = &faultTransport{next: transport}
+	}
+	client = &http.Client{Transport: transport}
+	return nil
+}
+
+// Builds the TLS settings from -tls-min-version, -tls-ciphers, the
+// certificate flags and -tls-session-cache. A build with -tags fips
+// checks them against what FIPS 140-3 allows, and fails if the Go
+// Cryptographic Module's FIPS mode has been turned off with GODEBUG.
+func newTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[*tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown -tls-min-version %q", *tlsMinVersion)
+	}
+	conf := &tls.Config{MinVersion: minVersion}
+	if err := addCertificates(conf); err != nil {
+		return nil, err
+	}
+	if err := setupSessionResumption(conf); err != nil {
+		return nil, err
+	}
+
+	if *tlsCiphers != "" {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(*tlsCiphers, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			if fipsBuild && !fipsCipherSuites[id] {
+				return nil, fmt.Errorf("cipher suite %v isn't FIPS approved", name)
+			}
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+	}
+
+	if fipsBuild {
+		if !fipsEnabled() {
+			return nil, errors.New("this is a FIPS build but FIPS 140-3 mode is off, check GODEBUG doesn't set fips140=off")
+		}
+		if minVersion < tls.VersionTLS12 {
+			return nil, errors.New("a FIPS build needs -tls-min-version 1.2 or later")
+		}
+		conf.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+		log.Printf("Using the Go Cryptographic Module in FIPS 140-3 mode")
+	}
+	return conf, nil
+}
+
+var localHostname, _ = os.Hostname()
+
+// Identifies the run to the API: in the User-Agent, for logs that keep only
+// that, and in headers of its own.
+func setAuditHeaders(req *http.Request) {
+	agent := fmt.Sprintf("orcbulkimport (run %v; host %v", runID, localHostname)
+	if *operator != "" {
+		agent += "; operator " + *operator
+	}
+	req.Header.Set("User-Agent", agent+")")
+	req.Header.Set("X-Import-Run", runID)
+	if *operator != "" {
+		req.Header.Set("X-Import-Operator", *operator)
+	}
+}
+
+// The scheme API requests are made with, the -scheme if there is one. A
+// gateway behind -unix-socket terminates TLS itself, so it's spoken to in
+// plain HTTP.
+func apiScheme() string {
+	if *schemeFlag != "" {
+		return *schemeFlag
+	}
+	if *unixSocket != "" {
+		return "http"
+	}
+	return "https"
+}
+
+// Opens and handshakes connections up front, all at once, so the workers
+// start on warm connections rather than each waiting on its own handshake.
+// The requests are all in flight together which makes the transport open a
+// connection for each, and they stay pooled for the workers to pick up.
+func prewarmConnections() {
+	n := *prewarm
+	if n < 0 {
+		n = *workerCount
+	}
+	if *maxConnsPerHost > 0 && n > *maxConnsPerHost {
+		n = *maxConnsPerHost
+	}
+	if n == 0 || replay != nil || *dryRun {
+		return
+	}
+
+	started := time.Now()
+	var warmed sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for i := 0; i < n; i++ {
+		warmed.Add(1)
+		go func() {
+			defer warmed.Done()
+			resp, err := doRequest("HEAD", "", nil, nil)
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			// Whatever the status, drain the body so the connection is kept.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	warmed.Wait()
+
+	if failed > 0 {
+		log.Printf("Warning: %v of %v connections failed to open", failed, n)
+	}
+	log.Printf("Opened %v connections in %v", n-failed, time.Since(started).Round(time.Millisecond))
+}
+
+// Counts the connections to the API, for the admin status.
+var conns = &connCounter{}
+
+type connCounter struct {
+	open, peak, dialed int64
+	warned             int32
+}
+
+// A connection that is counted until it's closed.
+type countedConn struct {
+	net.Conn
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { atomic.AddInt64(&conns.open, -1) })
+	return c.Conn.Close()
+}
+
+// Counts a new connection. Each worker needs only one, so without a
+// -max-conns-per-host cap a warning is logged the first time there are more
+// open than workers: the transport is opening duplicates, usually because
+// hedged or timed out requests left their connections busy.
+func (c *connCounter) track(conn net.Conn) net.Conn {
+	atomic.AddInt64(&c.dialed, 1)
+	open := atomic.AddInt64(&c.open, 1)
+	for {
+		peak := atomic.LoadInt64(&c.peak)
+		if open <= peak || atomic.CompareAndSwapInt64(&c.peak, peak, open) {
+			break
+		}
+	}
+
+	if *maxConnsPerHost == 0 && open > int64(*workerCount) && atomic.CompareAndSwapInt32(&c.warned, 0, 1) {
+		log.Printf("Warning: %v connections are open for %v workers, set -max-conns-per-host to cap them", open, *workerCount)
+	}
+	return &countedConn{Conn: conn}
+}
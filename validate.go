@@ -0,0 +1,314 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/moediddy/db/bulkimport"
+)
+
+var (
+	validateWorkers = flag.Int("validate-workers", resources.cpus, "the number of procs validating and transforming records, separate from -workers")
+	invalidRecords  = flag.String("invalid-records", "skip", "what to do with records that aren't JSON objects, found before anything is sent: skip logs and leaves them out, fail stops the import at the first, dead-letter also writes them to the -dead-letter file")
+)
+
+type rawRecord struct {
+	line []byte
+	pos  recordPos
+}
+
+type checkedRecord struct {
+	line   []byte
+	record batchRecord
+}
+
+// How a chunk of records was validated, as the importer's Chunk.Meta.
+type validateResult struct {
+	records   []checkedRecord
+	unchanged int
+	exists    int
+	dropped   int
+	// Records imported by the run being resumed.
+	resumed int
+	// Records that lost the -merge to another with the same key.
+	merged int
+	// Records skipped because they couldn't be processed.
+	skipped int
+	// Records that aren't JSON objects, and that don't match the -schema.
+	invalid    int
+	violations int
+	// Lines for the -config pipeline's file sinks.
+	archived []archivedLine
+}
+
+// How many records have been found invalid, before or, with -dry-run,
+// after the transforms.
+var invalidCount int64
+
+func setupValidation() error {
+	switch *invalidRecords {
+	case "skip", "fail":
+	case "dead-letter":
+		if !*deadLetter {
+			return fmt.Errorf("-invalid-records dead-letter needs -dead-letter")
+		}
+	default:
+		return fmt.Errorf("unknown -invalid-records %q", *invalidRecords)
+	}
+	return nil
+}
+
+// Checks a record as read is a JSON object, reporting where it isn't as
+// -invalid-records says.
+func checkRecord(raw rawRecord) (bool, error) {
+	return recordValid(raw, scanObject(raw.line))
+}
+
+// Reports the record as -invalid-records says if err says why it's invalid,
+// returning whether it's valid. The error, with -invalid-records fail, stops
+// the import.
+func recordValid(raw rawRecord, err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	atomic.AddInt64(&invalidCount, 1)
+	logCode(codeRecordInvalid, "Invalid record at %v:%v: %v", raw.pos.file, raw.pos.line, err)
+	if *invalidRecords == "fail" {
+		return false, fmt.Errorf("stopped at the invalid record at %v:%v, as -invalid-records is fail", raw.pos.file, raw.pos.line)
+	}
+	if *invalidRecords == "dead-letter" {
+		deadLetters.writeInvalid(raw, err)
+	}
+	return false, nil
+}
+
+// Runs the CPU bound part of an import, transforms, -enrich-url and the
+// -hash-store and -mode checks, on a chunk of a stream's records, leaving
+// in it those to be sent.
+func validateStream(stream *bulkimport.Stream, chunk *bulkimport.Chunk) error {
+	started := time.Now()
+	raws := make([]rawRecord, len(chunk.Records))
+	for i, record := range chunk.Records {
+		raws[i] = rawRecord{record.Line, record.Meta.(recordPos)}
+	}
+	result, err := validateChunk(raws)
+	stages.transform.add(len(raws), chunk.Bytes, time.Since(started), chunk.Waiting)
+	if err != nil {
+		return err
+	}
+
+	records := make([]bulkimport.Record, len(result.records))
+	for i, checked := range result.records {
+		records[i] = bulkimport.Record{Line: checked.line, Key: batchKey{checked.record.tenant, checked.record.group}, Meta: checked.record}
+	}
+	chunk.Records, result.records = records, nil
+	chunk.Meta = result
+	return nil
+}
+
+func validateChunk(raws []rawRecord) (validateResult, error) {
+	if *passthrough {
+		return passthroughChunk(raws)
+	}
+	var result validateResult
+	observeSchema(raws)
+
+	var transformed []rawRecord
+	// The records as they were read, kept for the -dead-letter file when
+	// transforms or -enrich-url change them.
+	var sources [][]byte
+	keepSources := *deadLetter && (transforming() || *enrichURL != "")
+	for _, raw := range raws {
+		if checkpoints.imported(raw.pos) {
+			result.resumed++
+			continue
+		}
+		valid, err := checkRecord(raw)
+		if err != nil {
+			return result, err
+		}
+		if !valid {
+			result.invalid++
+			continue
+		}
+		if !mergeWins(raw.line, raw.pos) {
+			result.merged++
+			continue
+		}
+		line, archived, err := transformRecord(raw.line, raw.pos)
+		result.archived = append(result.archived, archived...)
+		if err == errDropRecord {
+			result.dropped++
+			continue
+		}
+		if err != nil {
+			logCode(codeRecordSkipped, "Skipping record from %v:%v: %v", raw.pos.file, raw.pos.line, err)
+			result.skipped++
+			continue
+		}
+		transformed = append(transformed, rawRecord{line, raw.pos})
+		if keepSources {
+			sources = append(sources, raw.line)
+		}
+	}
+
+	if *enrichURL != "" && len(transformed) > 0 {
+		lines := make([][]byte, len(transformed))
+		for i, raw := range transformed {
+			lines[i] = raw.line
+		}
+		enriched, err := enrich(lines)
+		if err != nil {
+			first, last := transformed[0].pos, transformed[len(transformed)-1].pos
+			logCode(codeRecordSkipped, "Skipping %v records from %v:%v to %v:%v: %v", len(transformed), first.file, first.line, last.file, last.line, err)
+			result.skipped += len(transformed)
+			return result, nil
+		}
+		for i := range transformed {
+			transformed[i].line = enriched[i]
+		}
+	}
+
+	for i, raw := range transformed {
+		line, pos := raw.line, raw.pos
+		record := batchRecord{pos: pos}
+		if keepSources {
+			record.source = sources[i]
+		}
+		if *dryRun && !dryRunValid(line, pos) {
+			result.skipped++
+			continue
+		}
+		if !checkSchema(line, pos) {
+			result.violations++
+			continue
+		}
+		if tenants != nil {
+			var err error
+			if record.tenant, err = routeTenant(line); err != nil {
+				logCode(codeRecordSkipped, "Skipping record from %v:%v: %v", pos.file, pos.line, err)
+				result.skipped++
+				continue
+			}
+		}
+		var err error
+		if record.group, err = recordGroup(line); err != nil {
+			logCode(codeRecordSkipped, "Skipping record from %v:%v: %v", pos.file, pos.line, err)
+			result.skipped++
+			continue
+		}
+		if checkpoints.importedKey(record.tenant, line) {
+			result.resumed++
+			continue
+		}
+		if hashes != nil {
+			var changed bool
+			var err error
+			if record.id, record.hash, changed, err = hashes.check(line); err != nil {
+				logCode(codeRecordSkipped, "Skipping record from %v:%v: %v", pos.file, pos.line, err)
+				result.skipped++
+				continue
+			}
+			if !changed {
+				result.unchanged++
+				continue
+			}
+		}
+		if createOnly(line) {
+			found, err := itemExists(line)
+			if err != nil {
+				logCode(codeRecordSkipped, "Skipping record from %v:%v: %v", pos.file, pos.line, err)
+				result.skipped++
+				continue
+			}
+			if found {
+				result.exists++
+				continue
+			}
+		}
+
+		result.records = append(result.records, checkedRecord{line, record})
+	}
+	return result, nil
+}
+
+// Where the nth record read from an input came from: its line, or the
+// file and line a recordSource says.
+func recordPosition(filename string, n int, records recordReader) recordPos {
+	pos := recordPos{filename, n}
+	if src, ok := records.(recordSource); ok {
+		var file string
+		if file, pos.line = src.Source(); file != "" {
+			pos.file = file
+		}
+	}
+	return pos
+}
+
+// Implements "orcbulkimport validate <files>", which checks that every record
+// is a well formed item addressed to a collection and key without sending
+// anything. Exits with status 1 if any record is invalid.
+func validateCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport validate [-validate-report file] <files>")
+	}
+	if err := setupFormat(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := checkValidateReport(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	invalid := 0
+	var validated []validatedFile
+	for _, filename := range args {
+		records, _, file, err := openRecords(filename)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		count, bad := 0, 0
+		var failures []validationFailure
+		for {
+			line, err := records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Error reading %v: %v", filename, err)
+			}
+			count++
+
+			if _, _, err := scanItemPath(line); err != nil {
+				pos := recordPos{filename, count}
+				if src, ok := records.(recordSource); ok {
+					var name string
+					if name, pos.line = src.Source(); name != "" {
+						pos.file = name
+					}
+				}
+				log.Printf("Invalid record at %v:%v: %v", pos.file, pos.line, err)
+				failures = append(failures, validationFailure{pos, err})
+				bad++
+			}
+		}
+		file.Close()
+
+		log.Printf("Validated %v records from %v (%v invalid)", count, filename, bad)
+		invalid += bad
+		validated = append(validated, validatedFile{filename, count, failures})
+	}
+
+	if err := writeValidateReport(validated); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
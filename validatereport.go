@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	validateReport       = flag.String("validate-report", "", "write validate's results to this file for CI, in the -validate-report-format")
+	validateReportFormat = flag.String("validate-report-format", "junit", "the format of the -validate-report: junit (XML) or sarif")
+)
+
+// An invalid record, for the -validate-report.
+type validationFailure struct {
+	pos recordPos
+	err error
+}
+
+// The records validate checked in one file.
+type validatedFile struct {
+	name     string
+	count    int
+	failures []validationFailure
+}
+
+func checkValidateReport() error {
+	switch *validateReportFormat {
+	case "junit", "sarif":
+		return nil
+	}
+	return fmt.Errorf("unknown -validate-report-format %q", *validateReportFormat)
+}
+
+func writeValidateReport(files []validatedFile) error {
+	if *validateReport == "" {
+		return nil
+	}
+	file, err := os.Create(*validateReport)
+	if err != nil {
+		return err
+	}
+	if *validateReportFormat == "sarif" {
+		err = writeSARIF(file, files)
+	} else {
+		err = writeJUnit(file, files)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// Writes a suite for each file with a failing case for each invalid record,
+// or a single passing case when they're all valid.
+func writeJUnit(file *os.File, files []validatedFile) error {
+	suites := junitSuites{Name: "orcbulkimport validate"}
+	for _, f := range files {
+		suite := junitSuite{Name: f.name, Failures: len(f.failures)}
+		for _, failure := range f.failures {
+			suite.Cases = append(suite.Cases, junitCase{
+				Name:      fmt.Sprintf("%v:%v", failure.pos.file, failure.pos.line),
+				Classname: f.name,
+				File:      failure.pos.file,
+				Line:      failure.pos.line,
+				Failure:   &junitFailure{Message: failure.err.Error(), Type: "invalid-record"},
+			})
+		}
+		if len(suite.Cases) == 0 {
+			suite.Cases = []junitCase{{Name: fmt.Sprintf("%v valid records", f.count), Classname: f.name}}
+		}
+		suite.Tests = len(suite.Cases)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := file.WriteString(xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(file)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := file.WriteString("\n")
+	return err
+}
+
+// Writes a SARIF 2.1.0 log with a result for each invalid record.
+func writeSARIF(file *os.File, files []validatedFile) error {
+	type location struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region struct {
+				StartLine int `json:"startLine"`
+			} `json:"region"`
+		} `json:"physicalLocation"`
+	}
+	type message struct {
+		Text string `json:"text"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+
+	results := []result{}
+	for _, f := range files {
+		for _, failure := range f.failures {
+			var loc location
+			loc.PhysicalLocation.ArtifactLocation.URI = filepath.ToSlash(failure.pos.file)
+			loc.PhysicalLocation.Region.StartLine = failure.pos.line
+			results = append(results, result{
+				RuleID:    "invalid-record",
+				Level:     "error",
+				Message:   message{failure.err.Error()},
+				Locations: []location{loc},
+			})
+		}
+	}
+
+	sarif := map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []interface{}{map[string]interface{}{
+			"tool": map[string]interface{}{"driver": map[string]interface{}{
+				"name": "orcbulkimport",
+				"rules": []interface{}{map[string]interface{}{
+					"id":               "invalid-record",
+					"shortDescription": message{"The record isn't a valid export stream item"},
+				}},
+			}},
+			"results": results,
+		}},
+	}
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarif)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var (
+	verifySample = flag.Float64("verify-sample", 100, "the percentage of the records verify checks, chosen at random")
+	verifyReport = flag.String("verify-report", "", "write verify's report of the missing and mismatched records to this file instead of stdout")
+)
+
+// A record verify checks, as the import would have sent it.
+type verifyRecord struct {
+	id    itemID
+	pos   recordPos
+	value json.RawMessage
+}
+
+// A record of the report verify writes, one JSON object per line.
+type verifyDiff struct {
+	Collection string   `json:"collection"`
+	Key        string   `json:"key"`
+	Source     string   `json:"source"`
+	Status     string   `json:"status"`
+	Fields     []string `json:"fields,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Implements "orcbulkimport verify [-verify-sample percent] <files>", which
+// reads the files as an import would, transforms and all, gets each record's
+// key from the destination, -workers at once, and checks its value is the
+// one the file has. The records missing or different, or that couldn't be
+// got, are reported a line each, and verify exits with 1 if there are any.
+// Where a file has a key more than once, its last record is the one checked,
+// being the one the import left.
+func verifyCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: orcbulkimport verify [-verify-sample percent] [-verify-report file] <files>")
+	}
+	if *verifySample <= 0 || *verifySample > 100 {
+		log.Fatalf("Error: -verify-sample should be a percentage, more than 0 and at most 100")
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupFormat(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupCollections(args); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupTransforms(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupRateLimit(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	records := make(map[itemID]verifyRecord)
+	total := 0
+	for _, filename := range args {
+		n, err := readVerifyFile(filename, records)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		total += n
+	}
+	sampled := make([]verifyRecord, 0, len(records))
+	for _, record := range records {
+		sampled = append(sampled, record)
+	}
+	sort.Slice(sampled, func(i, j int) bool {
+		a, b := sampled[i].id, sampled[j].id
+		return a.collection < b.collection || a.collection == b.collection && a.key < b.key
+	})
+	log.Printf("Verifying %v of the %v records read", len(sampled), total)
+
+	out := os.Stdout
+	if *verifyReport != "" {
+		file, err := os.Create(*verifyReport)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		out = file
+	}
+	diffs := verifyRecords(sampled)
+	encoder := json.NewEncoder(out)
+	counts := make(map[string]int)
+	for _, diff := range diffs {
+		counts[diff.Status]++
+		if err := encoder.Encode(diff); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	if *verifyReport != "" {
+		if err := out.Close(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	log.Printf("%v of the %v records verified match, %v missing, %v different, %v couldn't be checked",
+		len(sampled)-len(diffs), len(sampled), counts["missing"], counts["mismatch"], counts["error"])
+	if len(diffs) > 0 {
+		if *verifyReport != "" {
+			log.Printf("Wrote the %v records that don't match to %v", len(diffs), *verifyReport)
+		}
+		os.Exit(1)
+	}
+}
+
+// Reads a file's records, transformed as the import would, keeping the
+// -verify-sample of them. Returns how many records the file has.
+func readVerifyFile(filename string, records map[itemID]verifyRecord) (int, error) {
+	reader, _, file, err := openRecords(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	src, _ := reader.(recordSource)
+
+	count := 0
+	for n := 1; ; n++ {
+		line, err := reader.ReadRecord()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("reading %v: %v", filename, err)
+		}
+		pos := recordPos{filename, n}
+		if src != nil {
+			if source, sourceLine := src.Source(); source != "" {
+				pos = recordPos{source, sourceLine}
+			}
+		}
+		if line, err = applyTransforms(line, pos); err != nil {
+			// Records the transforms drop or fail weren't imported.
+			continue
+		}
+		var item struct {
+			Path struct {
+				Collection string `json:"collection"`
+				Key        string `json:"key"`
+			} `json:"path"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(line, &item); err != nil || item.Path.Collection == "" || item.Path.Key == "" {
+			continue
+		}
+		count++
+		id := itemID{item.Path.Collection, item.Path.Key}
+		if _, ok := records[id]; ok || *verifySample >= 100 || rand.Float64()*100 < *verifySample {
+			records[id] = verifyRecord{id, pos, item.Value}
+		}
+	}
+}
+
+// Gets the records' keys from the destination, -workers at once, returning
+// the records that don't match.
+func verifyRecords(records []verifyRecord) []verifyDiff {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var diffs []verifyDiff
+	jobs := make(chan verifyRecord)
+	for i := 0; i < *workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range jobs {
+				if diff := verifyItem(record); diff != nil {
+					mu.Lock()
+					diffs = append(diffs, *diff)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, record := range records {
+		jobs <- record
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i], diffs[j]
+		return a.Collection < b.Collection || a.Collection == b.Collection && a.Key < b.Key
+	})
+	return diffs
+}
+
+// Checks a record against its key on the destination, nil if it matches.
+func verifyItem(record verifyRecord) *verifyDiff {
+	diff := &verifyDiff{
+		Collection: record.id.collection,
+		Key:        record.id.key,
+		Source:     fmt.Sprintf("%v:%v", record.pos.file, record.pos.line),
+	}
+	var value json.RawMessage
+	found := true
+	path := url.PathEscape(record.id.collection) + "/" + url.PathEscape(record.id.key)
+	err := retryRequest(fmt.Sprintf("getting %v/%v", record.id.collection, record.id.key), func() error {
+		_, err := jsonReply("GET", path, nil, 200, &value)
+		if bulk.StatusCode(err) == 404 {
+			found, err = false, nil
+		}
+		return err
+	})
+
+	switch {
+	case err != nil:
+		diff.Status, diff.Error = "error", err.Error()
+	case !found:
+		diff.Status = "missing"
+	default:
+		fields, err := diffValues(record.value, value)
+		switch {
+		case err != nil:
+			diff.Status, diff.Error = "error", err.Error()
+		case len(fields) > 0:
+			diff.Status, diff.Fields = "mismatch", fields
+		default:
+			return nil
+		}
+	}
+	return diff
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/moediddy/db/bulk"
+)
+
+var journalReport = flag.String("journal-report", "", "write verify-journal's discrepancy report to this file as JSON; defaults to stdout")
+
+type journalVerification struct {
+	Journal     string    `json:"journal"`
+	Destination string    `json:"destination"`
+	Generated   time.Time `json:"generated"`
+	Runs        []string  `json:"runs"`
+	Keys        int       `json:"keys"`
+	Verified    int       `json:"verified"`
+	// Items missing altogether, present but without the journaled ref, and
+	// those that couldn't be checked.
+	Missing    []journalDiscrepancy `json:"missing,omitempty"`
+	RefMissing []journalDiscrepancy `json:"ref_missing,omitempty"`
+	Errors     []journalDiscrepancy `json:"errors,omitempty"`
+}
+
+type journalDiscrepancy struct {
+	journalItem
+	Run   string `json:"run"`
+	Batch int    `json:"batch"`
+	Error string `json:"error,omitempty"`
+}
+
+// Implements "orcbulkimport verify-journal -journal file", which checks
+// that every item the journal has as acknowledged is on the destination at
+// the ref it was given, with -workers reads at once. The journal's batches
+// are written only once the destination has answered for them, so anything
+// missing was lost after it was acknowledged. Exits with 1 if anything is.
+func verifyJournalCommand(args []string) {
+	if *journalFile == "" || len(args) > 0 {
+		log.Fatalf("Usage: orcbulkimport verify-journal -journal file [-journal-report file]")
+	}
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupTenants(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if err := setupClient(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	items, runs, err := readJournalItems(*journalFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	result := &journalVerification{Journal: *journalFile, Destination: *host, Generated: time.Now().UTC(), Runs: runs, Keys: len(items)}
+	log.Printf("Verifying %v items from %v runs", len(items), len(runs))
+
+	var mu sync.Mutex
+	work := make(chan journalDiscrepancy)
+	var wg sync.WaitGroup
+	for i := 0; i < *workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				found, err := verifyJournalItem(item.journalItem)
+				mu.Lock()
+				switch {
+				case err != nil:
+					item.Error = err.Error()
+					result.Errors = append(result.Errors, item)
+				case found == "":
+					result.Verified++
+				case found == "key":
+					result.Missing = append(result.Missing, item)
+				default:
+					result.RefMissing = append(result.RefMissing, item)
+				}
+				if done := result.Verified + len(result.Missing) + len(result.RefMissing) + len(result.Errors); done%10000 == 0 {
+					log.Printf("Progress verified %v of %v items", done, len(items))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, item := range items {
+		work <- item
+	}
+	close(work)
+	wg.Wait()
+
+	for _, list := range [][]journalDiscrepancy{result.Missing, result.RefMissing, result.Errors} {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Collection != list[j].Collection {
+				return list[i].Collection < list[j].Collection
+			}
+			return list[i].Key < list[j].Key
+		})
+	}
+	log.Printf("Verified %v of %v items: %v missing, %v without the journaled ref, %v couldn't be checked",
+		result.Verified, len(items), len(result.Missing), len(result.RefMissing), len(result.Errors))
+	if err := writeJournalReport(result); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if result.Verified < len(items) {
+		os.Exit(1)
+	}
+}
+
+// Reads the acknowledged items of every run in the journal. An item
+// acknowledged more than once is checked at the last ref it was given.
+func readJournalItems(name string) ([]journalDiscrepancy, []string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	latest := make(map[journalItem]int)
+	var items []journalDiscrepancy
+	var runs []string
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		var entry journalEntry
+		if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				// A last line cut short by a crash.
+				break
+			}
+			return nil, nil, fmt.Errorf("%v:%v: %v", name, n, jsonErr)
+		}
+		if entry.Type == "start" {
+			runs = append(runs, entry.Run)
+		}
+		for _, item := range entry.Items {
+			id := journalItem{Collection: item.Collection, Key: item.Key, Tenant: item.Tenant}
+			d := journalDiscrepancy{journalItem: item, Run: entry.Run, Batch: entry.Batch}
+			if i, ok := latest[id]; ok {
+				items[i] = d
+				continue
+			}
+			latest[id] = len(items)
+			items = append(items, d)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return items, runs, nil
+}
+
+// Looks the item up on the destination, returning what's missing: "key"
+// when there's no item, "ref" when the item is there but not at the ref,
+// and nothing when it's as journaled.
+func verifyJournalItem(item journalItem) (string, error) {
+	var t *tenant
+	if item.Tenant != "" {
+		if t = tenants[item.Tenant]; t == nil {
+			return "", fmt.Errorf("tenant %v isn't in the -config, pass it with -tenant-field", item.Tenant)
+		}
+	}
+	path := url.PathEscape(item.Collection) + "/" + url.PathEscape(item.Key)
+	if item.Ref != "" {
+		found, err := journalItemExists(t, path+"/refs/"+url.PathEscape(item.Ref))
+		if err != nil || found {
+			return "", err
+		}
+	}
+	found, err := journalItemExists(t, path)
+	switch {
+	case err != nil:
+		return "", err
+	case !found:
+		return "key", nil
+	case item.Ref != "":
+		return "ref", nil
+	}
+	return "", nil
+}
+
+func journalItemExists(t *tenant, path string) (bool, error) {
+	resp, err := doRequestContext(withTenant(context.Background(), t), "GET", path, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		io.Copy(ioutil.Discard, resp.Body)
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, bulk.ParseError(resp)
+}
+
+func writeJournalReport(result *journalVerification) error {
+	var out io.Writer = os.Stdout
+	if *journalReport != "" {
+		file, err := os.Create(*journalReport)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	body, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(body, '\n'))
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	stallTimeout = flag.Duration("stall-timeout", 5*time.Minute, "how long an import can have batches outstanding without one being acknowledged before the watchdog writes out the goroutine stacks and pipeline state and acts on the stall; 0 turns it off")
+	stallAction  = flag.String("stall-action", "recover", "what the watchdog does about a stall: recover gives up on the requests being sent so they're retried, aborting if nothing is acknowledged by the next -stall-timeout either; abort saves the checkpoint and exits")
+)
+
+// Watches for an import that has batches to send and isn't getting any of
+// them acknowledged, which would otherwise run forever.
+type stallWatchdog struct {
+	// Batches queued and not yet answered, and requests being sent.
+	outstanding int64
+	inFlight    int64
+	// When a batch was last answered, or the first queued after none were
+	// outstanding, in Unix nanoseconds.
+	progressed int64
+
+	mu sync.Mutex
+	// The context batches are sent in, which recovering from a stall
+	// cancels and replaces.
+	attempts context.Context
+	cancel   context.CancelFunc
+	// The stalls since a batch was last answered.
+	stalls int
+
+	// How many batches are waiting for a sender, once the import has
+	// started.
+	waiting func() int
+}
+
+var watchdog = newStallWatchdog()
+
+func newStallWatchdog() *stallWatchdog {
+	w := &stallWatchdog{}
+	w.attempts, w.cancel = context.WithCancel(sending)
+	return w
+}
+
+func setupWatchdog() error {
+	switch {
+	case *stallTimeout < 0:
+		return errors.New("-stall-timeout can't be negative")
+	case *stallAction != "recover" && *stallAction != "abort":
+		return fmt.Errorf("-stall-action %v isn't recover or abort", *stallAction)
+	}
+	return nil
+}
+
+// Checks for stalls every tenth of the -stall-timeout.
+func startWatchdog() {
+	if *stallTimeout == 0 {
+		return
+	}
+	interval := *stallTimeout / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	go func() {
+		for range time.Tick(interval) {
+			watchdog.check()
+		}
+	}()
+}
+
+// The context a batch's attempt is sent in.
+func (w *stallWatchdog) context() context.Context {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.attempts
+}
+
+// Records a batch queued to be sent.
+func (w *stallWatchdog) queued() {
+	if atomic.AddInt64(&w.outstanding, 1) == 1 {
+		atomic.StoreInt64(&w.progressed, time.Now().UnixNano())
+	}
+}
+
+// Records a response to a batch, done if nothing more of the batch is left
+// to send.
+func (w *stallWatchdog) answered(done bool) {
+	if done {
+		atomic.AddInt64(&w.outstanding, -1)
+	}
+	atomic.StoreInt64(&w.progressed, time.Now().UnixNano())
+	w.mu.Lock()
+	w.stalls = 0
+	w.mu.Unlock()
+}
+
+func (w *stallWatchdog) queue() int {
+	if w.waiting == nil {
+		return 0
+	}
+	return w.waiting()
+}
+
+// Records a request starting or, with -1, finishing.
+func (w *stallWatchdog) sendingRequest(delta int64) {
+	atomic.AddInt64(&w.inFlight, delta)
+}
+
+func (w *stallWatchdog) check() {
+	if atomic.LoadInt64(&w.outstanding) <= 0 || isStopping() {
+		return
+	}
+	stalled := time.Since(time.Unix(0, atomic.LoadInt64(&w.progressed)))
+	if stalled < *stallTimeout {
+		return
+	}
+	// The next stall is counted from now.
+	atomic.StoreInt64(&w.progressed, time.Now().UnixNano())
+
+	state := fmt.Sprintf("no batch acknowledged for %v, with %v batches outstanding, %v requests being sent and %v queued",
+		stalled.Round(time.Second), atomic.LoadInt64(&w.outstanding), atomic.LoadInt64(&w.inFlight), w.queue())
+	if name, err := w.dump(state); err != nil {
+		log.Printf("Error writing the goroutine stacks: %v", err)
+		logCode(codeStalled, "Stalled: %v", state)
+	} else {
+		logCode(codeStalled, "Stalled: %v; wrote the goroutine stacks to %v", state, name)
+	}
+
+	w.mu.Lock()
+	w.stalls++
+	recovering := *stallAction == "recover" && w.stalls == 1
+	if recovering {
+		w.cancel()
+		w.attempts, w.cancel = context.WithCancel(sending)
+	}
+	w.mu.Unlock()
+	if recovering {
+		log.Printf("Giving up on the requests being sent to retry them")
+		return
+	}
+
+	log.Printf("Aborting the stalled import")
+	checkpoints.save()
+	os.Exit(1)
+}
+
+// Writes the pipeline state and every goroutine's stack to a temporary
+// file, returning its name.
+func (w *stallWatchdog) dump(state string) (string, error) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "Run %v stalled at %v: %v\n\n", runID, time.Now().Format(time.RFC3339), state)
+	out.Write(buf)
+
+	file, err := ioutil.TempFile("", "orcbulkimport-stall-*.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(out.Bytes()); err != nil {
+		file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// An xz decoder for .xz inputs: the container format with LZMA2 blocks,
+// which is all xz writes unless a filter such as BCJ is asked for. Block
+// checks are verified; the index is checked only for its integrity.
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+var errXZCorrupt = errors.New("xz: corrupt input")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+type xzReader struct {
+	r   *bufio.Reader
+	err error
+
+	// The check of the stream being read, -1 between streams.
+	check     int
+	checkHash hash.Hash
+
+	// Within a block.
+	inBlock   bool
+	lzma2     *lzma2Decoder
+	compSize  int64
+	outBuffer []byte
+}
+
+func newXZReader(r *bufio.Reader) (io.Reader, error) {
+	x := &xzReader{r: r, check: -1}
+	if err := x.streamHeader(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xzReader) Read(p []byte) (int, error) {
+	for len(x.outBuffer) == 0 {
+		if x.err != nil {
+			return 0, x.err
+		}
+		x.err = x.next()
+	}
+	n := copy(p, x.outBuffer)
+	x.outBuffer = x.outBuffer[n:]
+	return n, nil
+}
+
+func (x *xzReader) next() error {
+	switch {
+	case x.check < 0:
+		// Between streams, which may be separated by padding.
+		for {
+			b, err := x.r.Peek(1)
+			if err == io.EOF {
+				return io.EOF
+			}
+			if err != nil {
+				return err
+			}
+			if b[0] != 0 {
+				return x.streamHeader()
+			}
+			var padding [4]byte
+			if _, err := io.ReadFull(x.r, padding[:]); err != nil || padding != [4]byte{} {
+				return errXZCorrupt
+			}
+		}
+	case !x.inBlock:
+		return x.blockHeader()
+	}
+
+	chunk, err := x.lzma2.chunk()
+	if err != nil {
+		return err
+	}
+	if chunk == nil {
+		return x.endBlock()
+	}
+	if x.checkHash != nil {
+		x.checkHash.Write(chunk)
+	}
+	x.outBuffer = chunk
+	return nil
+}
+
+func (x *xzReader) streamHeader() error {
+	var header [12]byte
+	if _, err := io.ReadFull(x.r, header[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if !bytes.Equal(header[:6], xzMagic) {
+		return errors.New("xz: not an xz stream")
+	}
+	if header[6] != 0 || header[7] > 0x0f || crc32.ChecksumIEEE(header[6:8]) != binary.LittleEndian.Uint32(header[8:]) {
+		return errXZCorrupt
+	}
+	x.check = int(header[7])
+	return nil
+}
+
+// The size of each check type's field, from the spec.
+func xzCheckSize(check int) int {
+	if check == 0 {
+		return 0
+	}
+	return 4 << uint((check-1)/3)
+}
+
+func (x *xzReader) newCheck() hash.Hash {
+	switch x.check {
+	case 1:
+		return crc32.NewIEEE()
+	case 4:
+		return crc64.New(crc64Table)
+	case 10:
+		return sha256.New()
+	}
+	// Other checks aren't verified.
+	return nil
+}
+
+func (x *xzReader) blockHeader() error {
+	size, err := x.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if size == 0 {
+		return x.index()
+	}
+	header := make([]byte, 4*(int(size)+1))
+	header[0] = size
+	if _, err := io.ReadFull(x.r, header[1:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	end := len(header) - 4
+	if crc32.ChecksumIEEE(header[:end]) != binary.LittleEndian.Uint32(header[end:]) {
+		return errXZCorrupt
+	}
+
+	flags := header[1]
+	if flags&0x3c != 0 {
+		return errXZCorrupt
+	}
+	fields := bytes.NewReader(header[2:end])
+	if flags&0x40 != 0 {
+		if _, err := binary.ReadUvarint(fields); err != nil {
+			return errXZCorrupt
+		}
+	}
+	if flags&0x80 != 0 {
+		if _, err := binary.ReadUvarint(fields); err != nil {
+			return errXZCorrupt
+		}
+	}
+	var dictSize uint32
+	for i := 0; i <= int(flags&3); i++ {
+		id, err := binary.ReadUvarint(fields)
+		if err != nil {
+			return errXZCorrupt
+		}
+		propsSize, err := binary.ReadUvarint(fields)
+		if err != nil || propsSize > uint64(fields.Len()) {
+			return errXZCorrupt
+		}
+		props := make([]byte, propsSize)
+		fields.Read(props)
+		if id != 0x21 || i != int(flags&3) {
+			return errors.New("xz: only LZMA2 compressed inputs without other filters can be read")
+		}
+		if len(props) != 1 || props[0] > 40 {
+			return errXZCorrupt
+		}
+		dictSize = lzma2DictSize(props[0])
+	}
+	for fields.Len() > 0 {
+		if b, _ := fields.ReadByte(); b != 0 {
+			return errXZCorrupt
+		}
+	}
+
+	x.inBlock = true
+	x.compSize = 0
+	x.checkHash = x.newCheck()
+	x.lzma2 = newLZMA2Decoder(&xzCountingReader{r: x.r, n: &x.compSize}, dictSize)
+	return nil
+}
+
+func (x *xzReader) endBlock() error {
+	x.inBlock = false
+	if padding := int((4 - x.compSize%4) % 4); padding > 0 {
+		var zeros [3]byte
+		if _, err := io.ReadFull(x.r, zeros[:padding]); err != nil || zeros != [3]byte{} {
+			return errXZCorrupt
+		}
+	}
+	check := make([]byte, xzCheckSize(x.check))
+	if _, err := io.ReadFull(x.r, check); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if x.checkHash == nil {
+		return nil
+	}
+	sum := x.checkHash.Sum(nil)
+	if x.check != 10 {
+		// CRCs are stored least significant byte first.
+		for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+			sum[i], sum[j] = sum[j], sum[i]
+		}
+	}
+	if !bytes.Equal(sum, check) {
+		return errors.New("xz: block check mismatch")
+	}
+	return nil
+}
+
+// Reads the index, whose indicator has been read, and the stream footer.
+func (x *xzReader) index() error {
+	r := &indexReader{r: x.r, crc: crc32.NewIEEE(), n: 1}
+	r.crc.Write([]byte{0})
+	records, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errXZCorrupt
+	}
+	for i := uint64(0); i < 2*records; i++ {
+		if _, err := binary.ReadUvarint(r); err != nil {
+			return errXZCorrupt
+		}
+	}
+	for r.n%4 != 0 {
+		if b, err := r.ReadByte(); err != nil || b != 0 {
+			return errXZCorrupt
+		}
+	}
+	sum := r.crc.Sum32()
+	var footer [16]byte
+	if _, err := io.ReadFull(x.r, footer[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	switch {
+	case binary.LittleEndian.Uint32(footer[:]) != sum,
+		crc32.ChecksumIEEE(footer[8:14]) != binary.LittleEndian.Uint32(footer[4:]),
+		(int64(binary.LittleEndian.Uint32(footer[8:]))+1)*4 != r.n+4,
+		footer[12] != 0 || int(footer[13]) != x.check,
+		footer[14] != 'Y' || footer[15] != 'Z':
+		return errXZCorrupt
+	}
+	x.check = -1
+	return nil
+}
+
+// Reads the index a byte at a time, keeping its CRC and size.
+type indexReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	n   int64
+}
+
+func (r *indexReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.crc.Write([]byte{b})
+	r.n++
+	return b, nil
+}
+
+// Counts the compressed bytes of a block.
+type xzCountingReader struct {
+	r *bufio.Reader
+	n *int64
+}
+
+func (c *xzCountingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		*c.n++
+	}
+	return b, err
+}
+
+func (c *xzCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func lzma2DictSize(p byte) uint32 {
+	if p == 40 {
+		return 0xffffffff
+	}
+	return (2 | uint32(p)&1) << (p/2 + 11)
+}
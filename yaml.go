@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This is a parser for the subset of YAML found in front-matter and config
+// files: block mappings and sequences nested by indentation, flow [lists]
+// and {maps}, quoted and plain scalars, and | or > block scalars. Anchors,
+// tags and multiple documents are not supported. Numbers are returned as
+// json.Number so the result marshals back to JSON unchanged.
+
+var (
+	yamlNumberPattern = regexp.MustCompile(`^[-+]?(\d[\d_]*(\.\d*)?|\.\d+)([eE][-+]?\d+)?$`)
+	yamlLeadingZero   = regexp.MustCompile(`^[-+]?0[\d_]`)
+)
+
+type yamlLine struct {
+	indent int
+	text   string
+	number int
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		text := strings.TrimRight(raw, " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "#") {
+			// Blank lines still matter inside block scalars.
+			p.lines = append(p.lines, yamlLine{indent: -1, number: i + 1, text: ""})
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{indent: len(text) - len(trimmed), text: trimmed, number: i + 1})
+	}
+
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	v, err := p.parseNode(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank(); p.pos < len(p.lines) {
+		return nil, fmt.Errorf("yaml: line %d: unexpected indentation", p.lines[p.pos].number)
+	}
+	return v, nil
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].indent < 0 {
+		p.pos++
+	}
+}
+
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseYAMLValue(line.text, line.number)
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml: line %d: unexpected indentation", line.number)
+		}
+
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: expected a key", line.number)
+		}
+		p.pos++
+
+		v, err := p.parseValue(indent, rest, line.number, true)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	var s []interface{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent != indent || !(line.text == "-" || strings.HasPrefix(line.text, "- ")) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("yaml: line %d: unexpected indentation", line.number)
+			}
+			break
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if _, _, ok := splitYAMLKey(rest); ok || strings.HasPrefix(rest, "- ") {
+			// An inline mapping or sequence, "- key: value". Re-read the rest
+			// of the line as though it started on its own at that column.
+			p.lines[p.pos] = yamlLine{
+				indent: indent + len(line.text) - len(rest),
+				text:   rest,
+				number: line.number,
+			}
+			v, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+			continue
+		}
+
+		p.pos++
+		v, err := p.parseValue(indent, rest, line.number, false)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	return s, nil
+}
+
+// Parses the value following a key or sequence dash, which is either on the
+// same line or a more indented block on the lines that follow.
+func (p *yamlParser) parseValue(indent int, rest string, number int, inMapping bool) (interface{}, error) {
+	if rest == "|" || rest == ">" || strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">") {
+		return p.parseBlockScalar(indent, rest), nil
+	}
+	if rest != "" {
+		return parseYAMLValue(rest, number)
+	}
+
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent {
+		return p.parseNode(next.indent)
+	}
+
+	// A sequence may sit at the same indentation as its key.
+	if inMapping && next.indent == indent && (next.text == "-" || strings.HasPrefix(next.text, "- ")) {
+		return p.parseSequence(indent)
+	}
+	return nil, nil
+}
+
+// Reads a literal (|) or folded (>) block scalar.
+func (p *yamlParser) parseBlockScalar(indent int, header string) string {
+	folded := header[0] == '>'
+	chomp := strings.TrimLeft(header[1:], "0123456789")
+
+	var lines []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if line.indent < 0 {
+			lines = append(lines, "")
+			continue
+		}
+		if line.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = line.indent
+		}
+		lines = append(lines, strings.Repeat(" ", line.indent-blockIndent)+line.text)
+	}
+
+	// Trailing blank lines belong to whatever follows.
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	p.pos -= trailing
+
+	var text string
+	if folded {
+		text = foldLines(lines)
+	} else {
+		text = strings.Join(lines, "\n")
+	}
+
+	switch chomp {
+	case "-":
+		return text
+	case "+":
+		return text + strings.Repeat("\n", trailing+1)
+	}
+	return text + "\n"
+}
+
+// Folds a > scalar's lines: adjacent lines are joined with a space and each
+// blank line between them is a newline. More indented lines keep theirs.
+func foldLines(lines []string) string {
+	var b strings.Builder
+	for i, line := range lines {
+		if i > 0 && line != "" && lines[i-1] != "" {
+			if strings.HasPrefix(line, " ") || strings.HasPrefix(lines[i-1], " ") {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		if line == "" {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// Splits "key: value" outside of any quotes, returning the unquoted key.
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || strings.ContainsRune("[{\"'", rune(text[0])) && !isQuotedYAMLKey(text) {
+		return "", "", false
+	}
+
+	i := yamlKeyEnd(text)
+	if i < 0 {
+		return "", "", false
+	}
+	key := strings.TrimSpace(text[:i])
+	if unquoted, err := parseYAMLScalar(key); err == nil {
+		if s, ok := unquoted.(string); ok && (key[0] == '"' || key[0] == '\'') {
+			key = s
+		}
+	}
+	return key, strings.TrimSpace(stripYAMLComment(text[i+1:])), true
+}
+
+func isQuotedYAMLKey(text string) bool {
+	if text[0] != '"' && text[0] != '\'' {
+		return false
+	}
+	end := strings.IndexByte(text[1:], text[0])
+	return end >= 0 && strings.HasPrefix(text[end+2:], ":")
+}
+
+// Finds the colon ending a mapping key, which must be followed by a space
+// or the end of the line.
+func yamlKeyEnd(text string) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == '#' && i > 0 && text[i-1] == ' ':
+			return -1
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// Parses an inline value: a flow collection or a scalar.
+func parseYAMLValue(text string, number int) (interface{}, error) {
+	text = strings.TrimSpace(stripYAMLComment(text))
+	if text != "" && !strings.ContainsRune("[{\"'", rune(text[0])) {
+		// Outside a flow collection a plain scalar may contain , ] and }.
+		return parseYAMLScalar(text)
+	}
+	v, rest, err := parseYAMLFlow(text)
+	if err == nil && strings.TrimSpace(rest) != "" {
+		err = fmt.Errorf("unexpected %q", rest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("yaml: line %d: %v", number, err)
+	}
+	return v, nil
+}
+
+func parseYAMLFlow(text string) (interface{}, string, error) {
+	text = strings.TrimLeft(text, " ")
+	if text == "" {
+		return nil, "", nil
+	}
+
+	switch text[0] {
+	case '[':
+		var s []interface{}
+		text = strings.TrimLeft(text[1:], " ")
+		for !strings.HasPrefix(text, "]") {
+			v, rest, err := parseYAMLFlow(text)
+			if err != nil {
+				return nil, "", err
+			}
+			s = append(s, v)
+			if text = strings.TrimLeft(rest, " "); strings.HasPrefix(text, ",") {
+				text = strings.TrimLeft(text[1:], " ")
+			} else if !strings.HasPrefix(text, "]") {
+				return nil, "", fmt.Errorf("unterminated flow sequence")
+			}
+		}
+		if s == nil {
+			s = []interface{}{}
+		}
+		return s, text[1:], nil
+
+	case '{':
+		m := make(map[string]interface{})
+		text = strings.TrimLeft(text[1:], " ")
+		for !strings.HasPrefix(text, "}") {
+			i := strings.IndexByte(text, ':')
+			if i < 0 {
+				return nil, "", fmt.Errorf("unterminated flow mapping")
+			}
+			key, err := parseYAMLScalar(strings.TrimSpace(text[:i]))
+			if err != nil {
+				return nil, "", err
+			}
+			v, rest, err := parseYAMLFlow(text[i+1:])
+			if err != nil {
+				return nil, "", err
+			}
+			m[fmt.Sprint(key)] = v
+			if text = strings.TrimLeft(rest, " "); strings.HasPrefix(text, ",") {
+				text = strings.TrimLeft(text[1:], " ")
+			} else if !strings.HasPrefix(text, "}") {
+				return nil, "", fmt.Errorf("unterminated flow mapping")
+			}
+		}
+		return m, text[1:], nil
+
+	case '"', '\'':
+		end := 1
+		for ; end < len(text); end++ {
+			if text[end] == '\\' && text[0] == '"' {
+				end++
+			} else if text[end] == text[0] {
+				if text[0] == '\'' && end+1 < len(text) && text[end+1] == '\'' {
+					end++
+					continue
+				}
+				break
+			}
+		}
+		if end >= len(text) {
+			return nil, "", fmt.Errorf("unterminated quoted string")
+		}
+		v, err := parseYAMLScalar(text[:end+1])
+		return v, text[end+1:], err
+	}
+
+	// A plain scalar runs to the end of the text, or to the next flow
+	// indicator when nested in a flow collection.
+	end := strings.IndexAny(text, ",]}")
+	if end < 0 {
+		end = len(text)
+	}
+	v, err := parseYAMLScalar(strings.TrimSpace(text[:end]))
+	return v, text[end:], err
+}
+
+func parseYAMLScalar(text string) (interface{}, error) {
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		return strconv.Unquote(text)
+	}
+	if len(text) >= 2 && text[0] == '\'' && text[len(text)-1] == '\'' {
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	// Leading zeros, as in a zip code or 007, make it a string, as they do
+	// in YAML 1.2.
+	if yamlNumberPattern.MatchString(text) && !yamlLeadingZero.MatchString(text) {
+		n := strings.TrimPrefix(strings.Replace(text, "_", "", -1), "+")
+		if strings.HasPrefix(n, ".") {
+			n = "0" + n
+		} else if strings.HasPrefix(n, "-.") {
+			n = "-0" + n[1:]
+		}
+		// 1. and 1.e5 are written 1 and 1e5 in JSON.
+		n = strings.Replace(strings.Replace(n, ".e", "e", 1), ".E", "E", 1)
+		n = strings.TrimSuffix(n, ".")
+		if json.Valid([]byte(n)) {
+			return json.Number(n), nil
+		}
+	}
+	return text, nil
+}
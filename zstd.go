@@ -0,0 +1,1041 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// A Zstandard decoder (RFC 8878) for .zst inputs. It handles everything the
+// zstd tool writes apart from dictionaries: any number of frames, skippable
+// frames, and content checksums, which are verified.
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+const (
+	zstdMaxBlockSize = 128 << 10
+	// Larger windows are refused rather than allocated.
+	zstdMaxWindow = 1 << 31
+)
+
+var errZstdCorrupt = errors.New("zstd: corrupt input")
+
+type zstdReader struct {
+	r   *bufio.Reader
+	err error
+
+	// The frame being decoded, nil between frames.
+	frame *zstdFrame
+
+	// Decoded data, keeping the window of earlier output that matches can
+	// copy from. Bytes from read on haven't been returned yet.
+	window []byte
+	read   int
+
+	block    []byte
+	literals []byte
+
+	// Carried from block to block within a frame.
+	huffman          *huffmanTable
+	llTable, ofTable *fseTable
+	mlTable          *fseTable
+	repeatedOffsets  [3]int
+}
+
+type zstdFrame struct {
+	windowSize  int
+	contentSize int64 // -1 when the header doesn't give it
+	checksum    bool
+	decoded     int64
+	hash        xxhash64
+	lastBlock   bool
+}
+
+func newZstdReader(r *bufio.Reader) (io.Reader, error) {
+	return &zstdReader{r: r}, nil
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.read == len(z.window) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.window[z.read:])
+	z.read += n
+	return n, nil
+}
+
+// Decodes the next block, reading frame headers and footers on the way.
+func (z *zstdReader) next() error {
+	if z.frame == nil {
+		return z.startFrame()
+	}
+	if z.frame.lastBlock {
+		return z.endFrame()
+	}
+	return z.decodeBlock()
+}
+
+func (z *zstdReader) startFrame() error {
+	var magic [4]byte
+	if n, err := io.ReadFull(z.r, magic[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	id := binary.LittleEndian.Uint32(magic[:])
+	if id&0xfffffff0 == 0x184d2a50 {
+		// A skippable frame.
+		var size [4]byte
+		if _, err := io.ReadFull(z.r, size[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(size[:]))); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	if id != binary.LittleEndian.Uint32(zstdMagic) {
+		return errors.New("zstd: not a zstd frame")
+	}
+
+	descriptor, err := z.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if descriptor&0x08 != 0 {
+		return errZstdCorrupt
+	}
+	singleSegment := descriptor&0x20 != 0
+	frame := &zstdFrame{contentSize: -1, checksum: descriptor&0x04 != 0}
+	frame.hash.reset()
+
+	if !singleSegment {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		exponent, mantissa := uint(b>>3), uint64(b&7)
+		base := uint64(1) << (10 + exponent)
+		size := base + base/8*mantissa
+		if size > zstdMaxWindow {
+			return fmt.Errorf("zstd: a %v byte window is too large", size)
+		}
+		frame.windowSize = int(size)
+	}
+
+	dictionaryID := [4]int{0, 1, 2, 4}[descriptor&3]
+	if dictionaryID > 0 {
+		var id [4]byte
+		if _, err := io.ReadFull(z.r, id[:dictionaryID]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if binary.LittleEndian.Uint32(id[:]) != 0 {
+			return errors.New("zstd: the input needs a dictionary")
+		}
+	}
+
+	contentSizeBytes := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeBytes == 0 && singleSegment {
+		contentSizeBytes = 1
+	}
+	if contentSizeBytes > 0 {
+		var size [8]byte
+		if _, err := io.ReadFull(z.r, size[:contentSizeBytes]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		frame.contentSize = int64(binary.LittleEndian.Uint64(size[:]))
+		if contentSizeBytes == 2 {
+			frame.contentSize += 256
+		}
+	}
+	if singleSegment {
+		if frame.contentSize > zstdMaxWindow {
+			return fmt.Errorf("zstd: a %v byte window is too large", frame.contentSize)
+		}
+		frame.windowSize = int(frame.contentSize)
+	}
+
+	z.frame = frame
+	z.huffman, z.llTable, z.ofTable, z.mlTable = nil, nil, nil, nil
+	z.repeatedOffsets = [3]int{1, 4, 8}
+	z.discardWindow(0)
+	return nil
+}
+
+func (z *zstdReader) endFrame() error {
+	frame := z.frame
+	if frame.contentSize >= 0 && frame.decoded != frame.contentSize {
+		return errZstdCorrupt
+	}
+	if frame.checksum {
+		var sum [4]byte
+		if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != uint32(frame.hash.sum()) {
+			return errors.New("zstd: checksum mismatch")
+		}
+	}
+	z.frame = nil
+	return nil
+}
+
+// Drops decoded data that has been read and is older than the window
+// needs, once that's enough to be worth moving the rest.
+func (z *zstdReader) discardWindow(keep int) {
+	drop := len(z.window) - keep
+	if drop > z.read {
+		drop = z.read
+	}
+	if drop <= 0 || drop < len(z.window)/2 && keep > 0 {
+		return
+	}
+	n := copy(z.window, z.window[drop:])
+	z.window = z.window[:n]
+	z.read -= drop
+}
+
+func (z *zstdReader) decodeBlock() error {
+	var header [3]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	h := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	z.frame.lastBlock = h&1 != 0
+	size := int(h >> 3)
+
+	maxBlock := zstdMaxBlockSize
+	if z.frame.windowSize < maxBlock {
+		maxBlock = z.frame.windowSize
+	}
+	if size > maxBlock {
+		return errZstdCorrupt
+	}
+	z.discardWindow(z.frame.windowSize)
+	start := len(z.window)
+
+	switch (h >> 1) & 3 {
+	case 0: // raw
+		z.window = append(z.window, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.window[start:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	case 1: // RLE
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		for i := 0; i < size; i++ {
+			z.window = append(z.window, b)
+		}
+	case 2: // compressed
+		if cap(z.block) < size {
+			z.block = make([]byte, size)
+		}
+		z.block = z.block[:size]
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err := z.compressedBlock(z.block); err != nil {
+			return err
+		}
+		if len(z.window)-start > zstdMaxBlockSize {
+			return errZstdCorrupt
+		}
+	default:
+		return errZstdCorrupt
+	}
+
+	decoded := z.window[start:]
+	z.frame.decoded += int64(len(decoded))
+	if z.frame.checksum {
+		z.frame.hash.write(decoded)
+	}
+	return nil
+}
+
+func (z *zstdReader) compressedBlock(data []byte) error {
+	literals, n, err := z.readLiterals(data)
+	if err != nil {
+		return err
+	}
+	return z.executeSequences(data[n:], literals)
+}
+
+// Reads the literals section of a compressed block, returning the literals
+// and the size of the section.
+func (z *zstdReader) readLiterals(data []byte) ([]byte, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	blockType, sizeFormat := data[0]&3, (data[0]>>2)&3
+
+	if blockType < 2 {
+		// Raw or RLE literals.
+		var size, header int
+		switch sizeFormat {
+		case 0, 2:
+			size, header = int(data[0]>>3), 1
+		case 1:
+			if len(data) < 2 {
+				return nil, 0, errZstdCorrupt
+			}
+			size, header = int(data[0]>>4)|int(data[1])<<4, 2
+		case 3:
+			if len(data) < 3 {
+				return nil, 0, errZstdCorrupt
+			}
+			size, header = int(data[0]>>4)|int(data[1])<<4|int(data[2])<<12, 3
+		}
+		if blockType == 0 {
+			if len(data) < header+size {
+				return nil, 0, errZstdCorrupt
+			}
+			return data[header : header+size], header + size, nil
+		}
+		if len(data) < header+1 || size > zstdMaxBlockSize {
+			return nil, 0, errZstdCorrupt
+		}
+		literals := z.literalBuffer(size)
+		for i := range literals {
+			literals[i] = data[header]
+		}
+		return literals, header + 1, nil
+	}
+
+	// Huffman coded literals, with a new table or the last one.
+	var regenerated, compressed, header int
+	streams := 4
+	switch sizeFormat {
+	case 0, 1:
+		if sizeFormat == 0 {
+			streams = 1
+		}
+		if len(data) < 3 {
+			return nil, 0, errZstdCorrupt
+		}
+		h := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+		regenerated, compressed, header = int(h>>4&0x3ff), int(h>>14&0x3ff), 3
+	case 2:
+		if len(data) < 4 {
+			return nil, 0, errZstdCorrupt
+		}
+		h := binary.LittleEndian.Uint32(data)
+		regenerated, compressed, header = int(h>>4&0x3fff), int(h>>18&0x3fff), 4
+	case 3:
+		if len(data) < 5 {
+			return nil, 0, errZstdCorrupt
+		}
+		h := uint64(binary.LittleEndian.Uint32(data)) | uint64(data[4])<<32
+		regenerated, compressed, header = int(h>>4&0x3ffff), int(h>>22&0x3ffff), 5
+	}
+	if regenerated > zstdMaxBlockSize || len(data) < header+compressed {
+		return nil, 0, errZstdCorrupt
+	}
+	src := data[header : header+compressed]
+	if blockType == 2 {
+		table, n, err := readHuffmanTable(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		z.huffman = table
+		src = src[n:]
+	} else if z.huffman == nil {
+		return nil, 0, errZstdCorrupt
+	}
+
+	literals := z.literalBuffer(regenerated)
+	if streams == 1 {
+		if err := z.huffman.decode(literals, src); err != nil {
+			return nil, 0, err
+		}
+		return literals, header + compressed, nil
+	}
+
+	if len(src) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+	size1 := int(binary.LittleEndian.Uint16(src))
+	size2 := int(binary.LittleEndian.Uint16(src[2:]))
+	size3 := int(binary.LittleEndian.Uint16(src[4:]))
+	src = src[6:]
+	if size1+size2+size3 > len(src) {
+		return nil, 0, errZstdCorrupt
+	}
+	segment := (regenerated + 3) / 4
+	if 3*segment > regenerated {
+		return nil, 0, errZstdCorrupt
+	}
+	ends := [4]int{size1, size1 + size2, size1 + size2 + size3, len(src)}
+	begin := 0
+	for i, end := range ends {
+		dst := literals[i*segment:]
+		if i < 3 {
+			dst = dst[:segment]
+		}
+		if err := z.huffman.decode(dst, src[begin:end]); err != nil {
+			return nil, 0, err
+		}
+		begin = end
+	}
+	return literals, header + compressed, nil
+}
+
+func (z *zstdReader) literalBuffer(size int) []byte {
+	if cap(z.literals) < size {
+		z.literals = make([]byte, size, zstdMaxBlockSize)
+	}
+	return z.literals[:size]
+}
+
+// Decodes the sequences section and carries out the sequences, copying
+// literals and matches to the window.
+func (z *zstdReader) executeSequences(data, literals []byte) error {
+	if len(data) == 0 {
+		return errZstdCorrupt
+	}
+	count := int(data[0])
+	switch {
+	case count == 0:
+		if len(data) != 1 {
+			return errZstdCorrupt
+		}
+		z.window = append(z.window, literals...)
+		return nil
+	case count < 128:
+		data = data[1:]
+	case count < 255:
+		if len(data) < 2 {
+			return errZstdCorrupt
+		}
+		count = (count-128)<<8 | int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errZstdCorrupt
+		}
+		count = int(data[1]) | int(data[2])<<8 + 0x7f00
+		data = data[3:]
+	}
+	if len(data) == 0 {
+		return errZstdCorrupt
+	}
+	modes := data[0]
+	data = data[1:]
+	if modes&3 != 0 {
+		return errZstdCorrupt
+	}
+
+	var err error
+	tables := []struct {
+		table      **fseTable
+		mode       byte
+		predefined *fseTable
+		maxLog     uint8
+		maxSymbol  int
+	}{
+		{&z.llTable, modes >> 6, predefinedLiteralLengths, 9, 35},
+		{&z.ofTable, modes >> 4 & 3, predefinedOffsets, 8, 31},
+		{&z.mlTable, modes >> 2 & 3, predefinedMatchLengths, 9, 52},
+	}
+	for _, t := range tables {
+		switch t.mode {
+		case 0:
+			*t.table = t.predefined
+		case 1:
+			if len(data) == 0 || int(data[0]) > t.maxSymbol {
+				return errZstdCorrupt
+			}
+			*t.table = &fseTable{entries: []fseEntry{{symbol: data[0]}}}
+			data = data[1:]
+		case 2:
+			var n int
+			if *t.table, n, err = readFSETable(data, t.maxLog, t.maxSymbol); err != nil {
+				return err
+			}
+			data = data[n:]
+		case 3:
+			if *t.table == nil {
+				return errZstdCorrupt
+			}
+		}
+	}
+
+	var br reverseBits
+	if err := br.init(data); err != nil {
+		return err
+	}
+	ll, of, ml := z.llTable, z.ofTable, z.mlTable
+	llState := br.read(ll.log)
+	ofState := br.read(of.log)
+	mlState := br.read(ml.log)
+
+	reps := &z.repeatedOffsets
+	for i := 0; i < count; i++ {
+		ofCode := of.entries[ofState].symbol
+		llCode := ll.entries[llState].symbol
+		mlCode := ml.entries[mlState].symbol
+		if ofCode > 31 {
+			return errZstdCorrupt
+		}
+
+		offsetValue := 1<<ofCode + int(br.read(ofCode))
+		matchLength := matchLengthBase[mlCode] + int(br.read(matchLengthBits[mlCode]))
+		literalLength := literalLengthBase[llCode] + int(br.read(literalLengthBits[llCode]))
+
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+		} else {
+			index := offsetValue - 1
+			if literalLength == 0 {
+				index++
+			}
+			switch index {
+			case 0:
+				offset = reps[0]
+			case 1:
+				offset = reps[1]
+				reps[1], reps[0] = reps[0], offset
+			case 2:
+				offset = reps[2]
+				reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+			case 3:
+				offset = reps[0] - 1
+				reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+			}
+		}
+
+		if i < count-1 {
+			llState = ll.entries[llState].next(&br)
+			mlState = ml.entries[mlState].next(&br)
+			ofState = of.entries[ofState].next(&br)
+		}
+
+		if literalLength > len(literals) {
+			return errZstdCorrupt
+		}
+		z.window = append(z.window, literals[:literalLength]...)
+		literals = literals[literalLength:]
+
+		if offset <= 0 || offset > len(z.window) {
+			return errZstdCorrupt
+		}
+		start := len(z.window) - offset
+		for matchLength > 0 {
+			n := matchLength
+			if n > offset {
+				n = offset
+			}
+			z.window = append(z.window, z.window[start:start+n]...)
+			start += n
+			matchLength -= n
+		}
+	}
+	if !br.finished() {
+		return errZstdCorrupt
+	}
+	z.window = append(z.window, literals...)
+	return nil
+}
+
+var (
+	literalLengthBase = [36]int{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	literalLengthBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	matchLengthBase = [53]int{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	matchLengthBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	predefinedLiteralLengths = mustBuildFSE(6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	})
+	predefinedMatchLengths = mustBuildFSE(6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	})
+	predefinedOffsets = mustBuildFSE(5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	})
+)
+
+// A finite state entropy decoding table.
+type fseTable struct {
+	log     uint8
+	entries []fseEntry
+}
+
+type fseEntry struct {
+	symbol uint8
+	bits   uint8
+	base   uint16
+}
+
+// Moves to the next state, reading its bits from the stream.
+func (e fseEntry) next(br *reverseBits) uint32 {
+	return uint32(e.base) + br.read(e.bits)
+}
+
+func mustBuildFSE(log uint8, counts []int16) *fseTable {
+	t, err := buildFSE(log, counts)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Reads an FSE table description, returning the table and its size.
+func readFSETable(data []byte, maxLog uint8, maxSymbol int) (*fseTable, int, error) {
+	fb := forwardBits{data: data}
+	log := uint8(fb.read(4)) + 5
+	if log > maxLog {
+		return nil, 0, errZstdCorrupt
+	}
+
+	counts := make([]int16, 0, maxSymbol+1)
+	remaining := int32(1)<<log + 1
+	threshold := int32(1) << log
+	width := log + 1
+	zero := false
+	for remaining > 1 {
+		if zero {
+			// How many symbols after one with no probability also have none.
+			n := len(counts)
+			for fb.peek(16) == 0xffff {
+				n += 24
+				fb.skip(16)
+			}
+			for fb.peek(2) == 3 {
+				n += 3
+				fb.skip(2)
+			}
+			n += int(fb.read(2))
+			if n > maxSymbol {
+				return nil, 0, errZstdCorrupt
+			}
+			for len(counts) < n {
+				counts = append(counts, 0)
+			}
+		}
+		if len(counts) > maxSymbol {
+			return nil, 0, errZstdCorrupt
+		}
+
+		max := 2*threshold - 1 - remaining
+		v := int32(fb.peek(width))
+		var count int32
+		if v&(threshold-1) < max {
+			count = v & (threshold - 1)
+			fb.skip(width - 1)
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			fb.skip(width)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, int16(count))
+		zero = count == 0
+		for remaining < threshold {
+			width--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || fb.pos > 8*len(data) {
+		return nil, 0, errZstdCorrupt
+	}
+	t, err := buildFSE(log, counts)
+	return t, (fb.pos + 7) / 8, err
+}
+
+// Builds the decoding table for the normalized symbol counts, -1 standing
+// for a less than 1 probability.
+func buildFSE(log uint8, counts []int16) (*fseTable, error) {
+	size := 1 << log
+	entries := make([]fseEntry, size)
+	next := make([]uint16, len(counts))
+	high := size - 1
+	for symbol, count := range counts {
+		if count == -1 {
+			entries[high].symbol = uint8(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = uint16(count)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	mask := size - 1
+	pos := 0
+	for symbol, count := range counts {
+		for i := 0; i < int(count); i++ {
+			entries[pos].symbol = uint8(symbol)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errZstdCorrupt
+	}
+
+	for i := range entries {
+		state := next[entries[i].symbol]
+		next[entries[i].symbol]++
+		if state == 0 {
+			return nil, errZstdCorrupt
+		}
+		n := log - uint8(bits.Len16(state)-1)
+		entries[i].bits = n
+		entries[i].base = state<<n - uint16(size)
+	}
+	return &fseTable{log: log, entries: entries}, nil
+}
+
+// A Huffman decoding table indexed by the next maxBits bits of a stream.
+type huffmanTable struct {
+	maxBits uint8
+	entries []huffmanEntry
+}
+
+type huffmanEntry struct {
+	symbol uint8
+	bits   uint8
+}
+
+// Reads a Huffman tree description, returning the table and its size.
+func readHuffmanTable(data []byte) (*huffmanTable, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	header := int(data[0])
+	var weights []uint8
+	var size int
+
+	if header < 128 {
+		// Weights compressed with FSE, in two interleaved states.
+		size = 1 + header
+		if len(data) < size {
+			return nil, 0, errZstdCorrupt
+		}
+		table, n, err := readFSETable(data[1:size], 6, 255)
+		if err != nil {
+			return nil, 0, err
+		}
+		var br reverseBits
+		if err := br.init(data[1+n : size]); err != nil {
+			return nil, 0, err
+		}
+		state1, state2 := br.read(table.log), br.read(table.log)
+		for {
+			if len(weights) > 253 {
+				return nil, 0, errZstdCorrupt
+			}
+			weights = append(weights, table.entries[state1].symbol)
+			state1 = table.entries[state1].next(&br)
+			if br.overflow {
+				weights = append(weights, table.entries[state2].symbol)
+				break
+			}
+			weights = append(weights, table.entries[state2].symbol)
+			state2 = table.entries[state2].next(&br)
+			if br.overflow {
+				weights = append(weights, table.entries[state1].symbol)
+				break
+			}
+		}
+	} else {
+		// Weights given directly, four bits each.
+		count := header - 127
+		size = 1 + (count+1)/2
+		if len(data) < size {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < count; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&15)
+			}
+		}
+	}
+
+	// The last weight isn't given, it's whatever completes the tree.
+	var total uint32
+	for _, w := range weights {
+		if w > 11 {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	maxBits := uint8(bits.Len32(total))
+	rest := uint32(1)<<maxBits - total
+	if maxBits > 11 || rest&(rest-1) != 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(bits.Len32(rest)))
+
+	// Codes are given out from the lowest weight up, by symbol within
+	// each weight.
+	var start [13]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 2; w < len(start); w++ {
+		start[w] += start[w-1]
+	}
+	t := &huffmanTable{maxBits: maxBits, entries: make([]huffmanEntry, 1<<maxBits)}
+	for symbol, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e := huffmanEntry{symbol: uint8(symbol), bits: maxBits + 1 - w}
+		for i := 0; i < 1<<(w-1); i++ {
+			t.entries[start[w]+i] = e
+		}
+		start[w] += 1 << (w - 1)
+	}
+	return t, size, nil
+}
+
+// Decodes a Huffman coded stream filling dst.
+func (t *huffmanTable) decode(dst, src []byte) error {
+	var br reverseBits
+	if err := br.init(src); err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.entries[br.peek(t.maxBits)]
+		br.skip(e.bits)
+		dst[i] = e.symbol
+	}
+	if !br.finished() {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+// Reads a bit stream from its end back to its start, as zstd writes its
+// entropy coded streams. The last byte's highest set bit marks the end.
+type reverseBits struct {
+	data []byte
+	// data[:off] hasn't been loaded yet.
+	off int
+	// The low cnt bits are unread, the highest of them read next.
+	bits uint64
+	cnt  uint
+	// Set once more bits have been read than the stream has.
+	overflow bool
+}
+
+func (r *reverseBits) init(data []byte) error {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return errZstdCorrupt
+	}
+	last := data[len(data)-1]
+	*r = reverseBits{data: data, off: len(data) - 1, bits: uint64(last), cnt: uint(bits.Len8(last) - 1)}
+	r.fill()
+	return nil
+}
+
+func (r *reverseBits) fill() {
+	for r.cnt <= 56 && r.off > 0 {
+		r.off--
+		r.bits = r.bits<<8 | uint64(r.data[r.off])
+		r.cnt += 8
+	}
+}
+
+func (r *reverseBits) peek(n uint8) uint32 {
+	if uint(n) > r.cnt {
+		r.fill()
+	}
+	mask := uint64(1)<<n - 1
+	if uint(n) <= r.cnt {
+		return uint32(r.bits >> (r.cnt - uint(n)) & mask)
+	}
+	// Past the start of the stream, which reads as zeros.
+	return uint32(r.bits & (uint64(1)<<r.cnt - 1) << (uint(n) - r.cnt) & mask)
+}
+
+func (r *reverseBits) skip(n uint8) {
+	if uint(n) > r.cnt {
+		r.fill()
+	}
+	if uint(n) > r.cnt {
+		r.overflow = true
+		r.cnt = 0
+		return
+	}
+	r.cnt -= uint(n)
+}
+
+func (r *reverseBits) read(n uint8) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+// Whether exactly all of the stream has been read.
+func (r *reverseBits) finished() bool {
+	return !r.overflow && r.cnt == 0 && r.off == 0
+}
+
+// Reads bits from the start of a stream, lowest first, as zstd writes
+// table descriptions. Bits past its end read as zeros.
+type forwardBits struct {
+	data []byte
+	pos  int
+}
+
+func (f *forwardBits) peek(n uint8) uint32 {
+	var v uint32
+	for i := uint8(0); i < n; i++ {
+		if p := f.pos + int(i); p < 8*len(f.data) && f.data[p/8]>>(p%8)&1 != 0 {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+func (f *forwardBits) skip(n uint8) { f.pos += int(n) }
+
+func (f *forwardBits) read(n uint8) uint32 {
+	v := f.peek(n)
+	f.skip(n)
+	return v
+}
+
+// The 64 bit xxHash, which zstd checksums frames with.
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (h *xxhash64) reset() {
+	p1, p2 := xxPrime1, xxPrime2
+	*h = xxhash64{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+func xxRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxPrime2, 31) * xxPrime1
+}
+
+func (h *xxhash64) write(p []byte) {
+	h.total += uint64(len(p))
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < 32 {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for len(p) >= 32 {
+		h.stripe(p)
+		p = p[32:]
+	}
+	h.n = copy(h.buf[:], p)
+}
+
+func (h *xxhash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+	}
+}
+
+func (h *xxhash64) sum() uint64 {
+	var s uint64
+	if h.total >= 32 {
+		v := h.v
+		s = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, x := range v {
+			s = (s^xxRound(0, x))*xxPrime1 + xxPrime4
+		}
+	} else {
+		s = xxPrime5
+	}
+	s += h.total
+
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		s ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		s = bits.RotateLeft64(s, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		s ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		s = bits.RotateLeft64(s, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		s ^= uint64(b) * xxPrime5
+		s = bits.RotateLeft64(s, 11) * xxPrime1
+	}
+
+	s ^= s >> 33
+	s *= xxPrime2
+	s ^= s >> 29
+	s *= xxPrime3
+	s ^= s >> 32
+	return s
+}
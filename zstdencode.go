@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// A zstd encoder for request bodies. It finds matches greedily with a hash
+// table rather than searching hard, and codes sequences with the predefined
+// tables, which is fast and, against a dictionary of the documents' common
+// shapes, still most of the gain. Literals are stored raw.
+
+const zstdHashLog = 17
+
+type zstdEncoder struct {
+	dict []byte
+	// The hash table primed with the dictionary's positions, copied for
+	// each body.
+	table []int32
+}
+
+func newZstdEncoder(dict []byte) *zstdEncoder {
+	e := &zstdEncoder{dict: dict, table: make([]int32, 1<<zstdHashLog)}
+	for p := 0; p+4 <= len(dict); p++ {
+		e.table[zstdHash(dict[p:])] = int32(p + 1)
+	}
+	return e
+}
+
+func zstdHash(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - zstdHashLog)
+}
+
+// Compresses src as a single frame with a content checksum. Matches may
+// reach back into the dictionary, as if it came before src, which the
+// decoder has to be given as a raw content dictionary.
+func (e *zstdEncoder) compress(src []byte) []byte {
+	history := make([]byte, len(e.dict), len(e.dict)+len(src))
+	copy(history, e.dict)
+	history = append(history, src...)
+	table := make([]int32, len(e.table))
+	copy(table, e.table)
+
+	// The window covers the dictionary and the whole body.
+	exponent := 0
+	if n := len(history); n > 1<<10 {
+		exponent = bits.Len(uint(n-1)) - 10
+	}
+	out := append([]byte(nil), zstdMagic...)
+	out = append(out, 3<<6|1<<2, byte(exponent<<3))
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(src)))
+	out = append(out, size[:]...)
+
+	for start := len(e.dict); ; start += zstdMaxBlockSize {
+		end := start + zstdMaxBlockSize
+		last := end >= len(history)
+		if last {
+			end = len(history)
+		}
+		block := compressBlock(history, table, start, end)
+		blockType := 2
+		if len(block) >= end-start {
+			block, blockType = history[start:end], 0
+		}
+		header := uint32(len(block))<<3 | uint32(blockType)<<1
+		if last {
+			header |= 1
+		}
+		out = append(out, byte(header), byte(header>>8), byte(header>>16))
+		out = append(out, block...)
+		if last {
+			break
+		}
+	}
+
+	var h xxhash64
+	h.reset()
+	h.write(src)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(h.sum()))
+	return append(out, sum[:]...)
+}
+
+type zstdSequence struct {
+	literals, offset, match int
+}
+
+// Returns the content of a compressed block for history[start:end].
+func compressBlock(history []byte, table []int32, start, end int) []byte {
+	var sequences []zstdSequence
+	var literals []byte
+	literalStart := start
+	for p := start; p+4 <= end; {
+		h := zstdHash(history[p:])
+		candidate := int(table[h]) - 1
+		table[h] = int32(p + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(history[candidate:]) != binary.LittleEndian.Uint32(history[p:]) {
+			p++
+			continue
+		}
+
+		n := 4
+		for p+n < end && history[candidate+n] == history[p+n] {
+			n++
+		}
+		for p > literalStart && candidate > 0 && history[p-1] == history[candidate-1] {
+			p, candidate, n = p-1, candidate-1, n+1
+		}
+		sequences = append(sequences, zstdSequence{p - literalStart, p - candidate, n})
+		literals = append(literals, history[literalStart:p]...)
+		for q := p + 1; q < p+n && q+4 <= len(history); q++ {
+			table[zstdHash(history[q:])] = int32(q + 1)
+		}
+		p += n
+		literalStart = p
+	}
+	literals = append(literals, history[literalStart:end]...)
+
+	// Raw literals.
+	var out []byte
+	switch n := len(literals); {
+	case n < 32:
+		out = append(out, byte(n<<3))
+	case n < 4096:
+		out = append(out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		out = append(out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	out = append(out, literals...)
+
+	switch n := len(sequences); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if len(sequences) == 0 {
+		return out
+	}
+	// All three codes use the predefined tables.
+	out = append(out, 0)
+	return append(out, encodeSequences(sequences)...)
+}
+
+var (
+	literalLengthEncoder = newFSEEncoder(predefinedLiteralLengths)
+	offsetEncoder        = newFSEEncoder(predefinedOffsets)
+	matchLengthEncoder   = newFSEEncoder(predefinedMatchLengths)
+)
+
+// Writes the sequences' bit stream. The decoder reads it from the end, so
+// everything is written in the reverse of the order it's read in: the last
+// sequence first, and each sequence's state updates before its extra bits.
+func encodeSequences(sequences []zstdSequence) []byte {
+	var w bitWriter
+	var llState, ofState, mlState uint32
+	for i := len(sequences) - 1; i >= 0; i-- {
+		s := sequences[i]
+		llCode, llExtra := lengthCode(literalLengthBase[:], s.literals)
+		mlCode, mlExtra := lengthCode(matchLengthBase[:], s.match)
+		offsetValue := s.offset + 3
+		ofCode := uint8(bits.Len(uint(offsetValue)) - 1)
+
+		if i == len(sequences)-1 {
+			llState = literalLengthEncoder.start(llCode)
+			ofState = offsetEncoder.start(ofCode)
+			mlState = matchLengthEncoder.start(mlCode)
+		} else {
+			ofState = offsetEncoder.encode(&w, ofCode, ofState)
+			mlState = matchLengthEncoder.encode(&w, mlCode, mlState)
+			llState = literalLengthEncoder.encode(&w, llCode, llState)
+		}
+		w.add(uint64(llExtra), literalLengthBits[llCode])
+		w.add(uint64(mlExtra), matchLengthBits[mlCode])
+		w.add(uint64(offsetValue-1<<ofCode), ofCode)
+	}
+	w.add(uint64(mlState), matchLengthEncoder.log)
+	w.add(uint64(ofState), offsetEncoder.log)
+	w.add(uint64(llState), literalLengthEncoder.log)
+	return w.finish()
+}
+
+// Returns the code for a literal or match length and its extra bits.
+func lengthCode(base []int, n int) (uint8, int) {
+	code := len(base) - 1
+	for base[code] > n {
+		code--
+	}
+	return uint8(code), n - base[code]
+}
+
+// Encodes symbols with a decoding table, by finding for each symbol the
+// state whose range of next states holds the one already chosen.
+type fseEncoder struct {
+	log     uint8
+	entries []fseEntry
+	// For each symbol, the state leading to each next state.
+	states [][]uint32
+}
+
+func newFSEEncoder(t *fseTable) *fseEncoder {
+	e := &fseEncoder{log: t.log, entries: t.entries}
+	for state, entry := range t.entries {
+		for int(entry.symbol) >= len(e.states) {
+			e.states = append(e.states, nil)
+		}
+		states := e.states[entry.symbol]
+		if states == nil {
+			states = make([]uint32, len(t.entries))
+			e.states[entry.symbol] = states
+		}
+		for next := int(entry.base); next < int(entry.base)+1<<entry.bits; next++ {
+			states[next] = uint32(state)
+		}
+	}
+	return e
+}
+
+// Returns a state for the last symbol coded, which the decoder starts in.
+func (e *fseEncoder) start(symbol uint8) uint32 {
+	return e.states[symbol][0]
+}
+
+// Returns the state for the symbol that leads to next, writing the bits
+// the decoder reads to move on to it.
+func (e *fseEncoder) encode(w *bitWriter, symbol uint8, next uint32) uint32 {
+	state := e.states[symbol][next]
+	entry := e.entries[state]
+	w.add(uint64(next-uint32(entry.base)), entry.bits)
+	return state
+}
+
+// Writes bits lowest first, for reverseBits to read back from the end.
+type bitWriter struct {
+	out  []byte
+	bits uint64
+	n    uint
+}
+
+func (w *bitWriter) add(v uint64, n uint8) {
+	w.bits |= v << w.n
+	w.n += uint(n)
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+// Marks the end of the stream, for the reader to start from.
+func (w *bitWriter) finish() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+	}
+	return w.out
+}